@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// Audit log paging limits
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditPage is a page of audit events
+type AuditPage struct {
+	Events []data.AuditEvent `json:"events"`
+
+	// Next is the 'after' value to use to get the next page
+	Next int64 `json:"next"`
+}
+
+// GetAuditEvents gets a page of the audit log for a system admin
+// @Summary gets a page of the audit log
+// @Description gets audit events with ids after 'after' (oldest first).  Pass the 'next' value from the response as 'after' to get the next page
+// @ID get-audit-events
+// @Accept  json
+// @Produce  json
+// @Param after query int false "Return events after this id"
+// @Param limit query int false "Maximum number of events to return (default 100, max 1000)"
+// @Security OAuth2Application
+// @Success 200 {object} api.AuditPage
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/audit [get]
+func (service Service) GetAuditEvents(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	//	Get the token from the authorization header.  If it wasn't supplied, return an error
+	logger := loggerFor(req, "")
+	token, presented, outcome, err := service.getAccessToken(req)
+	if err != nil {
+		logger.Warn("Audit log request rejected", logging.FieldOutcome, outcome, "error", err)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		sendAccessTokenErrorResponse(rw, err, outcome)
+		return
+	}
+
+	//	Find out who's asking
+	db := service.dbFor(req, "")
+	scopeUser, err := db.GetScopesForBoundToken(token, presented)
+	if err != nil {
+		logger.Warn("Audit log request rejected", logging.FieldOutcome, "invalid_token", "error", err)
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	if scopeUserIsSystemAdmin(scopeUser) != true {
+		logger.Warn("Audit log request rejected", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "forbidden")
+		metrics.AuthFailures.WithLabelValues("forbidden").Inc()
+		sendErrorResponse(rw, fmt.Errorf("User '%s' does not have permission to read the audit log", scopeUser.Name), http.StatusForbidden)
+		return
+	}
+
+	//	Get the paging parameters
+	after := int64(0)
+	if value := req.URL.Query().Get("after"); value != "" {
+		after, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || after < 0 {
+			sendErrorResponse(rw, fmt.Errorf("'after' must be a positive number"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultAuditPageSize
+	if value := req.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			sendErrorResponse(rw, fmt.Errorf("'limit' must be a number between 1 and %v", maxAuditPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//	Get the page
+	events, err := db.GetAuditEvents(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, after, limit)
+	if err != nil {
+		logger.Error("Audit log request failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "error", "error", err)
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	response := AuditPage{Events: events, Next: after}
+	if len(events) > 0 {
+		response.Next = events[len(events)-1].ID
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(response)
+}
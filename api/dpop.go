@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/jose"
+)
+
+// dpopSigningAlgorithms are the algorithms DPoP proofs can be signed with.  Proofs are
+// signed with the client's private key, so symmetric algorithms (and 'none') aren't allowed
+var dpopSigningAlgorithms = map[string]bool{
+	"ES256": true, "ES384": true, "ES512": true,
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"EdDSA": true,
+}
+
+// dpopClaims are the claims in a DPoP proof (RFC 9449, section 4.2)
+type dpopClaims struct {
+	ID         string `json:"jti"`
+	Method     string `json:"htm"`
+	URI        string `json:"htu"`
+	IssuedAt   int64  `json:"iat"`
+	AccessHash string `json:"ath,omitempty"`
+}
+
+// dpopProofLifetime returns how far a DPoP proof's 'iat' can be from now
+func (service Service) dpopProofLifetime() time.Duration {
+	if service.DPoPProofLifetime <= 0 {
+		return 1 * time.Minute
+	}
+
+	return service.DPoPProofLifetime
+}
+
+// checkDPoPProof validates the request's DPoP proof (RFC 9449, section 4.3) and returns
+// the thumbprint of the key that signed it.  'accessToken' is the (encoded) access token
+// the proof was sent with, which the proof has to include a hash of -- it's blank at the
+// token endpoint.  Each proof can only be used once
+func (service Service) checkDPoPProof(req *http.Request, accessToken string) (string, error) {
+	proofs := req.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("The request should have exactly one DPoP proof, but has %v", len(proofs))
+	}
+
+	//	Check the proof's header and signature
+	proof, err := jose.Parse(proofs[0])
+	if err != nil {
+		return "", fmt.Errorf("Problem reading the DPoP proof: %s", err)
+	}
+
+	if proof.Header.Typ != "dpop+jwt" {
+		return "", fmt.Errorf("The DPoP proof's type should be 'dpop+jwt', but is '%s'", proof.Header.Typ)
+	}
+
+	if dpopSigningAlgorithms[proof.Header.Alg] != true {
+		return "", fmt.Errorf("The DPoP proof can't be signed with '%s'", proof.Header.Alg)
+	}
+
+	if proof.Header.JWK == nil {
+		return "", fmt.Errorf("The DPoP proof doesn't have the public key ('jwk') it was signed with")
+	}
+
+	key, err := proof.Header.JWK.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("Problem reading the DPoP proof's key: %s", err)
+	}
+
+	if err := proof.Verify(key); err != nil {
+		return "", fmt.Errorf("Problem checking the DPoP proof's signature: %s", err)
+	}
+
+	//	Check that the proof is for this request, and is recent
+	claims := dpopClaims{}
+	if err := proof.Claims(&claims); err != nil {
+		return "", fmt.Errorf("Problem reading the DPoP proof's claims: %s", err)
+	}
+
+	if claims.ID == "" {
+		return "", fmt.Errorf("The DPoP proof doesn't have an id ('jti')")
+	}
+
+	if claims.Method != req.Method {
+		return "", fmt.Errorf("The DPoP proof is for a %s request, not %s", claims.Method, req.Method)
+	}
+
+	if dpopURIMatches(claims.URI, service.targetURI(req)) != true {
+		return "", fmt.Errorf("The DPoP proof is for '%s', not '%s'", claims.URI, service.targetURI(req))
+	}
+
+	lifetime := service.dpopProofLifetime()
+	issued := time.Unix(claims.IssuedAt, 0)
+	if issued.Before(time.Now().Add(-lifetime)) || issued.After(time.Now().Add(lifetime)) {
+		return "", fmt.Errorf("The DPoP proof was issued at %s, which isn't within %s of now", issued.UTC().Format(time.RFC3339), lifetime)
+	}
+
+	if accessToken != "" && claims.AccessHash != jose.HashClaim(accessToken) {
+		return "", fmt.Errorf("The DPoP proof isn't for the access token it was sent with")
+	}
+
+	thumbprint, err := proof.Header.JWK.Thumbprint()
+	if err != nil {
+		return "", fmt.Errorf("Problem reading the DPoP proof's key: %s", err)
+	}
+
+	//	Finally, make sure it hasn't been used before (proof ids only have to be unique for each key)
+	unused, err := service.dbFor(req, "").UseOnce("dpop:"+thumbprint+":"+claims.ID, issued.Add(lifetime))
+	if err != nil {
+		return "", fmt.Errorf("Problem checking whether the DPoP proof has been used: %s", err)
+	}
+
+	if unused != true {
+		return "", fmt.Errorf("The DPoP proof has already been used")
+	}
+
+	return thumbprint, nil
+}
+
+// targetURI returns the URI the request was made to, without the query and fragment
+// (what a DPoP proof's 'htu' claim should be, and a client assertion's 'aud' can be).
+// If the service has an external URL, that's where requests are made to
+func (service Service) targetURI(req *http.Request) string {
+	if service.ExternalURL != "" {
+		return strings.TrimSuffix(service.ExternalURL, "/") + req.URL.Path
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + req.Host + req.URL.Path
+}
+
+// dpopURIMatches returns 'true' if the proof's 'htu' is the target URI.  The scheme and host
+// aren't case sensitive, and the query and fragment are ignored (RFC 9449, section 4.3)
+func dpopURIMatches(htu, target string) bool {
+	proofURI, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	targetURI, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(proofURI.Scheme, targetURI.Scheme) &&
+		strings.EqualFold(proofURI.Host, targetURI.Host) &&
+		proofURI.Path == targetURI.Path
+}
+
+// getAccessToken gets the access token from the Authorization header ('Bearer <token>', or
+// 'DPoP <token>' along with a DPoP proof), and what the request presents to use a bound token
+// with.  If there's a problem, it returns the outcome (for logging and metrics) and an error
+func (service Service) getAccessToken(req *http.Request) (string, data.Confirmation, string, error) {
+	authHeader := req.Header.Get("Authorization")
+	presented := requestConfirmation(req)
+
+	switch {
+	case authHeaderValid(authHeader):
+		//	DPoP tokens can't be used as bearer tokens:  the key thumbprint isn't presented
+		return getTokenFromAuthHeader(authHeader), presented, "", nil
+	case dpopHeaderValid(authHeader):
+		encodedToken := authHeader[len("DPoP "):]
+		thumbprint, err := service.checkDPoPProof(req, encodedToken)
+		if err != nil {
+			return "", presented, "invalid_dpop_proof", err
+		}
+
+		tokenBytes, err := base64.StdEncoding.DecodeString(encodedToken)
+		if err != nil {
+			return "", presented, "invalid_token", fmt.Errorf("Problem decoding the DPoP token: %s", err)
+		}
+
+		presented.KeyThumbprint = thumbprint
+		return string(tokenBytes), presented, "", nil
+	}
+
+	return "", presented, "missing_token", fmt.Errorf("Bearer or DPoP token was not supplied")
+}
+
+// dpopHeaderValid returns true if the passed header value is a valid
+// for a "DPoP token" authorization field -- otherwise return false
+func dpopHeaderValid(header string) bool {
+	//	If we don't have at least x number characters,
+	//	it must not include the prefix text 'DPoP '
+	if len(header) < len("DPoP ") {
+		return false
+	}
+
+	//	If the first part of the string isn't 'DPoP ' then it's not a DPoP token...
+	return strings.EqualFold(header[:len("DPoP ")], "DPoP ")
+}
+
+// sendAccessTokenErrorResponse sends the error for a problem getting the access
+// token from a request (see getAccessToken) -- a 401, with a DPoP challenge if the proof was invalid
+func sendAccessTokenErrorResponse(rw http.ResponseWriter, err error, outcome string) {
+	if outcome == "invalid_dpop_proof" {
+		sendDPoPErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	sendErrorResponse(rw, err, http.StatusUnauthorized)
+}
+
+// sendDPoPErrorResponse sends an invalid_dpop_proof error, with the WWW-Authenticate
+// challenge that tells the client which algorithms it can sign proofs with (RFC 9449, section 7.1)
+func sendDPoPErrorResponse(rw http.ResponseWriter, err error, code int) {
+	rw.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof", algs="ES256 ES384 ES512 RS256 RS384 RS512 PS256 PS384 PS512 EdDSA"`)
+	sendErrorResponse(rw, err, code)
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/jose"
+	"github.com/rs/xid"
+)
+
+//	Gets a service with bootstrapped test datastores (used DPoP proofs are kept in the
+//	token datastore), and a function that closes and removes them
+func getTestService(t *testing.T) (Service, func()) {
+	systemdbfilename, tokendbfilename := "testapisystem.db", "testapitoken.db"
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewDBManager failed: %s", err)
+	}
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Fatalf("AuthSystemBootstrap failed: %s", err)
+	}
+
+	return Service{DB: db}, func() {
+		db.Close()
+		os.Remove(systemdbfilename)
+		os.Remove(tokendbfilename)
+	}
+}
+
+// createTestProof creates a DPoP proof for the method and URI, signed with the key.
+// If the access token isn't blank, the proof includes its hash
+func createTestProof(t *testing.T, key *ecdsa.PrivateKey, method, uri, accessToken string, issued time.Time) string {
+	jwk, err := jose.NewJWK(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Problem creating JWK: %s", err)
+	}
+
+	claims := dpopClaims{ID: xid.New().String(), Method: method, URI: uri, IssuedAt: issued.Unix()}
+	if accessToken != "" {
+		claims.AccessHash = jose.HashClaim(accessToken)
+	}
+
+	proof, err := jose.Sign(jose.Header{Alg: "ES256", Typ: "dpop+jwt", JWK: &jwk}, claims, key)
+	if err != nil {
+		t.Fatalf("Problem signing DPoP proof: %s", err)
+	}
+
+	return proof
+}
+
+func TestCheckDPoPProof_ValidProof_ReturnsKeyThumbprint(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+	expected, _ := jwk.Thumbprint()
+
+	req := httptest.NewRequest("POST", "https://auth.example.com/oauth/token?ignored=1", nil)
+	req.Header.Set("DPoP", createTestProof(t, key, "POST", "https://AUTH.example.com/oauth/token", "", time.Now()))
+
+	//	Act
+	thumbprint, err := service.checkDPoPProof(req, "")
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("checkDPoPProof failed: Should have accepted the proof, but got: %s", err)
+	}
+
+	if thumbprint != expected {
+		t.Errorf("checkDPoPProof failed: Should have returned the key's thumbprint %s, but got %s", expected, thumbprint)
+	}
+}
+
+func TestCheckDPoPProof_ReplayedProof_ReturnsError(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proof := createTestProof(t, key, "POST", "https://auth.example.com/oauth/token", "", time.Now())
+
+	first := httptest.NewRequest("POST", "https://auth.example.com/oauth/token", nil)
+	first.Header.Set("DPoP", proof)
+	replay := httptest.NewRequest("POST", "https://auth.example.com/oauth/token", nil)
+	replay.Header.Set("DPoP", proof)
+
+	//	Act
+	_, firstErr := service.checkDPoPProof(first, "")
+	_, replayErr := service.checkDPoPProof(replay, "")
+
+	//	Assert
+	if firstErr != nil {
+		t.Errorf("checkDPoPProof failed: Should have accepted the proof the first time, but got: %s", firstErr)
+	}
+
+	if replayErr == nil {
+		t.Errorf("checkDPoPProof failed: Should have rejected a replayed proof")
+	}
+}
+
+func TestCheckDPoPProof_WrongRequestOrStale_ReturnsError(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uri := "https://auth.example.com/oauth/authorize"
+	token := base64.StdEncoding.EncodeToString([]byte("sometoken"))
+
+	tests := []struct {
+		name  string
+		proof string
+	}{
+		{"wrong method", createTestProof(t, key, "POST", uri, token, time.Now())},
+		{"wrong uri", createTestProof(t, key, "GET", "https://auth.example.com/oauth/token", token, time.Now())},
+		{"stale", createTestProof(t, key, "GET", uri, token, time.Now().Add(-10*time.Minute))},
+		{"future", createTestProof(t, key, "GET", uri, token, time.Now().Add(10*time.Minute))},
+		{"other token", createTestProof(t, key, "GET", uri, "someothertoken", time.Now())},
+		{"no token hash", createTestProof(t, key, "GET", uri, "", time.Now())},
+		{"not a JWS", "not-a-proof"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("DPoP", test.proof)
+
+		//	Act
+		_, err := service.checkDPoPProof(req, token)
+
+		//	Assert
+		if err == nil {
+			t.Errorf("checkDPoPProof failed: Should have rejected the proof (%s)", test.name)
+		}
+	}
+}
+
+func TestCheckDPoPProof_SymmetricAlgorithm_ReturnsError(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+
+	claims := dpopClaims{ID: xid.New().String(), Method: "POST", URI: "https://auth.example.com/oauth/token", IssuedAt: time.Now().Unix()}
+	proof, err := jose.Sign(jose.Header{Alg: "HS256", Typ: "dpop+jwt", JWK: &jwk}, claims, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Problem signing DPoP proof: %s", err)
+	}
+
+	req := httptest.NewRequest("POST", "https://auth.example.com/oauth/token", nil)
+	req.Header.Set("DPoP", proof)
+
+	//	Act
+	_, err = service.checkDPoPProof(req, "")
+
+	//	Assert
+	if err == nil {
+		t.Errorf("checkDPoPProof failed: Should have rejected a proof signed with a shared secret")
+	}
+}
+
+func TestGetAccessToken_DPoPScheme_PresentsKeyThumbprint(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+	expected, _ := jwk.Thumbprint()
+	token := base64.StdEncoding.EncodeToString([]byte("sometoken"))
+
+	dpopReq := httptest.NewRequest("GET", "https://auth.example.com/oauth/authorize", nil)
+	dpopReq.Header.Set("Authorization", "DPoP "+token)
+	dpopReq.Header.Set("DPoP", createTestProof(t, key, "GET", "https://auth.example.com/oauth/authorize", token, time.Now()))
+
+	noProofReq := httptest.NewRequest("GET", "https://auth.example.com/oauth/authorize", nil)
+	noProofReq.Header.Set("Authorization", "DPoP "+token)
+
+	bearerReq := httptest.NewRequest("GET", "https://auth.example.com/oauth/authorize", nil)
+	bearerReq.Header.Set("Authorization", "Bearer "+token)
+	bearerReq.Header.Set("DPoP", createTestProof(t, key, "GET", "https://auth.example.com/oauth/authorize", token, time.Now()))
+
+	//	Act
+	dpopToken, dpopPresented, _, dpopErr := service.getAccessToken(dpopReq)
+	_, _, noProofOutcome, noProofErr := service.getAccessToken(noProofReq)
+	bearerToken, bearerPresented, _, bearerErr := service.getAccessToken(bearerReq)
+
+	//	Assert
+	if dpopErr != nil || dpopToken != "sometoken" || dpopPresented.KeyThumbprint != expected {
+		t.Errorf("getAccessToken failed: Should have gotten the DPoP token and the proof's key, but got '%s' / %+v (%v)", dpopToken, dpopPresented, dpopErr)
+	}
+
+	if noProofErr == nil || noProofOutcome != "invalid_dpop_proof" {
+		t.Errorf("getAccessToken failed: Should have rejected a DPoP token without a proof, but got outcome '%s'", noProofOutcome)
+	}
+
+	if bearerErr != nil || bearerToken != "sometoken" || bearerPresented.KeyThumbprint != "" {
+		t.Errorf("getAccessToken failed: A bearer token shouldn't present a DPoP key, but got %+v (%v)", bearerPresented, bearerErr)
+	}
+}
+
+func TestCheckDPoPProof_ExternalURL_ChecksProofAgainstIt(t *testing.T) {
+	//	Arrange
+	service, cleanup := getTestService(t)
+	defer cleanup()
+	service.ExternalURL = "https://auth.example.com/authserver/"
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	//	-- the proxy forwards https://auth.example.com/authserver/oauth/token to http://10.0.0.5:3001/oauth/token
+	external := httptest.NewRequest("POST", "http://10.0.0.5:3001/oauth/token", nil)
+	external.Header.Set("DPoP", createTestProof(t, key, "POST", "https://auth.example.com/authserver/oauth/token", "", time.Now()))
+
+	internal := httptest.NewRequest("POST", "http://10.0.0.5:3001/oauth/token", nil)
+	internal.Header.Set("DPoP", createTestProof(t, key, "POST", "http://10.0.0.5:3001/oauth/token", "", time.Now()))
+
+	//	Act
+	_, externalErr := service.checkDPoPProof(external, "")
+	_, internalErr := service.checkDPoPProof(internal, "")
+
+	//	Assert
+	if externalErr != nil {
+		t.Errorf("checkDPoPProof failed: Should have accepted a proof for the external URL, but got: %s", externalErr)
+	}
+
+	if internalErr == nil {
+		t.Errorf("checkDPoPProof failed: Should have rejected a proof for the address behind the proxy")
+	}
+}
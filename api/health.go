@@ -0,0 +1,184 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// Component statuses
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+// ComponentStatus is the health of one thing the service depends on
+type ComponentStatus struct {
+	Status  string     `json:"status"`
+	Message string     `json:"message,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// HealthResponse is the response from /healthz and /readyz.  Status is 'fail' if any
+// component failed, 'warn' if any component has a warning, and 'ok' otherwise
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Service    string                     `json:"service"`
+	Checked    time.Time                  `json:"checked"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// HealthService checks the health of the API or UI service
+type HealthService struct {
+	DB *data.DBManager
+
+	// Service is the name of the service being checked ('api' or 'ui')
+	Service string
+
+	// TLSCert and TLSKey are the service's certificate and key files
+	TLSCert string
+	TLSKey  string
+
+	// Certificate returns the service's certificate, if it doesn't come from
+	// files (like when it's provisioned with ACME).  It's used instead of TLSCert and TLSKey
+	Certificate func() (*tls.Certificate, error)
+
+	// CertWarning is how long before the certificate expires to start warning
+	CertWarning time.Duration
+}
+
+// Healthz reports the status of each component.  It's a liveness check:  it responds
+// with 200 as long as the service is running (so a datastore outage doesn't get the
+// service restarted) -- check the status in the response for the details
+// @Summary service health
+// @Description reports the status of the datastores, bootstrap state, TLS certificate and signing key
+// @ID healthz
+// @Produce  json
+// @Success 200 {object} api.HealthResponse
+// @Router /healthz [get]
+func (service HealthService) Healthz(rw http.ResponseWriter, req *http.Request) {
+	service.sendHealth(rw, service.Check(), false)
+}
+
+// Readyz reports the status of each component.  It's a readiness check:  it
+// responds with 503 if any component failed, so no traffic is sent to the service
+// @Summary service readiness
+// @Description reports the status of the datastores, bootstrap state, TLS certificate and signing key (503 if any of them failed)
+// @ID readyz
+// @Produce  json
+// @Success 200 {object} api.HealthResponse
+// @Failure 503 {object} api.HealthResponse
+// @Router /readyz [get]
+func (service HealthService) Readyz(rw http.ResponseWriter, req *http.Request) {
+	service.sendHealth(rw, service.Check(), true)
+}
+
+// Check checks each component
+func (service HealthService) Check() HealthResponse {
+	retval := HealthResponse{
+		Service:    service.Service,
+		Checked:    time.Now().UTC(),
+		Components: map[string]ComponentStatus{},
+	}
+
+	retval.Components["systemdb"] = errorStatus(service.DB.PingSystemStore())
+	retval.Components["tokendb"] = errorStatus(service.DB.PingTokenStore())
+	retval.Components["bootstrap"] = errorStatus(service.DB.CheckBootstrap())
+	retval.Components["tls"] = service.checkTLS(time.Now())
+
+	//	Tokens are opaque (not signed), so the signing key is the
+	//	audit key used to HMAC audit events and sign checkpoints
+	retval.Components["signing_key"] = ComponentStatus{Status: StatusOK}
+	if service.DB.HasAuditKey() == false {
+		retval.Components["signing_key"] = ComponentStatus{Status: StatusWarn, Message: "audit.hmackey isn't set, so audit events aren't HMAC'd and checkpoints aren't signed"}
+	}
+
+	retval.Status = overallStatus(retval.Components)
+	return retval
+}
+
+// sendHealth sends the health response (with a 503 if it failed and 'failOnError' is set)
+func (service HealthService) sendHealth(rw http.ResponseWriter, response HealthResponse, failOnError bool) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if failOnError && response.Status == StatusFail {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(rw).Encode(response)
+}
+
+// errorStatus returns a failed status with the error (or an ok status if there isn't one)
+func errorStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Message: err.Error()}
+	}
+
+	return ComponentStatus{Status: StatusOK}
+}
+
+// checkTLS checks the service's certificate
+func (service HealthService) checkTLS(now time.Time) ComponentStatus {
+	if service.Certificate == nil {
+		return checkCertificate(service.TLSCert, service.TLSKey, now, service.CertWarning)
+	}
+
+	pair, err := service.Certificate()
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Message: fmt.Sprintf("Problem getting the TLS certificate: %s", err)}
+	}
+
+	return checkCertificateExpiry(pair, now, service.CertWarning)
+}
+
+// checkCertificate checks that the certificate and key can be loaded, and warns
+// if the certificate expires within 'warning' of 'now' (and fails if it has expired)
+func checkCertificate(certFile, keyFile string, now time.Time, warning time.Duration) ComponentStatus {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Message: fmt.Sprintf("Problem loading the TLS certificate: %s", err)}
+	}
+
+	return checkCertificateExpiry(&pair, now, warning)
+}
+
+// checkCertificateExpiry warns if the certificate expires within 'warning'
+// of 'now' (and fails if it has expired)
+func checkCertificateExpiry(pair *tls.Certificate, now time.Time, warning time.Duration) ComponentStatus {
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Message: fmt.Sprintf("Problem parsing the TLS certificate: %s", err)}
+	}
+
+	expires := cert.NotAfter.UTC()
+	switch {
+	case now.After(expires):
+		return ComponentStatus{Status: StatusFail, Message: "The TLS certificate has expired", Expires: &expires}
+	case now.Add(warning).After(expires):
+		return ComponentStatus{Status: StatusWarn, Message: fmt.Sprintf("The TLS certificate expires in %s", expires.Sub(now).Round(time.Minute)), Expires: &expires}
+	}
+
+	return ComponentStatus{Status: StatusOK, Expires: &expires}
+}
+
+// overallStatus returns the worst of the component statuses
+func overallStatus(components map[string]ComponentStatus) string {
+	retval := StatusOK
+	for _, component := range components {
+		switch component.Status {
+		case StatusFail:
+			return StatusFail
+		case StatusWarn:
+			retval = StatusWarn
+		}
+	}
+
+	return retval
+}
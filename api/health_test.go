@@ -0,0 +1,137 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//	Writes a self-signed certificate (and its key) that expires at the given time
+func writeTestCertificate(t *testing.T, expires time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    expires.Add(-24 * time.Hour),
+		NotAfter:     expires,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Problem marshalling key: %s", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestCheckCertificate_ValidCertificate_ReturnsOK(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, now.Add(90*24*time.Hour))
+
+	//	Act
+	status := checkCertificate(certFile, keyFile, now, 14*24*time.Hour)
+
+	//	Assert
+	if status.Status != StatusOK || status.Expires == nil {
+		t.Errorf("checkCertificate failed: Should have returned ok with the expiry, but got: %+v", status)
+	}
+}
+
+func TestCheckCertificate_ExpiringSoon_ReturnsWarning(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, now.Add(7*24*time.Hour))
+
+	//	Act
+	status := checkCertificate(certFile, keyFile, now, 14*24*time.Hour)
+
+	//	Assert
+	if status.Status != StatusWarn {
+		t.Errorf("checkCertificate failed: Should have warned about the expiry, but got: %+v", status)
+	}
+}
+
+func TestCheckCertificate_ExpiredOrMissing_ReturnsFail(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, now.Add(-1*time.Hour))
+
+	//	Act
+	expired := checkCertificate(certFile, keyFile, now, 14*24*time.Hour)
+	missing := checkCertificate("nosuchcert.pem", "nosuchkey.pem", now, 14*24*time.Hour)
+
+	//	Assert
+	if expired.Status != StatusFail || missing.Status != StatusFail {
+		t.Errorf("checkCertificate failed: Should have failed for expired and missing certificates, but got: %+v / %+v", expired, missing)
+	}
+}
+
+func TestCheckTLS_CertificateFunc_UsesCertificate(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, now.Add(7*24*time.Hour))
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Problem loading the test certificate: %s", err)
+	}
+
+	service := HealthService{
+		TLSCert:     "nosuchcert.pem",
+		TLSKey:      "nosuchkey.pem",
+		CertWarning: 14 * 24 * time.Hour,
+		Certificate: func() (*tls.Certificate, error) { return &pair, nil },
+	}
+
+	failing := HealthService{
+		Certificate: func() (*tls.Certificate, error) { return nil, fmt.Errorf("no certificate yet") },
+	}
+
+	//	Act
+	status := service.checkTLS(now)
+	failed := failing.checkTLS(now)
+
+	//	Assert
+	if status.Status != StatusWarn {
+		t.Errorf("checkTLS failed: Should have checked the certificate from the function (and warned about the expiry), but got: %+v", status)
+	}
+
+	if failed.Status != StatusFail {
+		t.Errorf("checkTLS failed: Should have failed if the certificate couldn't be gotten, but got: %+v", failed)
+	}
+}
+
+func TestOverallStatus_Components_ReturnsWorstStatus(t *testing.T) {
+	//	Arrange
+	warning := map[string]ComponentStatus{"a": {Status: StatusOK}, "b": {Status: StatusWarn}}
+	failed := map[string]ComponentStatus{"a": {Status: StatusWarn}, "b": {Status: StatusFail}, "c": {Status: StatusOK}}
+
+	//	Act / Assert
+	if overallStatus(warning) != StatusWarn || overallStatus(failed) != StatusFail || overallStatus(map[string]ComponentStatus{}) != StatusOK {
+		t.Errorf("overallStatus failed: Should have returned the worst component status")
+	}
+}
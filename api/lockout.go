@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// GetLockout gets the recent failed logins (and any lockout) for a user name or ip address
+// @Summary gets the failed logins and lockout for a user name or ip address
+// @Description gets the recent failed logins for a user name ('user') or an ip address ('ip'), and when its lockout ends (if it's locked out)
+// @ID get-lockout
+// @Accept  json
+// @Produce  json
+// @Param user query string false "The user name"
+// @Param ip query string false "The ip address"
+// @Security OAuth2Application
+// @Success 200 {object} data.LoginAttempts
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/lockout [get]
+func (service Service) GetLockout(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.lockoutAdmin(rw, req)
+	if ok == false {
+		return
+	}
+
+	targetType, target, err := lockoutTarget(req)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := db.GetLoginAttempts(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, targetType, target)
+	if err != nil {
+		loggerFor(req, "").Error("Lockout request failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "error", "error", err)
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(attempts)
+}
+
+// Unlock ends the lockout for a user name or ip address
+// @Summary unlocks a user name or ip address
+// @Description ends the lockout for a user name ('user') or an ip address ('ip') and forgets its failed logins.  It returns the failed logins from before the unlock
+// @ID unlock
+// @Accept  json
+// @Produce  json
+// @Param user query string false "The user name"
+// @Param ip query string false "The ip address"
+// @Security OAuth2Application
+// @Success 200 {object} data.LoginAttempts
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/lockout [delete]
+func (service Service) Unlock(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.lockoutAdmin(rw, req)
+	if ok == false {
+		return
+	}
+
+	targetType, target, err := lockoutTarget(req)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	context := data.User{ID: scopeUser.ID, Name: scopeUser.Name}
+	attempts, err := db.GetLoginAttempts(context, targetType, target)
+	if err == nil {
+		err = db.UnlockLogins(context, targetType, target)
+	}
+	if err != nil {
+		loggerFor(req, "").Error("Unlock request failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "error", "error", err)
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	loggerFor(req, "").Info("Logins unlocked", logging.FieldUserID, scopeUser.ID, "key", attempts.Key)
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(attempts)
+}
+
+// lockoutAdmin checks that the request's access token belongs to a system admin, and returns
+// the DBManager to use for the request along with the admin.  If it doesn't, it sends the
+// error response and returns 'false'
+func (service Service) lockoutAdmin(rw http.ResponseWriter, req *http.Request) (data.DBManager, data.ScopeUser, bool) {
+	//	Get the token from the authorization header.  If it wasn't supplied, return an error
+	logger := loggerFor(req, "")
+	token, presented, outcome, err := service.getAccessToken(req)
+	if err != nil {
+		logger.Warn("Lockout request rejected", logging.FieldOutcome, outcome, "error", err)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		sendAccessTokenErrorResponse(rw, err, outcome)
+		return data.DBManager{}, data.ScopeUser{}, false
+	}
+
+	//	Find out who's asking
+	db := service.dbFor(req, "")
+	scopeUser, err := db.GetScopesForBoundToken(token, presented)
+	if err != nil {
+		logger.Warn("Lockout request rejected", logging.FieldOutcome, "invalid_token", "error", err)
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return db, scopeUser, false
+	}
+
+	if scopeUserIsSystemAdmin(scopeUser) != true {
+		logger.Warn("Lockout request rejected", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "forbidden")
+		metrics.AuthFailures.WithLabelValues("forbidden").Inc()
+		sendErrorResponse(rw, fmt.Errorf("User '%s' does not have permission to manage lockouts", scopeUser.Name), http.StatusForbidden)
+		return db, scopeUser, false
+	}
+
+	return db, scopeUser, true
+}
+
+// lockoutTarget gets what a lockout request is for -- a 'user' (name) or an 'ip' (address)
+// query parameter -- and returns the target type and the target
+func lockoutTarget(req *http.Request) (string, string, error) {
+	query := req.URL.Query()
+	user, ip := query.Get("user"), query.Get("ip")
+
+	switch {
+	case user != "" && ip != "":
+		return "", "", fmt.Errorf("Pass either 'user' or 'ip', not both")
+	case user != "":
+		return "user", user, nil
+	case ip != "":
+		return "ip", ip, nil
+	}
+
+	return "", "", fmt.Errorf("Pass the 'user' name or 'ip' address")
+}
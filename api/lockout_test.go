@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLockoutTarget_UserOrIP_ReturnsTarget(t *testing.T) {
+	//	Arrange
+	userReq := httptest.NewRequest("GET", "/api/v1/lockout?user=client1", nil)
+	ipReq := httptest.NewRequest("DELETE", "/api/v1/lockout?ip=10.0.0.1", nil)
+
+	//	Act
+	userType, user, userErr := lockoutTarget(userReq)
+	ipType, ip, ipErr := lockoutTarget(ipReq)
+
+	//	Assert
+	if userErr != nil || userType != "user" || user != "client1" {
+		t.Errorf("lockoutTarget failed: Should have gotten the user name, but got %s '%s' (%v)", userType, user, userErr)
+	}
+
+	if ipErr != nil || ipType != "ip" || ip != "10.0.0.1" {
+		t.Errorf("lockoutTarget failed: Should have gotten the ip address, but got %s '%s' (%v)", ipType, ip, ipErr)
+	}
+}
+
+func TestLockoutTarget_NeitherOrBoth_ReturnsError(t *testing.T) {
+	//	Arrange
+	neitherReq := httptest.NewRequest("GET", "/api/v1/lockout", nil)
+	bothReq := httptest.NewRequest("GET", "/api/v1/lockout?user=client1&ip=10.0.0.1", nil)
+
+	//	Act
+	_, _, neitherErr := lockoutTarget(neitherReq)
+	_, _, bothErr := lockoutTarget(bothReq)
+
+	//	Assert
+	if neitherErr == nil || bothErr == nil {
+		t.Errorf("lockoutTarget failed: Should have required exactly one of 'user' or 'ip'")
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/danesparza/authserver/basicauth"
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/gorilla/mux"
+)
+
+// OneTimeCodeRequest is a request with a one-time code from the user's authenticator app
+type OneTimeCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse has a user's new recovery codes.  They're only ever shown once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrollTOTP starts setting up a TOTP second factor for the caller
+// @Summary starts setting up a TOTP second factor
+// @Description starts setting up a TOTP second factor for the user in the basic auth credentials (their name and password).  Add the returned secret (or provisioning uri, as a QR code) to an authenticator app, then confirm it with a code from the app
+// @ID enroll-totp
+// @Accept  json
+// @Produce  json
+// @Security BasicAuth
+// @Success 200 {object} data.TOTPEnrollment
+// @Failure 401 {object} api.ErrorResponse
+// @Router /api/v1/mfa/totp [post]
+func (service Service) EnrollTOTP(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	name, password, ok := basicauth.Credentials(req)
+	if ok == false {
+		sendErrorResponse(rw, fmt.Errorf("Pass the user name and password with HTTP basic auth"), http.StatusUnauthorized)
+		return
+	}
+
+	enrollment, err := service.dbFor(req, name).EnrollTOTP(name, password)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	loggerFor(req, name).Info("TOTP enrollment started")
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(enrollment)
+}
+
+// ConfirmTOTP finishes setting up the caller's TOTP second factor
+// @Summary confirms a TOTP second factor
+// @Description confirms the TOTP second factor of the user in the basic auth credentials with a code from their authenticator app.  From then on, the user needs a one-time code to log in.  The response has the user's recovery codes
+// @ID confirm-totp
+// @Accept  json
+// @Produce  json
+// @Param code body api.OneTimeCodeRequest true "A code from the authenticator app"
+// @Security BasicAuth
+// @Success 200 {object} api.RecoveryCodesResponse
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Router /api/v1/mfa/totp/verify [post]
+func (service Service) ConfirmTOTP(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	name, password, ok := basicauth.Credentials(req)
+	if ok == false {
+		sendErrorResponse(rw, fmt.Errorf("Pass the user name and password with HTTP basic auth"), http.StatusUnauthorized)
+		return
+	}
+
+	request := OneTimeCodeRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Code == "" {
+		sendErrorResponse(rw, fmt.Errorf("Pass the one-time 'code' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := service.dbFor(req, name).ConfirmTOTP(name, password, request.Code)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	loggerFor(req, name).Info("TOTP enrollment confirmed")
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes
+// @Summary replaces a user's recovery codes
+// @Description replaces the recovery codes of the user in the basic auth credentials.  It needs a code from their authenticator app (or a recovery code), and the old recovery codes stop working
+// @ID regenerate-recovery-codes
+// @Accept  json
+// @Produce  json
+// @Param code body api.OneTimeCodeRequest true "A code from the authenticator app (or a recovery code)"
+// @Security BasicAuth
+// @Success 200 {object} api.RecoveryCodesResponse
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Router /api/v1/mfa/recovery-codes [post]
+func (service Service) RegenerateRecoveryCodes(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	name, password, ok := basicauth.Credentials(req)
+	if ok == false {
+		sendErrorResponse(rw, fmt.Errorf("Pass the user name and password with HTTP basic auth"), http.StatusUnauthorized)
+		return
+	}
+
+	request := OneTimeCodeRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Code == "" {
+		sendErrorResponse(rw, fmt.Errorf("Pass the one-time 'code' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := service.dbFor(req, name).RegenerateRecoveryCodes(name, password, request.Code)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	loggerFor(req, name).Info("Recovery codes replaced")
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// ResetMFA removes a user's second factors
+// @Summary resets a user's second factors
+// @Description removes a user's TOTP second factor and recovery codes (if they've lost their authenticator).  They can log in with just their password until they set up a new one
+// @ID reset-mfa
+// @Accept  json
+// @Produce  json
+// @Param id path string true "The user id"
+// @Security OAuth2Application
+// @Success 204
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/users/{id}/mfa [delete]
+func (service Service) ResetMFA(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.userManager(rw, req)
+	if ok == false {
+		return
+	}
+
+	userID := mux.Vars(req)["id"]
+	if err := db.ResetMFA(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, userID); err != nil {
+		loggerFor(req, "").Warn("MFA reset request failed", logging.FieldUserID, scopeUser.ID, "target", userID, "error", err)
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	loggerFor(req, "").Info("MFA reset", logging.FieldUserID, scopeUser.ID, "target", userID)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
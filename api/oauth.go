@@ -1,15 +1,20 @@
 package api
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/danesparza/authserver/basicauth"
 	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
 )
 
 // AuthRequest is an OAuth2 based request.  For more information on the
@@ -28,7 +33,8 @@ type AuthRequest struct {
 	Code         string `json:"code"`
 }
 
-// AuthResponse is an OAuth2 based response
+// AuthResponse is an OAuth2 based response.  The token type is 'DPoP' if
+// the token is bound to the key of a DPoP proof, and 'Bearer' otherwise
 type AuthResponse struct {
 	TokenType    string `json:"token_type"`
 	ExpiresIn    string `json:"expires_in"`
@@ -41,54 +47,123 @@ func HelloWorld(rw http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(rw, "Hello, world - service")
 }
 
+// IntrospectionResponse is an OAuth2 token introspection response (RFC 7662).  Inactive
+// tokens only have 'active' set.  Tokens bound to a client certificate or DPoP key have a 'cnf' claim,
+// and 'amr' lists how the token's user authenticated (RFC 8176)
+type IntrospectionResponse struct {
+	Active       bool               `json:"active"`
+	ClientID     string             `json:"client_id,omitempty"`
+	Subject      string             `json:"sub,omitempty"`
+	TokenType    string             `json:"token_type,omitempty"`
+	IssuedAt     int64              `json:"iat,omitempty"`
+	ExpiresAt    int64              `json:"exp,omitempty"`
+	Confirmation *data.Confirmation `json:"cnf,omitempty"`
+	AMR          []string           `json:"amr,omitempty"`
+}
+
+// clientCredentials are the credentials a client authenticates with at the token endpoint
+type clientCredentials struct {
+	ClientID string
+
+	// Method is how the client sent its credentials (client_secret_basic, client_secret_post
+	// or private_key_jwt).  It's blank if the client only sent a certificate
+	Method string
+
+	// Secret is the client secret from the HTTP basic auth header (client_secret_basic)
+	// or the client_secret form value (client_secret_post)
+	Secret string
+
+	// Assertion is the JWT from the client_assertion form value (private_key_jwt)
+	Assertion string
+
+	// Certificate is the client's TLS certificate (if it sent one), and Verified is
+	// 'true' if it chains to one of the trusted client CAs (RFC 8705)
+	Certificate *x509.Certificate
+	Verified    bool
+}
+
 // ClientCredentialsGrant implements the OAuth 2 'Client Credentials' grant --
-// see https://alexbilbie.com/guide-to-oauth-2-grants/ for more information
+// see https://alexbilbie.com/guide-to-oauth-2-grants/ for more information.  Clients
+// authenticate with their secret (HTTP basic auth, or the client_id and client_secret form
+// values), a signed JWT assertion (RFC 7523), or a TLS client certificate and the client_id
+// form value (RFC 8705) -- whichever they're set up to use.  Users with a TOTP second factor
+// also send a one-time (or recovery) code in the 'otp' form value.  If the client presents a
+// certificate, the token is bound to it.
+// If the request has a DPoP proof (RFC 9449), the token is bound to the proof's key
 func (service Service) ClientCredentialsGrant(rw http.ResponseWriter, req *http.Request) {
 	//	req.Body is a ReadCloser -- we need to remember to close it:
 	defer req.Body.Close()
 
-	//	Get the authorization header:
-	authHeader := req.Header.Get("Authorization")
-
-	//	If the basic auth header wasn't supplied, return an error
-	if basicHeaderValid(authHeader) != true {
-		sendErrorResponse(rw, fmt.Errorf("HTTP basic auth credentials not supplied"), http.StatusUnauthorized)
-		return
-	}
-
-	//	Get just the credentials from basic auth information:
-	clientid, clientsecret := getCredentialsFromAuthHeader(authHeader)
-
 	//	Decode the request using ParseForm:
 	err := req.ParseForm()
 	if err != nil {
+		loggerFor(req, "").Warn("Token request rejected", logging.FieldOutcome, "bad_request", "error", err)
+		metrics.AuthFailures.WithLabelValues("bad_request").Inc()
 		sendErrorResponse(rw, err, http.StatusBadRequest)
 		return
 	}
 
+	//	Get the client's credentials.  If they weren't supplied, return an error
+	credentials, ok := service.getClientCredentials(req)
+	if ok != true {
+		loggerFor(req, "").Warn("Token request rejected", logging.FieldOutcome, "missing_credentials")
+		metrics.AuthFailures.WithLabelValues("missing_credentials").Inc()
+		sendErrorResponse(rw, errMissingClientCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	clientid := credentials.ClientID
+	db := service.dbFor(req, clientid)
+	logger := loggerFor(req, clientid).With(logging.FieldGrantType, req.PostForm.Get("grant_type"))
+
 	/*
 		log.Println("Parsed grant type: ", req.PostForm["grant_type"])
 		log.Println("Parsed scopes: ", req.PostForm["scope"])
 	*/
 
+	//	If the client sent a DPoP proof, check it -- the token will be bound to its key
+	confirmation := credentials.confirmation()
+	tokenType := "Bearer"
+	if len(req.Header.Values("DPoP")) > 0 {
+		confirmation.KeyThumbprint, err = service.checkDPoPProof(req, "")
+		if err != nil {
+			logger.Warn("Token request rejected", logging.FieldOutcome, "invalid_dpop_proof", "error", err)
+			metrics.AuthFailures.WithLabelValues("invalid_dpop_proof").Inc()
+			sendDPoPErrorResponse(rw, err, http.StatusBadRequest)
+			return
+		}
+		tokenType = "DPoP"
+	}
+
 	//	Send the request to the datamanager and get grant information for the given credentials:
-	scopeUser, err := service.DB.GetUserScopesWithCredentials(clientid, clientsecret)
+	scopeUser, err := service.authenticate(req, db, credentials)
 	if err != nil {
+		logger.Warn("Token request rejected", logging.FieldOutcome, "invalid_client")
 		sendErrorResponse(rw, err, http.StatusUnauthorized)
 		return
 	}
 
-	//	Get a token for the returned user information
-	token, err := service.DB.GetNewToken(data.User{ID: scopeUser.ID}, 1*time.Hour)
+	//	Clients using an assertion don't have to send their client_id
+	if clientid == "" {
+		clientid = scopeUser.Name
+		logger = logger.With(logging.FieldClientID, clientid)
+	}
+
+	//	Get a token for the returned user information (bound to the client's certificate and DPoP key, if it sent them)
+	token, err := db.GetNewAuthenticatedToken(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, service.tokenLifetime(), confirmation, scopeUser.AMR)
 	if err != nil {
+		logger.Error("Token request failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "error", "error", err)
 		sendErrorResponse(rw, err, http.StatusUnauthorized)
 		return
 	}
 
+	logger.Info("Token issued", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "issued")
+	metrics.TokensIssued.WithLabelValues("client_credentials", clientid).Inc()
+
 	//	Create our response and send information back:
 	encodedToken := base64.StdEncoding.EncodeToString([]byte(token.ID))
 	response := AuthResponse{
-		TokenType:   "Bearer",
+		TokenType:   tokenType,
 		ExpiresIn:   strconv.FormatFloat(token.Expires.Sub(time.Now()).Seconds(), 'f', 0, 64),
 		AccessToken: encodedToken,
 	}
@@ -98,9 +173,101 @@ func (service Service) ClientCredentialsGrant(rw http.ResponseWriter, req *http.
 	json.NewEncoder(rw).Encode(response)
 }
 
-// ScopesForToken gets the scope information for the bearer token passed in the header
+// IntrospectToken reports whether a token is active, and who it was issued to (RFC 7662)
+// @Summary introspects a token
+// @Description reports whether the token in the 'token' form value is active, who it was issued to and what it's bound to.  The caller authenticates like it does at the token endpoint.  If the request has a DPoP proof for the token, the token is only active if it's bound to the proof's key
+// @ID introspect-token
+// @Accept  x-www-form-urlencoded
+// @Produce  json
+// @Param token formData string true "The token to introspect"
+// @Success 200 {object} api.IntrospectionResponse
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Router /oauth/introspect [post]
+func (service Service) IntrospectToken(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	//	Decode the request using ParseForm:
+	err := req.ParseForm()
+	if err != nil {
+		loggerFor(req, "").Warn("Introspection request rejected", logging.FieldOutcome, "bad_request", "error", err)
+		metrics.AuthFailures.WithLabelValues("bad_request").Inc()
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	//	Authenticate the caller
+	credentials, ok := service.getClientCredentials(req)
+	if ok != true {
+		loggerFor(req, "").Warn("Introspection request rejected", logging.FieldOutcome, "missing_credentials")
+		metrics.AuthFailures.WithLabelValues("missing_credentials").Inc()
+		sendErrorResponse(rw, errMissingClientCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	db := service.dbFor(req, credentials.ClientID)
+	logger := loggerFor(req, credentials.ClientID)
+	if _, err := service.authenticate(req, db, credentials); err != nil {
+		logger.Warn("Introspection request rejected", logging.FieldOutcome, "invalid_client")
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	//	If the caller sent a DPoP proof for the token, check it
+	encodedToken := req.PostForm.Get("token")
+	presented := data.Confirmation{}
+	outcome := "ok"
+	if len(req.Header.Values("DPoP")) > 0 {
+		presented.KeyThumbprint, err = service.checkDPoPProof(req, encodedToken)
+		if err != nil {
+			logger.Warn("Introspection DPoP proof rejected", logging.FieldOutcome, "invalid_dpop_proof", "error", err)
+			outcome = "invalid_dpop_proof"
+		}
+	}
+
+	//	Look up the token (tokens are handed out base64 encoded).  Tokens that can't
+	//	be found (or don't match the DPoP proof) aren't an error -- they're just not active
+	response := IntrospectionResponse{}
+	tokenBytes, err := base64.StdEncoding.DecodeString(encodedToken)
+	if err == nil && outcome == "ok" {
+		token, user, err := db.IntrospectToken(string(tokenBytes))
+		if err == nil && (presented.KeyThumbprint == "" || presented.KeyThumbprint == token.Confirmation.KeyThumbprint) {
+			response = IntrospectionResponse{
+				Active:    true,
+				ClientID:  user.Name,
+				Subject:   user.ID,
+				TokenType: "Bearer",
+				IssuedAt:  token.Created.Unix(),
+				ExpiresAt: token.Expires.Unix(),
+				AMR:       token.AMR,
+			}
+
+			if token.Confirmation.IsDPoP() {
+				response.TokenType = "DPoP"
+			}
+
+			if token.Confirmation.IsZero() != true {
+				response.Confirmation = &token.Confirmation
+			}
+		}
+	}
+
+	if response.Active != true && outcome == "ok" {
+		outcome = "invalid_token"
+	}
+
+	logger.Debug("Introspection request succeeded", logging.FieldOutcome, outcome)
+	metrics.TokenChecks.WithLabelValues("introspect", outcome).Inc()
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// ScopesForToken gets the scope information for the bearer (or DPoP) token passed in the header
 // @Summary gets the scope information
-// @Description gets the scope information for the bearer token passed in the header
+// @Description gets the scope information for the bearer token passed in the header.  DPoP tokens are passed with the 'DPoP' scheme, along with a DPoP proof for the request
 // @ID scopes-for-user-id
 // @Accept  json
 // @Produce  json
@@ -112,30 +279,179 @@ func (service Service) ScopesForToken(rw http.ResponseWriter, req *http.Request)
 	//	req.Body is a ReadCloser -- we need to remember to close it:
 	defer req.Body.Close()
 
-	//	Get the authorization header:
-	authHeader := req.Header.Get("Authorization")
-
-	//	If the auth header wasn't supplied, return an error
-	if authHeaderValid(authHeader) != true {
-		sendErrorResponse(rw, fmt.Errorf("Bearer token was not supplied"), http.StatusUnauthorized)
+	//	Get the token from the authorization header (checking the DPoP proof, if it's a DPoP token).
+	//	If it wasn't supplied, return an error
+	logger := loggerFor(req, "")
+	token, presented, outcome, err := service.getAccessToken(req)
+	if err != nil {
+		logger.Warn("Authorize request rejected", logging.FieldOutcome, outcome, "error", err)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		metrics.TokenChecks.WithLabelValues("authorize", outcome).Inc()
+		sendAccessTokenErrorResponse(rw, err, outcome)
 		return
 	}
 
-	//	Get just the bearer token itself:
-	token := getTokenFromAuthHeader(authHeader)
-
-	//	Send the request to the datamanager and get scope information for the given credentials:
-	response, err := service.DB.GetScopesForToken(token)
+	//	Send the request to the datamanager and get scope information for the given credentials
+	//	(if the token is bound to a client certificate or DPoP key, the request has to present it):
+	response, err := service.dbFor(req, "").GetScopesForBoundToken(token, presented)
 	if err != nil {
+		logger.Warn("Authorize request rejected", logging.FieldOutcome, "invalid_token", "error", err)
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		metrics.TokenChecks.WithLabelValues("authorize", "invalid_token").Inc()
 		sendErrorResponse(rw, err, http.StatusUnauthorized)
 		return
 	}
 
+	logger.Debug("Authorize request succeeded", logging.FieldUserID, response.ID, logging.FieldOutcome, "ok")
+	metrics.TokenChecks.WithLabelValues("authorize", "ok").Inc()
+
 	//	Serialize to JSON & return the response:
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(rw).Encode(response)
 }
 
+// errMissingClientCredentials is returned when a client doesn't authenticate (or uses more than one method)
+var errMissingClientCredentials = fmt.Errorf("Client credentials not supplied:  use HTTP basic auth, the client_id and client_secret form values, a client assertion or a client certificate (and only one of them)")
+
+// getClientCredentials gets the client's credentials from the request (the form has to be
+// parsed first):  the client id and secret from the HTTP basic auth header or the client_id
+// and client_secret form values, a JWT client assertion (RFC 7523), or the client_id form value
+// if the client sent a TLS certificate.  It returns 'false' if there aren't any, or if the
+// client used more than one way to send them (RFC 6749, section 2.3)
+func (service Service) getClientCredentials(req *http.Request) (clientCredentials, bool) {
+	retval := clientCredentials{}
+	retval.Certificate, retval.Verified = service.clientCertificate(req)
+
+	authHeader := req.Header.Get("Authorization")
+	hasBasic := basicHeaderValid(authHeader)
+	hasSecret := req.PostForm.Get("client_secret") != ""
+	hasAssertion := req.PostForm.Get("client_assertion") != "" || req.PostForm.Get("client_assertion_type") != ""
+
+	methods := 0
+	for _, has := range []bool{hasBasic, hasSecret, hasAssertion} {
+		if has {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return retval, false
+	}
+
+	switch {
+	case hasBasic:
+		retval.Method = data.AuthMethodSecretBasic
+		retval.ClientID, retval.Secret = getCredentialsFromAuthHeader(authHeader)
+	case hasSecret:
+		retval.Method = data.AuthMethodSecretPost
+		retval.ClientID, retval.Secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	case hasAssertion:
+		if req.PostForm.Get("client_assertion_type") != data.ClientAssertionType {
+			return retval, false
+		}
+
+		//	The client_id is optional -- it's the assertion's subject
+		retval.Method = data.AuthMethodPrivateKeyJWT
+		retval.ClientID, retval.Assertion = req.PostForm.Get("client_id"), req.PostForm.Get("client_assertion")
+		return retval, retval.Assertion != ""
+	case retval.Certificate != nil:
+		retval.ClientID = req.PostForm.Get("client_id")
+	}
+
+	return retval, retval.ClientID != ""
+}
+
+// clientCertificate returns the client's TLS certificate (nil if it didn't send one), and
+// 'true' if the certificate (and any intermediates it sent) chain to one of the trusted client CAs
+func (service Service) clientCertificate(req *http.Request) (*x509.Certificate, bool) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+
+	cert := req.TLS.PeerCertificates[0]
+	if service.ClientCAs == nil {
+		return cert, false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         service.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return cert, err == nil
+}
+
+// authenticate checks the client's credentials and returns its scopes.  Clients that only
+// sent a certificate authenticate with it.  Users with a second factor send their one-time
+// code in the 'otp' form value.  Client assertions can only be used once
+func (service Service) authenticate(req *http.Request, db data.DBManager, credentials clientCredentials) (data.ScopeUser, error) {
+	switch credentials.Method {
+	case data.AuthMethodSecretBasic, data.AuthMethodSecretPost:
+		return db.GetUserScopesWithSecondFactor(credentials.ClientID, credentials.Secret, credentials.Method, req.PostForm.Get("otp"))
+	case data.AuthMethodPrivateKeyJWT:
+		scopeUser, assertion, err := db.GetUserScopesWithClientAssertion(credentials.ClientID, credentials.Assertion, service.clientAssertionAudiences(req))
+		if err != nil {
+			return scopeUser, err
+		}
+
+		unused, err := db.UseOnce("client_assertion:"+scopeUser.ID+":"+assertion.ID, assertion.Expires)
+		if err != nil {
+			return data.ScopeUser{}, fmt.Errorf("Problem checking whether the client assertion has been used: %s", err)
+		}
+
+		if unused != true {
+			loggerFor(req, scopeUser.Name).Warn("Login failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "replayed_assertion")
+			metrics.AuthFailures.WithLabelValues("replayed_assertion").Inc()
+			return data.ScopeUser{}, fmt.Errorf("The client assertion has already been used")
+		}
+
+		return scopeUser, nil
+	}
+
+	return db.GetUserScopesWithClientCertificate(credentials.ClientID, credentials.Certificate, credentials.Verified)
+}
+
+// clientAssertionAudiences are the audiences a client assertion sent with the request can be
+// intended for:  the endpoint the request was made to, or authserver itself (its base URL)
+func (service Service) clientAssertionAudiences(req *http.Request) []string {
+	if service.ExternalURL != "" {
+		base := strings.TrimSuffix(service.ExternalURL, "/")
+		return []string{service.targetURI(req), base, base + "/"}
+	}
+
+	endpoint, err := url.Parse(service.targetURI(req))
+	if err != nil {
+		return []string{service.targetURI(req)}
+	}
+
+	return []string{endpoint.String(), endpoint.Scheme + "://" + endpoint.Host, endpoint.Scheme + "://" + endpoint.Host + "/"}
+}
+
+// confirmation returns what a token issued with the credentials is bound to:  the
+// client's certificate if it sent one (RFC 8705, section 3), or nothing
+func (credentials clientCredentials) confirmation() data.Confirmation {
+	if credentials.Certificate == nil {
+		return data.Confirmation{}
+	}
+
+	return data.Confirmation{CertThumbprint: data.CertThumbprint(credentials.Certificate)}
+}
+
+// requestConfirmation returns what the request presents to use a bound token with:  the
+// thumbprint of the TLS client certificate the request was made with (if there is one)
+func requestConfirmation(req *http.Request) data.Confirmation {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return data.Confirmation{}
+	}
+
+	return data.Confirmation{CertThumbprint: data.CertThumbprint(req.TLS.PeerCertificates[0])}
+}
+
 // authHeaderValid returns true if the passed header value is a valid
 // for a "bearer token" authorization field -- otherwise return false
 func authHeaderValid(header string) bool {
@@ -203,33 +519,8 @@ func getTokenFromAuthHeader(header string) string {
 }
 
 // getCredentialsFromAuthHeader returns the username/password from the Authorization header
+// (see basicauth.Parse -- every endpoint reads basic auth credentials the same way)
 func getCredentialsFromAuthHeader(header string) (string, string) {
-	username := ""
-	password := ""
-
-	//	If we don't have at least x number characters,
-	//	it must not include the prefix text 'Basic '
-	if len(header) < len("Basic ") {
-		return "", ""
-	}
-
-	//	If the first part of the string isn't 'Basic ' then it's not a basic auth string...
-	if strings.EqualFold(header[:len("Basic ")], "Basic ") != true {
-		return "", ""
-	}
-
-	//	Get the credentials and decode them
-	encodedCredentials := header[len("Basic "):]
-	credentialBytes, err := base64.StdEncoding.DecodeString(encodedCredentials)
-	if err != nil {
-		return "", ""
-	}
-
-	//	Change the type to string
-	credentials := strings.Split(string(credentialBytes), ":")
-
-	username = credentials[0]
-	password = credentials[1]
-
+	username, password, _ := basicauth.Parse(header)
 	return username, password
 }
@@ -1,15 +1,45 @@
 package api
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
 )
 
 // Service encapsulates API service operations
 type Service struct {
 	DB *data.DBManager
+
+	// TokenLifetime returns how long new tokens are valid for.  It's a function so the
+	// lifetime can change while the service is running.  If it isn't set, tokens last an hour
+	TokenLifetime func() time.Duration
+
+	// ClientCAs are the CAs that issue certificates for tls_client_auth clients (RFC 8705).
+	// If it isn't set, only self_signed_tls_client_auth clients can use certificates
+	ClientCAs *x509.CertPool
+
+	// ExternalURL is the URL clients reach the service at, like https://auth.example.com (with
+	// any path prefix a proxy in front of the service strips).  DPoP proofs and client assertions
+	// are checked against it.  If it isn't set, it's the scheme and host the request came in on
+	ExternalURL string
+
+	// DPoPProofLifetime is how far a DPoP proof's 'iat' can be from now.  If it isn't set, it's a minute
+	DPoPProofLifetime time.Duration
+}
+
+// tokenLifetime returns how long new tokens are valid for
+func (service Service) tokenLifetime() time.Duration {
+	if service.TokenLifetime == nil {
+		return 1 * time.Hour
+	}
+
+	return service.TokenLifetime()
 }
 
 // ErrorResponse represents an API response
@@ -30,3 +60,43 @@ func sendErrorResponse(rw http.ResponseWriter, err error, code int) {
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(rw).Encode(response)
 }
+
+// dbFor returns the DBManager to use for a request, so changes are recorded
+// in the audit log with the request's ip address and client, log lines
+// include the request id, and DBManager spans are part of the request's trace
+func (service Service) dbFor(req *http.Request, clientID string) data.DBManager {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	return service.DB.From(ip, clientID).WithLogger(loggerFor(req, clientID)).WithContext(req.Context())
+}
+
+// loggerFor returns the logger for a request (including the client, if we know it)
+func loggerFor(req *http.Request, clientID string) *slog.Logger {
+	logger := logging.FromContext(req.Context())
+	if clientID != "" {
+		logger = logger.With(logging.FieldClientID, clientID)
+	}
+
+	return logger
+}
+
+// scopeUserIsSystemAdmin returns 'true' if the scope user has the
+// system admin role on the system resource
+func scopeUserIsSystemAdmin(scopeUser data.ScopeUser) bool {
+	for _, resource := range scopeUser.ScopeResources {
+		if resource.ID != data.BuiltIn.SystemResource {
+			continue
+		}
+
+		for _, role := range resource.ScopeRoles {
+			if role.ID == data.BuiltIn.AdminRole {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+func TestScopeUserIsSystemAdmin_SystemAdmin_ReturnsTrue(t *testing.T) {
+	//	Arrange
+	scopeUser := data.ScopeUser{
+		ScopeResources: []data.ScopeResource{
+			{ID: data.BuiltIn.SystemResource, ScopeRoles: []data.ScopeRole{{ID: data.BuiltIn.AdminRole}}},
+		},
+	}
+
+	//	Act
+	retval := scopeUserIsSystemAdmin(scopeUser)
+
+	//	Assert
+	if retval == false {
+		t.Errorf("scopeUserIsSystemAdmin indicates the user isn't a system admin, but should be")
+	}
+}
+
+func TestScopeUserIsSystemAdmin_ResourceDelegate_ReturnsFalse(t *testing.T) {
+	//	Arrange
+	scopeUser := data.ScopeUser{
+		ScopeResources: []data.ScopeResource{
+			{ID: "someresource", ScopeRoles: []data.ScopeRole{{ID: data.BuiltIn.AdminRole}}},
+			{ID: data.BuiltIn.SystemResource, ScopeRoles: []data.ScopeRole{{ID: data.BuiltIn.ResourceDelegateRole}}},
+		},
+	}
+
+	//	Act
+	retval := scopeUserIsSystemAdmin(scopeUser)
+
+	//	Assert
+	if retval == true {
+		t.Errorf("scopeUserIsSystemAdmin indicates the user is a system admin, but shouldn't be")
+	}
+}
+
+func TestTokenLifetime_NotSet_ReturnsAnHour(t *testing.T) {
+	//	Arrange
+	service := Service{}
+
+	//	Act
+	retval := service.tokenLifetime()
+
+	//	Assert
+	if retval != time.Hour {
+		t.Errorf("tokenLifetime should default to an hour, but got %s", retval)
+	}
+}
+
+func TestTokenLifetime_Changed_ReturnsCurrentLifetime(t *testing.T) {
+	//	Arrange
+	lifetime := 10 * time.Minute
+	service := Service{TokenLifetime: func() time.Duration { return lifetime }}
+
+	//	Act
+	lifetime = 5 * time.Minute
+	retval := service.tokenLifetime()
+
+	//	Assert
+	if retval != 5*time.Minute {
+		t.Errorf("tokenLifetime should return the current lifetime, but got %s", retval)
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/danesparza/authserver/basicauth"
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/gorilla/mux"
+)
+
+// AddUserRequest is a request to add a user
+type AddUserRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Password    string `json:"password"`
+}
+
+// PasswordRequest is a request to change or reset a user's password
+type PasswordRequest struct {
+	Password string `json:"password"`
+
+	// Code is a one-time code (or recovery code) from a user with a second factor changing their own password
+	Code string `json:"code,omitempty"`
+}
+
+// PasswordPolicyErrorResponse is the response when a password doesn't meet the password
+// policy.  It has each of the rules the password doesn't follow
+type PasswordPolicyErrorResponse struct {
+	Status     int                      `json:"status"`
+	Message    string                   `json:"message"`
+	Violations []data.PasswordViolation `json:"violations"`
+}
+
+// AddUser adds a user
+// @Summary adds a user
+// @Description adds a user with the given password.  If the password doesn't meet the password policy, the response lists the rules it doesn't follow
+// @ID add-user
+// @Accept  json
+// @Produce  json
+// @Param user body api.AddUserRequest true "The user to add"
+// @Security OAuth2Application
+// @Success 200 {object} data.User
+// @Failure 400 {object} api.PasswordPolicyErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/users [post]
+func (service Service) AddUser(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.userManager(rw, req)
+	if ok == false {
+		return
+	}
+
+	request := AddUserRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Name == "" {
+		sendErrorResponse(rw, fmt.Errorf("Pass the user's 'name', 'description' and 'password' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.AddUser(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, data.User{Name: request.Name, Description: request.Description}, request.Password)
+	if err != nil {
+		loggerFor(req, "").Warn("Add user request failed", logging.FieldUserID, scopeUser.ID, "user", request.Name, "error", err)
+		sendPasswordErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	//	Don't send back the secret hash
+	user.SecretHash = ""
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(user)
+}
+
+// ResetPassword sets a user's password
+// @Summary resets a user's password
+// @Description sets a user's password (without their current one).  If the password doesn't meet the password policy, the response lists the rules it doesn't follow
+// @ID reset-password
+// @Accept  json
+// @Produce  json
+// @Param id path string true "The user id"
+// @Param password body api.PasswordRequest true "The new password"
+// @Security OAuth2Application
+// @Success 200 {object} data.User
+// @Failure 400 {object} api.PasswordPolicyErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/users/{id}/password [put]
+func (service Service) ResetPassword(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.userManager(rw, req)
+	if ok == false {
+		return
+	}
+
+	request := PasswordRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		sendErrorResponse(rw, fmt.Errorf("Pass the new 'password' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	userID := mux.Vars(req)["id"]
+	user, err := db.ResetPassword(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, userID, request.Password)
+	if err != nil {
+		loggerFor(req, "").Warn("Password reset request failed", logging.FieldUserID, scopeUser.ID, "target", userID, "error", err)
+		sendPasswordErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	loggerFor(req, "").Info("Password reset", logging.FieldUserID, scopeUser.ID, "target", userID)
+
+	//	Don't send back the secret hash
+	user.SecretHash = ""
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(user)
+}
+
+// ChangePassword changes the caller's password
+// @Summary changes a user's password
+// @Description changes the password of the user in the basic auth credentials (their name and current password -- even if it has expired).  Users with a TOTP second factor also pass a one-time (or recovery) 'code'.  If the new password doesn't meet the password policy, the response lists the rules it doesn't follow
+// @ID change-password
+// @Accept  json
+// @Produce  json
+// @Param password body api.PasswordRequest true "The new password"
+// @Security BasicAuth
+// @Success 200 {object} data.User
+// @Failure 400 {object} api.PasswordPolicyErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 500 {object} api.ErrorResponse
+// @Router /api/v1/password [post]
+func (service Service) ChangePassword(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	name, currentPassword, ok := basicauth.Credentials(req)
+	if ok == false {
+		sendErrorResponse(rw, fmt.Errorf("Pass the user name and current password with HTTP basic auth"), http.StatusUnauthorized)
+		return
+	}
+
+	request := PasswordRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		sendErrorResponse(rw, fmt.Errorf("Pass the new 'password' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := service.dbFor(req, name).ChangePassword(name, currentPassword, request.Code, request.Password)
+	if err != nil {
+		sendPasswordErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	loggerFor(req, name).Info("Password changed", logging.FieldUserID, user.ID)
+
+	//	Don't send back the secret hash
+	user.SecretHash = ""
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(user)
+}
+
+// userManager checks that the request's access token belongs to a system admin or a resource
+// delegate, and returns the DBManager to use for the request along with the user.  If it doesn't,
+// it sends the error response and returns 'false'
+func (service Service) userManager(rw http.ResponseWriter, req *http.Request) (data.DBManager, data.ScopeUser, bool) {
+	//	Get the token from the authorization header.  If it wasn't supplied, return an error
+	logger := loggerFor(req, "")
+	token, presented, outcome, err := service.getAccessToken(req)
+	if err != nil {
+		logger.Warn("User request rejected", logging.FieldOutcome, outcome, "error", err)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		sendAccessTokenErrorResponse(rw, err, outcome)
+		return data.DBManager{}, data.ScopeUser{}, false
+	}
+
+	//	Find out who's asking
+	db := service.dbFor(req, "")
+	scopeUser, err := db.GetScopesForBoundToken(token, presented)
+	if err != nil {
+		logger.Warn("User request rejected", logging.FieldOutcome, "invalid_token", "error", err)
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return db, scopeUser, false
+	}
+
+	if scopeUserIsSystemAdmin(scopeUser) != true && scopeUserIsResourceDelegate(scopeUser) != true {
+		logger.Warn("User request rejected", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "forbidden")
+		metrics.AuthFailures.WithLabelValues("forbidden").Inc()
+		sendErrorResponse(rw, fmt.Errorf("User '%s' does not have permission to manage users", scopeUser.Name), http.StatusForbidden)
+		return db, scopeUser, false
+	}
+
+	return db, scopeUser, true
+}
+
+// scopeUserIsResourceDelegate returns 'true' if the scope user has the
+// resource delegate role on any resource
+func scopeUserIsResourceDelegate(scopeUser data.ScopeUser) bool {
+	for _, resource := range scopeUser.ScopeResources {
+		for _, role := range resource.ScopeRoles {
+			if role.ID == data.BuiltIn.ResourceDelegateRole {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sendPasswordErrorResponse sends a 400 with the rules the password doesn't follow if the error
+// is a password policy error -- otherwise it sends the error with the passed status code
+func sendPasswordErrorResponse(rw http.ResponseWriter, err error, code int) {
+	policyErr := data.PasswordPolicyError{}
+	if errors.As(err, &policyErr) != true {
+		sendErrorResponse(rw, err, code)
+		return
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(rw).Encode(PasswordPolicyErrorResponse{
+		Status:     http.StatusBadRequest,
+		Message:    "Error: " + policyErr.Error(),
+		Violations: policyErr.Violations,
+	})
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danesparza/authserver/data"
+)
+
+func TestSendPasswordErrorResponse_PolicyError_ListsViolations(t *testing.T) {
+	//	Arrange
+	policyErr := data.PasswordPolicyError{Violations: []data.PasswordViolation{
+		{Rule: data.PasswordRuleMinLength, Message: "The password needs to be at least 8 characters long"},
+		{Rule: data.PasswordRuleDigit, Message: "The password needs a digit"},
+	}}
+	rw := httptest.NewRecorder()
+
+	//	Act
+	sendPasswordErrorResponse(rw, policyErr, http.StatusInternalServerError)
+	response := PasswordPolicyErrorResponse{}
+	decodeErr := json.NewDecoder(rw.Body).Decode(&response)
+
+	//	Assert
+	if rw.Code != http.StatusBadRequest || decodeErr != nil {
+		t.Errorf("sendPasswordErrorResponse failed: Should have sent a 400 with the violations, but got %v (%v)", rw.Code, decodeErr)
+	}
+
+	if len(response.Violations) != 2 || response.Violations[0].Rule != data.PasswordRuleMinLength || response.Violations[1].Rule != data.PasswordRuleDigit {
+		t.Errorf("sendPasswordErrorResponse failed: Should have listed both violations, but got %+v", response.Violations)
+	}
+}
+
+func TestSendPasswordErrorResponse_OtherError_UsesStatusCode(t *testing.T) {
+	//	Arrange
+	rw := httptest.NewRecorder()
+
+	//	Act
+	sendPasswordErrorResponse(rw, fmt.Errorf("The user was not found or the password was incorrect"), http.StatusUnauthorized)
+	response := PasswordPolicyErrorResponse{}
+	json.NewDecoder(rw.Body).Decode(&response)
+
+	//	Assert
+	if rw.Code != http.StatusUnauthorized || response.Violations != nil {
+		t.Errorf("sendPasswordErrorResponse failed: Should have sent a 401 without violations, but got %v %+v", rw.Code, response)
+	}
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danesparza/authserver/basicauth"
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/danesparza/authserver/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// WebAuthnRegistrationRequest starts registering a WebAuthn credential
+type WebAuthnRegistrationRequest struct {
+	// Passkey is 'true' to register a passkey (that can be used to log in without a password),
+	// and 'false' to register a security key (that's used as a second factor after the password)
+	Passkey bool `json:"passkey"`
+
+	// Password and Code are the user's password and one-time code.  They're needed unless the
+	// bearer token was issued with a second factor (with 'mfa' in its authentication methods)
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// WebAuthnRemovalRequest is the user's password and one-time code, for removing one of their
+// WebAuthn credentials with a bearer token that wasn't issued with a second factor
+type WebAuthnRemovalRequest struct {
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// WebAuthnRegistration is the browser's response to a registration ceremony
+type WebAuthnRegistration struct {
+	// Name is what the user calls the authenticator (like 'YubiKey' or 'Laptop')
+	Name       string                        `json:"name"`
+	Credential webauthn.RegistrationResponse `json:"credential"`
+}
+
+// WebAuthnAssertion is the browser's response to a login ceremony
+type WebAuthnAssertion struct {
+	Credential webauthn.AuthenticationResponse `json:"credential"`
+}
+
+// tokenUser returns the user the request's access token was issued to.  If the token is
+// missing or invalid, it sends the error response and returns 'false'
+func (service Service) tokenUser(rw http.ResponseWriter, req *http.Request) (data.DBManager, data.ScopeUser, bool) {
+	logger := loggerFor(req, "")
+	token, presented, outcome, err := service.getAccessToken(req)
+	if err != nil {
+		logger.Warn("WebAuthn request rejected", logging.FieldOutcome, outcome, "error", err)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		sendAccessTokenErrorResponse(rw, err, outcome)
+		return data.DBManager{}, data.ScopeUser{}, false
+	}
+
+	db := service.dbFor(req, "")
+	scopeUser, err := db.GetScopesForBoundToken(token, presented)
+	if err != nil {
+		logger.Warn("WebAuthn request rejected", logging.FieldOutcome, "invalid_token", "error", err)
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return db, scopeUser, false
+	}
+
+	return db, scopeUser, true
+}
+
+// BeginWebAuthnRegistration starts registering a WebAuthn credential for the caller
+// @Summary starts registering a passkey or security key
+// @Description starts registering a WebAuthn credential for the user the bearer token was issued to.  Unless the token was issued with a second factor ('mfa' in its amr), the request needs the user's password (and one-time code, if they have one).  Pass the returned options to navigator.credentials.create() and send the result to /webauthn/register/finish
+// @ID begin-webauthn-registration
+// @Accept  json
+// @Produce  json
+// @Param request body api.WebAuthnRegistrationRequest true "Whether to register a passkey or a security key (and the user's password and one-time code)"
+// @Security OAuth2Application
+// @Success 200 {object} webauthn.CreationOptions
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/register/begin [post]
+func (service Service) BeginWebAuthnRegistration(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.tokenUser(rw, req)
+	if ok == false {
+		return
+	}
+
+	request := WebAuthnRegistrationRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		sendErrorResponse(rw, fmt.Errorf("Pass whether to register a 'passkey' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	verification := data.WebAuthnVerification{AMR: scopeUser.AMR, Password: request.Password, Code: request.Code}
+	options, ceremony, err := db.BeginWebAuthnRegistration(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, verification, request.Passkey)
+	if err != nil {
+		loggerFor(req, "").Warn("WebAuthn registration refused", logging.FieldUserID, scopeUser.ID, "error", err)
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.SaveWebAuthnCeremony(ceremony); err != nil {
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(options)
+}
+
+// FinishWebAuthnRegistration finishes registering a WebAuthn credential for the caller
+// @Summary finishes registering a passkey or security key
+// @Description checks the result of navigator.credentials.create() and stores the new credential for the user the bearer token was issued to
+// @ID finish-webauthn-registration
+// @Accept  json
+// @Produce  json
+// @Param registration body api.WebAuthnRegistration true "The authenticator's name and the new credential"
+// @Security OAuth2Application
+// @Success 200 {object} data.WebAuthnCredential
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/register/finish [post]
+func (service Service) FinishWebAuthnRegistration(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.tokenUser(rw, req)
+	if ok == false {
+		return
+	}
+
+	request := WebAuthnRegistration{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		sendErrorResponse(rw, fmt.Errorf("Pass the new 'credential' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := request.Credential.Challenge()
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	ceremony, found, err := db.TakeWebAuthnCeremony(challenge)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	if found == false {
+		sendErrorResponse(rw, fmt.Errorf("The registration wasn't started, or has already finished"), http.StatusBadRequest)
+		return
+	}
+
+	credential, err := db.FinishWebAuthnRegistration(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, ceremony, request.Name, request.Credential)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	loggerFor(req, "").Info("WebAuthn credential registered", logging.FieldUserID, scopeUser.ID, "credential", credential.ID, "passkey", credential.Passkey)
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(credential)
+}
+
+// BeginWebAuthnLogin starts logging in with a passkey or security key
+// @Summary starts logging in with a passkey or security key
+// @Description starts a WebAuthn login.  Without credentials, the user logs in with a passkey.  With the user's name and password in the basic auth credentials, they log in with their security key as a second factor.  Pass the returned options to navigator.credentials.get() and send the result to /webauthn/login/finish
+// @ID begin-webauthn-login
+// @Accept  json
+// @Produce  json
+// @Security BasicAuth
+// @Success 200 {object} webauthn.RequestOptions
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/login/begin [post]
+func (service Service) BeginWebAuthnLogin(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	name, password, _ := basicauth.Credentials(req)
+	db := service.dbFor(req, name)
+	options, ceremony, err := db.BeginWebAuthnLogin(name, password)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.SaveWebAuthnCeremony(ceremony); err != nil {
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(options)
+}
+
+// FinishWebAuthnLogin finishes logging in with a passkey or security key, and issues a token
+// @Summary finishes logging in with a passkey or security key
+// @Description checks the result of navigator.credentials.get() and issues a bearer token for the user the credential belongs to
+// @ID finish-webauthn-login
+// @Accept  json
+// @Produce  json
+// @Param assertion body api.WebAuthnAssertion true "The credential's assertion"
+// @Success 200 {object} api.AuthResponse
+// @Failure 400 {object} api.ErrorResponse
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/login/finish [post]
+func (service Service) FinishWebAuthnLogin(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	logger := loggerFor(req, "")
+
+	request := WebAuthnAssertion{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		sendErrorResponse(rw, fmt.Errorf("Pass the 'credential' assertion as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := request.Credential.Challenge()
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	db := service.dbFor(req, "")
+	ceremony, found, err := db.TakeWebAuthnCeremony(challenge)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	if found == false {
+		sendErrorResponse(rw, fmt.Errorf("The login wasn't started, or has already finished"), http.StatusBadRequest)
+		return
+	}
+	scopeUser, err := db.GetUserScopesWithWebAuthn(ceremony, request.Credential)
+	if err != nil {
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := db.GetNewAuthenticatedToken(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, service.tokenLifetime(), data.Confirmation{}, scopeUser.AMR)
+	if err != nil {
+		logger.Error("Token request failed", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "error", "error", err)
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	logger.Info("Token issued", logging.FieldUserID, scopeUser.ID, logging.FieldOutcome, "issued")
+	metrics.TokensIssued.WithLabelValues("webauthn", scopeUser.Name).Inc()
+
+	//	Create our response and send information back:
+	response := AuthResponse{
+		TokenType:   "Bearer",
+		ExpiresIn:   strconv.FormatFloat(token.Expires.Sub(time.Now()).Seconds(), 'f', 0, 64),
+		AccessToken: base64.StdEncoding.EncodeToString([]byte(token.ID)),
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// GetOwnWebAuthnCredentials lists the caller's WebAuthn credentials
+// @Summary lists the caller's passkeys and security keys
+// @Description lists the WebAuthn credentials of the user the bearer token was issued to
+// @ID get-own-webauthn-credentials
+// @Produce  json
+// @Security OAuth2Application
+// @Success 200 {array} data.WebAuthnCredential
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/credentials [get]
+func (service Service) GetOwnWebAuthnCredentials(rw http.ResponseWriter, req *http.Request) {
+	db, scopeUser, ok := service.tokenUser(rw, req)
+	if ok == false {
+		return
+	}
+
+	service.sendWebAuthnCredentials(rw, req, db, scopeUser, scopeUser.ID)
+}
+
+// RemoveOwnWebAuthnCredential removes one of the caller's WebAuthn credentials
+// @Summary removes one of the caller's passkeys or security keys
+// @Description removes a WebAuthn credential of the user the bearer token was issued to.  Unless the token was issued with a second factor ('mfa' in its amr), the request needs the user's password (and one-time code, if they have one)
+// @ID remove-own-webauthn-credential
+// @Accept  json
+// @Param id path string true "The credential id"
+// @Param request body api.WebAuthnRemovalRequest false "The user's password and one-time code"
+// @Security OAuth2Application
+// @Success 204
+// @Failure 401 {object} api.ErrorResponse
+// @Router /webauthn/credentials/{id} [delete]
+func (service Service) RemoveOwnWebAuthnCredential(rw http.ResponseWriter, req *http.Request) {
+	//	req.Body is a ReadCloser -- we need to remember to close it:
+	defer req.Body.Close()
+
+	db, scopeUser, ok := service.tokenUser(rw, req)
+	if ok != true {
+		return
+	}
+
+	//	The body is optional (tokens issued with a second factor don't need it)
+	request := WebAuthnRemovalRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		sendErrorResponse(rw, fmt.Errorf("Pass the 'password' and 'code' as JSON"), http.StatusBadRequest)
+		return
+	}
+
+	credentialID := mux.Vars(req)["id"]
+	verification := data.WebAuthnVerification{AMR: scopeUser.AMR, Password: request.Password, Code: request.Code}
+	if err := db.RemoveOwnWebAuthnCredential(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, verification, credentialID); err != nil {
+		loggerFor(req, "").Warn("WebAuthn credential removal failed", logging.FieldUserID, scopeUser.ID, "credential", credentialID, "error", err)
+		sendErrorResponse(rw, err, http.StatusUnauthorized)
+		return
+	}
+
+	loggerFor(req, "").Info("WebAuthn credential removed", logging.FieldUserID, scopeUser.ID, "target", scopeUser.ID, "credential", credentialID)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// GetUserWebAuthnCredentials lists a user's WebAuthn credentials
+// @Summary lists a user's passkeys and security keys
+// @Description lists the WebAuthn credentials of a user.  The caller has to be a system admin or resource delegate
+// @ID get-user-webauthn-credentials
+// @Produce  json
+// @Param id path string true "The user id"
+// @Security OAuth2Application
+// @Success 200 {array} data.WebAuthnCredential
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Router /api/v1/users/{id}/webauthn [get]
+func (service Service) GetUserWebAuthnCredentials(rw http.ResponseWriter, req *http.Request) {
+	db, scopeUser, ok := service.userManager(rw, req)
+	if ok == false {
+		return
+	}
+
+	service.sendWebAuthnCredentials(rw, req, db, scopeUser, mux.Vars(req)["id"])
+}
+
+// RemoveUserWebAuthnCredential removes one of a user's WebAuthn credentials
+// @Summary removes one of a user's passkeys or security keys
+// @Description removes a WebAuthn credential of a user (like when they've lost the authenticator).  The caller has to be a system admin or resource delegate
+// @ID remove-user-webauthn-credential
+// @Param id path string true "The user id"
+// @Param credential path string true "The credential id"
+// @Security OAuth2Application
+// @Success 204
+// @Failure 401 {object} api.ErrorResponse
+// @Failure 403 {object} api.ErrorResponse
+// @Failure 404 {object} api.ErrorResponse
+// @Router /api/v1/users/{id}/webauthn/{credential} [delete]
+func (service Service) RemoveUserWebAuthnCredential(rw http.ResponseWriter, req *http.Request) {
+	db, scopeUser, ok := service.userManager(rw, req)
+	if ok == false {
+		return
+	}
+
+	service.removeWebAuthnCredential(rw, req, db, scopeUser, mux.Vars(req)["id"], mux.Vars(req)["credential"])
+}
+
+// sendWebAuthnCredentials sends a user's WebAuthn credentials
+func (service Service) sendWebAuthnCredentials(rw http.ResponseWriter, req *http.Request, db data.DBManager, scopeUser data.ScopeUser, userID string) {
+	credentials, err := db.GetWebAuthnCredentials(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, userID)
+	if err != nil {
+		loggerFor(req, "").Warn("WebAuthn credentials request failed", logging.FieldUserID, scopeUser.ID, "target", userID, "error", err)
+		sendErrorResponse(rw, err, http.StatusForbidden)
+		return
+	}
+
+	//	Serialize to JSON & return the response:
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(credentials)
+}
+
+// removeWebAuthnCredential removes one of a user's WebAuthn credentials
+func (service Service) removeWebAuthnCredential(rw http.ResponseWriter, req *http.Request, db data.DBManager, scopeUser data.ScopeUser, userID, credentialID string) {
+	if err := db.RemoveWebAuthnCredential(data.User{ID: scopeUser.ID, Name: scopeUser.Name}, userID, credentialID); err != nil {
+		loggerFor(req, "").Warn("WebAuthn credential removal failed", logging.FieldUserID, scopeUser.ID, "target", userID, "credential", credentialID, "error", err)
+		sendErrorResponse(rw, err, http.StatusNotFound)
+		return
+	}
+
+	loggerFor(req, "").Info("WebAuthn credential removed", logging.FieldUserID, scopeUser.ID, "target", userID, "credential", credentialID)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
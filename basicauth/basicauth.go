@@ -0,0 +1,62 @@
+// Package basicauth reads HTTP basic auth credentials (RFC 7617).  Every endpoint (and the
+// rate limiter) reads them with Credentials, so a name or password means the same thing everywhere
+package basicauth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// The prefix of basic auth Authorization headers
+const prefix = "Basic "
+
+// formURLEncoded is 'true' if names and passwords are form-urlencoded (see SetFormURLEncoded)
+var formURLEncoded atomic.Bool
+
+// SetFormURLEncoded sets whether names and passwords are form-urlencoded before they're base64
+// encoded, like RFC 6749 (section 2.3.1) says OAuth clients encode their ids and secrets.  It's
+// off by default, so names and passwords with '+' or '%' in them are read as they were sent
+func SetFormURLEncoded(encoded bool) {
+	formURLEncoded.Store(encoded)
+}
+
+// Credentials returns the name and password in the request's basic auth credentials, and
+// 'false' if it doesn't have any (or they can't be read)
+func Credentials(req *http.Request) (string, string, bool) {
+	return Parse(req.Header.Get("Authorization"))
+}
+
+// Parse returns the name and password in a basic auth Authorization header, and 'false' if
+// it isn't one (or it can't be read)
+func Parse(header string) (string, string, bool) {
+	if len(header) < len(prefix) || strings.EqualFold(header[:len(prefix)], prefix) == false {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	//	Split them at the first colon (the password can have colons in it, but
+	//	the name can't).  Without a colon, they aren't credentials at all
+	name, password, found := strings.Cut(string(decoded), ":")
+	if found == false {
+		return "", "", false
+	}
+
+	if formURLEncoded.Load() {
+		if name, err = url.QueryUnescape(name); err != nil {
+			return "", "", false
+		}
+
+		if password, err = url.QueryUnescape(password); err != nil {
+			return "", "", false
+		}
+	}
+
+	return name, password, true
+}
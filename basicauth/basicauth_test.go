@@ -0,0 +1,47 @@
+package basicauth_test
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/danesparza/authserver/basicauth"
+)
+
+func TestCredentials_RequestBasicAuth_ReadsTheSameAsNetHTTP(t *testing.T) {
+	//	Arrange
+	req := httptest.NewRequest("POST", "/oauth/token", nil)
+	req.SetBasicAuth("test+user", "p@ss+w%rd:with:colons")
+
+	//	Act
+	name, password, ok := basicauth.Credentials(req)
+	wantName, wantPassword, wantOK := req.BasicAuth()
+
+	//	Assert
+	if ok != wantOK || name != wantName || password != wantPassword {
+		t.Errorf("Credentials should have read %s / %s, but got %s / %s (%v)", wantName, wantPassword, name, password, ok)
+	}
+}
+
+func TestParse_FormURLEncoded_DecodesCredentials(t *testing.T) {
+	//	Arrange
+	basicauth.SetFormURLEncoded(true)
+	defer basicauth.SetFormURLEncoded(false)
+
+	encoded := "Basic " + base64.StdEncoding.EncodeToString([]byte(url.QueryEscape("test client:1")+":"+url.QueryEscape("p@ss+w%rd:")))
+	badEscape := "Basic " + base64.StdEncoding.EncodeToString([]byte("testuser:100%"))
+
+	//	Act
+	name, password, ok := basicauth.Parse(encoded)
+	_, _, badOK := basicauth.Parse(badEscape)
+
+	//	Assert
+	if ok != true || name != "test client:1" || password != "p@ss+w%rd:" {
+		t.Errorf("Parse should have form-urldecoded the credentials, but got %s / %s (%v)", name, password, ok)
+	}
+
+	if badOK {
+		t.Errorf("Parse should have rejected credentials that aren't form-urlencoded")
+	}
+}
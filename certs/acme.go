@@ -0,0 +1,134 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig is the ACME configuration (the 'acme' section of the config file)
+type ACMEConfig struct {
+	// DirectoryURL is the CA's ACME directory (Let's Encrypt if it's blank)
+	DirectoryURL string
+
+	// Email is the contact address for the ACME account (optional)
+	Email string
+
+	// Domains are the host names certificates are requested for.  Requests
+	// for other host names are rejected
+	Domains []string
+
+	// AcceptTOS accepts the CA's terms of service.  It has to be set
+	AcceptTOS bool
+
+	// CacheDir is where the account key and certificates are kept
+	CacheDir string
+
+	// CACert is a PEM file of extra root certificates to trust when talking to the
+	// ACME directory (like the root of a local test CA such as Pebble)
+	CACert string
+
+	// RenewBefore is how long before a certificate expires to renew it (30 days if it's 0)
+	RenewBefore time.Duration
+}
+
+// NewACMEManager returns a manager that gets certificates for the configured domains from the
+// ACME CA, caches them in the cache directory and renews them before they expire.  Use its
+// GetCertificate (with ACMETLSConfig, to answer TLS-ALPN-01 challenges) and HTTPHandler (to
+// answer HTTP-01 challenges on port 80)
+func NewACMEManager(config ACMEConfig) (*autocert.Manager, error) {
+	domains := []string{}
+	for _, domain := range config.Domains {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("Problem setting up ACME: there aren't any domains to request certificates for (acme.domains)")
+	}
+
+	if config.AcceptTOS == false {
+		return nil, fmt.Errorf("Problem setting up ACME: the CA's terms of service have to be accepted (acme.accepttos)")
+	}
+
+	if config.CacheDir == "" {
+		return nil, fmt.Errorf("Problem setting up ACME: the certificate cache directory isn't set (acme.cache)")
+	}
+
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("Problem creating the ACME certificate cache directory %s: %s", config.CacheDir, err)
+	}
+
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if config.CACert != "" {
+		roots, err := loadRoots(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		client.HTTPClient = &http.Client{
+			Timeout:   time.Minute,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: config.RenewBefore,
+		Client:      client,
+		Email:       config.Email,
+	}, nil
+}
+
+// ACMETLSConfig returns TLS config that serves the manager's certificates and
+// answers TLS-ALPN-01 challenges (as well as HTTP/2 and HTTP/1.1 requests)
+func ACMETLSConfig(manager *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: manager.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// ACMECertificate returns the manager's certificate for the domain (the way a client
+// connecting to the domain would get it), getting one from the CA if it isn't cached
+func ACMECertificate(manager *autocert.Manager, domain string) (*tls.Certificate, error) {
+	return manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       domain,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+}
+
+// loadRoots returns the system roots plus the certificates in the PEM file
+func loadRoots(caCertFile string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	pemCerts, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading the ACME CA certificate %s: %s", caCertFile, err)
+	}
+
+	if roots.AppendCertsFromPEM(pemCerts) == false {
+		return nil, fmt.Errorf("Problem reading the ACME CA certificate %s: there aren't any PEM certificates in it", caCertFile)
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,168 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/certs"
+)
+
+// getTestACMEConfig returns ACME config for example.com, using a cache directory in a
+// temporary directory and a directory URL nothing is listening on
+func getTestACMEConfig(t *testing.T) certs.ACMEConfig {
+	return certs.ACMEConfig{
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		Domains:      []string{"example.com"},
+		AcceptTOS:    true,
+		CacheDir:     filepath.Join(t.TempDir(), "acme"),
+		RenewBefore:  time.Hour,
+	}
+}
+
+// writeCachedCertificate writes a certificate for the domain to the cache directory,
+// in the format the ACME manager caches certificates in
+func writeCachedCertificate(t *testing.T, cacheDir, domain string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Problem marshalling key: %s", err)
+	}
+
+	contents := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	os.WriteFile(filepath.Join(cacheDir, domain), contents, 0600)
+}
+
+func TestNewACMEManager_InvalidConfig_ReturnsError(t *testing.T) {
+	//	Arrange
+	noDomains := getTestACMEConfig(t)
+	noDomains.Domains = []string{" "}
+
+	noTOS := getTestACMEConfig(t)
+	noTOS.AcceptTOS = false
+
+	badCACert := getTestACMEConfig(t)
+	badCACert.CACert = filepath.Join(t.TempDir(), "missing.pem")
+
+	//	Act
+	_, noDomainsErr := certs.NewACMEManager(noDomains)
+	_, noTOSErr := certs.NewACMEManager(noTOS)
+	_, badCACertErr := certs.NewACMEManager(badCACert)
+
+	//	Assert
+	if noDomainsErr == nil {
+		t.Errorf("NewACMEManager failed: Should have returned an error without any domains")
+	}
+
+	if noTOSErr == nil {
+		t.Errorf("NewACMEManager failed: Should have returned an error if the terms of service weren't accepted")
+	}
+
+	if badCACertErr == nil {
+		t.Errorf("NewACMEManager failed: Should have returned an error for a missing CA certificate file")
+	}
+}
+
+func TestNewACMEManager_ValidConfig_CreatesCacheDir(t *testing.T) {
+	//	Arrange
+	config := getTestACMEConfig(t)
+
+	//	Act
+	_, err := certs.NewACMEManager(config)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: Should have created the manager without error: %s", err)
+	}
+
+	if info, err := os.Stat(config.CacheDir); err != nil || info.IsDir() == false {
+		t.Errorf("NewACMEManager failed: Should have created the cache directory %s", config.CacheDir)
+	}
+}
+
+func TestACMECertificate_CachedCertificate_IsServed(t *testing.T) {
+	//	Arrange
+	config := getTestACMEConfig(t)
+	manager, err := certs.NewACMEManager(config)
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %s", err)
+	}
+	writeCachedCertificate(t, config.CacheDir, "example.com")
+
+	//	Act
+	cert, err := certs.ACMECertificate(manager, "example.com")
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ACMECertificate failed: Should have served the cached certificate without contacting the CA: %s", err)
+	}
+
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "example.com" {
+		t.Errorf("ACMECertificate failed: Should have served the certificate for example.com")
+	}
+}
+
+func TestACMECertificate_OtherDomain_ReturnsError(t *testing.T) {
+	//	Arrange
+	manager, err := certs.NewACMEManager(getTestACMEConfig(t))
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %s", err)
+	}
+
+	//	Act
+	_, err = certs.ACMECertificate(manager, "other.example.com")
+
+	//	Assert
+	if err == nil {
+		t.Errorf("ACMECertificate failed: Should have refused to get a certificate for a domain that isn't configured")
+	}
+}
+
+func TestACMETLSConfig_Manager_AnswersTLSALPNChallenges(t *testing.T) {
+	//	Arrange
+	manager, err := certs.NewACMEManager(getTestACMEConfig(t))
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %s", err)
+	}
+
+	//	Act
+	config := certs.ACMETLSConfig(manager)
+
+	//	Assert
+	found := false
+	for _, proto := range config.NextProtos {
+		if proto == "acme-tls/1" {
+			found = true
+		}
+	}
+
+	if found == false || config.GetCertificate == nil {
+		t.Errorf("ACMETLSConfig failed: Should serve the manager's certificates and offer the acme-tls/1 protocol, but got %v", config.NextProtos)
+	}
+}
@@ -0,0 +1,168 @@
+// Package certs serves TLS certificates that can change while the services are running.
+// A Reloader serves a certificate and key from files, and picks up new files when they
+// are rotated (on a timer with Watch, or on demand with Reload).  An ACME manager (see
+// NewACMEManager) gets certificates from an ACME CA like Let's Encrypt and renews them
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves the certificate in a certificate / key file pair, reloading
+// it when the files change.  Use GetCertificate in a tls.Config
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      *sync.RWMutex
+	current *tls.Certificate
+	stamp   string
+}
+
+// NewReloader loads the certificate and key files and returns a Reloader for them
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	retval := &Reloader{certFile: certFile, keyFile: keyFile, mu: &sync.RWMutex{}}
+
+	if err := retval.Reload(); err != nil {
+		return nil, err
+	}
+
+	return retval, nil
+}
+
+// GetCertificate returns the current certificate.  It's meant to be used as tls.Config.GetCertificate
+func (reloader *Reloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return reloader.current, nil
+}
+
+// Expires returns when the current certificate expires
+func (reloader *Reloader) Expires() time.Time {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return reloader.current.Leaf.NotAfter
+}
+
+// Reload loads the certificate and key files.  If they can't be loaded
+// (or don't match), the current certificate is kept and an error is returned
+func (reloader *Reloader) Reload() error {
+	//	Get the files' stamp before reading them, so a change while
+	//	we're reading gets picked up the next time we check
+	stamp, err := fileStamp(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("Problem checking the TLS certificate files: %s", err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("Problem loading the TLS certificate %s: %s", reloader.certFile, err)
+	}
+
+	if pair.Leaf == nil {
+		pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("Problem parsing the TLS certificate %s: %s", reloader.certFile, err)
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	reloader.current = &pair
+	reloader.stamp = stamp
+
+	return nil
+}
+
+// ReloadIfChanged reloads the certificate and key files if either of them has
+// changed since they were last loaded.  It returns 'true' if they were reloaded
+func (reloader *Reloader) ReloadIfChanged() (bool, error) {
+	stamp, err := fileStamp(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("Problem checking the TLS certificate files: %s", err)
+	}
+
+	reloader.mu.RLock()
+	unchanged := stamp == reloader.stamp
+	reloader.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	if err := reloader.Reload(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Watch checks the certificate and key files every 'interval' and reloads them when they
+// change, until the context is cancelled.  A zero (or negative) interval disables watching
+func (reloader *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := reloader.ReloadIfChanged()
+		if err != nil {
+			log.Printf("[ERROR] %s -- still using the current certificate", err)
+			continue
+		}
+
+		if reloaded {
+			log.Printf("[INFO] Reloaded the TLS certificate %s (expires %s)\n", reloader.certFile, reloader.Expires().UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// LoadCertPool returns a pool of the certificates in the PEM file (like a bundle of the
+// CAs that issue client certificates).  System roots aren't included
+func LoadCertPool(pemFile string) (*x509.CertPool, error) {
+	pemCerts, err := os.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading the certificates in %s: %s", pemFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(pemCerts) == false {
+		return nil, fmt.Errorf("Problem reading the certificates in %s: there aren't any PEM certificates in it", pemFile)
+	}
+
+	return pool, nil
+}
+
+// fileStamp returns a string that changes when either of the files is modified or replaced
+func fileStamp(files ...string) (string, error) {
+	retval := ""
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+
+		retval += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+
+	return retval, nil
+}
@@ -0,0 +1,149 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/certs"
+)
+
+// writeTestCertificate writes a self-signed certificate (for the given common name) and
+// its key to the given files
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Problem marshalling key: %s", err)
+	}
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// getTestFiles returns the certificate and key file names in a temporary directory
+func getTestFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// servedName returns the common name of the certificate the reloader is serving
+func servedName(t *testing.T, reloader *certs.Reloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %s", err)
+	}
+
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestNewReloader_MissingFiles_ReturnsError(t *testing.T) {
+	//	Arrange
+	certFile, keyFile := getTestFiles(t)
+
+	//	Act
+	_, err := certs.NewReloader(certFile, keyFile)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("NewReloader failed: Should have returned an error for missing files")
+	}
+}
+
+func TestReloadIfChanged_RotatedFiles_ServesNewCertificate(t *testing.T) {
+	//	Arrange
+	certFile, keyFile := getTestFiles(t)
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader failed: %s", err)
+	}
+
+	//	Act
+	unchangedReload, unchangedErr := reloader.ReloadIfChanged()
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	reloaded, err := reloader.ReloadIfChanged()
+
+	//	Assert
+	if unchangedReload || unchangedErr != nil {
+		t.Errorf("ReloadIfChanged failed: Shouldn't have reloaded files that haven't changed (err: %v)", unchangedErr)
+	}
+
+	if reloaded == false || err != nil {
+		t.Errorf("ReloadIfChanged failed: Should have reloaded the rotated files without error (err: %v)", err)
+	}
+
+	if name := servedName(t, reloader); name != "second" {
+		t.Errorf("ReloadIfChanged failed: Should be serving the new certificate, but got '%s'", name)
+	}
+}
+
+func TestReload_BadFiles_KeepsCurrentCertificate(t *testing.T) {
+	//	Arrange
+	certFile, keyFile := getTestFiles(t)
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader failed: %s", err)
+	}
+
+	//	Act
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	err = reloader.Reload()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Reload failed: Should have returned an error for a bad certificate file")
+	}
+
+	if name := servedName(t, reloader); name != "first" {
+		t.Errorf("Reload failed: Should still be serving the original certificate, but got '%s'", name)
+	}
+}
+
+func TestLoadCertPool_Bundle_ContainsCertificates(t *testing.T) {
+	//	Arrange
+	certFile, keyFile := getTestFiles(t)
+	writeTestCertificate(t, certFile, keyFile, "Test CA")
+
+	//	Act
+	pool, err := certs.LoadCertPool(certFile)
+	_, keyErr := certs.LoadCertPool(keyFile)
+
+	//	Assert
+	if err != nil || pool == nil {
+		t.Errorf("LoadCertPool failed: Should have loaded the certificate without error: %s", err)
+	}
+
+	if keyErr == nil {
+		t.Errorf("LoadCertPool failed: Should have returned an error for a file without any certificates")
+	}
+}
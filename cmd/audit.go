@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Audit log commands",
+	Long:  `Audit log commands`,
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+}
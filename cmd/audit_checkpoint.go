@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var auditCheckpointFile string
+
+// auditcheckpointCmd represents the audit checkpoint command
+var auditcheckpointCmd = &cobra.Command{
+	Use:   "checkpoint",
+	Short: "Appends a checkpoint of the audit log to a file",
+	Long: `Appends a checkpoint (the id and hash of the last audit event, signed 
+with audit.hmackey if it's set) to a checkpoint file.  Keep the file 
+somewhere other than the datastore, then use 'audit verify --checkpoints' 
+to check the log against it.
+
+The 'start' command also does this in the background every 
+audit.checkpoint.interval if audit.checkpoint.file is set`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if auditCheckpointFile == "" {
+			auditCheckpointFile = viper.GetString("audit.checkpoint.file")
+		}
+
+		if auditCheckpointFile == "" {
+			log.Printf("[ERROR] A checkpoint file is required.  Use --file or set audit.checkpoint.file in the config file")
+			return
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		checkpoint, err := writeAuditCheckpoint(db, auditCheckpointFile)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		fmt.Printf("Checkpoint at event #%v written to %s\n", checkpoint.ID, auditCheckpointFile)
+	},
+}
+
+// writeAuditCheckpoint appends a checkpoint of the audit log to the given file
+func writeAuditCheckpoint(db *data.DBManager, filename string) (data.AuditCheckpoint, error) {
+	//	Checkpoint as the admin user
+	admin, err := db.GetAdminUser()
+	if err != nil {
+		return data.AuditCheckpoint{}, err
+	}
+
+	checkpoint, err := db.CreateAuditCheckpoint(admin)
+	if err != nil {
+		return checkpoint, fmt.Errorf("Error trying to create an audit checkpoint: %s", err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return checkpoint, fmt.Errorf("Error trying to open the checkpoint file: %s", err)
+	}
+	defer f.Close()
+
+	if err := data.WriteAuditCheckpoint(f, checkpoint); err != nil {
+		return checkpoint, err
+	}
+
+	return checkpoint, f.Close()
+}
+
+// writeAuditCheckpoints appends a checkpoint of the audit log to the given file every
+// 'interval' until the context is cancelled.  A blank file (or zero interval) disables checkpoints
+func writeAuditCheckpoints(ctx context.Context, db *data.DBManager, filename string, interval time.Duration) {
+	if filename == "" || interval <= 0 {
+		log.Printf("[INFO] Audit checkpoints are disabled\n")
+		return
+	}
+
+	log.Printf("[INFO] Writing audit checkpoints to %s every %s\n", filename, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastID := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkpoint, err := writeAuditCheckpoint(db, filename)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			continue
+		}
+
+		if checkpoint.ID != lastID {
+			log.Printf("[DEBUG] Audit checkpoint at event #%v\n", checkpoint.ID)
+			lastID = checkpoint.ID
+		}
+	}
+}
+
+func init() {
+	auditCmd.AddCommand(auditcheckpointCmd)
+
+	auditcheckpointCmd.Flags().StringVar(&auditCheckpointFile, "file", "", "Checkpoint file to append to (defaults to audit.checkpoint.file)")
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var (
+	auditTailLines  int64
+	auditTailFollow bool
+)
+
+// audittailCmd represents the audit tail command
+var audittailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Shows the most recent audit log events",
+	Long: `Shows the most recent audit log events.  Use --follow 
+to keep showing new events as they are added`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+
+		//	Read the log as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		//	Start 'auditTailLines' events back from the end
+		after, err := db.GetLastAuditEventID(admin)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to read the audit log: %s", err)
+			return
+		}
+
+		after -= auditTailLines
+		if after < 0 {
+			after = 0
+		}
+
+		for {
+			events, err := db.GetAuditEvents(admin, after, 100)
+			if err != nil {
+				log.Printf("[ERROR] Error trying to read the audit log: %s", err)
+				return
+			}
+
+			for _, event := range events {
+				fmt.Println(formatAuditEvent(event))
+				after = event.ID
+			}
+
+			//	If we got a full page, there may be more waiting
+			if len(events) == 100 {
+				continue
+			}
+
+			if auditTailFollow == false {
+				return
+			}
+
+			time.Sleep(1 * time.Second)
+		}
+	},
+}
+
+// formatAuditEvent formats an audit event as a single line
+func formatAuditEvent(event data.AuditEvent) string {
+	retval := fmt.Sprintf("%v %s #%v %s %s", event.Created.Local().Format(time.RFC3339), event.Action, event.ID, event.Actor, event.TargetType)
+	if event.TargetID != "" {
+		retval += "/" + event.TargetID
+	}
+
+	if event.IP != "" {
+		retval += " ip=" + event.IP
+	}
+
+	if event.ClientID != "" {
+		retval += " client=" + event.ClientID
+	}
+
+	if event.Detail != "" {
+		retval += fmt.Sprintf(" detail=%q", event.Detail)
+	}
+
+	if event.Before != "" {
+		retval += " before=" + event.Before
+	}
+
+	if event.After != "" {
+		retval += " after=" + event.After
+	}
+
+	return retval
+}
+
+func init() {
+	auditCmd.AddCommand(audittailCmd)
+
+	audittailCmd.Flags().Int64VarP(&auditTailLines, "lines", "n", 20, "Number of events to show")
+	audittailCmd.Flags().BoolVarP(&auditTailFollow, "follow", "f", false, "Keep showing new events as they are added")
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var auditVerifyCheckpoints string
+
+// auditverifyCmd represents the audit verify command
+var auditverifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verifies the audit log hasn't been changed",
+	Long: `Walks the audit log and checks that every event is there, chains 
+to the event before it, and hasn't been changed.  If audit.hmackey is set 
+in the config file, each event's HMAC is checked too.
+
+Use --checkpoints to also check the log against a checkpoint file (by 
+default, the audit.checkpoint.file from the config file).  The first broken 
+link in the chain is reported and the command exits with a non-zero status`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Read the checkpoints (if we have any).  The checkpoint file from the
+		//	config file may not have been written yet
+		fromConfig := false
+		if auditVerifyCheckpoints == "" {
+			auditVerifyCheckpoints = viper.GetString("audit.checkpoint.file")
+			fromConfig = true
+		}
+
+		checkpoints := []data.AuditCheckpoint{}
+		if auditVerifyCheckpoints != "" {
+			f, err := os.Open(auditVerifyCheckpoints)
+			if err != nil && fromConfig && os.IsNotExist(err) {
+				log.Printf("[WARN] The checkpoint file %s doesn't exist yet", auditVerifyCheckpoints)
+			} else if err != nil {
+				log.Printf("[ERROR] Error trying to open the checkpoint file: %s", err)
+				os.Exit(1)
+			} else {
+				checkpoints, err = data.ReadAuditCheckpoints(f)
+				f.Close()
+				if err != nil {
+					log.Printf("[ERROR] %s", err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Verify as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			os.Exit(1)
+		}
+
+		result, err := db.VerifyAuditLog(admin, checkpoints)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to verify the audit log: %s", err)
+			os.Exit(1)
+		}
+
+		if result.BrokenID != 0 {
+			fmt.Printf("FAILED: the audit log is broken at event %v: %s\n", result.BrokenID, result.Problem)
+			fmt.Printf("%v events verified before the break\n", result.Verified)
+			db.Close()
+			os.Exit(1)
+		}
+
+		fmt.Printf("OK: %v events verified (%v with an HMAC), %v of %v checkpoints matched\n", result.Verified, result.Signed, result.Checkpoints, len(checkpoints))
+		if result.Pending > 0 {
+			fmt.Printf("%v newer events are still being added (they haven't been chained yet)\n", result.Pending)
+		}
+		if result.LastID > 0 {
+			fmt.Printf("Last event: #%v %s\n", result.LastID, result.LastHash)
+		}
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditverifyCmd)
+
+	auditverifyCmd.Flags().StringVar(&auditVerifyCheckpoints, "checkpoints", "", "Checkpoint file to check the log against (defaults to audit.checkpoint.file)")
+}
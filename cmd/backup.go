@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var (
+	backupFile     string
+	backupTokens   bool
+	backupCompress bool
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Backs up the system (and optionally token) datastores",
+	Long: `Writes a consistent, versioned JSON export of all users, resources, roles 
+and user/resource/role assignments.  It's safe to run while the server is running.
+
+Use --tokens to include unexpired tokens, and --compress (or a filename 
+ending in .gz) to gzip the export.  Use 'restore' to load it into a fresh datastore.
+
+User secret hashes are included in the backup, so keep it somewhere safe`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+
+		//	Take the backup
+		backup, err := db.Backup(backupTokens)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to back up: %s", err)
+			return
+		}
+
+		//	Write it out
+		var output io.Writer = os.Stdout
+		if backupFile != "" {
+			f, err := os.OpenFile(backupFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Printf("[ERROR] Error trying to create the backup file: %s", err)
+				return
+			}
+			defer f.Close()
+			output = f
+		}
+
+		compress := backupCompress || strings.HasSuffix(backupFile, ".gz")
+		if err := data.WriteBackup(output, backup, compress); err != nil {
+			log.Printf("[ERROR] Error trying to write the backup: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Backed up %v users, %v resources, %v roles, %v user/resource/roles and %v tokens\n",
+			len(backup.Users), len(backup.Resources), len(backup.Roles), len(backup.UserResourceRoles), len(backup.Tokens))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+
+	backupCmd.Flags().StringVarP(&backupFile, "output", "o", "", "File to write the backup to (default is stdout)")
+	backupCmd.Flags().BoolVar(&backupTokens, "tokens", false, "Include unexpired tokens in the backup")
+	backupCmd.Flags().BoolVar(&backupCompress, "compress", false, "Gzip the backup")
+}
@@ -18,6 +18,12 @@ indices, admin user, and credentials.
 
 Running this more than once may result in errors`,
 	Run: func(cmd *cobra.Command, args []string) {
+		hasher, err := secretHasher()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
 		//	Spin up a SystemDB
 		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
 		if err != nil {
@@ -25,6 +31,7 @@ Running this more than once may result in errors`,
 			return
 		}
 		defer db.Close()
+		db.SetSecretHasher(hasher)
 
 		//	Call bootstrap
 		user, secret, err := db.AuthSystemBootstrap()
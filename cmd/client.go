@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// clientCmd represents the client command
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Client maintenance commands",
+	Long:  `Client maintenance commands`,
+}
+
+func init() {
+	rootCmd.AddCommand(clientCmd)
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/jose"
+)
+
+var (
+	clientAuthMethod    string
+	clientAuthSubjectDN string
+	clientAuthCerts     []string
+	clientAuthKeys      []string
+	clientAuthJWKSURI   string
+)
+
+// clientauthCmd represents the client auth command
+var clientauthCmd = &cobra.Command{
+	Use:   "auth <client name>",
+	Short: "Shows or sets how a client authenticates at the token endpoint",
+	Long: `Shows how a client (user) authenticates at the token endpoint, or sets it 
+with --method:
+
+  client_secret_basic          its secret, with HTTP basic auth (the default)
+  client_secret_post           its secret, in the client_id and client_secret 
+                               form values
+  private_key_jwt              a JWT assertion (RFC 7523) signed with one of the 
+                               keys passed in --key (JWK sets, JWKs or PEM public 
+                               keys), or published at --jwks-uri
+  tls_client_auth              a TLS certificate issued by one of the CAs in 
+                               apiservice.clientca, with the subject DN passed 
+                               in --subject-dn (like 'CN=client,O=Example')
+  self_signed_tls_client_auth  one of the self-signed TLS certificates passed 
+                               in --cert (PEM files)
+
+Clients that authenticate with a certificate send their name in the client_id 
+form value instead of using HTTP basic auth.  Clients that authenticate with an 
+assertion send it in the client_assertion form value (with client_assertion_type 
+urn:ietf:params:oauth:client-assertion-type:jwt-bearer).  The assertion's iss and 
+sub are the client's name, its aud is the token endpoint URL, and it can only be 
+used once`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Make changes as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+		cli := db.From("", "cli")
+
+		//	Find the client
+		user, err := findUserByName(cli, admin, args[0])
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		auth := data.ClientAuth{}
+		if clientAuthMethod == "" {
+			//	Just show it
+			auth, err = cli.GetClientAuth(user.ID)
+			if err != nil {
+				log.Printf("[ERROR] %s", err)
+				return
+			}
+		} else {
+			auth = data.ClientAuth{
+				UserID: user.ID,
+				Method: clientAuthMethod,
+				ClientAuthSettings: data.ClientAuthSettings{
+					TLSSubjectDN: clientAuthSubjectDN,
+					JWKSURI:      clientAuthJWKSURI,
+				},
+			}
+
+			for _, file := range clientAuthKeys {
+				keys, err := readKeySet(file)
+				if err != nil {
+					log.Printf("[ERROR] %s", err)
+					return
+				}
+
+				if auth.JWKS == nil {
+					auth.JWKS = &jose.JWKSet{}
+				}
+				auth.JWKS.Keys = append(auth.JWKS.Keys, keys.Keys...)
+			}
+
+			for _, file := range clientAuthCerts {
+				cert, err := readCertificate(file)
+				if err != nil {
+					log.Printf("[ERROR] %s", err)
+					return
+				}
+
+				auth.CertThumbprints = append(auth.CertThumbprints, data.CertThumbprint(cert))
+			}
+
+			auth, err = cli.SetClientAuth(admin, auth)
+			if err != nil {
+				log.Printf("[ERROR] Error trying to set client authentication: %s", err)
+				return
+			}
+		}
+
+		output, err := json.MarshalIndent(auth, "", "  ")
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		fmt.Println(string(output))
+	},
+}
+
+// findUserByName returns the user with the given name
+func findUserByName(db data.DBManager, context data.User, name string) (data.User, error) {
+	users, err := db.GetAllUsers(context)
+	if err != nil {
+		return data.User{}, fmt.Errorf("Error trying to get users: %s", err)
+	}
+
+	for _, user := range users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+
+	return data.User{}, fmt.Errorf("There isn't a user named '%s'", name)
+}
+
+// readCertificate reads the first certificate in a PEM file
+func readCertificate(file string) (*x509.Certificate, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error trying to read the certificate %s: %s", file, err)
+	}
+
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+
+	return nil, fmt.Errorf("There isn't a PEM certificate in %s", file)
+}
+
+// readKeySet reads the public keys in a file:  a JWK set, a single JWK or a PEM public key
+func readKeySet(file string) (jose.JWKSet, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return jose.JWKSet{}, fmt.Errorf("Error trying to read the key %s: %s", file, err)
+	}
+
+	//	A JWK set, or a single JWK
+	set := jose.JWKSet{}
+	if err := json.Unmarshal(contents, &set); err == nil && len(set.Keys) > 0 {
+		return set, nil
+	}
+
+	key := jose.JWK{}
+	if err := json.Unmarshal(contents, &key); err == nil && key.Kty != "" {
+		return jose.JWKSet{Keys: []jose.JWK{key}}, nil
+	}
+
+	//	A PEM public key
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return set, fmt.Errorf("Error trying to read the public key in %s: %s", file, err)
+		}
+
+		key, err := jose.NewJWK(publicKey)
+		if err != nil {
+			return set, err
+		}
+
+		return jose.JWKSet{Keys: []jose.JWK{key}}, nil
+	}
+
+	return set, fmt.Errorf("There isn't a JWK set, JWK or PEM public key in %s", file)
+}
+
+func init() {
+	clientCmd.AddCommand(clientauthCmd)
+	clientauthCmd.Flags().StringVar(&clientAuthMethod, "method", "", "The authentication method to set (client_secret_basic, client_secret_post, private_key_jwt, tls_client_auth or self_signed_tls_client_auth)")
+	clientauthCmd.Flags().StringVar(&clientAuthSubjectDN, "subject-dn", "", "The subject DN of the client's certificate (tls_client_auth)")
+	clientauthCmd.Flags().StringSliceVar(&clientAuthCerts, "cert", []string{}, "A PEM file with one of the client's certificates (self_signed_tls_client_auth) -- can be repeated")
+	clientauthCmd.Flags().StringSliceVar(&clientAuthKeys, "key", []string{}, "A file with the client's public key(s) -- a JWK set, JWK or PEM public key (private_key_jwt).  Can be repeated")
+	clientauthCmd.Flags().StringVar(&clientAuthJWKSURI, "jwks-uri", "", "The https URL the client publishes its JWK set at (private_key_jwt)")
+}
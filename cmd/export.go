@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var (
+	exportFile    string
+	exportFormat  string
+	exportSecrets bool
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports resources, roles, users and assignments as a state document",
+	Long: `Writes the resources, roles, users and user/resource/role assignments 
+in the system as a YAML (or JSON) state document that can be used with 'import'.
+
+User secrets aren't exported unless --secrets is set (which exports the 
+secret hashes).  The built-in admin user, system resource and system roles 
+are never exported`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+
+		//	Export as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		state, err := db.ExportState(admin, exportSecrets)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to export: %s", err)
+			return
+		}
+
+		//	Write it out
+		var output io.Writer = os.Stdout
+		if exportFile != "" {
+			f, err := os.OpenFile(exportFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Printf("[ERROR] Error trying to create the export file: %s", err)
+				return
+			}
+			defer f.Close()
+			output = f
+		}
+
+		if err := data.WriteState(output, state, exportFormat); err != nil {
+			log.Printf("[ERROR] Error trying to write the export: %s", err)
+			return
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringVarP(&exportFile, "output", "o", "", "File to write the state document to (default is stdout)")
+	exportCmd.Flags().StringVar(&exportFormat, "format", "yaml", "Output format: yaml/json")
+	exportCmd.Flags().BoolVar(&exportSecrets, "secrets", false, "Include user secret hashes")
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var (
+	importFile string
+	importPlan bool
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports resources, roles, users and assignments from a state document",
+	Long: `Compares a YAML (or JSON) state document with the system, shows the 
+changes, and creates the resources, roles, users and assignments that don't 
+exist yet.  Use --plan to only show the changes.
+
+Items are matched by name.  Updates and removals can't be applied:  they're 
+shown as not applied, and nothing is imported until they're made by hand (or 
+the state file is changed to match the system)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Read the state document
+		f, err := os.Open(importFile)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the state file: %s", err)
+			return
+		}
+		defer f.Close()
+
+		state, err := data.ReadState(f)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to read the state file: %s", err)
+			return
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Import as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+		cli := db.From("", "cli")
+
+		//	Show the plan
+		plan, err := cli.PlanState(admin, state)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to plan the import: %s", err)
+			return
+		}
+
+		if len(plan) == 0 {
+			fmt.Println("No changes.  The system matches the state file")
+			return
+		}
+
+		notApplied := data.NotApplied(plan)
+		for _, change := range plan {
+			if change.Action == data.PlanCreate {
+				fmt.Println(change)
+			}
+		}
+
+		if len(notApplied) > 0 {
+			fmt.Println("\nNot applied (updates and removals have to be made by hand):")
+			for _, change := range notApplied {
+				fmt.Println(change)
+			}
+		}
+
+		if importPlan {
+			return
+		}
+
+		//	Apply it
+		applied, err := cli.ApplyState(admin, state)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to import: %s", err)
+			return
+		}
+
+		fmt.Printf("\nCreated %v items\n", len(applied))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&importFile, "file", "f", "", "State file to import")
+	importCmd.Flags().BoolVar(&importPlan, "plan", false, "Only show the changes the import would make")
+	importCmd.MarkFlagRequired("file")
+}
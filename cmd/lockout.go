@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var (
+	lockoutUser string
+	lockoutIP   string
+)
+
+// lockoutCmd represents the lockout command
+var lockoutCmd = &cobra.Command{
+	Use:   "lockout",
+	Short: "Shows and unlocks user names and ip addresses locked out after failed logins",
+	Long: `Shows and unlocks user names and ip addresses locked out after too many 
+failed logins.  
+
+Failed logins are remembered for lockout.window after the last one.  After 
+lockout.userthreshold failures for a user name (or lockout.ipthreshold from an 
+ip address), logins for it are turned away for lockout.duration`,
+}
+
+// lockoutTarget returns the target type ('user' or 'ip') and the target from the --user and --ip flags
+func lockoutTarget() (string, string, error) {
+	switch {
+	case lockoutUser != "" && lockoutIP != "":
+		return "", "", fmt.Errorf("Pass either --user or --ip, not both")
+	case lockoutUser != "":
+		return "user", lockoutUser, nil
+	case lockoutIP != "":
+		return "ip", lockoutIP, nil
+	}
+
+	return "", "", fmt.Errorf("Pass the --user name or --ip address")
+}
+
+// lockoutPolicy returns the lockout policy from the config
+func lockoutPolicy() data.LockoutPolicy {
+	return data.LockoutPolicy{
+		UserThreshold: viper.GetInt("lockout.userthreshold"),
+		IPThreshold:   viper.GetInt("lockout.ipthreshold"),
+		Window:        viper.GetDuration("lockout.window"),
+		Duration:      viper.GetDuration("lockout.duration"),
+		Delay:         viper.GetDuration("lockout.delay"),
+		MaxDelay:      viper.GetDuration("lockout.maxdelay"),
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(lockoutCmd)
+	lockoutCmd.PersistentFlags().StringVar(&lockoutUser, "user", "", "The user name")
+	lockoutCmd.PersistentFlags().StringVar(&lockoutIP, "ip", "", "The ip address")
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// lockoutshowCmd represents the lockout show command
+var lockoutshowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Shows the failed logins for a user name or ip address",
+	Long: `Shows the recent failed logins for a user name (--user) or an ip address 
+(--ip), and when its lockout ends (if it's locked out)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		targetType, target, err := lockoutTarget()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		attempts, err := db.GetLoginAttempts(admin, targetType, target)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to get login attempts: %s", err)
+			return
+		}
+
+		output, err := json.MarshalIndent(attempts, "", "  ")
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		fmt.Println(string(output))
+	},
+}
+
+func init() {
+	lockoutCmd.AddCommand(lockoutshowCmd)
+}
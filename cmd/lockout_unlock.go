@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// lockoutunlockCmd represents the lockout unlock command
+var lockoutunlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Unlocks a user name or ip address",
+	Long: `Ends the lockout for a user name (--user) or an ip address (--ip) and 
+forgets its failed logins.  The unlock is recorded in the audit log`,
+	Run: func(cmd *cobra.Command, args []string) {
+		targetType, target, err := lockoutTarget()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Make changes as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		if err := db.From("", "cli").UnlockLogins(admin, targetType, target); err != nil {
+			log.Printf("[ERROR] Error trying to unlock logins: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Unlocked %s '%s'", targetType, target)
+	},
+}
+
+func init() {
+	lockoutCmd.AddCommand(lockoutunlockCmd)
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danesparza/authserver/certs"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/ratelimit"
+	"github.com/rs/cors"
+	"github.com/spf13/viper"
+)
+
+// restartKeys are the config keys that are only read when the services start.
+// Changing them in the config file doesn't take effect until authserver is restarted
+var restartKeys = []string{
+	"logformat",
+	"uiservice.bind", "uiservice.port", "uiservice.tlscert", "uiservice.tlskey",
+	"apiservice.bind", "apiservice.port", "apiservice.tlscert", "apiservice.tlskey", "apiservice.clientcerts", "apiservice.clientca", "apiservice.dpopprooflifetime", "apiservice.externalurl", "apiservice.formurlencodedbasicauth",
+	"datastore.system", "datastore.tokens",
+	"acme.enabled", "acme.directory", "acme.email", "acme.domains", "acme.accepttos", "acme.httpchallenge", "acme.cache", "acme.cacert", "acme.renewbefore",
+	"server.shutdowntimeout", "server.readtimeout", "server.writetimeout", "server.idletimeout", "server.certwatchinterval", "server.trustedproxies",
+	"tokenpurge.interval", "tokenpurge.retention",
+	"audit.hmackey", "audit.checkpoint.file", "audit.checkpoint.interval",
+	"lockout.userthreshold", "lockout.ipthreshold", "lockout.window", "lockout.duration", "lockout.delay", "lockout.maxdelay",
+	"password.minlength", "password.requireupper", "password.requirelower", "password.requiredigit", "password.requiresymbol", "password.maxage", "password.history", "password.denylist",
+	"hashing.algorithm", "hashing.argon2.memory", "hashing.argon2.iterations", "hashing.argon2.parallelism", "hashing.bcrypt.cost",
+	"mfa.issuer",
+	"webauthn.rpid", "webauthn.rpname", "webauthn.origins", "webauthn.timeout",
+	"ldap.url", "ldap.starttls", "ldap.cacert", "ldap.binddn", "ldap.bindpassword", "ldap.basedn", "ldap.userfilter", "ldap.nameattribute", "ldap.descriptionattribute", "ldap.groupattribute", "ldap.groupbasedn", "ldap.groupfilter", "ldap.timeout", "ldap.groups",
+	"health.certwarning",
+	"metrics.listen",
+	"tracing.exporter", "tracing.endpoint", "tracing.insecure", "tracing.sampleratio",
+}
+
+// liveConfig is the part of the config that can be changed while the services are
+// running (by editing the config file and sending authserver SIGHUP)
+type liveConfig struct {
+	LogLevel       string
+	AllowedOrigins []string
+	TokenLifetime  time.Duration
+	RateLimit      ratelimit.Config
+}
+
+// readLiveConfig reads the live config settings, and returns an error if any of them are invalid
+func readLiveConfig(v *viper.Viper) (liveConfig, error) {
+	retval := liveConfig{
+		LogLevel: strings.ToUpper(v.GetString("loglevel")),
+	}
+
+	if _, err := logging.ParseLevel(retval.LogLevel); err != nil {
+		return retval, err
+	}
+
+	for _, origin := range strings.Split(v.GetString("apiservice.allowed-origins"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" || strings.ContainsAny(origin, " \t") {
+			return retval, fmt.Errorf("apiservice.allowed-origins should be a comma separated list of origins, but got '%s'", v.GetString("apiservice.allowed-origins"))
+		}
+
+		retval.AllowedOrigins = append(retval.AllowedOrigins, origin)
+	}
+
+	lifetime, err := time.ParseDuration(v.GetString("apiservice.tokenlifetime"))
+	if err != nil || lifetime <= 0 {
+		return retval, fmt.Errorf("apiservice.tokenlifetime should be a positive duration (like 1h), but got '%s'", v.GetString("apiservice.tokenlifetime"))
+	}
+	retval.TokenLifetime = lifetime
+
+	retval.RateLimit, err = readRateLimitConfig(v)
+	if err != nil {
+		return retval, err
+	}
+
+	return retval, nil
+}
+
+// readRateLimitConfig reads the rate limits.  The overrides are read as maps so the
+// defaults for the client, ip and route limits still apply when they're set
+func readRateLimitConfig(v *viper.Viper) (ratelimit.Config, error) {
+	retval := ratelimit.Config{}
+
+	for name, limit := range map[string]*ratelimit.Limit{"client": &retval.Client, "ip": &retval.IP, "route": &retval.Route} {
+		limit.Rate = v.GetFloat64("ratelimit." + name + ".rate")
+		limit.Burst = v.GetInt("ratelimit." + name + ".burst")
+	}
+
+	if err := v.UnmarshalKey("ratelimit.clients", &retval.Clients); err != nil {
+		return retval, fmt.Errorf("ratelimit.clients should map client_ids to limits (rate and burst): %s", err)
+	}
+
+	if err := v.UnmarshalKey("ratelimit.routes", &retval.Routes); err != nil {
+		return retval, fmt.Errorf("ratelimit.routes should map routes to limits (rate and burst): %s", err)
+	}
+
+	if err := retval.Validate(); err != nil {
+		return retval, err
+	}
+
+	return retval, nil
+}
+
+// changes describes the settings that differ between the two configs
+func (config liveConfig) changes(previous liveConfig) []string {
+	retval := []string{}
+
+	if config.LogLevel != previous.LogLevel {
+		retval = append(retval, fmt.Sprintf("loglevel: %s -> %s", previous.LogLevel, config.LogLevel))
+	}
+
+	if strings.Join(config.AllowedOrigins, ",") != strings.Join(previous.AllowedOrigins, ",") {
+		retval = append(retval, fmt.Sprintf("apiservice.allowed-origins: %s -> %s", strings.Join(previous.AllowedOrigins, ","), strings.Join(config.AllowedOrigins, ",")))
+	}
+
+	if config.TokenLifetime != previous.TokenLifetime {
+		retval = append(retval, fmt.Sprintf("apiservice.tokenlifetime: %s -> %s", previous.TokenLifetime, config.TokenLifetime))
+	}
+
+	if fmt.Sprint(config.RateLimit) != fmt.Sprint(previous.RateLimit) {
+		retval = append(retval, "ratelimit")
+	}
+
+	return retval
+}
+
+// liveServices holds the parts of the running services that change when the config is
+// reloaded:  the log level, the API's CORS handler, the token lifetime, the rate limits and the TLS certificates
+type liveServices struct {
+	mu     *sync.Mutex
+	config liveConfig
+
+	// router is the API router the CORS handler wraps
+	router http.Handler
+
+	// apiHandler is the current CORS handler (wrapping the router)
+	apiHandler atomic.Pointer[http.Handler]
+
+	// tokenLifetime is the current token lifetime (in nanoseconds)
+	tokenLifetime atomic.Int64
+
+	// limiter rate limits both services' requests
+	limiter *ratelimit.Limiter
+
+	certificates []*certs.Reloader
+}
+
+// newLiveServices sets up the live parts of the services using the given config
+func newLiveServices(config liveConfig, router http.Handler, certificates ...*certs.Reloader) *liveServices {
+	retval := &liveServices{mu: &sync.Mutex{}, router: router, limiter: ratelimit.New(config.RateLimit), certificates: certificates}
+	retval.apply(config)
+
+	return retval
+}
+
+// apply puts the config into effect
+func (services *liveServices) apply(config liveConfig) {
+	services.config = config
+
+	logging.SetLevel(config.LogLevel)
+
+	corsHandler := cors.New(cors.Options{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowCredentials: true,
+	}).Handler(services.router)
+	services.apiHandler.Store(&corsHandler)
+
+	services.tokenLifetime.Store(int64(config.TokenLifetime))
+
+	services.limiter.SetConfig(config.RateLimit)
+}
+
+// ServeHTTP serves the request with the current CORS handler
+func (services *liveServices) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	(*services.apiHandler.Load()).ServeHTTP(rw, req)
+}
+
+// TokenLifetime returns the current token lifetime
+func (services *liveServices) TokenLifetime() time.Duration {
+	return time.Duration(services.tokenLifetime.Load())
+}
+
+// reload re-reads the config file and reloads the TLS certificates.  If the new config
+// is invalid it's rejected (and logged), and the services keep running with the current one
+func (services *liveServices) reload() {
+	services.mu.Lock()
+	defer services.mu.Unlock()
+
+	log.Printf("[INFO] Reloading the config and TLS certificates\n")
+
+	for _, certificate := range services.certificates {
+		if err := certificate.Reload(); err != nil {
+			log.Printf("[ERROR] %s -- still using the current certificate\n", err)
+		}
+	}
+
+	v, err := readConfigFile()
+	if err != nil {
+		log.Printf("[ERROR] Not reloading the config: %s\n", err)
+		return
+	}
+
+	config, err := readLiveConfig(v)
+	if err != nil {
+		log.Printf("[ERROR] Not reloading the config: %s\n", err)
+		return
+	}
+
+	//	Let them know about changes that need a restart
+	for _, key := range restartKeys {
+		if fmt.Sprint(v.Get(key)) != fmt.Sprint(viper.Get(key)) {
+			log.Printf("[WARN] %s changed, but won't take effect until authserver is restarted\n", key)
+		}
+	}
+
+	changes := config.changes(services.config)
+	if len(changes) == 0 {
+		log.Printf("[INFO] No live config settings changed\n")
+		return
+	}
+
+	services.apply(config)
+	log.Printf("[INFO] Config reloaded: %s\n", strings.Join(changes, ", "))
+}
+
+// readConfigFile reads the config file that was used at startup into a new viper
+// instance (with the same defaults, environment variables and flags)
+func readConfigFile() (*viper.Viper, error) {
+	if viper.ConfigFileUsed() == "" {
+		return nil, fmt.Errorf("there isn't a config file to reload")
+	}
+
+	v := viper.New()
+	setConfigDefaults(v)
+	v.SetConfigFile(viper.ConfigFileUsed())
+	v.AutomaticEnv()
+	v.BindPFlag("loglevel", rootCmd.PersistentFlags().Lookup("loglevel"))
+	v.BindPFlag("logformat", rootCmd.PersistentFlags().Lookup("logformat"))
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Problem reading the config file %s: %s", viper.ConfigFileUsed(), err)
+	}
+
+	return v, nil
+}
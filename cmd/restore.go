@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var restoreFile string
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restores a backup into fresh datastores",
+	Long: `Loads a backup created with 'backup' into the configured system and 
+token datastores.  Compressed backups are detected automatically.
+
+The datastores must be fresh -- don't run 'bootstrap' first`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Read the backup
+		f, err := os.Open(restoreFile)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the backup file: %s", err)
+			return
+		}
+		defer f.Close()
+
+		backup, err := data.ReadBackup(f)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to read the backup: %s", err)
+			return
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+
+		//	Restore it
+		if err := db.Restore(backup); err != nil {
+			log.Printf("[ERROR] Error trying to restore: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Restored %v users, %v resources, %v roles, %v user/resource/roles and %v tokens from a backup taken %s\n",
+			len(backup.Users), len(backup.Resources), len(backup.Roles), len(backup.UserResourceRoles), len(backup.Tokens), backup.Created)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringVarP(&restoreFile, "file", "f", "", "Backup file to restore")
+	restoreCmd.MarkFlagRequired("file")
+}
@@ -5,7 +5,7 @@ import (
 	"log"
 	"os"
 
-	"github.com/hashicorp/logutils"
+	"github.com/danesparza/authserver/logging"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,6 +15,7 @@ var (
 	cfgFile               string
 	problemWithConfigFile bool
 	loglevel              string
+	logformat             string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -44,9 +45,11 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/authserver.yml)")
 
 	rootCmd.PersistentFlags().StringVarP(&loglevel, "loglevel", "l", "WARN", "Log level: DEBUG/INFO/WARN/ERROR")
+	rootCmd.PersistentFlags().StringVar(&logformat, "logformat", "text", "Log format: text/json/logfmt")
 
 	//	Bind config flags for optional config file override:
 	viper.BindPFlag("loglevel", rootCmd.PersistentFlags().Lookup("loglevel"))
+	viper.BindPFlag("logformat", rootCmd.PersistentFlags().Lookup("logformat"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -70,28 +73,85 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	//	Set our defaults
-	viper.SetDefault("loglevel", "INFO")
-	viper.SetDefault("apiservice.port", "3000")
-	viper.SetDefault("uiservice.port", "3001")
-	viper.SetDefault("apiservice.allowed-origins", "*")
-	viper.SetDefault("datastore.system", "system.db")
-	viper.SetDefault("datastore.tokens", "tokens.db")
+	setConfigDefaults(viper.GetViper())
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err != nil {
 		problemWithConfigFile = true
 	}
 
-	//	Set the log level from config (if we have it)
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"},
-		MinLevel: logutils.LogLevel(viper.GetString("loglevel")),
-		Writer:   os.Stderr,
+	//	Set the log level and format from config (if we have them)
+	if err := logging.Setup(os.Stderr, viper.GetString("logformat"), viper.GetString("loglevel")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	log.SetOutput(filter)
 
 	//	If we have a config file, report it:
 	if viper.ConfigFileUsed() != "" {
 		log.Println("[DEBUG] Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// setConfigDefaults sets the default config values
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("loglevel", "INFO")
+	v.SetDefault("logformat", "text")
+	v.SetDefault("apiservice.port", "3000")
+	v.SetDefault("uiservice.port", "3001")
+	v.SetDefault("apiservice.allowed-origins", "*")
+	v.SetDefault("apiservice.tokenlifetime", "1h")
+	v.SetDefault("apiservice.dpopprooflifetime", "1m")
+	v.SetDefault("apiservice.externalurl", "")
+	v.SetDefault("apiservice.formurlencodedbasicauth", false)
+	v.SetDefault("datastore.system", "system.db")
+	v.SetDefault("datastore.tokens", "tokens.db")
+	v.SetDefault("server.shutdowntimeout", "30s")
+	v.SetDefault("server.readtimeout", "15s")
+	v.SetDefault("server.writetimeout", "30s")
+	v.SetDefault("server.idletimeout", "2m")
+	v.SetDefault("server.certwatchinterval", "1m")
+	v.SetDefault("server.trustedproxies", []string{})
+	v.SetDefault("acme.directory", "https://acme-v02.api.letsencrypt.org/directory")
+	v.SetDefault("acme.httpchallenge", ":80")
+	v.SetDefault("acme.renewbefore", "720h")
+	v.SetDefault("tokenpurge.interval", "1h")
+	v.SetDefault("tokenpurge.retention", "24h")
+	v.SetDefault("audit.checkpoint.interval", "1h")
+	v.SetDefault("lockout.userthreshold", 5)
+	v.SetDefault("lockout.ipthreshold", 0)
+	v.SetDefault("lockout.window", "15m")
+	v.SetDefault("lockout.duration", "15m")
+	v.SetDefault("lockout.delay", "100ms")
+	v.SetDefault("lockout.maxdelay", "5s")
+	v.SetDefault("password.minlength", 8)
+	v.SetDefault("password.maxage", "0s")
+	v.SetDefault("password.history", 0)
+	v.SetDefault("hashing.algorithm", "argon2id")
+	v.SetDefault("hashing.argon2.memory", 19456)
+	v.SetDefault("hashing.argon2.iterations", 2)
+	v.SetDefault("hashing.argon2.parallelism", 1)
+	v.SetDefault("hashing.bcrypt.cost", 10)
+	v.SetDefault("mfa.issuer", "authserver")
+	v.SetDefault("webauthn.rpid", "localhost")
+	v.SetDefault("webauthn.rpname", "authserver")
+	v.SetDefault("webauthn.origins", []string{})
+	v.SetDefault("webauthn.timeout", "5m")
+	v.SetDefault("ldap.url", "")
+	v.SetDefault("ldap.starttls", false)
+	v.SetDefault("ldap.userfilter", "(uid=%s)")
+	v.SetDefault("ldap.nameattribute", "uid")
+	v.SetDefault("ldap.descriptionattribute", "cn")
+	v.SetDefault("ldap.groupattribute", "memberOf")
+	v.SetDefault("ldap.timeout", "10s")
+	v.SetDefault("ratelimit.client.rate", 10)
+	v.SetDefault("ratelimit.client.burst", 20)
+	v.SetDefault("ratelimit.ip.rate", 20)
+	v.SetDefault("ratelimit.ip.burst", 40)
+	v.SetDefault("ratelimit.route.rate", 0)
+	v.SetDefault("ratelimit.route.burst", 0)
+	v.SetDefault("health.certwarning", "336h")
+	v.SetDefault("metrics.listen", "127.0.0.1:3002")
+	v.SetDefault("tracing.exporter", "none")
+	v.SetDefault("tracing.endpoint", "localhost:4318")
+	v.SetDefault("tracing.sampleratio", 1.0)
+}
@@ -1,15 +1,27 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/danesparza/authserver/api"
+	"github.com/danesparza/authserver/basicauth"
 	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/danesparza/authserver/tracing"
 	"github.com/gorilla/mux"
-	"github.com/rs/cors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/swaggo/http-swagger"
@@ -46,20 +58,144 @@ var startCmd = &cobra.Command{
 // @scope.sys_admin Grants read and write access to administrative information
 
 func start(cmd *cobra.Command, args []string) {
+	//	Exit with an error if the services couldn't be started (or
+	//	one of them failed).  The problem has already been logged
+	if err := runServices(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// runServices runs the API and UI services until the process is sent SIGINT or SIGTERM (or
+// one of the listeners fails), then stops accepting requests, lets in-flight requests finish
+// (for up to server.shutdowntimeout) and stops the background tasks before the datastores are closed
+func runServices() error {
+	//	Listen for shutdown signals before anything starts, so one can't be missed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	defer signal.Stop(reloads)
+
+	//	Check the settings that can be reloaded
+	config, err := readLiveConfig(viper.GetViper())
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+
+	//	Load the TLS certificates (they're reloaded when the files change, and
+	//	on SIGHUP) or set up ACME (which renews certificates on its own)
+	tlsConfig, err := setupTLS()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+
+	//	Check the URL clients reach the API service at (if it's behind a proxy)
+	externalURL, err := apiExternalURL()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+
+	//	Check the proxies we take the client's address from
+	proxies, err := trustedProxies()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
 
 	//	Create a DBManager object and associate with the api.Service
 	db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
 	if err != nil {
 		log.Printf("[ERROR] Error trying to open the system database: %s", err)
-		return
+		return err
 	}
 	defer db.Close()
-	apiService := api.Service{DB: db}
+	db.SetAuditKey(viper.GetString("audit.hmackey"))
+	db.SetLockoutPolicy(lockoutPolicy())
+
+	policy, err := passwordPolicy()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	db.SetPasswordPolicy(policy)
+
+	hasher, err := secretHasher()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	db.SetSecretHasher(hasher)
+	db.SetTOTPIssuer(viper.GetString("mfa.issuer"))
+	db.SetWebAuthnRelyingParty(webauthnRelyingParty())
+
+	//	New users and directory users log in with the directory (if there is one)
+	if viper.GetString("ldap.url") != "" {
+		directory, groupRoles, err := ldapAuthenticator()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return err
+		}
+		db.SetAuthenticator(directory)
+		db.SetGroupRoles(groupRoles)
+		log.Printf("[INFO] New users and directory users log in with the directory at %s\n", directory.URL)
+	}
+
+	//	Start tracing (if it's been configured)
+	shutdownTracing, err := tracing.Setup(tracing.Config{
+		Exporter:    viper.GetString("tracing.exporter"),
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Insecure:    viper.GetBool("tracing.insecure"),
+		SampleRatio: viper.GetFloat64("tracing.sampleratio"),
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	//	Start the background tasks.  They're stopped (and waited for) when we shut down
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	background := &sync.WaitGroup{}
+
+	//	Purge expired tokens in the background
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		purgeExpiredTokens(backgroundCtx, db, viper.GetDuration("tokenpurge.interval"), viper.GetDuration("tokenpurge.retention"))
+	}()
+
+	//	Write audit checkpoints in the background
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		writeAuditCheckpoints(backgroundCtx, db, viper.GetString("audit.checkpoint.file"), viper.GetDuration("audit.checkpoint.interval"))
+	}()
+
+	//	Watch the TLS certificate files for changes
+	tlsConfig.watch(backgroundCtx, background)
+
+	//	Basic auth credentials are read the same way by every endpoint (and the rate limiter)
+	basicauth.SetFormURLEncoded(viper.GetBool("apiservice.formurlencodedbasicauth"))
 
 	//	Create a router and setup our REST endpoints...
 	SystemRouter := mux.NewRouter()
 	OAuthRouter := mux.NewRouter()
 
+	//	The CORS handler (for the API router), log level, token lifetime and rate limits are reloaded on SIGHUP
+	live := newLiveServices(config, OAuthRouter, tlsConfig.reloaders...)
+	apiService := api.Service{
+		DB:                db,
+		TokenLifetime:     live.TokenLifetime,
+		ClientCAs:         tlsConfig.clientCAs,
+		ExternalURL:       externalURL,
+		DPoPProofLifetime: viper.GetDuration("apiservice.dpopprooflifetime"),
+	}
+
 	//	Setup the swagger doc routes:
 	OAuthRouter.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 	SystemRouter.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
@@ -67,17 +203,70 @@ func start(cmd *cobra.Command, args []string) {
 	//	Setup our UI routes
 	SystemRouter.HandleFunc("/", api.ShowUI)
 
+	//	Setup the WebAuthn routes.  Ceremonies run in the browser, on the UI service
+	SystemRouter.HandleFunc("/webauthn/register/begin", apiService.BeginWebAuthnRegistration).Methods("POST")
+	SystemRouter.HandleFunc("/webauthn/register/finish", apiService.FinishWebAuthnRegistration).Methods("POST")
+	SystemRouter.HandleFunc("/webauthn/login/begin", apiService.BeginWebAuthnLogin).Methods("POST")
+	SystemRouter.HandleFunc("/webauthn/login/finish", apiService.FinishWebAuthnLogin).Methods("POST")
+	SystemRouter.HandleFunc("/webauthn/credentials", apiService.GetOwnWebAuthnCredentials).Methods("GET")
+	SystemRouter.HandleFunc("/webauthn/credentials/{id}", apiService.RemoveOwnWebAuthnCredential).Methods("DELETE")
+
+	//	Metrics have their own listener (see metrics.listen), so they aren't served to everyone who can reach the UI
+	if err := metrics.RegisterActiveTokens(db.CountActiveTokens); err != nil {
+		log.Printf("[ERROR] Error trying to register the active tokens metric: %s", err)
+	}
+
+	//	Record request latency, trace requests and rate limit them for both services
+	SystemRouter.Use(metrics.Middleware("ui"), tracing.Middleware("ui"), live.limiter.Middleware("ui"))
+	OAuthRouter.Use(metrics.Middleware("api"), tracing.Middleware("api"), live.limiter.Middleware("api"))
+
+	//	Setup our health routes
+	apiHealth := api.HealthService{
+		DB:          db,
+		Service:     "api",
+		TLSCert:     viper.GetString("apiservice.tlscert"),
+		TLSKey:      viper.GetString("apiservice.tlskey"),
+		Certificate: tlsConfig.healthCertificate(),
+		CertWarning: viper.GetDuration("health.certwarning"),
+	}
+	OAuthRouter.HandleFunc("/healthz", apiHealth.Healthz).Methods("GET")
+	OAuthRouter.HandleFunc("/readyz", apiHealth.Readyz).Methods("GET")
+
+	uiHealth := api.HealthService{
+		DB:          db,
+		Service:     "ui",
+		TLSCert:     viper.GetString("uiservice.tlscert"),
+		TLSKey:      viper.GetString("uiservice.tlskey"),
+		Certificate: tlsConfig.healthCertificate(),
+		CertWarning: viper.GetDuration("health.certwarning"),
+	}
+	SystemRouter.HandleFunc("/healthz", uiHealth.Healthz).Methods("GET")
+	SystemRouter.HandleFunc("/readyz", uiHealth.Readyz).Methods("GET")
+
 	//	Setup our Service routes
 	OAuthRouter.HandleFunc("/oauth/token/client", apiService.ClientCredentialsGrant).Methods("POST")
 	OAuthRouter.HandleFunc("/oauth/authorize", apiService.ScopesForToken).Methods("GET")
+	OAuthRouter.HandleFunc("/oauth/introspect", apiService.IntrospectToken).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/audit", apiService.GetAuditEvents).Methods("GET")
+	OAuthRouter.HandleFunc("/api/v1/lockout", apiService.GetLockout).Methods("GET")
+	OAuthRouter.HandleFunc("/api/v1/lockout", apiService.Unlock).Methods("DELETE")
+	OAuthRouter.HandleFunc("/api/v1/users", apiService.AddUser).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/users/{id}/password", apiService.ResetPassword).Methods("PUT")
+	OAuthRouter.HandleFunc("/api/v1/password", apiService.ChangePassword).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/mfa/totp", apiService.EnrollTOTP).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/mfa/totp/verify", apiService.ConfirmTOTP).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/mfa/recovery-codes", apiService.RegenerateRecoveryCodes).Methods("POST")
+	OAuthRouter.HandleFunc("/api/v1/users/{id}/mfa", apiService.ResetMFA).Methods("DELETE")
+	OAuthRouter.HandleFunc("/api/v1/users/{id}/webauthn", apiService.GetUserWebAuthnCredentials).Methods("GET")
+	OAuthRouter.HandleFunc("/api/v1/users/{id}/webauthn/{credential}", apiService.RemoveUserWebAuthnCredential).Methods("DELETE")
 
-	//	Setup the CORS options:
-	log.Printf("[INFO] Allowed CORS origins: %s\n", viper.GetString("apiservice.allowed-origins"))
+	//	Report the CORS options:
+	log.Printf("[INFO] Allowed CORS origins: %s\n", strings.Join(config.AllowedOrigins, ","))
 
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   strings.Split(viper.GetString("apiservice.allowed-origins"), ","),
-		AllowCredentials: true,
-	}).Handler(OAuthRouter)
+	//	Give each request an id (and a logger that includes it), and the client's
+	//	address if it came through a trusted proxy
+	apiHandler := logging.ForwardedFor(proxies)(logging.Middleware(live))
+	uiHandler := logging.ForwardedFor(proxies)(logging.Middleware(SystemRouter))
 
 	//	Format the bound interface:
 	formattedAPIInterface := viper.GetString("apiservice.bind")
@@ -91,28 +280,158 @@ func start(cmd *cobra.Command, args []string) {
 	}
 
 	//	Log our TLS key information
-	log.Printf("[INFO] API TLS cert: %s\n", viper.GetString("apiservice.tlscert"))
-	log.Printf("[INFO] API TLS key: %s\n", viper.GetString("apiservice.tlskey"))
-	log.Printf("[INFO] UI TLS cert: %s\n", viper.GetString("uiservice.tlscert"))
-	log.Printf("[INFO] UI TLS key: %s\n", viper.GetString("uiservice.tlskey"))
+	tlsConfig.report()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	//	Create the servers
+	apiServer := newServer(viper.GetString("apiservice.bind")+":"+viper.GetString("apiservice.port"), apiHandler, tlsConfig.apiConfig)
+	uiServer := newServer(viper.GetString("uiservice.bind")+":"+viper.GetString("uiservice.port"), uiHandler, tlsConfig.uiConfig)
+	servers := []*http.Server{apiServer, uiServer}
+
+	//	Start the servers.  If any of them fails, we shut everything down
+	failures := make(chan error, 4)
 	go func() {
-		defer wg.Done()
 		log.Printf("[INFO] Starting API service: https://%s:%s\n", formattedAPIInterface, viper.GetString("apiservice.port"))
-		log.Printf("[ERROR] %v\n", http.ListenAndServeTLS(viper.GetString("apiservice.bind")+":"+viper.GetString("apiservice.port"), viper.GetString("apiservice.tlscert"), viper.GetString("apiservice.tlskey"), corsHandler))
+		if err := apiServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			failures <- fmt.Errorf("API service failed: %s", err)
+		}
 	}()
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
 		log.Printf("[INFO] Starting UI service: https://%s:%s\n", formattedUIInterface, viper.GetString("uiservice.port"))
-		log.Printf("[ERROR] %v\n", http.ListenAndServeTLS(viper.GetString("uiservice.bind")+":"+viper.GetString("uiservice.port"), viper.GetString("uiservice.tlscert"), viper.GetString("uiservice.tlskey"), SystemRouter))
+		if err := uiServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			failures <- fmt.Errorf("UI service failed: %s", err)
+		}
 	}()
 
-	//	Wait for everything to stop...
-	wg.Wait()
+	//	Answer ACME HTTP-01 challenges (if they're enabled)
+	if tlsConfig.acmeManager != nil && viper.GetString("acme.httpchallenge") != "" {
+		challengeServer := newServer(viper.GetString("acme.httpchallenge"), tlsConfig.acmeManager.HTTPHandler(nil), nil)
+		servers = append(servers, challengeServer)
+
+		go func() {
+			log.Printf("[INFO] Answering ACME HTTP-01 challenges on %s\n", challengeServer.Addr)
+			if err := challengeServer.ListenAndServe(); err != http.ErrServerClosed {
+				failures <- fmt.Errorf("ACME HTTP-01 challenge service failed: %s", err)
+			}
+		}()
+	}
+
+	//	Serve the metrics (if they're enabled)
+	if viper.GetString("metrics.listen") != "" {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", metrics.Handler())
+		metricsServer := newServer(viper.GetString("metrics.listen"), metricsRouter, nil)
+		servers = append(servers, metricsServer)
+
+		go func() {
+			log.Printf("[INFO] Serving metrics on http://%s/metrics\n", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				failures <- fmt.Errorf("Metrics service failed: %s", err)
+			}
+		}()
+	}
+
+	//	Wait for a shutdown signal (or a failure), reloading on SIGHUP...
+	var failure error
+wait:
+	for {
+		select {
+		case <-reloads:
+			live.reload()
+		case sig := <-signals:
+			log.Printf("[INFO] Received %s, shutting down\n", sig)
+			break wait
+		case failure = <-failures:
+			log.Printf("[ERROR] %s -- shutting down\n", failure)
+			break wait
+		}
+	}
+
+	//	Stop accepting requests and let the in-flight requests finish
+	shutdownServers(viper.GetDuration("server.shutdowntimeout"), servers...)
+
+	//	Stop the background tasks before the datastores are closed
+	stopBackground()
+	background.Wait()
+
+	log.Printf("[INFO] Shutdown complete\n")
+	return failure
+}
 
+// apiExternalURL returns the URL clients reach the API service at (apiservice.externalurl),
+// or "" if it isn't set.  It has to be an absolute http(s) URL without a query
+func apiExternalURL() (string, error) {
+	setting := viper.GetString("apiservice.externalurl")
+	if setting == "" {
+		return "", nil
+	}
+
+	parsed, err := url.Parse(setting)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("apiservice.externalurl should be an http(s) URL like https://auth.example.com, but got '%s'", setting)
+	}
+
+	return strings.TrimSuffix(setting, "/"), nil
+}
+
+// trustedProxies returns the proxies in front of authserver (server.trustedproxies).  Each
+// one is an ip address or a CIDR
+func trustedProxies() ([]*net.IPNet, error) {
+	var retval []*net.IPNet
+	for _, setting := range viper.GetStringSlice("server.trustedproxies") {
+		setting = strings.TrimSpace(setting)
+		if strings.Contains(setting, "/") == false {
+			if ip := net.ParseIP(setting); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				retval = append(retval, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, network, err := net.ParseCIDR(setting)
+		if err != nil {
+			return nil, fmt.Errorf("server.trustedproxies should be a list of ip addresses or CIDRs (like 10.0.0.0/8), but got '%s'", setting)
+		}
+		retval = append(retval, network)
+	}
+
+	return retval, nil
+}
+
+// newServer creates a server for the handler using the TLS config, with
+// the read, write and idle timeouts from the config file
+func newServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  viper.GetDuration("server.readtimeout"),
+		WriteTimeout: viper.GetDuration("server.writetimeout"),
+		IdleTimeout:  viper.GetDuration("server.idletimeout"),
+	}
+}
+
+// shutdownServers stops the servers accepting new connections and waits up to 'timeout'
+// for their in-flight requests to finish.  Connections still busy after that are closed
+func shutdownServers(timeout time.Duration, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("[WARN] Requests to %s didn't finish within %s, closing their connections: %s\n", server.Addr, timeout, err)
+				server.Close()
+			}
+		}(server)
+	}
+
+	wg.Wait()
 }
 
 func init() {
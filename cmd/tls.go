@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/danesparza/authserver/certs"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serviceTLS is where the API and UI services get their certificates:  from their tlscert /
+// tlskey files (reloaded when the files change), or from an ACME CA (when acme.enabled is set).
+// It also has the CAs API clients' certificates are checked against
+type serviceTLS struct {
+	apiConfig *tls.Config
+	uiConfig  *tls.Config
+
+	// clientCAs are the CAs that issue certificates for tls_client_auth clients (from apiservice.clientca)
+	clientCAs *x509.CertPool
+
+	// reloaders are the certificate file reloaders (there aren't any when ACME is used)
+	reloaders []*certs.Reloader
+
+	// acme is the ACME manager (if ACME is used)
+	acme        *certs.ACMEConfig
+	acmeManager *autocert.Manager
+}
+
+// setupTLS loads the services' certificate files (or sets up ACME), and sets up
+// client certificates for the API service
+func setupTLS() (serviceTLS, error) {
+	retval, err := setupCertificates()
+	if err != nil {
+		return retval, err
+	}
+
+	//	Ask API clients for a certificate (so they can authenticate with it, and get tokens
+	//	bound to it -- RFC 8705).  Certificates are checked by the token endpoint, since
+	//	self-signed certificates are allowed too
+	clientCA := viper.GetString("apiservice.clientca")
+	if viper.GetBool("apiservice.clientcerts") || clientCA != "" {
+		retval.apiConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	if clientCA != "" {
+		retval.clientCAs, err = certs.LoadCertPool(clientCA)
+		if err != nil {
+			return retval, err
+		}
+	}
+
+	return retval, nil
+}
+
+// setupCertificates loads the services' certificate files, or sets up ACME
+func setupCertificates() (serviceTLS, error) {
+	if viper.GetBool("acme.enabled") {
+		config := certs.ACMEConfig{
+			DirectoryURL: viper.GetString("acme.directory"),
+			Email:        viper.GetString("acme.email"),
+			Domains:      viper.GetStringSlice("acme.domains"),
+			AcceptTOS:    viper.GetBool("acme.accepttos"),
+			CacheDir:     acmeCacheDir(),
+			CACert:       viper.GetString("acme.cacert"),
+			RenewBefore:  viper.GetDuration("acme.renewbefore"),
+		}
+
+		manager, err := certs.NewACMEManager(config)
+		if err != nil {
+			return serviceTLS{}, err
+		}
+
+		return serviceTLS{
+			apiConfig:   certs.ACMETLSConfig(manager),
+			uiConfig:    certs.ACMETLSConfig(manager),
+			acme:        &config,
+			acmeManager: manager,
+		}, nil
+	}
+
+	apiCertificate, err := certs.NewReloader(viper.GetString("apiservice.tlscert"), viper.GetString("apiservice.tlskey"))
+	if err != nil {
+		return serviceTLS{}, err
+	}
+
+	uiCertificate, err := certs.NewReloader(viper.GetString("uiservice.tlscert"), viper.GetString("uiservice.tlskey"))
+	if err != nil {
+		return serviceTLS{}, err
+	}
+
+	return serviceTLS{
+		apiConfig: &tls.Config{GetCertificate: apiCertificate.GetCertificate},
+		uiConfig:  &tls.Config{GetCertificate: uiCertificate.GetCertificate},
+		reloaders: []*certs.Reloader{apiCertificate, uiCertificate},
+	}, nil
+}
+
+// report logs where the certificates come from (and whether API clients are asked for certificates)
+func (config serviceTLS) report() {
+	switch {
+	case config.apiConfig.ClientAuth == tls.NoClientCert:
+	case config.clientCAs == nil:
+		log.Printf("[INFO] API clients can authenticate with self-signed certificates\n")
+	default:
+		log.Printf("[INFO] API clients can authenticate with certificates issued by the CAs in %s (or self-signed certificates)\n", viper.GetString("apiservice.clientca"))
+	}
+
+	if config.acme != nil {
+		log.Printf("[INFO] Getting TLS certificates for %s from %s (cached in %s)\n", strings.Join(config.acme.Domains, ", "), config.acmeManager.Client.DirectoryURL, config.acme.CacheDir)
+		return
+	}
+
+	log.Printf("[INFO] API TLS cert: %s\n", viper.GetString("apiservice.tlscert"))
+	log.Printf("[INFO] API TLS key: %s\n", viper.GetString("apiservice.tlskey"))
+	log.Printf("[INFO] UI TLS cert: %s\n", viper.GetString("uiservice.tlscert"))
+	log.Printf("[INFO] UI TLS key: %s\n", viper.GetString("uiservice.tlskey"))
+}
+
+// watch watches the certificate files for changes (in the background) until the
+// context is cancelled.  ACME certificates are renewed by the ACME manager instead
+func (config serviceTLS) watch(ctx context.Context, background *sync.WaitGroup) {
+	for _, reloader := range config.reloaders {
+		background.Add(1)
+		go func(reloader *certs.Reloader) {
+			defer background.Done()
+			reloader.Watch(ctx, viper.GetDuration("server.certwatchinterval"))
+		}(reloader)
+	}
+}
+
+// healthCertificate returns the function the health check uses to get the
+// certificate when it doesn't come from files (nil if it does).  If the ACME
+// certificate hasn't been issued yet, this gets it
+func (config serviceTLS) healthCertificate() func() (*tls.Certificate, error) {
+	if config.acme == nil {
+		return nil
+	}
+
+	return func() (*tls.Certificate, error) {
+		return certs.ACMECertificate(config.acmeManager, strings.TrimSpace(config.acme.Domains[0]))
+	}
+}
+
+// acmeCacheDir returns the ACME certificate cache directory:  acme.cache, or an 'acme'
+// directory next to the system datastore (in the working directory for PostgreSQL)
+func acmeCacheDir() string {
+	if dir := viper.GetString("acme.cache"); dir != "" {
+		return dir
+	}
+
+	system := viper.GetString("datastore.system")
+	switch {
+	case strings.HasPrefix(system, "postgres://"), strings.HasPrefix(system, "postgresql://"):
+		return "acme"
+	case strings.HasPrefix(system, "sqlite://"):
+		return filepath.Join(filepath.Dir(strings.TrimPrefix(system, "sqlite://")), "acme")
+	default:
+		return filepath.Join(filepath.Dir(system), "acme")
+	}
+}
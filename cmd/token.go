@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Token maintenance commands",
+	Long:  `Token maintenance commands`,
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+}
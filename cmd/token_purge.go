@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// tokenpurgeCmd represents the token purge command
+var tokenpurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Removes expired tokens from the token datastore",
+	Long: `Removes tokens that expired longer ago than the retention window 
+(tokenpurge.retention in the config file) from the token datastore.  
+
+The 'start' command also does this in the background on the interval 
+set by tokenpurge.interval`,
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Purge the tokens
+		retention := viper.GetDuration("tokenpurge.retention")
+		removed, err := db.PurgeExpiredTokens(retention)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to purge expired tokens: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Purged %v tokens that expired more than %s ago\n", removed, retention)
+	},
+}
+
+// purgeExpiredTokens removes expired tokens every 'interval' until the
+// context is cancelled.  A zero (or negative) interval disables purging
+func purgeExpiredTokens(ctx context.Context, db *data.DBManager, interval, retention time.Duration) {
+	if interval <= 0 {
+		log.Printf("[INFO] Expired token purging is disabled\n")
+		return
+	}
+
+	log.Printf("[INFO] Purging tokens that expired more than %s ago every %s\n", retention, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := db.PurgeExpiredTokens(retention)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to purge expired tokens: %s", err)
+			continue
+		}
+
+		log.Printf("[DEBUG] Purged %v expired tokens\n", removed)
+	}
+}
+
+func init() {
+	tokenCmd.AddCommand(tokenpurgeCmd)
+}
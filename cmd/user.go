@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/certs"
+	"github.com/danesparza/authserver/data"
+)
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "User maintenance commands",
+	Long:  `User maintenance commands`,
+}
+
+// passwordPolicy returns the password policy from the config (reading the deny list file, if there is one)
+func passwordPolicy() (data.PasswordPolicy, error) {
+	retval := data.PasswordPolicy{
+		MinLength:     viper.GetInt("password.minlength"),
+		RequireUpper:  viper.GetBool("password.requireupper"),
+		RequireLower:  viper.GetBool("password.requirelower"),
+		RequireDigit:  viper.GetBool("password.requiredigit"),
+		RequireSymbol: viper.GetBool("password.requiresymbol"),
+		MaxAge:        viper.GetDuration("password.maxage"),
+		History:       viper.GetInt("password.history"),
+	}
+
+	if file := viper.GetString("password.denylist"); file != "" {
+		denyList, err := os.Open(file)
+		if err != nil {
+			return retval, fmt.Errorf("Problem opening the password deny list: %s", err)
+		}
+		defer denyList.Close()
+
+		retval.DenyList, err = data.ReadPasswordDenyList(denyList)
+		if err != nil {
+			return retval, err
+		}
+	}
+
+	return retval, nil
+}
+
+// secretHasher returns the hasher for new secrets from the config
+func secretHasher() (data.SecretHasher, error) {
+	switch algorithm := viper.GetString("hashing.algorithm"); algorithm {
+	case data.HashArgon2id:
+		return data.Argon2idHasher{
+			Memory:      viper.GetUint32("hashing.argon2.memory"),
+			Iterations:  viper.GetUint32("hashing.argon2.iterations"),
+			Parallelism: uint8(viper.GetUint("hashing.argon2.parallelism")),
+			SaltLength:  16,
+			KeyLength:   32,
+		}, nil
+	case data.HashBcrypt:
+		return data.BcryptHasher{Cost: viper.GetInt("hashing.bcrypt.cost")}, nil
+	default:
+		return nil, fmt.Errorf("Unknown hashing algorithm '%s' (use '%s' or '%s')", algorithm, data.HashArgon2id, data.HashBcrypt)
+	}
+}
+
+// ldapAuthenticator returns the LDAP directory new and directory users log in with,
+// and the roles members of its groups get, from the config
+func ldapAuthenticator() (data.LDAPAuthenticator, []data.GroupRole, error) {
+	retval := data.LDAPAuthenticator{
+		URL:                  viper.GetString("ldap.url"),
+		StartTLS:             viper.GetBool("ldap.starttls"),
+		BindDN:               viper.GetString("ldap.binddn"),
+		BindPassword:         viper.GetString("ldap.bindpassword"),
+		BaseDN:               viper.GetString("ldap.basedn"),
+		UserFilter:           viper.GetString("ldap.userfilter"),
+		NameAttribute:        viper.GetString("ldap.nameattribute"),
+		DescriptionAttribute: viper.GetString("ldap.descriptionattribute"),
+		GroupAttribute:       viper.GetString("ldap.groupattribute"),
+		GroupBaseDN:          viper.GetString("ldap.groupbasedn"),
+		GroupFilter:          viper.GetString("ldap.groupfilter"),
+		Timeout:              viper.GetDuration("ldap.timeout"),
+	}
+
+	if strings.Contains(retval.UserFilter, "%s") == false {
+		return retval, nil, fmt.Errorf("The LDAP user filter '%s' has to include %%s (where the user's name goes)", retval.UserFilter)
+	}
+
+	if retval.GroupFilter != "" && strings.Contains(retval.GroupFilter, "%s") == false {
+		return retval, nil, fmt.Errorf("The LDAP group filter '%s' has to include %%s (where the user's DN goes)", retval.GroupFilter)
+	}
+
+	if file := viper.GetString("ldap.cacert"); file != "" {
+		roots, err := certs.LoadCertPool(file)
+		if err != nil {
+			return retval, nil, err
+		}
+		retval.TLS = &tls.Config{RootCAs: roots}
+	}
+
+	groupRoles := []data.GroupRole{}
+	if err := viper.UnmarshalKey("ldap.groups", &groupRoles); err != nil {
+		return retval, nil, fmt.Errorf("Problem reading the LDAP group roles: %s", err)
+	}
+
+	return retval, groupRoles, nil
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+}
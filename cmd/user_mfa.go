@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// usermfaCmd represents the user mfa command
+var usermfaCmd = &cobra.Command{
+	Use:   "mfa <user name>",
+	Short: "Resets a user's second factor",
+	Long: `Removes a user's TOTP second factor and recovery codes (if they've lost 
+their authenticator app).  They can log in with just their password until they 
+set up a new one.  The reset is recorded in the audit log`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Make changes as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+		cli := db.From("", "cli")
+
+		//	Find the user
+		user, err := findUserByName(cli, admin, args[0])
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		if err := cli.ResetMFA(admin, user.ID); err != nil {
+			log.Printf("[ERROR] Error trying to reset the second factor: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Reset the second factor for user '%s'", user.Name)
+	},
+}
+
+func init() {
+	userCmd.AddCommand(usermfaCmd)
+}
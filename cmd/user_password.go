@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+)
+
+var userPassword string
+
+// userpasswordCmd represents the user password command
+var userpasswordCmd = &cobra.Command{
+	Use:   "password <user name>",
+	Short: "Resets a user's password",
+	Long: `Sets a user's password to the one passed in --password (or, if that's 
+blank, the first line of stdin).  The password has to meet the password policy 
+(see the password section of the config).  The reset is recorded in the audit log`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		policy, err := passwordPolicy()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		hasher, err := secretHasher()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		//	Read the password from stdin if it wasn't passed
+		if userPassword == "" {
+			userPassword, err = bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && userPassword == "" {
+				log.Printf("[ERROR] Pass the new password in --password or on stdin")
+				return
+			}
+			userPassword = strings.TrimRight(userPassword, "\r\n")
+		}
+
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+		db.SetPasswordPolicy(policy)
+		db.SetSecretHasher(hasher)
+
+		//	Make changes as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+		cli := db.From("", "cli")
+
+		//	Find the user
+		user, err := findUserByName(cli, admin, args[0])
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		if _, err := cli.ResetPassword(admin, user.ID, userPassword); err != nil {
+			if policyErr, ok := err.(data.PasswordPolicyError); ok {
+				output, _ := json.MarshalIndent(policyErr.Violations, "", "  ")
+				fmt.Println(string(output))
+			}
+
+			log.Printf("[ERROR] Error trying to reset the password: %s", err)
+			return
+		}
+
+		log.Printf("[INFO] Reset the password for user '%s'", user.Name)
+	},
+}
+
+func init() {
+	userCmd.AddCommand(userpasswordCmd)
+	userpasswordCmd.Flags().StringVar(&userPassword, "password", "", "The new password (read from stdin if it's blank)")
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/webauthn"
+)
+
+var userWebAuthnRemove string
+
+// userwebauthnCmd represents the user webauthn command
+var userwebauthnCmd = &cobra.Command{
+	Use:   "webauthn <user name>",
+	Short: "Lists and removes a user's passkeys and security keys",
+	Long: `Lists the WebAuthn credentials (passkeys and security keys) a user has
+registered, or removes one with --remove (if they've lost the authenticator).
+Removals are recorded in the audit log`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		//	Spin up a DBManager
+		db, err := data.NewDBManager(viper.GetString("datastore.system"), viper.GetString("datastore.tokens"))
+		if err != nil {
+			log.Printf("[ERROR] Error trying to open the system database: %s", err)
+			return
+		}
+		defer db.Close()
+		db.SetAuditKey(viper.GetString("audit.hmackey"))
+
+		//	Make changes as the admin user
+		admin, err := db.GetAdminUser()
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+		cli := db.From("", "cli")
+
+		//	Find the user
+		user, err := findUserByName(cli, admin, args[0])
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return
+		}
+
+		if userWebAuthnRemove != "" {
+			if err := cli.RemoveWebAuthnCredential(admin, user.ID, userWebAuthnRemove); err != nil {
+				log.Printf("[ERROR] Error trying to remove the credential: %s", err)
+				return
+			}
+
+			log.Printf("[INFO] Removed credential '%s' for user '%s'", userWebAuthnRemove, user.Name)
+			return
+		}
+
+		credentials, err := cli.GetWebAuthnCredentials(admin, user.ID)
+		if err != nil {
+			log.Printf("[ERROR] Error trying to list the credentials: %s", err)
+			return
+		}
+
+		for _, credential := range credentials {
+			kind := "security key"
+			if credential.Passkey {
+				kind = "passkey"
+			}
+
+			lastUsed := "never"
+			if credential.LastUsed.Valid {
+				lastUsed = credential.LastUsed.Time.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Printf("%s\t%s\t%s\tlast used %s\n", credential.ID, kind, credential.Name, lastUsed)
+		}
+	},
+}
+
+// webauthnRelyingParty returns the WebAuthn relying party from the config.  If no origins
+// are set, ceremonies run on the UI service (at the relying party id)
+func webauthnRelyingParty() webauthn.RelyingParty {
+	origins := viper.GetStringSlice("webauthn.origins")
+	if len(origins) == 0 {
+		origin := "https://" + viper.GetString("webauthn.rpid")
+		if port := viper.GetString("uiservice.port"); port != "443" {
+			origin += ":" + port
+		}
+		origins = []string{origin}
+	}
+
+	return webauthn.RelyingParty{
+		ID:      viper.GetString("webauthn.rpid"),
+		Name:    viper.GetString("webauthn.rpname"),
+		Origins: origins,
+		Timeout: viper.GetDuration("webauthn.timeout"),
+	}
+}
+
+func init() {
+	userCmd.AddCommand(userwebauthnCmd)
+	userwebauthnCmd.Flags().StringVar(&userWebAuthnRemove, "remove", "", "The id of a credential to remove")
+}
@@ -0,0 +1,509 @@
+package data
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AuditEvent is an entry in the append-only audit log.  Before and After are
+// JSON snapshots of the item that changed (secrets are never included).
+// Each event includes the hash of the event before it, so the log can be
+// verified with VerifyAuditLog.  Events are added without a hash, and chained
+// to the end of the log shortly after (see chainAuditEvents)
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	Created    time.Time `json:"created"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetID   string    `json:"target_id"`
+	IP         string    `json:"ip"`
+	ClientID   string    `json:"client_id"`
+	Detail     string    `json:"detail"`
+	Before     string    `json:"before"`
+	After      string    `json:"after"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+	HMAC       string    `json:"hmac,omitempty"`
+}
+
+// AuditCheckpoint is a signed record of the last audit event at a point in time.
+// Keeping checkpoints outside of the datastore means the log can't be rewritten
+// (even with the hashes recalculated) without the checkpoints no longer matching
+type AuditCheckpoint struct {
+	Created   time.Time `json:"created"`
+	ID        int64     `json:"id"`
+	Hash      string    `json:"hash"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// AuditVerification is the result of verifying the audit log
+type AuditVerification struct {
+	// Verified is the number of events checked
+	Verified int64 `json:"verified"`
+
+	// Signed is the number of events with a valid HMAC
+	Signed int64 `json:"signed"`
+
+	// Checkpoints is the number of checkpoints that matched the log
+	Checkpoints int `json:"checkpoints"`
+
+	// LastID and LastHash are the id and hash of the last event checked
+	LastID   int64  `json:"last_id"`
+	LastHash string `json:"last_hash"`
+
+	// Pending is the number of events at the end of the log that haven't been chained yet
+	// (they're still being added)
+	Pending int64 `json:"pending"`
+
+	// BrokenID is the id of the first broken link in the chain (0 if the log is intact)
+	BrokenID int64  `json:"broken_id"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// auditGapTimeout is how long a missing event id holds up chaining the events after
+// it.  Ids are handed out before events are added, so a missing id is usually an event
+// that's still being added -- one that takes longer than this was rolled back
+const auditGapTimeout = time.Minute
+
+// Audit event actions
+const (
+	AuditUserCreate           = "user.create"
+	AuditUserPasswordChange   = "user.password_change"
+	AuditUserPasswordReset    = "user.password_reset"
+	AuditUserMFAEnroll        = "user.mfa_enroll"
+	AuditUserMFARecovery      = "user.mfa_recovery"
+	AuditUserMFARecoveryUse   = "user.mfa_recovery_use"
+	AuditUserMFAReset         = "user.mfa_reset"
+	AuditUserWebAuthnRegister = "user.webauthn_register"
+	AuditUserWebAuthnRemove   = "user.webauthn_remove"
+	AuditResourceCreate       = "resource.create"
+	AuditRoleCreate           = "role.create"
+	AuditAssignmentCreate     = "assignment.create"
+	AuditAssignmentRemove     = "assignment.remove"
+	AuditTokenIssue           = "token.issue"
+	AuditTokenRevoke          = "token.revoke"
+	AuditTokenPurge           = "token.purge"
+	AuditLoginFailed          = "login.failed"
+	AuditLoginLockout         = "login.lockout"
+	AuditLoginUnlock          = "login.unlock"
+	AuditClientAuthSet        = "client_auth.set"
+)
+
+// auditSource is where the changes made through a DBManager are coming from
+type auditSource struct {
+	ip       string
+	clientID string
+}
+
+// From returns a copy of the DBManager that records the passed ip address and
+// client in the audit log for any changes made through it
+func (store DBManager) From(ip, clientID string) DBManager {
+	store.source = auditSource{ip: ip, clientID: clientID}
+	return store
+}
+
+// SetAuditKey sets the key used to HMAC each audit event and sign audit checkpoints.
+// A blank key means events aren't HMAC'd and checkpoints aren't signed
+func (store *DBManager) SetAuditKey(key string) {
+	store.auditKey = nil
+	if key != "" {
+		store.auditKey = []byte(key)
+	}
+}
+
+// GetAuditEvents returns up to 'limit' audit events with ids after 'afterID', oldest first.
+// Only system admins can read the audit log
+func (store DBManager) GetAuditEvents(context User, afterID int64, limit int) ([]AuditEvent, error) {
+	store, end := store.startSpan("GetAuditEvents")
+	defer end()
+
+	//	Validate:  Does the context user have permission to see the audit log?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return []AuditEvent{}, fmt.Errorf("User '%s' does not have permission to read the audit log", context.Name)
+	}
+
+	if err := store.sealAuditLog(); err != nil {
+		return []AuditEvent{}, err
+	}
+
+	return store.systemdb.GetAuditEvents(afterID, limit)
+}
+
+// GetLastAuditEventID returns the id of the newest chained audit event (0 if there aren't any).
+// Only system admins can read the audit log
+func (store DBManager) GetLastAuditEventID(context User) (int64, error) {
+	store, end := store.startSpan("GetLastAuditEventID")
+	defer end()
+
+	//	Validate:  Does the context user have permission to see the audit log?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return 0, fmt.Errorf("User '%s' does not have permission to read the audit log", context.Name)
+	}
+
+	if err := store.sealAuditLog(); err != nil {
+		return 0, err
+	}
+
+	return store.systemdb.GetLastAuditEventID()
+}
+
+// audit adds an event to the audit log, then chains it (along with any other events waiting to
+// be chained) unless someone else already is.  A problem adding the event is logged and returned:
+// changes made by admins and users return it (the change was made, but wasn't audited), and logins
+// and background tasks just log it
+func (store DBManager) audit(actor, action, targetType, targetID, detail string, before, after interface{}) error {
+	event := AuditEvent{
+		Created:    time.Now(),
+		Actor:      actor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         store.source.ip,
+		ClientID:   store.source.clientID,
+		Detail:     detail,
+		Before:     auditValue(before),
+		After:      auditValue(after),
+	}
+
+	if _, err := store.systemdb.AddAuditEvent(event, store.auditKey); err != nil {
+		store.log().Error("Problem adding audit event", "action", action, "actor", actor, "error", err)
+		return fmt.Errorf("The change was made, but it couldn't be recorded in the audit log: %s", err)
+	}
+
+	//	The event is recorded -- the next write or read of the log chains it if this doesn't
+	if err := store.systemdb.SealAuditEvents(store.auditKey, false); err != nil {
+		store.log().Warn("Problem chaining audit events", "error", err)
+	}
+
+	return nil
+}
+
+// sealAuditLog chains the audit events waiting to be chained (waiting for anyone
+// else chaining them to finish first), so reads of the log are up to date
+func (store DBManager) sealAuditLog() error {
+	if err := store.systemdb.SealAuditEvents(store.auditKey, true); err != nil {
+		return fmt.Errorf("Problem chaining audit events: %s", err)
+	}
+
+	return nil
+}
+
+// VerifyAuditLog walks the audit log and checks that every event is there, chains to the
+// event before it, and hasn't been changed.  If there is an audit key, HMACs are checked too
+// (once an event has an HMAC, every event after it must have one).  Each of the passed
+// checkpoints must match the event it was taken at.  Only system admins can verify the audit log
+func (store DBManager) VerifyAuditLog(context User, checkpoints []AuditCheckpoint) (AuditVerification, error) {
+	store, end := store.startSpan("VerifyAuditLog")
+	defer end()
+
+	retval := AuditVerification{}
+
+	//	Validate:  Does the context user have permission to see the audit log?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return retval, fmt.Errorf("User '%s' does not have permission to read the audit log", context.Name)
+	}
+
+	//	Index the checkpoints (and check their signatures)
+	checkpointsByID := map[int64][]AuditCheckpoint{}
+	for _, checkpoint := range checkpoints {
+		if store.auditKey != nil && hmac.Equal([]byte(checkpoint.Signature), []byte(store.signAuditCheckpoint(checkpoint))) == false {
+			retval.BrokenID = checkpoint.ID
+			retval.Problem = fmt.Sprintf("The checkpoint from %s has an invalid signature", checkpoint.Created.Format(time.RFC3339))
+			return retval, nil
+		}
+		checkpointsByID[checkpoint.ID] = append(checkpointsByID[checkpoint.ID], checkpoint)
+	}
+
+	if err := store.sealAuditLog(); err != nil {
+		return retval, err
+	}
+
+	//	Walk the log.  Ids can skip (an id is used up when an event isn't added), so events
+	//	are only missing if the chain is broken
+	signed := false
+	afterID, unchainedID := int64(0), int64(0)
+	for {
+		events, err := store.systemdb.GetAuditEvents(afterID, 1000)
+		if err != nil {
+			return retval, err
+		}
+
+		for _, event := range events {
+			afterID = event.ID
+
+			//	Events that haven't been chained are only expected at the end of the log
+			if event.Hash == "" {
+				if unchainedID == 0 {
+					unchainedID = event.ID
+				}
+				retval.Pending++
+				continue
+			}
+
+			if unchainedID != 0 {
+				retval.BrokenID = unchainedID
+				retval.Problem = fmt.Sprintf("Event %v was never chained", unchainedID)
+				return retval, nil
+			}
+
+			if problem := store.checkAuditEvent(event, retval.LastHash, signed); problem != "" {
+				retval.BrokenID = event.ID
+				if event.PrevHash != retval.LastHash && event.ID != retval.LastID+1 {
+					retval.BrokenID = retval.LastID + 1
+				}
+				retval.Problem = problem
+				return retval, nil
+			}
+
+			for _, checkpoint := range checkpointsByID[event.ID] {
+				if checkpoint.Hash != event.Hash {
+					retval.BrokenID = event.ID
+					retval.Problem = fmt.Sprintf("Event %v doesn't match the checkpoint from %s", event.ID, checkpoint.Created.Format(time.RFC3339))
+					return retval, nil
+				}
+				retval.Checkpoints++
+			}
+
+			if event.HMAC != "" {
+				signed = true
+				retval.Signed++
+			}
+
+			retval.Verified++
+			retval.LastID = event.ID
+			retval.LastHash = event.Hash
+		}
+
+		if len(events) < 1000 {
+			break
+		}
+	}
+
+	//	Make sure the log hasn't been cut short
+	for id, checkpoints := range checkpointsByID {
+		if id > retval.LastID {
+			retval.BrokenID = retval.LastID + 1
+			retval.Problem = fmt.Sprintf("The log ends at event %v, but there is a checkpoint for event %v from %s", retval.LastID, id, checkpoints[0].Created.Format(time.RFC3339))
+			return retval, nil
+		}
+	}
+
+	return retval, nil
+}
+
+// CreateAuditCheckpoint returns a checkpoint for the last event in the audit log, signed with
+// the audit key (if there is one).  Only system admins can create checkpoints
+func (store DBManager) CreateAuditCheckpoint(context User) (AuditCheckpoint, error) {
+	store, end := store.startSpan("CreateAuditCheckpoint")
+	defer end()
+
+	retval := AuditCheckpoint{Created: time.Now().UTC()}
+
+	lastID, err := store.GetLastAuditEventID(context)
+	if err != nil {
+		return retval, err
+	}
+
+	if lastID > 0 {
+		events, err := store.systemdb.GetAuditEvents(lastID-1, 1)
+		if err != nil {
+			return retval, err
+		}
+
+		if len(events) != 1 || events[0].ID != lastID {
+			return retval, fmt.Errorf("Problem finding the last audit event (%v)", lastID)
+		}
+
+		retval.ID = events[0].ID
+		retval.Hash = events[0].Hash
+	}
+
+	if store.auditKey != nil {
+		retval.Signature = store.signAuditCheckpoint(retval)
+	}
+
+	return retval, nil
+}
+
+// WriteAuditCheckpoint writes a checkpoint as a line of JSON
+func WriteAuditCheckpoint(w io.Writer, checkpoint AuditCheckpoint) error {
+	if err := json.NewEncoder(w).Encode(checkpoint); err != nil {
+		return fmt.Errorf("Problem writing audit checkpoint: %s", err)
+	}
+
+	return nil
+}
+
+// ReadAuditCheckpoints reads checkpoints written by WriteAuditCheckpoint (one per line)
+func ReadAuditCheckpoints(r io.Reader) ([]AuditCheckpoint, error) {
+	retval := []AuditCheckpoint{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		checkpoint := AuditCheckpoint{}
+		if err := json.Unmarshal(scanner.Bytes(), &checkpoint); err != nil {
+			return retval, fmt.Errorf("Problem reading audit checkpoint: %s", err)
+		}
+
+		retval = append(retval, checkpoint)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return retval, fmt.Errorf("Problem reading audit checkpoints: %s", err)
+	}
+
+	return retval, nil
+}
+
+// checkAuditEvent returns a description of what's wrong with the event
+// (or an empty string if it's the intact next link in the chain)
+func (store DBManager) checkAuditEvent(event AuditEvent, lastHash string, signed bool) string {
+	switch {
+	case event.PrevHash != lastHash:
+		return fmt.Sprintf("Event %v doesn't chain to the event before it", event.ID)
+	case event.Hash != auditEventHash(event):
+		return fmt.Sprintf("Event %v has been changed", event.ID)
+	case store.auditKey == nil:
+		return ""
+	case event.HMAC == "" && signed:
+		return fmt.Sprintf("Event %v is missing its HMAC", event.ID)
+	case event.HMAC != "" && hmac.Equal([]byte(event.HMAC), []byte(auditHMAC(store.auditKey, event.Hash))) == false:
+		return fmt.Sprintf("Event %v has an invalid HMAC", event.ID)
+	}
+
+	return ""
+}
+
+// unchainedAuditEvent prepares an event to be added to the log with the passed id.  It isn't
+// chained yet, but if there's a key its HMAC covers its contents, so chainAuditEvents can
+// tell it was added with the key (and hasn't been changed since)
+func unchainedAuditEvent(event AuditEvent, id int64, hmacKey []byte) AuditEvent {
+	event.ID = id
+	event.Created = event.Created.UTC().Truncate(time.Microsecond)
+	event.PrevHash = ""
+	event.Hash = ""
+
+	event.HMAC = ""
+	if hmacKey != nil {
+		event.HMAC = auditHMAC(hmacKey, auditEventHash(event))
+	}
+
+	return event
+}
+
+// chainAuditEvents seals the events waiting to be chained (oldest first) onto the end of the
+// chain (the last chained event's id and hash), and returns the events it sealed.  It stops at
+// a missing id until it's older than auditGapTimeout.  With a key, events without a valid HMAC
+// for their contents are left out of the chain (so VerifyAuditLog reports them).  Without one,
+// it stops at events added with a key -- they have to be chained with it
+func chainAuditEvents(events []AuditEvent, lastID int64, lastHash string, hmacKey []byte, now time.Time) []AuditEvent {
+	retval := []AuditEvent{}
+
+	for _, event := range events {
+		if event.ID != lastID+1 && now.Sub(event.Created) < auditGapTimeout {
+			break
+		}
+		lastID = event.ID
+
+		if hmacKey == nil && event.HMAC != "" {
+			break
+		}
+
+		if hmacKey != nil && hmac.Equal([]byte(event.HMAC), []byte(auditHMAC(hmacKey, auditEventHash(event)))) == false {
+			continue
+		}
+
+		event = sealAuditEvent(event, lastHash, hmacKey)
+		lastHash = event.Hash
+		retval = append(retval, event)
+	}
+
+	return retval
+}
+
+// sealAuditEvent chains the event to the event before it: it records the previous
+// event's hash, then hashes the event (and HMACs the hash if there's a key).  The
+// created time is truncated to microseconds, so it survives a round trip through any datastore
+func sealAuditEvent(event AuditEvent, prevHash string, hmacKey []byte) AuditEvent {
+	event.Created = event.Created.UTC().Truncate(time.Microsecond)
+	event.PrevHash = prevHash
+	event.Hash = auditEventHash(event)
+
+	event.HMAC = ""
+	if hmacKey != nil {
+		event.HMAC = auditHMAC(hmacKey, event.Hash)
+	}
+
+	return event
+}
+
+// auditEventHash returns the hex encoded SHA-256 hash of the event's contents (including
+// the previous event's hash).  The fields are encoded as a JSON array, so they can't run together
+func auditEventHash(event AuditEvent) string {
+	contents, _ := json.Marshal([]interface{}{
+		event.ID,
+		event.Created.UTC().Format(time.RFC3339Nano),
+		event.Actor,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.ClientID,
+		event.Detail,
+		event.Before,
+		event.After,
+		event.PrevHash,
+	})
+
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditHMAC returns the hex encoded HMAC-SHA256 of the value
+func auditHMAC(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAuditCheckpoint returns the signature for the checkpoint
+func (store DBManager) signAuditCheckpoint(checkpoint AuditCheckpoint) string {
+	return auditHMAC(store.auditKey, fmt.Sprintf("%v\n%s\n%s", checkpoint.ID, checkpoint.Hash, checkpoint.Created.UTC().Format(time.RFC3339Nano)))
+}
+
+// auditValue returns the JSON for an item in the audit log (or an empty string for nil).
+// User secret hashes are removed
+func auditValue(item interface{}) string {
+	if item == nil {
+		return ""
+	}
+
+	if user, ok := item.(User); ok {
+		user.SecretHash = ""
+		item = user
+	}
+
+	contents, err := json.Marshal(item)
+	if err != nil {
+		return ""
+	}
+
+	return string(contents)
+}
+
+// tokenFingerprint identifies a token in the audit log without recording the token itself
+func tokenFingerprint(tokenID string) string {
+	sum := sha256.Sum256([]byte(tokenID))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,484 @@
+package data_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+func TestAudit_AddUser_RecordsEvent(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	newUser, err := db.From("10.0.0.1", "testclient").AddUser(uctx, data.User{Name: "TestUser1", Description: "Unit test user"}, "newpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	events, err := db.GetAuditEvents(uctx, 0, 100)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetAuditEvents failed: Should have gotten events without error: %s", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("GetAuditEvents failed: Should have gotten 1 event, but got: %+v", events)
+	}
+
+	event := events[0]
+	if event.ID != 1 || event.Action != data.AuditUserCreate || event.Actor != uctx.Name || event.TargetID != newUser.ID {
+		t.Errorf("GetAuditEvents failed: Should have recorded who created which user, but got: %+v", event)
+	}
+
+	if event.IP != "10.0.0.1" || event.ClientID != "testclient" {
+		t.Errorf("GetAuditEvents failed: Should have recorded the ip and client, but got: %+v", event)
+	}
+
+	if strings.Contains(event.After, "TestUser1") == false || strings.Contains(event.After, newUser.SecretHash) {
+		t.Errorf("GetAuditEvents failed: Should have recorded the new user without the secret hash, but got: %s", event.After)
+	}
+}
+
+func TestAudit_AuthEvents_RecordsEvents(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	db.GetUserScopesWithCredentials(uctx.Name, "notthepassword")
+
+	token, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	if err := db.RevokeToken(uctx, token.ID); err != nil {
+		t.Errorf("RevokeToken failed: Should have revoked the token without an error, but got: %s", err)
+	}
+
+	events, err := db.GetAuditEvents(uctx, 0, 100)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetAuditEvents failed: Should have gotten events without error: %s", err)
+	}
+
+	expected := []string{data.AuditLoginFailed, data.AuditTokenIssue, data.AuditTokenRevoke}
+	if len(events) != len(expected) {
+		t.Fatalf("GetAuditEvents failed: Should have gotten %v events, but got: %+v", len(expected), events)
+	}
+
+	for i, event := range events {
+		if event.Action != expected[i] {
+			t.Errorf("GetAuditEvents failed: Should have recorded '%s', but got: %+v", expected[i], event)
+		}
+
+		if strings.Contains(event.TargetID+event.Detail, token.ID) {
+			t.Errorf("GetAuditEvents failed: Should not have recorded the token itself, but got: %+v", event)
+		}
+	}
+
+	if events[1].TargetID != events[2].TargetID {
+		t.Errorf("GetAuditEvents failed: Should have recorded the same token fingerprint when issued and revoked, but got: %s and %s", events[1].TargetID, events[2].TargetID)
+	}
+}
+
+func TestAudit_GetAuditEvents_Paging_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	for _, name := range []string{"TestRole1", "TestRole2", "TestRole3", "TestRole4", "TestRole5"} {
+		if _, err := db.AddRole(uctx, data.Role{Name: name}); err != nil {
+			t.Errorf("AddRole failed: Should have added an item without error: %s", err)
+		}
+	}
+
+	//	Act
+	lastID, err := db.GetLastAuditEventID(uctx)
+	if err != nil {
+		t.Errorf("GetLastAuditEventID failed: Should have gotten the last id without error: %s", err)
+	}
+
+	page, err := db.GetAuditEvents(uctx, 2, 2)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetAuditEvents failed: Should have gotten events without error: %s", err)
+	}
+
+	if lastID != 5 {
+		t.Errorf("GetLastAuditEventID failed: Should have gotten 5, but got: %v", lastID)
+	}
+
+	if len(page) != 2 || page[0].ID != 3 || page[1].ID != 4 {
+		t.Errorf("GetAuditEvents failed: Should have gotten events 3 and 4, but got: %+v", page)
+	}
+}
+
+func TestAudit_GetAuditEvents_NoPermission_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestUser1"}, "newpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, err = db.GetAuditEvents(newUser, 0, 100)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("GetAuditEvents failed: Should have returned an error for a user that isn't a system admin")
+	}
+}
+
+//	Bootstraps a test system and adds a few users (so there's something in the audit log)
+func getTestAuditLog(t *testing.T, systemdbfilename, tokendbfilename, key string) (*data.DBManager, data.User) {
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	db.SetAuditKey(key)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Fatalf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, err := db.AddUser(uctx, data.User{Name: fmt.Sprintf("TestUser%v", i)}, "newpassword"); err != nil {
+			t.Fatalf("AddUser failed: Should have added an item without error: %s", err)
+		}
+	}
+
+	return db, uctx
+}
+
+func TestAudit_VerifyAuditLog_Intact_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "testkey")
+	defer db.Close()
+
+	checkpoint, err := db.CreateAuditCheckpoint(uctx)
+	if err != nil {
+		t.Errorf("CreateAuditCheckpoint failed: Should have created a checkpoint without error: %s", err)
+	}
+
+	//	Act
+	result, err := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{checkpoint})
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyAuditLog failed: Should have verified without error: %s", err)
+	}
+
+	if result.BrokenID != 0 {
+		t.Errorf("VerifyAuditLog failed: Should not have found a broken link, but got: %+v", result)
+	}
+
+	if result.Verified != 3 || result.Signed != 3 || result.Checkpoints != 1 || checkpoint.ID != 3 {
+		t.Errorf("VerifyAuditLog failed: Should have verified 3 signed events and 1 checkpoint, but got: %+v", result)
+	}
+}
+
+func TestAudit_VerifyAuditLog_ChangedEvent_ReportsBrokenLink(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, _ := getTestAuditLog(t, systemdbfilename, tokendbfilename, "")
+	db.Close()
+
+	//	Change an event behind the DBManager's back
+	execTestSystemStatement(systemdbfilename, "UPDATE audit SET detail = $1 WHERE id = $2;", "nothing to see here", 2)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	admin, err := db.GetAdminUser()
+	if err != nil {
+		t.Fatalf("GetAdminUser failed: %s", err)
+	}
+
+	//	Act
+	result, err := db.VerifyAuditLog(admin, []data.AuditCheckpoint{})
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyAuditLog failed: Should have verified without error: %s", err)
+	}
+
+	if result.BrokenID != 2 || result.Verified != 1 {
+		t.Errorf("VerifyAuditLog failed: Should have reported event 2 as the first broken link, but got: %+v", result)
+	}
+}
+
+func TestAudit_VerifyAuditLog_TruncatedLog_ReportsCheckpointMismatch(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "testkey")
+	checkpoint, err := db.CreateAuditCheckpoint(uctx)
+	if err != nil {
+		t.Errorf("CreateAuditCheckpoint failed: Should have created a checkpoint without error: %s", err)
+	}
+	db.Close()
+
+	//	Remove the last event (the rest of the chain is still intact)
+	execTestSystemStatement(systemdbfilename, "DELETE FROM audit WHERE id = $1;", 3)
+
+	db, err = data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetAuditKey("testkey")
+
+	//	Act
+	intact, _ := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{})
+	result, err := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{checkpoint})
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyAuditLog failed: Should have verified without error: %s", err)
+	}
+
+	if intact.BrokenID != 0 {
+		t.Errorf("VerifyAuditLog failed: Should not have found a broken link without the checkpoint, but got: %+v", intact)
+	}
+
+	if result.BrokenID != 3 || result.Verified != 2 {
+		t.Errorf("VerifyAuditLog failed: Should have reported event 3 as missing, but got: %+v", result)
+	}
+}
+
+func TestAudit_VerifyAuditLog_WrongKey_ReportsBrokenLink(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "testkey")
+	defer db.Close()
+
+	checkpoint, err := db.CreateAuditCheckpoint(uctx)
+	if err != nil {
+		t.Errorf("CreateAuditCheckpoint failed: Should have created a checkpoint without error: %s", err)
+	}
+
+	//	Act
+	db.SetAuditKey("notthekey")
+	result, err := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{})
+	forged, _ := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{checkpoint})
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyAuditLog failed: Should have verified without error: %s", err)
+	}
+
+	if result.BrokenID != 1 || strings.Contains(result.Problem, "HMAC") == false {
+		t.Errorf("VerifyAuditLog failed: Should have reported an invalid HMAC on event 1, but got: %+v", result)
+	}
+
+	if forged.BrokenID != checkpoint.ID || strings.Contains(forged.Problem, "signature") == false {
+		t.Errorf("VerifyAuditLog failed: Should have reported an invalid checkpoint signature, but got: %+v", forged)
+	}
+}
+
+func TestAudit_VerifyAuditLog_ForgedEvent_ReportsBrokenLink(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "testkey")
+	db.Close()
+
+	//	Add an event behind the DBManager's back (without an HMAC for it)
+	execTestSystemStatement(systemdbfilename, `INSERT INTO audit (id, created, actor, action, targettype, targetid, ip, clientid, detail, beforevalue, aftervalue, prevhash, hash, hmac)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);`, 4, time.Now().UTC(), "admin", data.AuditUserCreate, "user", "forged", "", "", "", "", "", "", "", "")
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetAuditKey("testkey")
+
+	//	Act
+	_, addErr := db.AddUser(uctx, data.User{Name: "TestUser4"}, "newpassword")
+	result, err := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{})
+
+	//	Assert
+	if addErr != nil || err != nil {
+		t.Errorf("VerifyAuditLog failed: Should have added a user and verified without error: %v / %v", addErr, err)
+	}
+
+	if result.BrokenID != 4 || result.Verified != 3 || strings.Contains(result.Problem, "never chained") == false {
+		t.Errorf("VerifyAuditLog failed: Should have reported the forged event as never chained, but got: %+v", result)
+	}
+}
+
+func TestAudit_VerifyAuditLog_MissingID_WaitsForEvent(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "")
+	db.Close()
+
+	//	Add an event after an id that hasn't turned up yet (like an event that's still being added)
+	execTestSystemStatement(systemdbfilename, `INSERT INTO audit (id, created, actor, action, targettype, targetid, ip, clientid, detail, beforevalue, aftervalue, prevhash, hash, hmac)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);`, 5, time.Now().UTC(), "admin", data.AuditUserCreate, "user", "later", "", "", "", "", "", "", "", "")
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Act
+	result, err := db.VerifyAuditLog(uctx, []data.AuditCheckpoint{})
+	lastID, lastErr := db.GetLastAuditEventID(uctx)
+
+	//	Assert
+	if err != nil || lastErr != nil {
+		t.Errorf("VerifyAuditLog failed: Should have verified without error: %v / %v", err, lastErr)
+	}
+
+	if result.BrokenID != 0 || result.Verified != 3 || result.Pending != 1 {
+		t.Errorf("VerifyAuditLog failed: Should have left the event after the missing id waiting to be chained, but got: %+v", result)
+	}
+
+	if lastID != 3 {
+		t.Errorf("GetLastAuditEventID failed: Should have returned the last chained event, but got %v", lastID)
+	}
+}
+
+func TestAudit_AuditLogFailure_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "")
+	db.Close()
+
+	//	Take the audit log away
+	execTestSystemStatement(systemdbfilename, "DROP TABLE audit;")
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Act
+	_, err = db.AddResource(uctx, data.Resource{Name: "TestAuditResource1"})
+
+	//	Assert
+	if err == nil || strings.Contains(err.Error(), "audit log") == false {
+		t.Errorf("AddResource failed: Should have returned an error when the change couldn't be audited, but got %v", err)
+	}
+}
+
+func TestAudit_AuditCheckpoints_RoundTrip_Successful(t *testing.T) {
+	//	Arrange
+	checkpoints := []data.AuditCheckpoint{
+		{Created: time.Now().UTC(), ID: 1, Hash: "abc", Signature: "def"},
+		{Created: time.Now().UTC(), ID: 2, Hash: "ghi"},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, checkpoint := range checkpoints {
+		if err := data.WriteAuditCheckpoint(buf, checkpoint); err != nil {
+			t.Errorf("WriteAuditCheckpoint failed: Should have written without error: %s", err)
+		}
+	}
+
+	//	Act
+	got, err := data.ReadAuditCheckpoints(buf)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("ReadAuditCheckpoints failed: Should have read without error: %s", err)
+	}
+
+	if len(got) != 2 || got[0].ID != 1 || got[0].Signature != "def" || got[1].Hash != "ghi" {
+		t.Errorf("ReadAuditCheckpoints failed: Should have read the checkpoints back, but got: %+v", got)
+	}
+}
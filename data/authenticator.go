@@ -0,0 +1,202 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/rs/xid"
+)
+
+// ErrExternalLoginFailed is returned by an Authenticator when the name or password is wrong (or the
+// user isn't in the external system)
+var ErrExternalLoginFailed = errors.New("The user was not found or the password was incorrect")
+
+// directoryActor is who changes made by logins against the Authenticator are recorded as
+const directoryActor = "directory"
+
+// Authenticator checks user names and passwords against another system, like a company
+// directory (see LDAPAuthenticator).  Users it added (and users that don't exist yet) log in
+// with it -- see SetAuthenticator
+type Authenticator interface {
+	// Authenticate checks the name and password, and returns the user as the external system
+	// knows them.  It returns ErrExternalLoginFailed if the name or password is wrong
+	Authenticate(name, password string) (ExternalUser, error)
+}
+
+// ExternalUser is a user an Authenticator has checked
+type ExternalUser struct {
+	// Name is the user's (canonical) name in the external system, which is the name
+	// they're added with
+	Name        string
+	Description string
+
+	// Groups are the groups the user is in (like the DNs of their directory groups)
+	Groups []string
+}
+
+// GroupRole assigns the members of an external group a role within a resource (by their names)
+type GroupRole struct {
+	Group    string `json:"group" mapstructure:"group"`
+	Resource string `json:"resource" mapstructure:"resource"`
+	Role     string `json:"role" mapstructure:"role"`
+}
+
+// SetAuthenticator sets the external system directory users log in with.  Users that log in with it
+// for the first time are added to the system (without a local password, and marked as directory
+// users), and their group roles are brought up to date each time they log in (see SetGroupRoles).
+// Local users never log in with it.  If it's nil, only local passwords are used
+func (store *DBManager) SetAuthenticator(authenticator Authenticator) {
+	store.authenticator = authenticator
+}
+
+// SetGroupRoles sets the roles members of external groups get.  Roles in the list are managed by the
+// external system:  users that log in with the Authenticator get the roles for the groups they're in,
+// and lose the ones for groups they're no longer in.  Roles that aren't in the list are left alone
+func (store *DBManager) SetGroupRoles(groupRoles []GroupRole) {
+	store.groupRoles = groupRoles
+}
+
+// usesAuthenticator returns 'true' if the user logs in with the Authenticator:  it added them
+// (or they don't exist yet, when 'found' is false)
+func (store DBManager) usesAuthenticator(user User, found bool) bool {
+	return store.authenticator != nil && (found == false || user.Source == UserSourceDirectory)
+}
+
+// loginWithAuthenticator checks the name and password with the Authenticator, and returns the local
+// user (adding them if they're new, and updating their group roles).  Failed logins are counted like
+// wrong passwords (see SetLockoutPolicy), and the purpose of the check is noted in the audit log
+func (store DBManager) loginWithAuthenticator(name, secret, purpose string) (User, error) {
+	_, span := tracer.Start(store.requestContext(), "Authenticator.Authenticate")
+	external, err := store.authenticator.Authenticate(name, secret)
+	span.End()
+
+	if errors.Is(err, ErrExternalLoginFailed) {
+		store.log().Warn("Login failed", "user", name, "purpose", purpose, logging.FieldOutcome, "external_rejected")
+		metrics.AuthFailures.WithLabelValues("external_rejected").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "rejected by the directory ("+purpose+")", nil, nil)
+		store.loginFailed(name, "")
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	if err != nil {
+		store.log().Error("Login failed", "user", name, "purpose", purpose, logging.FieldOutcome, "external_error", "error", err)
+		metrics.AuthFailures.WithLabelValues("external_error").Inc()
+		return User{}, fmt.Errorf("There was a problem checking the password with the directory")
+	}
+
+	if external.Name == "" {
+		external.Name = name
+	}
+
+	//	Find the user (or add them, the first time they log in)
+	user, err := store.systemdb.GetUserByName(external.Name)
+	if err != nil {
+		user, err = store.systemdb.AddUser(User{ID: xid.New().String(), Name: external.Name, Description: external.Description, Source: UserSourceDirectory}, "", directoryActor)
+		if err != nil {
+			return User{}, fmt.Errorf("Problem adding the directory user: %s", err)
+		}
+
+		store.log().Info("User added from the directory", "user", user.Name, logging.FieldUserID, user.ID)
+		store.audit(directoryActor, AuditUserCreate, "user", user.ID, "added from the directory", nil, user)
+	}
+
+	//	Local users with the same name aren't taken over by the directory
+	if user.Source != UserSourceDirectory {
+		store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, "purpose", purpose, logging.FieldOutcome, "local_user")
+		metrics.AuthFailures.WithLabelValues("local_user").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "directory login for a local user ("+purpose+")", nil, nil)
+		store.loginFailed(name, user.ID)
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	if err := store.syncGroupRoles(user, external.Groups); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// syncGroupRoles gives the user the roles for the external groups they're in, and removes
+// the group roles for the groups they aren't in
+func (store DBManager) syncGroupRoles(user User, groups []string) error {
+	if len(store.groupRoles) == 0 {
+		return nil
+	}
+
+	resources, err := store.systemdb.GetAllResources()
+	if err != nil {
+		return fmt.Errorf("Problem getting resources for the user's group roles: %s", err)
+	}
+
+	roles, err := store.systemdb.GetAllRoles()
+	if err != nil {
+		return fmt.Errorf("Problem getting roles for the user's group roles: %s", err)
+	}
+
+	//	Find out which of the managed resource roles the user should have
+	type resourceRole struct{ resourceID, roleID string }
+	managed := map[resourceRole]bool{}
+
+	for _, groupRole := range store.groupRoles {
+		resourceID, roleID := "", ""
+		for _, resource := range resources {
+			if resource.Name == groupRole.Resource || resource.ID == groupRole.Resource {
+				resourceID = resource.ID
+			}
+		}
+		for _, role := range roles {
+			if role.Name == groupRole.Role || role.ID == groupRole.Role {
+				roleID = role.ID
+			}
+		}
+
+		if resourceID == "" || roleID == "" {
+			store.log().Warn("The group role's resource or role doesn't exist", "group", groupRole.Group, "resource", groupRole.Resource, "role", groupRole.Role)
+			continue
+		}
+
+		key := resourceRole{resourceID, roleID}
+		for _, group := range groups {
+			if strings.EqualFold(group, groupRole.Group) {
+				managed[key] = true
+			}
+		}
+
+		if _, ok := managed[key]; ok == false {
+			managed[key] = false
+		}
+	}
+
+	current, err := store.systemdb.GetUserResourceRoles(user.ID)
+	if err != nil {
+		return fmt.Errorf("Problem getting the user's roles: %s", err)
+	}
+
+	has := map[resourceRole]bool{}
+	for _, urr := range current {
+		has[resourceRole{urr.ResourceID, urr.RoleID}] = true
+	}
+
+	//	Add the roles for their groups, and remove the ones for groups they've left
+	for key, member := range managed {
+		switch {
+		case member && has[key] == false:
+			urr, err := store.systemdb.AddUserResourceRole(user.ID, key.resourceID, key.roleID, directoryActor)
+			if err != nil {
+				return err
+			}
+			store.audit(directoryActor, AuditAssignmentCreate, "assignment", user.ID+"/"+key.resourceID+"/"+key.roleID, "from a directory group", nil, urr)
+
+		case member == false && has[key]:
+			if err := store.systemdb.DeleteUserResourceRole(user.ID, key.resourceID, key.roleID); err != nil {
+				return err
+			}
+			store.audit(directoryActor, AuditAssignmentRemove, "assignment", user.ID+"/"+key.resourceID+"/"+key.roleID, "no longer in the directory group", nil, nil)
+		}
+	}
+
+	return nil
+}
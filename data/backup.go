@@ -0,0 +1,149 @@
+package data
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BackupSchemaVersion is the version of the backup format written by Backup.
+// Bump it whenever the shape of a Backup (or the items in it) changes.
+// Version 2 added client authentication and token confirmations, version 3 added
+// DPoP key confirmations, version 4 added password history, TOTP second factors
+// and token authentication methods, version 5 added WebAuthn credentials,
+// version 6 added the audit log and version 7 added user sources
+const BackupSchemaVersion = 7
+
+// Backup is a point in time export of the system (and optionally token) datastores
+type Backup struct {
+	SchemaVersion int       `json:"schema_version"`
+	Created       time.Time `json:"created"`
+	SystemSnapshot
+	Tokens []Token `json:"tokens,omitempty"`
+}
+
+// Backup exports all users, resources, roles and user/resource/role assignments, along with
+// the audit log (and unexpired tokens if 'includeTokens' is set).  It's safe to call while
+// the server is running -- events added after the rest of the system is exported are included
+func (store DBManager) Backup(includeTokens bool) (Backup, error) {
+	store, end := store.startSpan("Backup")
+	defer end()
+
+	retval := Backup{
+		SchemaVersion: BackupSchemaVersion,
+		Created:       time.Now(),
+	}
+
+	//	Export the system datastore
+	snapshot, err := store.systemdb.ExportSystem()
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting the system datastore: %s", err)
+	}
+	retval.SystemSnapshot = snapshot
+
+	//	Export the audit log (with its hashes and HMACs, so the restored log can be verified)
+	if err := store.sealAuditLog(); err != nil {
+		return retval, err
+	}
+
+	retval.AuditEvents = []AuditEvent{}
+	afterID := int64(0)
+	for {
+		events, err := store.systemdb.GetAuditEvents(afterID, 1000)
+		if err != nil {
+			return retval, fmt.Errorf("Problem exporting the audit log: %s", err)
+		}
+		retval.AuditEvents = append(retval.AuditEvents, events...)
+
+		if len(events) < 1000 {
+			break
+		}
+		afterID = events[len(events)-1].ID
+	}
+
+	//	Export the token datastore if we've been asked to
+	if includeTokens {
+		tokens, err := store.tokendb.ExportTokens()
+		if err != nil {
+			return retval, fmt.Errorf("Problem exporting the token datastore: %s", err)
+		}
+		retval.Tokens = tokens
+	}
+
+	return retval, nil
+}
+
+// Restore loads a backup into fresh (not bootstrapped) system and token datastores.  The
+// audit log is restored as it was, so it still verifies (with the same audit key)
+func (store DBManager) Restore(backup Backup) error {
+	store, end := store.startSpan("Restore")
+	defer end()
+
+	//	Validate the schema version
+	if backup.SchemaVersion < 1 {
+		return fmt.Errorf("The backup doesn't have a schema version -- it may not be an authserver backup")
+	}
+
+	if backup.SchemaVersion > BackupSchemaVersion {
+		return fmt.Errorf("The backup has schema version %v, but this version of authserver only supports up to version %v", backup.SchemaVersion, BackupSchemaVersion)
+	}
+
+	//	Restore the system datastore
+	if err := store.systemdb.ImportSystem(backup.SystemSnapshot); err != nil {
+		return fmt.Errorf("Problem restoring the system datastore: %s", err)
+	}
+
+	//	Restore the token datastore (this creates the token schema even if there are no tokens)
+	if err := store.tokendb.ImportTokens(backup.Tokens); err != nil {
+		return fmt.Errorf("Problem restoring the token datastore: %s", err)
+	}
+
+	return nil
+}
+
+// WriteBackup writes the backup as JSON, gzip compressed if 'compress' is set
+func WriteBackup(w io.Writer, backup Backup, compress bool) error {
+	if compress {
+		gz := gzip.NewWriter(w)
+		if err := json.NewEncoder(gz).Encode(backup); err != nil {
+			return fmt.Errorf("Problem writing backup: %s", err)
+		}
+
+		return gz.Close()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(backup); err != nil {
+		return fmt.Errorf("Problem writing backup: %s", err)
+	}
+
+	return nil
+}
+
+// ReadBackup reads a backup written by WriteBackup.  Compressed
+// backups are detected automatically
+func ReadBackup(r io.Reader) (Backup, error) {
+	retval := Backup{}
+	reader := bufio.NewReader(r)
+
+	//	Check for the gzip header
+	var source io.Reader = reader
+	if header, err := reader.Peek(2); err == nil && header[0] == 0x1f && header[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return retval, fmt.Errorf("Problem reading compressed backup: %s", err)
+		}
+		defer gz.Close()
+		source = gz
+	}
+
+	if err := json.NewDecoder(source).Decode(&retval); err != nil {
+		return retval, fmt.Errorf("Problem reading backup: %s", err)
+	}
+
+	return retval, nil
+}
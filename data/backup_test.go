@@ -0,0 +1,223 @@
+package data_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+func TestBackup_BackupAndRestore_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, adminSecret, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Add a user with a resource and role
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestUser1", Description: "Unit test user"}, "newpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	newResource, err := db.AddResource(uctx, data.Resource{Name: "TestResource1", Description: "Unit test resource"})
+	if err != nil {
+		t.Errorf("AddResource failed: Should have added an item without error: %s", err)
+	}
+
+	newRole, err := db.AddRole(uctx, data.Role{Name: "TestRole1", Description: "Unit test role"})
+	if err != nil {
+		t.Errorf("AddRole failed: Should have added an item without error: %s", err)
+	}
+
+	_, err = db.AddUserToResourceWithRole(uctx, newUser, newResource, newRole)
+	if err != nil {
+		t.Errorf("AddUserToResourceWithRole failed: Should have added an item without error: %s", err)
+	}
+
+	token, err := db.GetNewToken(newUser, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Our restore target
+	restoresystemdb, restoretokendb := getRestoreTestFiles()
+	defer os.Remove(restoresystemdb)
+	defer os.Remove(restoretokendb)
+
+	restoredb, err := data.NewDBManager(restoresystemdb, restoretokendb)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer restoredb.Close()
+
+	//	Act
+	backup, err := db.Backup(true)
+	if err != nil {
+		t.Errorf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := data.WriteBackup(buffer, backup, true); err != nil {
+		t.Errorf("WriteBackup failed: Should have written the backup without error: %s", err)
+	}
+
+	restored, err := data.ReadBackup(buffer)
+	if err != nil {
+		t.Errorf("ReadBackup failed: Should have read the backup without error: %s", err)
+	}
+
+	err = restoredb.Restore(restored)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("Restore failed: Should have restored without error: %s", err)
+	}
+
+	if restored.SchemaVersion != data.BackupSchemaVersion {
+		t.Errorf("ReadBackup failed: Should have read the schema version %v, but got %v", data.BackupSchemaVersion, restored.SchemaVersion)
+	}
+
+	//	-- the admin password should still work
+	if _, err := restoredb.GetUserScopesWithCredentials(uctx.Name, adminSecret); err != nil {
+		t.Errorf("Restore failed: Should have restored the admin user's credentials, but got: %s", err)
+	}
+
+	//	-- the user should have the same scopes
+	scopes, err := restoredb.GetUserScopesWithCredentials(newUser.Name, "newpassword")
+	if err != nil {
+		t.Errorf("Restore failed: Should have restored the user's credentials, but got: %s", err)
+	}
+
+	if len(scopes.ScopeResources) != 1 || scopes.ScopeResources[0].ID != newResource.ID {
+		t.Errorf("Restore failed: Should have restored the user's resources, but got: %+v", scopes.ScopeResources)
+	}
+
+	//	-- the token should still be valid
+	if _, err := restoredb.GetScopesForToken(token.ID); err != nil {
+		t.Errorf("Restore failed: Should have restored the user's token, but got: %s", err)
+	}
+}
+
+func TestBackup_RestoreIntoBootstrappedSystem_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	_, _, err = db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	backup, err := db.Backup(false)
+	if err != nil {
+		t.Errorf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	//	Act
+	err = db.Restore(backup)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Restore failed: Should have returned an error restoring into a bootstrapped system")
+	}
+}
+
+func TestBackup_RestoreUnsupportedSchemaVersion_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	backup := data.Backup{SchemaVersion: data.BackupSchemaVersion + 1}
+
+	//	Act
+	err = db.Restore(backup)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Restore failed: Should have returned an error for an unsupported schema version")
+	}
+}
+
+func TestBackup_BackupAndRestore_AuditLogVerifies(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, uctx := getTestAuditLog(t, systemdbfilename, tokendbfilename, "testkey")
+	defer db.Close()
+
+	checkpoint, err := db.CreateAuditCheckpoint(uctx)
+	if err != nil {
+		t.Errorf("CreateAuditCheckpoint failed: Should have created a checkpoint without error: %s", err)
+	}
+
+	restoresystemdb, restoretokendb := getRestoreTestFiles()
+	defer os.Remove(restoresystemdb)
+	defer os.Remove(restoretokendb)
+
+	restoredb, err := data.NewDBManager(restoresystemdb, restoretokendb)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer restoredb.Close()
+	restoredb.SetAuditKey("testkey")
+
+	//	Act
+	backup, err := db.Backup(false)
+	if err != nil {
+		t.Errorf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	restoreErr := restoredb.Restore(backup)
+	restored, verifyErr := restoredb.VerifyAuditLog(uctx, []data.AuditCheckpoint{checkpoint})
+
+	_, addErr := restoredb.AddUser(uctx, data.User{Name: "TestUser4"}, "newpassword")
+	added, addedErr := restoredb.VerifyAuditLog(uctx, []data.AuditCheckpoint{checkpoint})
+
+	//	Assert
+	if len(backup.AuditEvents) != 3 {
+		t.Errorf("Backup failed: Should have backed up the 3 audit events, but got %v", len(backup.AuditEvents))
+	}
+
+	if restoreErr != nil {
+		t.Errorf("Restore failed: Should have restored without error: %s", restoreErr)
+	}
+
+	if verifyErr != nil || restored.BrokenID != 0 || restored.Verified != 3 || restored.Signed != 3 || restored.Checkpoints != 1 {
+		t.Errorf("VerifyAuditLog failed: Should have verified the restored log against the checkpoint, but got %+v (%v)", restored, verifyErr)
+	}
+
+	if addErr != nil || addedErr != nil || added.BrokenID != 0 || added.Verified != 4 || added.Signed != 4 || added.LastID != 4 {
+		t.Errorf("VerifyAuditLog failed: Should have chained new events onto the restored log, but got %+v (%v, %v)", added, addErr, addedErr)
+	}
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/danesparza/authserver/jose"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// ClientAssertionType is the client_assertion_type for JWT client assertions (RFC 7523, section 2.2)
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+const (
+	// maxClientAssertionLifetime is how far in the future a client assertion can expire.
+	// Assertions are remembered until they expire, so they can't be replayed
+	maxClientAssertionLifetime = 10 * time.Minute
+
+	// clientAssertionLeeway allows for clock skew between the client and authserver
+	clientAssertionLeeway = 30 * time.Second
+)
+
+// clientKeySets caches the key sets of clients that publish them at a JWKS URI
+var clientKeySets = jose.NewKeySetCache(5 * time.Minute)
+
+// ClientAssertion is the id of a verified client assertion, and when authserver stops accepting it
+// (its expiry, allowing for clock skew).  The caller has to make sure the id isn't used again
+// before then (RFC 7523, section 3)
+type ClientAssertion struct {
+	ID      string
+	Expires time.Time
+}
+
+// clientAssertionClaims are the claims in a client assertion (RFC 7523, section 3)
+type clientAssertionClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ID        string   `json:"jti"`
+}
+
+// audience is a JWT 'aud' claim -- a single string or a list of them
+type audience []string
+
+// UnmarshalJSON reads an audience from a string or a list of strings
+func (aud *audience) UnmarshalJSON(value []byte) error {
+	single := ""
+	if err := json.Unmarshal(value, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+
+	list := []string{}
+	if err := json.Unmarshal(value, &list); err != nil {
+		return fmt.Errorf("The 'aud' claim should be a string or a list of strings")
+	}
+
+	*aud = list
+	return nil
+}
+
+// contains returns 'true' if the audience includes any of the values
+func (aud audience) contains(values []string) bool {
+	for _, item := range aud {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetUserScopesWithClientAssertion authenticates a client with a signed JWT assertion
+// (private_key_jwt -- RFC 7523) and returns the scopeuser hierarchy, along with the
+// assertion's id and expiry so the caller can make sure it isn't replayed.  The assertion
+// has to be issued by the client about itself, be intended for one of the audiences (the
+// token endpoint), and be signed with one of the client's registered keys.  If the name
+// is blank, the client is the assertion's subject
+func (store DBManager) GetUserScopesWithClientAssertion(name, assertion string, audiences []string) (ScopeUser, ClientAssertion, error) {
+	store, end := store.startSpan("GetUserScopesWithClientAssertion")
+	defer end()
+
+	retUser := ScopeUser{}
+	retAssertion := ClientAssertion{}
+
+	//	Read the assertion (it isn't trusted until its signature is checked)
+	jws, err := jose.Parse(assertion)
+	claims := clientAssertionClaims{}
+	if err == nil {
+		err = jws.Claims(&claims)
+	}
+	if err != nil {
+		store.log().Warn("Login failed", "user", name, logging.FieldOutcome, "incorrect_assertion", "problem", err)
+		metrics.AuthFailures.WithLabelValues("incorrect_assertion").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "unreadable client assertion", nil, nil)
+		return retUser, retAssertion, fmt.Errorf("The user was not found or the client assertion was incorrect")
+	}
+
+	if name == "" {
+		name = claims.Subject
+	}
+
+	//	Find the user with the given name and see how they authenticate
+	user, err := store.systemdb.GetUserByName(name)
+	if err != nil {
+		store.log().Warn("Login failed", "user", name, logging.FieldOutcome, "unknown_user")
+		metrics.AuthFailures.WithLabelValues("unknown_user").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "unknown user", nil, nil)
+		return retUser, retAssertion, fmt.Errorf("The user was not found or the client assertion was incorrect")
+	}
+
+	auth, err := store.GetClientAuth(user.ID)
+	if err != nil {
+		return retUser, retAssertion, err
+	}
+
+	if auth.Method != AuthMethodPrivateKeyJWT {
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "wrong_method")
+		metrics.AuthFailures.WithLabelValues("wrong_method").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "client authenticates with "+auth.Method, nil, nil)
+		return retUser, retAssertion, fmt.Errorf("The user was not found or the client assertion was incorrect")
+	}
+
+	//	Check the claims and the signature
+	problem := store.checkClientAssertion(jws, claims, name, audiences, auth)
+	if problem != "" {
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_assertion", "problem", problem)
+		metrics.AuthFailures.WithLabelValues("incorrect_assertion").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, problem, nil, nil)
+		return retUser, retAssertion, fmt.Errorf("The user was not found or the client assertion was incorrect")
+	}
+
+	//	If everything checks out, get the scopeuser information and return it:
+	retUser, err = store.getUserScopes(user)
+	if err != nil {
+		return retUser, retAssertion, fmt.Errorf("Problem fetching scopes for the user: %s", err)
+	}
+	retUser.AMR = []string{AMRProofOfPossession}
+
+	store.log().Debug("Login succeeded", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "ok", "method", auth.Method)
+
+	retAssertion = ClientAssertion{ID: claims.ID, Expires: time.Unix(claims.ExpiresAt, 0).Add(clientAssertionLeeway)}
+	return retUser, retAssertion, nil
+}
+
+// checkClientAssertion checks the assertion's claims and signature, and returns the problem (if there is one)
+func (store DBManager) checkClientAssertion(jws jose.JWS, claims clientAssertionClaims, name string, audiences []string, auth ClientAuth) string {
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != name || claims.Subject != name:
+		return "assertion not issued by the client about itself"
+	case claims.Audience.contains(audiences) != true:
+		return "assertion not intended for authserver"
+	case claims.ID == "":
+		return "assertion doesn't have an id"
+	case claims.ExpiresAt == 0 || time.Unix(claims.ExpiresAt, 0).Before(now.Add(-clientAssertionLeeway)):
+		return "assertion expired"
+	case time.Unix(claims.ExpiresAt, 0).After(now.Add(maxClientAssertionLifetime)):
+		return "assertion expires too far in the future"
+	case claims.NotBefore != 0 && time.Unix(claims.NotBefore, 0).After(now.Add(clientAssertionLeeway)):
+		return "assertion not valid yet"
+	}
+
+	//	Get the client's keys, and see if one of them signed the assertion
+	keys := auth.JWKS
+	if auth.JWKSURI != "" {
+		set, err := clientKeySets.Get(store.requestContext(), auth.JWKSURI)
+		if err != nil {
+			return err.Error()
+		}
+		keys = &set
+	}
+
+	for _, key := range keys.Match(jws.Header.Kid) {
+		publicKey, err := key.PublicKey()
+		if err != nil {
+			continue
+		}
+
+		if jws.Verify(publicKey) == nil {
+			return ""
+		}
+	}
+
+	return "assertion not signed by one of the client's keys"
+}
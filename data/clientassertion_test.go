@@ -0,0 +1,288 @@
+package data_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/jose"
+	"github.com/rs/xid"
+)
+
+// testTokenEndpoint is the audience test client assertions are intended for
+const testTokenEndpoint = "https://auth.example.com/oauth/token/client"
+
+// createTestAssertion creates a client assertion for the client, signed with the key
+func createTestAssertion(t *testing.T, key *ecdsa.PrivateKey, issuer, audience string, expires time.Time) string {
+	claims := map[string]interface{}{
+		"iss": issuer,
+		"sub": issuer,
+		"aud": audience,
+		"exp": expires.Unix(),
+		"jti": xid.New().String(),
+	}
+
+	assertion, err := jose.Sign(jose.Header{Alg: "ES256", Kid: "key1"}, claims, key)
+	if err != nil {
+		t.Fatalf("Problem signing client assertion: %s", err)
+	}
+
+	return assertion
+}
+
+func TestClientAssertion_PrivateKeyJWT_OnlyValidAssertions(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+	jwk.Kid = "key1"
+
+	_, err = db.SetClientAuth(uctx, data.ClientAuth{
+		UserID:             newUser.ID,
+		Method:             data.AuthMethodPrivateKeyJWT,
+		ClientAuthSettings: data.ClientAuthSettings{JWKS: &jose.JWKSet{Keys: []jose.JWK{jwk}}},
+	})
+	if err != nil {
+		t.Errorf("SetClientAuth failed: Should have set client authentication without error: %s", err)
+	}
+
+	audiences := []string{testTokenEndpoint}
+	expires := time.Now().Add(time.Minute)
+
+	//	Act
+	scopes, assertion, validErr := db.GetUserScopesWithClientAssertion("", createTestAssertion(t, key, newUser.Name, testTokenEndpoint, expires), audiences)
+	_, _, otherKeyErr := db.GetUserScopesWithClientAssertion(newUser.Name, createTestAssertion(t, otherKey, newUser.Name, testTokenEndpoint, expires), audiences)
+	_, _, otherAudienceErr := db.GetUserScopesWithClientAssertion(newUser.Name, createTestAssertion(t, key, newUser.Name, "https://elsewhere.example.com/token", expires), audiences)
+	_, _, expiredErr := db.GetUserScopesWithClientAssertion(newUser.Name, createTestAssertion(t, key, newUser.Name, testTokenEndpoint, time.Now().Add(-time.Hour)), audiences)
+	_, _, tooLongErr := db.GetUserScopesWithClientAssertion(newUser.Name, createTestAssertion(t, key, newUser.Name, testTokenEndpoint, time.Now().Add(24*time.Hour)), audiences)
+	_, _, otherClientErr := db.GetUserScopesWithClientAssertion(uctx.Name, createTestAssertion(t, key, newUser.Name, testTokenEndpoint, expires), audiences)
+	_, secretErr := db.GetUserScopesWithCredentials(newUser.Name, "clientpassword")
+
+	//	Assert
+	if validErr != nil || scopes.ID != newUser.ID {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have authenticated with a valid assertion, but got: %v", validErr)
+	}
+
+	if assertion.ID == "" || assertion.Expires.Before(expires) {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have returned the assertion's id and expiry, but got %+v", assertion)
+	}
+
+	if otherKeyErr == nil {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have rejected an assertion signed with another key")
+	}
+
+	if otherAudienceErr == nil {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have rejected an assertion for another audience")
+	}
+
+	if expiredErr == nil || tooLongErr == nil {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have rejected expired and long-lived assertions")
+	}
+
+	if otherClientErr == nil {
+		t.Errorf("GetUserScopesWithClientAssertion failed: Should have rejected an assertion issued by another client")
+	}
+
+	if secretErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: A client that authenticates with an assertion shouldn't be able to use its secret")
+	}
+}
+
+func TestClientAssertion_SecretClient_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	//	Act
+	_, _, err = db.GetUserScopesWithClientAssertion(newUser.Name, createTestAssertion(t, key, newUser.Name, testTokenEndpoint, time.Now().Add(time.Minute)), []string{testTokenEndpoint})
+
+	//	Assert
+	if err == nil {
+		t.Errorf("GetUserScopesWithClientAssertion failed: A client that uses a secret shouldn't be able to use an assertion")
+	}
+}
+
+func TestClientAssertion_SecretPost_OnlyWhenConfigured(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, beforeErr := db.GetUserScopesWithClientSecret(newUser.Name, "clientpassword", data.AuthMethodSecretPost)
+
+	_, err = db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodSecretPost})
+	if err != nil {
+		t.Errorf("SetClientAuth failed: Should have set client authentication without error: %s", err)
+	}
+
+	_, postErr := db.GetUserScopesWithClientSecret(newUser.Name, "clientpassword", data.AuthMethodSecretPost)
+	_, basicErr := db.GetUserScopesWithCredentials(newUser.Name, "clientpassword")
+	_, wrongSecretErr := db.GetUserScopesWithClientSecret(newUser.Name, "notthepassword", data.AuthMethodSecretPost)
+
+	//	Assert
+	if beforeErr == nil {
+		t.Errorf("GetUserScopesWithClientSecret failed: Clients use client_secret_basic unless they're set up otherwise")
+	}
+
+	if postErr != nil {
+		t.Errorf("GetUserScopesWithClientSecret failed: Should have authenticated with client_secret_post, but got: %s", postErr)
+	}
+
+	if basicErr == nil || wrongSecretErr == nil {
+		t.Errorf("GetUserScopesWithClientSecret failed: Should have rejected HTTP basic auth and the wrong secret")
+	}
+}
+
+// countingHasher counts the secrets it hashes
+type countingHasher struct {
+	data.Argon2idHasher
+	hashes *int
+}
+
+func (hasher countingHasher) Hash(secret string) (string, error) {
+	*hasher.hashes++
+	return hasher.Argon2idHasher.Hash(secret)
+}
+
+func TestClientAssertion_WrongMethod_StillHashesSecret(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	hashes := 0
+	db.SetSecretHasher(countingHasher{Argon2idHasher: testArgon2idHasher, hashes: &hashes})
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	hashes = 0
+	_, wrongMethodErr := db.GetUserScopesWithClientSecret(newUser.Name, "clientpassword", data.AuthMethodSecretPost)
+
+	//	Assert
+	if wrongMethodErr == nil {
+		t.Errorf("GetUserScopesWithClientSecret failed: Clients use client_secret_basic unless they're set up otherwise")
+	}
+
+	if hashes != 1 {
+		t.Errorf("GetUserScopesWithClientSecret failed: Should have taken as long as checking the secret (1 hash), but hashed %d times", hashes)
+	}
+}
+
+func TestClientAssertion_SetClientAuth_InvalidKeys_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+	privateJWK := jwk
+	privateJWK.D = "c2VjcmV0"
+
+	//	Act
+	_, noKeysErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodPrivateKeyJWT})
+	_, httpErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodPrivateKeyJWT, ClientAuthSettings: data.ClientAuthSettings{JWKSURI: "http://client.example.com/jwks.json"}})
+	_, privateErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodPrivateKeyJWT, ClientAuthSettings: data.ClientAuthSettings{JWKS: &jose.JWKSet{Keys: []jose.JWK{privateJWK}}}})
+	_, bothErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodPrivateKeyJWT, ClientAuthSettings: data.ClientAuthSettings{JWKS: &jose.JWKSet{Keys: []jose.JWK{jwk}}, JWKSURI: "https://client.example.com/jwks.json"}})
+	_, uriErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodPrivateKeyJWT, ClientAuthSettings: data.ClientAuthSettings{JWKSURI: "https://client.example.com/jwks.json"}})
+
+	//	Assert
+	if noKeysErr == nil || httpErr == nil || privateErr == nil || bothErr == nil {
+		t.Errorf("SetClientAuth failed: Should have rejected private_key_jwt without valid keys or an https JWKS URI (got %v / %v / %v / %v)", noKeysErr, httpErr, privateErr, bothErr)
+	}
+
+	if uriErr != nil {
+		t.Errorf("SetClientAuth failed: Should have accepted an https JWKS URI, but got: %s", uriErr)
+	}
+}
@@ -0,0 +1,250 @@
+package data
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danesparza/authserver/jose"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// Client authentication methods (the token_endpoint_auth_method values from RFC 7591)
+const (
+	// AuthMethodSecretBasic is a client secret sent with HTTP basic auth (the default)
+	AuthMethodSecretBasic = "client_secret_basic"
+
+	// AuthMethodSecretPost is a client secret sent in the client_secret form value
+	AuthMethodSecretPost = "client_secret_post"
+
+	// AuthMethodPrivateKeyJWT is a JWT assertion signed with one of the client's
+	// registered keys (RFC 7523 -- see GetUserScopesWithClientAssertion)
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+
+	// AuthMethodTLSClientAuth is a client certificate issued by a trusted CA, identified
+	// by its subject DN (RFC 8705, section 2.1)
+	AuthMethodTLSClientAuth = "tls_client_auth"
+
+	// AuthMethodSelfSignedTLSClientAuth is a self-signed client certificate, identified
+	// by its thumbprint (RFC 8705, section 2.2)
+	AuthMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+)
+
+// ClientAuth is how a client (user) authenticates at the token endpoint.  Clients
+// without ClientAuth use a client secret (client_secret_basic)
+type ClientAuth struct {
+	UserID string `json:"userid"`
+	Method string `json:"method"`
+	ClientAuthSettings
+	Updated   time.Time `json:"updated"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// ClientAuthSettings are the settings for the client's authentication method
+type ClientAuthSettings struct {
+	// TLSSubjectDN is the subject DN of the client's certificate, like
+	// 'CN=client,O=Example' (tls_client_auth)
+	TLSSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+
+	// CertThumbprints are the thumbprints of the client's self-signed certificates
+	// (self_signed_tls_client_auth) -- see CertThumbprint.  There can be more than
+	// one, so a client can roll over to a new certificate
+	CertThumbprints []string `json:"x5t#S256,omitempty"`
+
+	// JWKS are the public keys the client signs its assertions with (private_key_jwt)
+	JWKS *jose.JWKSet `json:"jwks,omitempty"`
+
+	// JWKSURI is where the client publishes the public keys it signs its assertions
+	// with (private_key_jwt).  It's used instead of JWKS, and has to be https
+	JWKSURI string `json:"jwks_uri,omitempty"`
+}
+
+// CertThumbprint returns the SHA-256 thumbprint of the certificate
+// (base64url encoded, without padding -- see RFC 8705, section 3.1)
+func CertThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// validate returns an error if the method is unknown, or doesn't have the settings it needs
+func (auth ClientAuth) validate() error {
+	switch auth.Method {
+	case AuthMethodSecretBasic, AuthMethodSecretPost:
+		return nil
+	case AuthMethodTLSClientAuth:
+		if strings.TrimSpace(auth.TLSSubjectDN) == "" {
+			return fmt.Errorf("The %s method needs the subject DN of the client's certificate", auth.Method)
+		}
+	case AuthMethodSelfSignedTLSClientAuth:
+		if len(auth.CertThumbprints) == 0 {
+			return fmt.Errorf("The %s method needs the client's certificate", auth.Method)
+		}
+	case AuthMethodPrivateKeyJWT:
+		if (auth.JWKS == nil) == (auth.JWKSURI == "") {
+			return fmt.Errorf("The %s method needs either the client's public keys or its JWKS URI", auth.Method)
+		}
+
+		if auth.JWKS != nil {
+			if len(auth.JWKS.Keys) == 0 {
+				return fmt.Errorf("The %s method needs at least one of the client's public keys", auth.Method)
+			}
+
+			for _, key := range auth.JWKS.Keys {
+				if _, err := key.PublicKey(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if auth.JWKSURI != "" {
+			uri, err := url.Parse(auth.JWKSURI)
+			if err != nil || uri.Scheme != "https" || uri.Host == "" {
+				return fmt.Errorf("The client's JWKS URI should be an https URL, but got '%s'", auth.JWKSURI)
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown client authentication method '%s'", auth.Method)
+	}
+
+	return nil
+}
+
+// SetClientAuth sets how the user authenticates as a client at the token endpoint.
+// Only system admins can change it
+func (store DBManager) SetClientAuth(context User, auth ClientAuth) (ClientAuth, error) {
+	store, end := store.startSpan("SetClientAuth")
+	defer end()
+
+	//	Validate:  Does the context user have permission to make the change?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return ClientAuth{}, fmt.Errorf("User '%s' does not have permission to change client authentication", context.Name)
+	}
+
+	//	Validate:  Does the user exist, and are the settings complete?
+	if _, err := store.systemdb.GetUser(auth.UserID); err != nil {
+		return ClientAuth{}, fmt.Errorf("The user '%s' doesn't exist: %s", auth.UserID, err)
+	}
+
+	if err := auth.validate(); err != nil {
+		return ClientAuth{}, err
+	}
+
+	before, err := store.GetClientAuth(auth.UserID)
+	if err != nil {
+		return ClientAuth{}, err
+	}
+
+	//	Store the item (and get it back)
+	if err := store.systemdb.SetClientAuth(auth, context.Name); err != nil {
+		return ClientAuth{}, err
+	}
+
+	retval, err := store.GetClientAuth(auth.UserID)
+	if err != nil {
+		return retval, err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditClientAuthSet, "user", auth.UserID, auth.Method, before, retval); err != nil {
+		return retval, err
+	}
+
+	return retval, nil
+}
+
+// GetClientAuth returns how the user authenticates as a client at the token endpoint
+func (store DBManager) GetClientAuth(userID string) (ClientAuth, error) {
+	store, end := store.startSpan("GetClientAuth")
+	defer end()
+
+	retval, err := store.systemdb.GetClientAuth(userID)
+	if err != nil {
+		return retval, fmt.Errorf("Problem getting client authentication for the user: %s", err)
+	}
+
+	//	Clients that haven't been set up otherwise use a client secret
+	if retval.Method == "" {
+		retval = ClientAuth{UserID: userID, Method: AuthMethodSecretBasic}
+	}
+
+	return retval, nil
+}
+
+// GetUserScopesWithClientCertificate authenticates a client with its TLS client certificate
+// (RFC 8705) and returns the scopeuser hierarchy.  'verified' is 'true' if the certificate
+// chains to one of the trusted client CAs -- tls_client_auth clients need a verified
+// certificate with their subject DN, and self_signed_tls_client_auth clients need one
+// of their registered certificates
+func (store DBManager) GetUserScopesWithClientCertificate(name string, cert *x509.Certificate, verified bool) (ScopeUser, error) {
+	store, end := store.startSpan("GetUserScopesWithClientCertificate")
+	defer end()
+
+	retUser := ScopeUser{}
+
+	//	First, find the user with the given name and see how they authenticate
+	user, err := store.systemdb.GetUserByName(name)
+	if err != nil {
+		store.log().Warn("Login failed", "user", name, logging.FieldOutcome, "unknown_user")
+		metrics.AuthFailures.WithLabelValues("unknown_user").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "unknown user", nil, nil)
+		return retUser, err
+	}
+
+	auth, err := store.GetClientAuth(user.ID)
+	if err != nil {
+		return retUser, err
+	}
+
+	//	Check the certificate against the method
+	problem := ""
+	switch auth.Method {
+	case AuthMethodTLSClientAuth:
+		if verified == false {
+			problem = "certificate not issued by a trusted CA"
+		} else if cert.Subject.String() != auth.TLSSubjectDN {
+			problem = "certificate subject mismatch"
+		}
+	case AuthMethodSelfSignedTLSClientAuth:
+		if thumbprintRegistered(auth.CertThumbprints, CertThumbprint(cert)) == false {
+			problem = "certificate not registered"
+		}
+	default:
+		problem = "client doesn't use certificate authentication"
+	}
+
+	if problem != "" {
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_certificate", "problem", problem)
+		metrics.AuthFailures.WithLabelValues("incorrect_certificate").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, problem, nil, nil)
+		return retUser, fmt.Errorf("The user was not found or the client certificate was incorrect")
+	}
+
+	//	If everything checks out, get the scopeuser information and return it:
+	retUser, err = store.getUserScopes(user)
+	if err != nil {
+		return retUser, fmt.Errorf("Problem fetching scopes for the user: %s", err)
+	}
+	retUser.AMR = []string{AMRProofOfPossession}
+
+	store.log().Debug("Login succeeded", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "ok", "method", auth.Method)
+
+	//	Return our user:
+	return retUser, nil
+}
+
+// thumbprintRegistered returns 'true' if the thumbprint is one of the registered thumbprints
+func thumbprintRegistered(registered []string, thumbprint string) bool {
+	for _, item := range registered {
+		if subtle.ConstantTimeCompare([]byte(item), []byte(thumbprint)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,308 @@
+package data_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+// getTestCertificate creates a self-signed client certificate with the given common name
+func getTestCertificate(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Problem parsing certificate: %s", err)
+	}
+
+	return cert
+}
+
+func TestClientAuth_GetClientAuth_NotSet_ReturnsSecretBasic(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	auth, err := db.GetClientAuth(uctx.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetClientAuth failed: Should have gotten client authentication without error: %s", err)
+	}
+
+	if auth.Method != data.AuthMethodSecretBasic {
+		t.Errorf("GetClientAuth failed: Clients should use a client secret by default, but got '%s'", auth.Method)
+	}
+}
+
+func TestClientAuth_SetClientAuth_InvalidSettings_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, unknownErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: "carrier_pigeon"})
+	_, noDNErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodTLSClientAuth})
+	_, noCertErr := db.SetClientAuth(uctx, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodSelfSignedTLSClientAuth})
+	_, notAdminErr := db.SetClientAuth(newUser, data.ClientAuth{UserID: newUser.ID, Method: data.AuthMethodSecretBasic})
+
+	//	Assert
+	if unknownErr == nil {
+		t.Errorf("SetClientAuth failed: Should have rejected an unknown method")
+	}
+
+	if noDNErr == nil {
+		t.Errorf("SetClientAuth failed: Should have rejected tls_client_auth without a subject DN")
+	}
+
+	if noCertErr == nil {
+		t.Errorf("SetClientAuth failed: Should have rejected self_signed_tls_client_auth without a certificate")
+	}
+
+	if notAdminErr == nil {
+		t.Errorf("SetClientAuth failed: Should have rejected a change by a user that isn't a system admin")
+	}
+}
+
+func TestClientAuth_SelfSignedTLSClientAuth_OnlyRegisteredCertificate(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	cert := getTestCertificate(t, "TestClient1")
+	otherCert := getTestCertificate(t, "TestClient1")
+
+	_, err = db.SetClientAuth(uctx, data.ClientAuth{
+		UserID:             newUser.ID,
+		Method:             data.AuthMethodSelfSignedTLSClientAuth,
+		ClientAuthSettings: data.ClientAuthSettings{CertThumbprints: []string{data.CertThumbprint(cert)}},
+	})
+	if err != nil {
+		t.Errorf("SetClientAuth failed: Should have set client authentication without error: %s", err)
+	}
+
+	//	Act
+	scopes, certErr := db.GetUserScopesWithClientCertificate(newUser.Name, cert, false)
+	_, otherCertErr := db.GetUserScopesWithClientCertificate(newUser.Name, otherCert, false)
+	_, secretErr := db.GetUserScopesWithCredentials(newUser.Name, "clientpassword")
+
+	//	Assert
+	if certErr != nil || scopes.ID != newUser.ID {
+		t.Errorf("GetUserScopesWithClientCertificate failed: Should have authenticated with the registered certificate, but got: %v", certErr)
+	}
+
+	if otherCertErr == nil {
+		t.Errorf("GetUserScopesWithClientCertificate failed: Should have rejected a certificate that isn't registered")
+	}
+
+	if secretErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: A client that authenticates with a certificate shouldn't be able to use its secret")
+	}
+}
+
+func TestClientAuth_TLSClientAuth_NeedsVerifiedCertificateWithSubject(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	cert := getTestCertificate(t, "TestClient1")
+	otherCert := getTestCertificate(t, "SomeoneElse")
+
+	_, err = db.SetClientAuth(uctx, data.ClientAuth{
+		UserID:             newUser.ID,
+		Method:             data.AuthMethodTLSClientAuth,
+		ClientAuthSettings: data.ClientAuthSettings{TLSSubjectDN: "CN=TestClient1,O=Example"},
+	})
+	if err != nil {
+		t.Errorf("SetClientAuth failed: Should have set client authentication without error: %s", err)
+	}
+
+	//	Act
+	_, verifiedErr := db.GetUserScopesWithClientCertificate(newUser.Name, cert, true)
+	_, unverifiedErr := db.GetUserScopesWithClientCertificate(newUser.Name, cert, false)
+	_, otherSubjectErr := db.GetUserScopesWithClientCertificate(newUser.Name, otherCert, true)
+
+	//	Assert
+	if verifiedErr != nil {
+		t.Errorf("GetUserScopesWithClientCertificate failed: Should have authenticated with a verified certificate with the subject DN, but got: %s", verifiedErr)
+	}
+
+	if unverifiedErr == nil {
+		t.Errorf("GetUserScopesWithClientCertificate failed: Should have rejected a certificate that wasn't issued by a trusted CA")
+	}
+
+	if otherSubjectErr == nil {
+		t.Errorf("GetUserScopesWithClientCertificate failed: Should have rejected a certificate with a different subject DN")
+	}
+}
+
+func TestClientAuth_BackupAndRestore_KeepsClientAuthAndBindings(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestClient1"}, "clientpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	cert := getTestCertificate(t, "TestClient1")
+	confirmation := data.Confirmation{CertThumbprint: data.CertThumbprint(cert)}
+
+	_, err = db.SetClientAuth(uctx, data.ClientAuth{
+		UserID:             newUser.ID,
+		Method:             data.AuthMethodSelfSignedTLSClientAuth,
+		ClientAuthSettings: data.ClientAuthSettings{CertThumbprints: []string{confirmation.CertThumbprint}},
+	})
+	if err != nil {
+		t.Errorf("SetClientAuth failed: Should have set client authentication without error: %s", err)
+	}
+
+	token, err := db.GetNewBoundToken(newUser, 5*time.Minute, confirmation)
+	if err != nil {
+		t.Errorf("GetNewBoundToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	restoresystemdb, restoretokendb := getRestoreTestFiles()
+	defer os.Remove(restoresystemdb)
+	defer os.Remove(restoretokendb)
+
+	restoredb, err := data.NewDBManager(restoresystemdb, restoretokendb)
+	if err != nil {
+		t.Errorf("NewDBManager failed: %s", err)
+	}
+	defer restoredb.Close()
+
+	//	Act
+	backup, err := db.Backup(true)
+	if err != nil {
+		t.Fatalf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := data.WriteBackup(buffer, backup, false); err != nil {
+		t.Fatalf("WriteBackup failed: %s", err)
+	}
+
+	restored, err := data.ReadBackup(buffer)
+	if err != nil {
+		t.Fatalf("ReadBackup failed: %s", err)
+	}
+
+	err = restoredb.Restore(restored)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Restore failed: Should have restored without error: %s", err)
+	}
+
+	if _, err := restoredb.GetUserScopesWithClientCertificate(newUser.Name, cert, false); err != nil {
+		t.Errorf("Restore failed: The client should still authenticate with its certificate, but got: %s", err)
+	}
+
+	restoredToken, _, err := restoredb.IntrospectToken(token.ID)
+	if err != nil || restoredToken.Confirmation != confirmation {
+		t.Errorf("Restore failed: The token should still be bound to the certificate, but got %+v (%v)", restoredToken.Confirmation, err)
+	}
+}
@@ -0,0 +1,27 @@
+package data
+
+/* Tables */
+// auditSchema defines the schema for the audit table.  The audit table is append-only --
+// ids are assigned in order as events are added, and each event includes the hash
+// of the event before it (see sealAuditEvent)
+var auditSchema = `
+CREATE TABLE IF NOT EXISTS audit (
+	id int64 NOT NULL,
+	created time NOT NULL,
+	actor string NOT NULL,
+	action string NOT NULL,
+	targettype string,
+	targetid string,
+	ip string,
+	clientid string,
+	detail string,
+	beforevalue string,
+	aftervalue string,
+	prevhash string,
+	hash string,
+	hmac string
+);`
+
+/* Indices */
+var auditIXID = `
+CREATE UNIQUE INDEX IF NOT EXISTS AuditID ON audit (id)`
@@ -0,0 +1,18 @@
+package data
+
+/* Tables */
+// clientAuthSchema defines the schema for the client_auth table.  Each client (user)
+// that doesn't authenticate with a client secret has a row, with the settings for
+// its method stored as JSON (see ClientAuthSettings)
+var clientAuthSchema = `
+CREATE TABLE IF NOT EXISTS client_auth (
+	userid string NOT NULL,
+	method string NOT NULL,
+	settings string,
+	updated time NOT NULL,
+	updatedby string NOT NULL
+);`
+
+/* Indices */
+var clientAuthIXUserID = `
+CREATE UNIQUE INDEX IF NOT EXISTS ClientAuthUser ON client_auth (userid)`
@@ -0,0 +1,20 @@
+package data
+
+/* Tables */
+// userMFASchema defines the schema for the user_mfa table.  Each user that has set
+// up (or started setting up) a TOTP second factor has a row, with the hashes of their
+// unused recovery codes stored as JSON
+var userMFASchema = `
+CREATE TABLE IF NOT EXISTS user_mfa (
+	userid string NOT NULL,
+	secret string NOT NULL,
+	confirmed bool NOT NULL,
+	laststep int64 NOT NULL,
+	recoverycodes string,
+	updated time NOT NULL,
+	updatedby string NOT NULL
+);`
+
+/* Indices */
+var userMFAIXUserID = `
+CREATE UNIQUE INDEX IF NOT EXISTS UserMFAUser ON user_mfa (userid)`
@@ -0,0 +1,15 @@
+package data
+
+/* Tables */
+// passwordHistorySchema defines the schema for the password_history table.  Each
+// password a user has had (up to the password policy's history) has a row
+var passwordHistorySchema = `
+CREATE TABLE IF NOT EXISTS password_history (
+	userid string NOT NULL,
+	secrethash string NOT NULL,
+	created time NOT NULL
+);`
+
+/* Indices */
+var passwordHistoryIXUserID = `
+CREATE INDEX IF NOT EXISTS PasswordHistoryUser ON password_history (userid)`
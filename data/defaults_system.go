@@ -19,6 +19,14 @@ type Defaults struct {
 var BuiltIn Defaults
 
 /* Tables */
+// schemaVersionSchema defines the schema for the schema_version table (how far each
+// store has been migrated -- see migrateSchema)
+var schemaVersionSchema = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	store string NOT NULL,
+	version int NOT NULL
+);`
+
 // resourceSchema defines the schema for the resource table
 var resourceSchema = `
 CREATE TABLE IF NOT EXISTS resource (
@@ -60,7 +68,8 @@ CREATE TABLE IF NOT EXISTS user (
 	updated time NOT NULL,
 	updatedby string NOT NULL,
 	deleted time,
-	deletedby string
+	deletedby string,
+	source string
 );`
 
 // userResourceRoleSchema defines the schema for the user_resource_role table
@@ -9,7 +9,10 @@ CREATE TABLE IF NOT EXISTS tokens (
 	created time NOT NULL,
 	expires time NOT NULL,
 	deleted time,
-	deletedby string
+	deletedby string,
+	x5ts256 string,
+	jkt string,
+	amr string
 );`
 
 /* Indices */
@@ -18,3 +21,42 @@ CREATE UNIQUE INDEX IF NOT EXISTS TokenID ON tokens (token)`
 
 var tokenIXUserID = `
 CREATE INDEX IF NOT EXISTS TokenUser ON tokens (userid)`
+
+// loginAttemptsSchema defines the schema for the login_attempts table (failed logins
+// for a user name or ip address, and when they're locked out until)
+var loginAttemptsSchema = `
+CREATE TABLE IF NOT EXISTS login_attempts (
+	attemptkey string NOT NULL,
+	failures int NOT NULL,
+	lastfailure time NOT NULL,
+	lockeduntil time,
+	expires time NOT NULL
+);`
+
+var loginAttemptsIXKey = `
+CREATE UNIQUE INDEX IF NOT EXISTS LoginAttemptKey ON login_attempts (attemptkey)`
+
+// usedIDSchema defines the schema for the used_ids table (ids that can only be used once,
+// like DPoP proof and client assertion ids, kept until they'd be too old to use anyway)
+var usedIDSchema = `
+CREATE TABLE IF NOT EXISTS used_ids (
+	usedid string NOT NULL,
+	expires time NOT NULL
+);`
+
+var usedIDIXID = `
+CREATE UNIQUE INDEX IF NOT EXISTS UsedID ON used_ids (usedid)`
+
+// webauthnCeremonySchema defines the schema for the webauthn_ceremony table (WebAuthn
+// ceremonies that have been started, by their challenge, until they're finished or time out)
+var webauthnCeremonySchema = `
+CREATE TABLE IF NOT EXISTS webauthn_ceremony (
+	challenge string NOT NULL,
+	userid string,
+	registration bool,
+	passkey bool NOT NULL,
+	expires time NOT NULL
+);`
+
+var webauthnCeremonyIXChallenge = `
+CREATE UNIQUE INDEX IF NOT EXISTS WebAuthnCeremonyChallenge ON webauthn_ceremony (challenge)`
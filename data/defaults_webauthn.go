@@ -0,0 +1,27 @@
+package data
+
+/* Tables */
+// webauthnCredentialSchema defines the schema for the webauthn_credential table.  Each
+// WebAuthn credential (passkey or security key) a user has registered has a row, linked
+// to the user table by userid.  Public keys are COSE keys, base64url encoded
+var webauthnCredentialSchema = `
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+	id string NOT NULL,
+	userid string NOT NULL,
+	name string NOT NULL,
+	publickey string NOT NULL,
+	signcount int64 NOT NULL,
+	aaguid string,
+	transports string,
+	passkey bool NOT NULL,
+	created time NOT NULL,
+	createdby string NOT NULL,
+	lastused time
+);`
+
+/* Indices */
+var webauthnCredentialIXID = `
+CREATE UNIQUE INDEX IF NOT EXISTS WebAuthnCredentialID ON webauthn_credential (id)`
+
+var webauthnCredentialIXUserID = `
+CREATE INDEX IF NOT EXISTS WebAuthnCredentialUser ON webauthn_credential (userid)`
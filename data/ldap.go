@@ -0,0 +1,165 @@
+package data
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danesparza/authserver/ldap"
+)
+
+// LDAPAuthenticator checks passwords against an LDAP directory (like Active Directory or
+// OpenLDAP).  It finds the user's entry with a search (as the service account, if there is one),
+// then binds as the user with their password
+type LDAPAuthenticator struct {
+	// URL is the directory's url, like ldap://ldap.example.com or ldaps://ldap.example.com:636
+	URL string
+
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+
+	// TLS is the config for ldaps:// and StartTLS (the system roots are used if it's nil)
+	TLS *tls.Config
+
+	// BindDN and BindPassword are the service account that searches for users.  If BindDN
+	// is blank, the search is anonymous
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users are searched for
+	BaseDN string
+
+	// UserFilter finds the user's entry:  %s is replaced with their (escaped) name,
+	// like (uid=%s) or (&(objectClass=user)(sAMAccountName=%s))
+	UserFilter string
+
+	// NameAttribute is the attribute users' names come from (like uid or sAMAccountName), so
+	// however the name was typed, the user is the same one.  If it's blank, the name as it was
+	// typed is used
+	NameAttribute string
+
+	// DescriptionAttribute is the attribute new users' descriptions come from (like cn)
+	DescriptionAttribute string
+
+	// GroupAttribute is the attribute on the user's entry listing their groups (like memberOf)
+	GroupAttribute string
+
+	// GroupFilter (if it's set) finds groups the user is in with another search (under GroupBaseDN,
+	// or BaseDN if it's blank):  %s is replaced with the user's (escaped) DN, like (member=%s)
+	GroupBaseDN string
+	GroupFilter string
+
+	// Timeout is how long connecting and each request can take
+	Timeout time.Duration
+}
+
+// DefaultLDAPTimeout is used when an LDAPAuthenticator doesn't have a timeout
+var DefaultLDAPTimeout = 10 * time.Second
+
+// Authenticate finds the user in the directory, checks their password by binding as
+// them, and returns their name, description and groups
+func (directory LDAPAuthenticator) Authenticate(name, password string) (ExternalUser, error) {
+	//	Blank passwords are anonymous binds, which servers allow
+	if name == "" || password == "" {
+		return ExternalUser{}, ErrExternalLoginFailed
+	}
+
+	timeout := directory.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLDAPTimeout
+	}
+
+	conn, err := ldap.Dial(directory.URL, timeout, directory.TLS)
+	if err != nil {
+		return ExternalUser{}, err
+	}
+	defer conn.Close()
+
+	if directory.StartTLS {
+		if err := conn.StartTLS(directory.TLS); err != nil {
+			return ExternalUser{}, err
+		}
+	}
+
+	if directory.BindDN != "" {
+		if err := conn.Bind(directory.BindDN, directory.BindPassword); err != nil {
+			return ExternalUser{}, fmt.Errorf("Problem binding as the LDAP service account: %s", err)
+		}
+	}
+
+	//	Find the user's entry (there should only be one)
+	attributes := []string{}
+	for _, attribute := range []string{directory.NameAttribute, directory.DescriptionAttribute, directory.GroupAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	entries, err := conn.Search(ldap.SearchRequest{
+		BaseDN:     directory.BaseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     strings.ReplaceAll(directory.UserFilter, "%s", ldap.EscapeFilter(name)),
+		Attributes: attributes,
+		SizeLimit:  2,
+	})
+	if err != nil && ldap.IsResult(err, ldap.ResultSizeLimitExceeded) == false {
+		return ExternalUser{}, fmt.Errorf("Problem searching for the user in the directory: %s", err)
+	}
+
+	if len(entries) == 0 {
+		return ExternalUser{}, ErrExternalLoginFailed
+	}
+
+	if len(entries) > 1 {
+		return ExternalUser{}, fmt.Errorf("More than one directory entry matches the user '%s'", name)
+	}
+
+	entry := entries[0]
+	retval := ExternalUser{Name: name, Groups: []string{}}
+	if directory.NameAttribute != "" {
+		retval.Name = entry.Value(directory.NameAttribute)
+		if retval.Name == "" {
+			return ExternalUser{}, fmt.Errorf("The directory entry for the user '%s' doesn't have a %s", name, directory.NameAttribute)
+		}
+	}
+	if directory.DescriptionAttribute != "" {
+		retval.Description = entry.Value(directory.DescriptionAttribute)
+	}
+	if directory.GroupAttribute != "" {
+		retval.Groups = append(retval.Groups, entry.Values(directory.GroupAttribute)...)
+	}
+
+	//	Find the groups that list the user as a member
+	if directory.GroupFilter != "" {
+		baseDN := directory.GroupBaseDN
+		if baseDN == "" {
+			baseDN = directory.BaseDN
+		}
+
+		groups, err := conn.Search(ldap.SearchRequest{
+			BaseDN:     baseDN,
+			Scope:      ldap.ScopeWholeSubtree,
+			Filter:     strings.ReplaceAll(directory.GroupFilter, "%s", ldap.EscapeFilter(entry.DN)),
+			Attributes: []string{"1.1"}, // no attributes, just the DNs
+		})
+		if err != nil {
+			return ExternalUser{}, fmt.Errorf("Problem searching for the user's groups in the directory: %s", err)
+		}
+
+		for _, group := range groups {
+			retval.Groups = append(retval.Groups, group.DN)
+		}
+	}
+
+	//	Last, check the password by binding as the user
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsResult(err, ldap.ResultInvalidCredentials) {
+			return ExternalUser{}, ErrExternalLoginFailed
+		}
+
+		return ExternalUser{}, fmt.Errorf("Problem binding as the user: %s", err)
+	}
+
+	return retval, nil
+}
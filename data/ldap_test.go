@@ -0,0 +1,401 @@
+package data_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/ldap/ldaptest"
+)
+
+//	Starts a test directory with a couple of people and a group, and returns
+//	it along with an authenticator that uses it
+func startTestLDAP(t *testing.T) (*ldaptest.Server, data.LDAPAuthenticator) {
+	server := ldaptest.NewServer()
+	server.AddEntry("dc=example,dc=com", "")
+	server.AddEntry("cn=authserver,dc=example,dc=com", "servicepassword")
+	server.AddEntry("uid=jdoe,ou=people,dc=example,dc=com", "jdoepassword", "uid", "jdoe", "cn", "Jane Doe", "memberOf", "cn=staff,ou=groups,dc=example,dc=com")
+	server.AddEntry("uid=jsmith,ou=people,dc=example,dc=com", "jsmithpassword", "uid", "jsmith", "cn", "John Smith")
+	server.AddEntry("cn=admins,ou=groups,dc=example,dc=com", "", "cn", "admins", "member", "uid=jsmith,ou=people,dc=example,dc=com")
+
+	url, err := server.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+
+	return server, data.LDAPAuthenticator{
+		URL:                  url,
+		BindDN:               "cn=authserver,dc=example,dc=com",
+		BindPassword:         "servicepassword",
+		BaseDN:               "dc=example,dc=com",
+		UserFilter:           "(uid=%s)",
+		NameAttribute:        "uid",
+		DescriptionAttribute: "cn",
+		GroupAttribute:       "memberOf",
+		Timeout:              5 * time.Second,
+	}
+}
+
+func TestLDAP_NewUser_AddedWithGroupRoles(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newResource, _ := db.AddResource(uctx, data.Resource{Name: "TestLDAPResource1"})
+	newRole, _ := db.AddRole(uctx, data.Role{Name: "TestLDAPRole1"})
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+	db.SetGroupRoles([]data.GroupRole{{Group: "CN=Staff,OU=Groups,DC=example,DC=com", Resource: newResource.Name, Role: newRole.Name}})
+
+	//	Act
+	scopes, loginErr := db.GetUserScopesWithCredentials("jdoe", "jdoepassword")
+	users, userErr := db.GetAllUsers(uctx)
+	user := data.User{}
+	for _, found := range users {
+		if found.ID == scopes.ID {
+			user = found
+		}
+	}
+
+	server.SetAttribute("uid=jdoe,ou=people,dc=example,dc=com", "memberOf")
+	leftScopes, leftErr := db.GetUserScopesWithCredentials("jdoe", "jdoepassword")
+
+	_, changeErr := db.ChangePassword("jdoe", "jdoepassword", "", "anewpassword123")
+
+	//	Assert
+	if loginErr != nil || scopes.Name != "jdoe" {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged the directory user in, but got %+v (%v)", scopes, loginErr)
+	}
+
+	if userErr != nil || user.Description != "Jane Doe" || user.SecretHash != "" || user.CreatedBy != "directory" || user.Source != data.UserSourceDirectory {
+		t.Errorf("GetUser failed: Should have added the directory user without a password, but got %+v (%v)", user, userErr)
+	}
+
+	if len(scopes.ScopeResources) != 1 || scopes.ScopeResources[0].ID != newResource.ID || len(scopes.ScopeResources[0].ScopeRoles) != 1 || scopes.ScopeResources[0].ScopeRoles[0].ID != newRole.ID {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have given the user the role for their group, but got %+v", scopes.ScopeResources)
+	}
+
+	if leftErr != nil || leftScopes.ID != scopes.ID || len(leftScopes.ScopeResources) != 0 {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have removed the role once the user left the group, but got %+v (%v)", leftScopes, leftErr)
+	}
+
+	if changeErr == nil {
+		t.Errorf("ChangePassword failed: Should have refused to set a local password for a directory user")
+	}
+}
+
+func TestLDAP_GroupFilter_FindsGroups(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	authenticator.GroupAttribute = ""
+	authenticator.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	authenticator.GroupFilter = "(member=%s)"
+
+	//	Act
+	user, err := authenticator.Authenticate("jsmith", "jsmithpassword")
+	binds := server.BoundDNs()
+
+	//	Assert
+	if err != nil || user.Name != "jsmith" || user.Description != "John Smith" {
+		t.Errorf("Authenticate failed: Should have authenticated the user, but got %+v (%v)", user, err)
+	}
+
+	if len(user.Groups) != 1 || user.Groups[0] != "cn=admins,ou=groups,dc=example,dc=com" {
+		t.Errorf("Authenticate failed: Should have found the user's group with the group filter, but got %v", user.Groups)
+	}
+
+	if len(binds) != 2 || binds[0] != authenticator.BindDN || binds[1] != "uid=jsmith,ou=people,dc=example,dc=com" {
+		t.Errorf("Authenticate failed: Should have bound as the service account, then the user, but got %v", binds)
+	}
+}
+
+func TestLDAP_WrongPassword_CountsAsFailedLogin(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	//	Act
+	_, wrongErr := db.GetUserScopesWithCredentials("jdoe", "notthepassword")
+	_, unknownErr := db.GetUserScopesWithCredentials("nobody", "jdoepassword")
+	_, injectedErr := db.GetUserScopesWithCredentials("*", "jdoepassword")
+	attempts, _ := db.GetLoginAttempts(uctx, "user", "jdoe")
+	users, _ := db.GetAllUsers(uctx)
+
+	//	Assert
+	if wrongErr == nil || unknownErr == nil || injectedErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have turned away wrong passwords and unknown users, but got %v, %v and %v", wrongErr, unknownErr, injectedErr)
+	}
+
+	if attempts.Failures != 1 {
+		t.Errorf("GetLoginAttempts failed: Should have counted the failed directory login, but got %+v", attempts)
+	}
+
+	for _, user := range users {
+		if user.Name == "jdoe" || user.Name == "nobody" {
+			t.Errorf("GetUserScopesWithCredentials failed: Shouldn't have added a user that didn't log in, but added %+v", user)
+		}
+	}
+}
+
+func TestLDAP_LocalUser_UsesLocalPassword(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "jsmith"}, "localpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	//	Act
+	_, directoryErr := db.GetUserScopesWithCredentials("jsmith", "jsmithpassword")
+	scopes, localErr := db.GetUserScopesWithCredentials("jsmith", "localpassword")
+
+	//	Assert
+	if directoryErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have checked the local password for a user that has one")
+	}
+
+	if localErr != nil || scopes.ID != newUser.ID {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged in with the local password, but got %+v (%v)", scopes, localErr)
+	}
+
+	if len(server.BoundDNs()) != 0 {
+		t.Errorf("GetUserScopesWithCredentials failed: Shouldn't have used the directory, but bound %v", server.BoundDNs())
+	}
+}
+
+func TestLDAP_PasswordlessLocalUser_NotTakenOver(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	A local user without a password (and one that claims to be from the directory)
+	_, err = db.AddUserWithSecretHash(uctx, data.User{Name: "jdoe"})
+	if err != nil {
+		t.Errorf("AddUserWithSecretHash failed: Should have added an item without error: %s", err)
+	}
+
+	claimed, err := db.AddUserWithSecretHash(uctx, data.User{Name: "jsmith", Source: data.UserSourceDirectory})
+	if err != nil {
+		t.Errorf("AddUserWithSecretHash failed: Should have added an item without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	//	Act
+	_, localErr := db.GetUserScopesWithCredentials("jdoe", "jdoepassword")
+	_, claimedErr := db.GetUserScopesWithCredentials("jsmith", "jsmithpassword")
+
+	//	Assert
+	if localErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Shouldn't have logged a local user in with the directory")
+	}
+
+	if claimed.Source != "" || claimedErr == nil {
+		t.Errorf("AddUserWithSecretHash failed: Should have added a local user, but got %+v (logged in with the directory: %v)", claimed, claimedErr == nil)
+	}
+}
+
+func TestLDAP_NameAttribute_SameUserHoweverTyped(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	//	Act
+	upper, upperErr := db.GetUserScopesWithCredentials("JDoe", "jdoepassword")
+	lower, lowerErr := db.GetUserScopesWithCredentials("jdoe", "jdoepassword")
+	users, _ := db.GetAllUsers(uctx)
+
+	//	Assert
+	if upperErr != nil || lowerErr != nil || upper.ID != lower.ID || upper.Name != "jdoe" {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged in the same user with the directory's name, but got %+v and %+v (%v, %v)", upper, lower, upperErr, lowerErr)
+	}
+
+	if len(users) != 2 {
+		t.Errorf("GetAllUsers failed: Should have added one directory user, but got %v users", len(users))
+	}
+}
+
+func TestLDAP_DirectoryUser_CantRegisterPasskey(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	_, _, err = db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	scopes, err := db.GetUserScopesWithCredentials("jdoe", "jdoepassword")
+	if err != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged the directory user in: %s", err)
+	}
+	user := data.User{ID: scopes.ID, Name: scopes.Name}
+
+	//	Act
+	_, _, passkeyErr := db.BeginWebAuthnRegistration(user, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, true)
+	_, _, securityKeyErr := db.BeginWebAuthnRegistration(user, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, false)
+
+	//	Assert
+	if passkeyErr == nil {
+		t.Errorf("BeginWebAuthnRegistration failed: Shouldn't have let a directory user register a passkey")
+	}
+
+	if securityKeyErr != nil {
+		t.Errorf("BeginWebAuthnRegistration failed: Should have let a directory user register a security key: %s", securityKeyErr)
+	}
+}
+
+func TestLDAP_DirectoryUser_KeptByStateImport(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	server, authenticator := startTestLDAP(t)
+	defer server.Close()
+	db.SetAuthenticator(authenticator)
+
+	if _, err := db.GetUserScopesWithCredentials("jdoe", "jdoepassword"); err != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged the directory user in: %s", err)
+	}
+
+	//	Act
+	state, exportErr := db.ExportState(uctx, true)
+	state.Users = append(state.Users, data.StateUser{Name: "jsmith", Source: data.UserSourceDirectory})
+	_, applyErr := db.ApplyState(uctx, state)
+	_, loginErr := db.GetUserScopesWithCredentials("jsmith", "jsmithpassword")
+	plan, planErr := db.PlanState(uctx, state)
+
+	state.Users = append(state.Users, data.StateUser{Name: "jroe", Source: data.UserSourceDirectory, SecretHash: secretHashFor(t, db, uctx, uctx.ID)})
+	_, secretErr := db.PlanState(uctx, state)
+
+	//	Assert
+	if exportErr != nil || len(state.Users) == 0 || state.Users[0].Name != "jdoe" || state.Users[0].Source != data.UserSourceDirectory {
+		t.Errorf("ExportState failed: Should have exported the directory user with their source, but got %+v (%v)", state.Users, exportErr)
+	}
+
+	if applyErr != nil || loginErr != nil {
+		t.Errorf("ApplyState failed: Should have added a directory user that logs in with the directory, but got %v / %v", applyErr, loginErr)
+	}
+
+	if planErr != nil || len(plan) != 0 {
+		t.Errorf("PlanState failed: Should have planned no changes after applying, but got %+v (%v)", plan, planErr)
+	}
+
+	if secretErr == nil {
+		t.Errorf("PlanState failed: Shouldn't have accepted a directory user with a secret hash")
+	}
+}
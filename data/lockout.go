@@ -0,0 +1,282 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/danesparza/authserver/metrics"
+)
+
+// LockoutPolicy is how failed logins are throttled.  Each failed login is delayed (longer for
+// each failure in a row), and a user name or source ip address is locked out for a while after
+// too many failures.  Failures are tracked by user name (not id), so names that don't exist are
+// throttled and locked out the same way -- the responses don't tell an attacker which names exist
+type LockoutPolicy struct {
+	// UserThreshold is how many failed logins for a user name lock it out (0 never locks user names out)
+	UserThreshold int
+
+	// IPThreshold is how many failed logins from an ip address lock it out (0 never locks ip addresses out).
+	// Behind a proxy, it needs the client's address (see logging.ForwardedFor) -- otherwise every
+	// login comes from the proxy, and one client guessing locks everyone out
+	IPThreshold int
+
+	// Window is how long failed logins are remembered after the last one
+	Window time.Duration
+
+	// Duration is how long a lockout lasts
+	Duration time.Duration
+
+	// Delay is how long the response to the first failed login is delayed.  It doubles
+	// for each failure after that, up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultLockoutPolicy is the lockout policy used unless another one is set (see SetLockoutPolicy).
+// It doesn't lock out ip addresses
+var DefaultLockoutPolicy = LockoutPolicy{
+	UserThreshold: 5,
+	IPThreshold:   0,
+	Window:        15 * time.Minute,
+	Duration:      15 * time.Minute,
+	Delay:         100 * time.Millisecond,
+	MaxDelay:      5 * time.Second,
+}
+
+// delay returns how long to delay the response to a failed login, after the given number of failures
+func (policy LockoutPolicy) delay(failures int) time.Duration {
+	retval := policy.Delay
+	for i := 1; i < failures && retval < policy.MaxDelay; i++ {
+		retval *= 2
+	}
+
+	if policy.MaxDelay > 0 && retval > policy.MaxDelay {
+		retval = policy.MaxDelay
+	}
+
+	return retval
+}
+
+// LoginAttempts are the recent failed logins for a user name or ip address
+type LoginAttempts struct {
+	// Key is what the failed logins are for -- 'user:<name>' or 'ip:<address>'
+	Key string `json:"key"`
+
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+
+	// LockedUntil is when the lockout ends (zero if the key hasn't been locked out)
+	LockedUntil time.Time `json:"locked_until"`
+
+	// Expires is when the failed logins are forgotten
+	Expires time.Time `json:"expires"`
+}
+
+// Locked returns 'true' if the key is locked out
+func (attempts LoginAttempts) Locked() bool {
+	return attempts.LockedUntil.After(time.Now())
+}
+
+// withFailure returns the attempts with another failure at 'now'.  They're
+// remembered for the window after it (or until the lockout ends, if that's later)
+func (attempts LoginAttempts) withFailure(now time.Time, window time.Duration) LoginAttempts {
+	attempts.Failures++
+	attempts.LastFailure = now
+	attempts.Expires = now.Add(window)
+	if attempts.LockedUntil.After(attempts.Expires) {
+		attempts.Expires = attempts.LockedUntil
+	}
+
+	return attempts
+}
+
+// withLock returns the attempts locked out until the given time
+func (attempts LoginAttempts) withLock(until time.Time) LoginAttempts {
+	attempts.LockedUntil = until
+	if until.After(attempts.Expires) {
+		attempts.Expires = until
+	}
+
+	return attempts
+}
+
+// loginAttemptKey returns the key login attempts are tracked by for a
+// target type ('user' for a user name, or 'ip' for an ip address)
+func loginAttemptKey(targetType, target string) string {
+	return targetType + ":" + target
+}
+
+// hashDummySecret hashes the secret when a user doesn't exist, so a failed login takes
+// about as long whether or not the user name exists
+func (store DBManager) hashDummySecret(secret string) {
+	store.hasher.Hash(secret)
+}
+
+// SetLockoutPolicy sets how failed logins are throttled and locked out
+func (store *DBManager) SetLockoutPolicy(policy LockoutPolicy) {
+	store.lockout = policy
+}
+
+// lockedOut returns 'true' if the user name (or the ip address the login is coming from) is locked out
+func (store DBManager) lockedOut(name string) bool {
+	keys := []string{loginAttemptKey("user", name)}
+	if store.source.ip != "" {
+		keys = append(keys, loginAttemptKey("ip", store.source.ip))
+	}
+
+	for _, key := range keys {
+		attempts, err := store.tokendb.GetLoginAttempts(key)
+		if err != nil {
+			//	Don't turn everyone away if the token store is having problems
+			store.log().Error("Problem checking for a lockout", "key", key, "error", err)
+			continue
+		}
+
+		if attempts.Locked() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loginFailed records a failed login for the user name (and the ip address it came from),
+// locks them out if they've reached the policy's thresholds, and then delays the response.
+// 'userID' is blank if the user doesn't exist
+func (store DBManager) loginFailed(name, userID string) {
+	policy := store.lockout
+
+	//	If the failure can't be recorded, we don't know how many there have been -- so use the longest delay
+	delay := policy.MaxDelay
+	if delay == 0 {
+		delay = policy.Delay
+	}
+
+	userAttempts, err := store.tokendb.AddLoginFailure(loginAttemptKey("user", name), policy.Window)
+	if err != nil {
+		store.log().Error("Problem recording a failed login", "user", name, "error", err)
+	} else {
+		delay = policy.delay(userAttempts.Failures)
+		if policy.UserThreshold > 0 && userAttempts.Failures >= policy.UserThreshold && userAttempts.Locked() != true {
+			store.lockOut(name, "user", userID, userAttempts)
+		}
+	}
+
+	if store.source.ip != "" {
+		ipAttempts, err := store.tokendb.AddLoginFailure(loginAttemptKey("ip", store.source.ip), policy.Window)
+		if err != nil {
+			store.log().Error("Problem recording a failed login", "ip", store.source.ip, "error", err)
+		} else if policy.IPThreshold > 0 && ipAttempts.Failures >= policy.IPThreshold && ipAttempts.Locked() != true {
+			store.lockOut(name, "ip", store.source.ip, ipAttempts)
+		}
+	}
+
+	//	Slow down whoever is guessing (unless they give up on the request)
+	select {
+	case <-time.After(delay):
+	case <-store.requestContext().Done():
+	}
+}
+
+// lockOut locks out the login attempts' key for the policy's duration.  'name' is the
+// user name of the login that tipped it over the threshold
+func (store DBManager) lockOut(name, targetType, targetID string, attempts LoginAttempts) {
+	until := time.Now().Add(store.lockout.Duration)
+	if err := store.tokendb.LockLogins(attempts.Key, until); err != nil {
+		store.log().Error("Problem locking out logins", "key", attempts.Key, "error", err)
+		return
+	}
+
+	store.log().Warn("Logins locked out", "user", name, "key", attempts.Key, "failures", attempts.Failures, "until", until.UTC().Format(time.RFC3339))
+	metrics.Lockouts.WithLabelValues(targetType).Inc()
+	store.audit(name, AuditLoginLockout, targetType, targetID, fmt.Sprintf("%s locked out until %s after %v failed logins", attempts.Key, until.UTC().Format(time.RFC3339), attempts.Failures), nil, nil)
+}
+
+// loginSucceeded forgets the failed logins for the user name.  Failures from the ip address
+// are still remembered, so one good login doesn't reset the count for someone guessing others
+func (store DBManager) loginSucceeded(name string) {
+	key := loginAttemptKey("user", name)
+
+	//	Most logins don't follow a failure, so there's usually nothing to forget
+	attempts, err := store.tokendb.GetLoginAttempts(key)
+	if err == nil && attempts.Failures == 0 {
+		return
+	}
+
+	if err := store.tokendb.ResetLoginAttempts(key); err != nil {
+		store.log().Error("Problem resetting failed logins", "user", name, "error", err)
+	}
+}
+
+// GetLoginAttempts returns the recent failed logins (and any lockout) for a user name or an
+// ip address -- the target type is 'user' or 'ip'.  Only system admins can see login attempts
+func (store DBManager) GetLoginAttempts(context User, targetType, target string) (LoginAttempts, error) {
+	store, end := store.startSpan("GetLoginAttempts")
+	defer end()
+
+	retval := LoginAttempts{}
+
+	//	Validate:  Does the context user have permission to see login attempts?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return retval, fmt.Errorf("User '%s' does not have permission to see login attempts", context.Name)
+	}
+
+	if err := validateLockoutTarget(targetType, target); err != nil {
+		return retval, err
+	}
+
+	return store.tokendb.GetLoginAttempts(loginAttemptKey(targetType, target))
+}
+
+// UnlockLogins ends the lockout for a user name or an ip address (and forgets its failed
+// logins) -- the target type is 'user' or 'ip'.  Only system admins can unlock logins
+func (store DBManager) UnlockLogins(context User, targetType, target string) error {
+	store, end := store.startSpan("UnlockLogins")
+	defer end()
+
+	//	Validate:  Does the context user have permission to unlock logins?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return fmt.Errorf("User '%s' does not have permission to unlock logins", context.Name)
+	}
+
+	if err := validateLockoutTarget(targetType, target); err != nil {
+		return err
+	}
+
+	key := loginAttemptKey(targetType, target)
+	before, err := store.tokendb.GetLoginAttempts(key)
+	if err != nil {
+		return err
+	}
+
+	if err := store.tokendb.ResetLoginAttempts(key); err != nil {
+		return err
+	}
+
+	//	Audit user unlocks by the user's id, if there is one
+	targetID := target
+	if targetType == "user" {
+		if user, err := store.systemdb.GetUserByName(target); err == nil {
+			targetID = user.ID
+		}
+	}
+
+	if err := store.audit(context.Name, AuditLoginUnlock, targetType, targetID, key, before, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateLockoutTarget returns an error if the target type isn't 'user' or 'ip', or the target is blank
+func validateLockoutTarget(targetType, target string) error {
+	if targetType != "user" && targetType != "ip" {
+		return fmt.Errorf("Logins are locked out by 'user' or 'ip', not '%s'", targetType)
+	}
+
+	if target == "" {
+		return fmt.Errorf("The %s can't be blank", targetType)
+	}
+
+	return nil
+}
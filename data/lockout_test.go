@@ -0,0 +1,280 @@
+package data_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+//	A lockout policy for tests:  lock out after 3 failures, without delaying failed logins
+var testLockoutPolicy = data.LockoutPolicy{
+	UserThreshold: 3,
+	IPThreshold:   5,
+	Window:        time.Minute,
+	Duration:      time.Minute,
+}
+
+func TestLockout_TooManyFailures_LocksOutUntilUnlocked(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestLockout1"}, "lockoutpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	for i := 0; i < testLockoutPolicy.UserThreshold; i++ {
+		db.GetUserScopesWithCredentials(newUser.Name, "notthepassword")
+	}
+
+	_, lockedErr := db.GetUserScopesWithCredentials(newUser.Name, "lockoutpassword")
+	attempts, attemptsErr := db.GetLoginAttempts(uctx, "user", newUser.Name)
+	unlockErr := db.UnlockLogins(uctx, "user", newUser.Name)
+	scopes, unlockedErr := db.GetUserScopesWithCredentials(newUser.Name, "lockoutpassword")
+
+	//	Assert
+	if lockedErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have turned away a locked out user, even with the right password")
+	}
+
+	if attemptsErr != nil || attempts.Failures != testLockoutPolicy.UserThreshold || attempts.Locked() != true {
+		t.Errorf("GetLoginAttempts failed: Should have gotten the failures and lockout, but got %+v (%v)", attempts, attemptsErr)
+	}
+
+	if unlockErr != nil {
+		t.Errorf("UnlockLogins failed: Should have unlocked the user without error: %s", unlockErr)
+	}
+
+	if unlockedErr != nil || scopes.ID != newUser.ID {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged in once unlocked, but got: %v", unlockedErr)
+	}
+}
+
+func TestLockout_UnknownUser_SameResponseAsWrongPassword(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestLockout1"}, "lockoutpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, wrongPasswordErr := db.GetUserScopesWithCredentials(newUser.Name, "notthepassword")
+	_, unknownUserErr := db.GetUserScopesWithCredentials("NoSuchUser", "notthepassword")
+
+	for i := 1; i < testLockoutPolicy.UserThreshold; i++ {
+		db.GetUserScopesWithCredentials("NoSuchUser", "notthepassword")
+	}
+	attempts, attemptsErr := db.GetLoginAttempts(uctx, "user", "NoSuchUser")
+
+	//	Assert
+	if wrongPasswordErr == nil || unknownUserErr == nil || wrongPasswordErr.Error() != unknownUserErr.Error() {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have failed the same way for an unknown user and a wrong password, but got '%v' and '%v'", unknownUserErr, wrongPasswordErr)
+	}
+
+	if attemptsErr != nil || attempts.Locked() != true {
+		t.Errorf("GetLoginAttempts failed: Unknown user names should be locked out too, but got %+v (%v)", attempts, attemptsErr)
+	}
+}
+
+func TestLockout_TooManyFailuresFromIP_LocksOutIP(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestLockout1"}, "lockoutpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	guesser := db.From("10.0.0.1", "")
+	other := db.From("10.0.0.2", "")
+
+	//	Act -- guess at a different name each time, so no user name is locked out
+	for i := 0; i < testLockoutPolicy.IPThreshold; i++ {
+		guesser.GetUserScopesWithCredentials(fmt.Sprintf("Guess%v", i), "notthepassword")
+	}
+
+	_, guesserErr := guesser.GetUserScopesWithCredentials(newUser.Name, "lockoutpassword")
+	_, otherErr := other.GetUserScopesWithCredentials(newUser.Name, "lockoutpassword")
+	unlockErr := db.UnlockLogins(uctx, "ip", "10.0.0.1")
+	_, unlockedErr := guesser.GetUserScopesWithCredentials(newUser.Name, "lockoutpassword")
+
+	//	Assert
+	if guesserErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have turned away a locked out ip address")
+	}
+
+	if otherErr != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Other ip addresses shouldn't be locked out, but got: %s", otherErr)
+	}
+
+	if unlockErr != nil || unlockedErr != nil {
+		t.Errorf("UnlockLogins failed: Should have unlocked the ip address, but got: %v / %v", unlockErr, unlockedErr)
+	}
+}
+
+func TestLockout_FailedLogin_IsDelayed(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	policy := testLockoutPolicy
+	policy.Delay = 50 * time.Millisecond
+	policy.MaxDelay = 100 * time.Millisecond
+	db.SetLockoutPolicy(policy)
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	started := time.Now()
+	db.GetUserScopesWithCredentials("NoSuchUser", "notthepassword")
+	first := time.Since(started)
+
+	started = time.Now()
+	db.GetUserScopesWithCredentials("NoSuchUser", "notthepassword")
+	second := time.Since(started)
+
+	//	Assert
+	if first < policy.Delay {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have delayed the first failure at least %s, but took %s", policy.Delay, first)
+	}
+
+	if second < 2*policy.Delay {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have doubled the delay for the second failure, but took %s", second)
+	}
+}
+
+func TestLockout_NonAdmin_CantUnlock(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestLockout1"}, "lockoutpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	unlockErr := db.UnlockLogins(newUser, "user", newUser.Name)
+	_, attemptsErr := db.GetLoginAttempts(newUser, "user", newUser.Name)
+	badTypeErr := db.UnlockLogins(uctx, "role", newUser.Name)
+
+	//	Assert
+	if unlockErr == nil || attemptsErr == nil {
+		t.Errorf("UnlockLogins failed: Only system admins should be able to see and unlock login attempts")
+	}
+
+	if badTypeErr == nil {
+		t.Errorf("UnlockLogins failed: Should have rejected a target type other than 'user' or 'ip'")
+	}
+}
+
+func TestLockout_ConcurrentFailures_AreAllCounted(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	policy := testLockoutPolicy
+	policy.UserThreshold = 0
+	db.SetLockoutPolicy(policy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	failures := 10
+	wg := sync.WaitGroup{}
+	for i := 0; i < failures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.GetUserScopesWithCredentials("NoSuchUser", "notthepassword")
+		}()
+	}
+	wg.Wait()
+
+	attempts, err := db.GetLoginAttempts(uctx, "user", "NoSuchUser")
+
+	//	Assert
+	if err != nil || attempts.Failures != failures {
+		t.Errorf("GetLoginAttempts failed: Should have counted all %v failures, but got %+v (%v)", failures, attempts, err)
+	}
+}
@@ -0,0 +1,446 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// Authentication methods (the 'amr' values from RFC 8176)
+const (
+	// AMRPassword is a password (or client secret)
+	AMRPassword = "pwd"
+
+	// AMROneTimePassword is a TOTP code (RFC 6238)
+	AMROneTimePassword = "otp"
+
+	// AMRMultiFactor is more than one factor:  a password and a TOTP code or a recovery code
+	AMRMultiFactor = "mfa"
+
+	// AMRHardwareKey is a WebAuthn credential:  a security key or passkey
+	AMRHardwareKey = "hwk"
+
+	// AMRProofOfPossession is proof of possession of a key:  a client certificate or
+	// a client assertion signed with the client's key
+	AMRProofOfPossession = "pop"
+)
+
+// TOTP settings:  6 digit codes that change every 30 seconds (the authenticator app
+// defaults), accepting a code from one step before or after the current one for clock skew
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+
+	// How many recovery codes a user gets, and how long they are (in base32 characters)
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// ErrMFARequired is returned when a user with a second factor logs in without a code
+var ErrMFARequired = errors.New("A one-time code is required -- pass the code from your authenticator app (or a recovery code) in the 'otp' form value")
+
+// UserMFA is a user's TOTP second factor (RFC 6238).  It isn't used to log in until
+// it's been confirmed with a code from the user's authenticator app (see ConfirmTOTP)
+type UserMFA struct {
+	UserID string `json:"userid"`
+
+	// Secret is the TOTP key (base32 encoded, without padding)
+	Secret string `json:"secret"`
+
+	// Confirmed is 'true' once the user has proven their authenticator app has the secret
+	Confirmed bool `json:"confirmed"`
+
+	// LastStep is the time step of the last code used, so codes can't be used twice
+	LastStep int64 `json:"last_step"`
+
+	// RecoveryCodes are the hashes of the user's unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	Updated   time.Time `json:"updated"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// TOTPEnrollment is what a user's authenticator app needs to generate their codes.  The
+// provisioning URI is usually shown as a QR code, and the secret can be typed in instead
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// Enabled returns 'true' if the user has a confirmed second factor (so they need it to log in)
+func (mfa UserMFA) Enabled() bool {
+	return mfa.Confirmed && mfa.Secret != ""
+}
+
+// totpCode returns the TOTP code for a key and time step (the HOTP algorithm -- RFC 4226, section 5)
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// checkTOTP returns the time step of the code if it's valid at the passed time (and newer
+// than the last code used), and 'false' if it isn't
+func (mfa UserMFA) checkTOTP(code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(mfa.Secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > mfa.LastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// normalizeRecoveryCode removes the dashes and spaces people type in recovery codes
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes generates a set of recovery codes, and returns them (to show the user
+// once) along with their hashes (to store)
+func (store DBManager) newRecoveryCodes() ([]string, []string, error) {
+	codes, hashes := []string{}, []string{}
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		random := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, fmt.Errorf("Problem generating recovery codes: %s", err)
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(random))[:recoveryCodeLength]
+		hash, err := store.hasher.Hash(code)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Problem hashing recovery codes: %s", err)
+		}
+
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hash)
+	}
+
+	return codes, hashes, nil
+}
+
+// SetTOTPIssuer sets the issuer shown next to users' codes in their authenticator apps
+func (store *DBManager) SetTOTPIssuer(issuer string) {
+	store.totpIssuer = issuer
+}
+
+// EnrollTOTP starts setting up a TOTP second factor for a user (who has to supply their
+// password), and returns what their authenticator app needs.  It isn't used to log in until
+// it's confirmed (see ConfirmTOTP).  Users that already have a second factor (a TOTP code or
+// a security key) have to have it reset or removed first (see ResetMFA)
+func (store DBManager) EnrollTOTP(name, secret string) (TOTPEnrollment, error) {
+	store, end := store.startSpan("EnrollTOTP")
+	defer end()
+
+	user, err := store.checkUserSecret(name, secret, "mfa enrollment")
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	existing, err := store.systemdb.GetUserMFA(user.ID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	if existing.Enabled() {
+		return TOTPEnrollment{}, fmt.Errorf("User '%s' already has a second factor -- it has to be reset before a new one is set up", name)
+	}
+
+	//	A password and a TOTP code can't stand in for a security key
+	if err := store.noSecurityKey(user); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	store.loginSucceeded(name)
+
+	//	Generate the key (160 bits, the size RFC 4226 recommends)
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("Problem generating a TOTP secret: %s", err)
+	}
+
+	mfa := UserMFA{
+		UserID: user.ID,
+		Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key),
+	}
+	if err := store.systemdb.SetUserMFA(mfa, name); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	//	The provisioning URI (https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+	issuer := store.totpIssuer
+	if issuer == "" {
+		issuer = "authserver"
+	}
+
+	query := url.Values{}
+	query.Set("secret", mfa.Secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%v", totpDigits))
+	query.Set("period", fmt.Sprintf("%v", totpPeriod))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + user.Name,
+		RawQuery: query.Encode(),
+	}
+
+	return TOTPEnrollment{Secret: mfa.Secret, URI: uri.String()}, nil
+}
+
+// ConfirmTOTP finishes setting up a user's TOTP second factor with a code from their authenticator
+// app (and their password).  It returns the user's recovery codes -- they're only shown this once
+func (store DBManager) ConfirmTOTP(name, secret, code string) ([]string, error) {
+	store, end := store.startSpan("ConfirmTOTP")
+	defer end()
+
+	user, err := store.checkUserSecret(name, secret, "mfa enrollment")
+	if err != nil {
+		return nil, err
+	}
+
+	mfa, err := store.systemdb.GetUserMFA(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mfa.Secret == "" || mfa.Confirmed {
+		return nil, fmt.Errorf("User '%s' isn't setting up a second factor", name)
+	}
+
+	//	They might have registered a security key since they started
+	if err := store.noSecurityKey(user); err != nil {
+		return nil, err
+	}
+
+	//	A wrong code counts as a failed login, the same as it does when logging in
+	step, ok := mfa.checkTOTP(code, time.Now())
+	if ok != true {
+		store.log().Warn("TOTP enrollment failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_otp")
+		metrics.AuthFailures.WithLabelValues("incorrect_otp").Inc()
+		store.audit(user.Name, AuditLoginFailed, "user", user.ID, "incorrect one-time code", nil, nil)
+		store.loginFailed(user.Name, user.ID)
+		return nil, fmt.Errorf("The code is incorrect -- check the time on the device with your authenticator app")
+	}
+	store.loginSucceeded(name)
+
+	codes, hashes, err := store.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	mfa.Confirmed = true
+	mfa.LastStep = step
+	mfa.RecoveryCodes = hashes
+	if err := store.systemdb.SetUserMFA(mfa, name); err != nil {
+		return nil, err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(name, AuditUserMFAEnroll, "user", user.ID, "totp", nil, nil); err != nil {
+		return codes, err
+	}
+
+	return codes, nil
+}
+
+// noSecurityKey returns an error if the user has a security key, so they can't set up a TOTP
+// second factor with just their password and use it to log in without the key
+func (store DBManager) noSecurityKey(user User) error {
+	securityKey, err := store.hasSecurityKey(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if securityKey {
+		store.log().Warn("TOTP enrollment refused", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "security_key_required")
+		return fmt.Errorf("User '%s' already has a security key -- it has to be removed before a TOTP second factor is set up", user.Name)
+	}
+
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes with new ones.  The user has to
+// supply their password and a one-time code (from their authenticator app, or a recovery code)
+func (store DBManager) RegenerateRecoveryCodes(name, secret, code string) ([]string, error) {
+	store, end := store.startSpan("RegenerateRecoveryCodes")
+	defer end()
+
+	user, err := store.checkUserSecret(name, secret, "recovery codes")
+	if err != nil {
+		return nil, err
+	}
+
+	mfa, err := store.systemdb.GetUserMFA(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mfa.Enabled() == false {
+		return nil, fmt.Errorf("User '%s' doesn't have a second factor", name)
+	}
+
+	if _, err := store.checkSecondFactor(user, code); err != nil {
+		return nil, err
+	}
+	store.loginSucceeded(name)
+
+	codes, hashes, err := store.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	//	Get it again, with the code that was just used
+	mfa, err = store.systemdb.GetUserMFA(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	mfa.RecoveryCodes = hashes
+	if err := store.systemdb.SetUserMFA(mfa, name); err != nil {
+		return nil, err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(name, AuditUserMFARecovery, "user", user.ID, "", nil, nil); err != nil {
+		return codes, err
+	}
+
+	return codes, nil
+}
+
+// ResetMFA removes a user's second factor (and recovery codes), so they can log in with just
+// their password and set up a new one.  Only system admins and resource delegates can reset
+// it, and only system admins can reset a system admin's
+func (store DBManager) ResetMFA(context User, userID string) error {
+	store, end := store.startSpan("ResetMFA")
+	defer end()
+
+	//	Validate:  Does the context user have permission to make the change?
+	if store.userCanManage(context.ID, userID) == false {
+		return fmt.Errorf("User '%s' does not have permission to reset the user's second factors", context.Name)
+	}
+
+	user, err := store.getUserForUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := store.systemdb.DeleteUserMFA(user.ID); err != nil {
+		return err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditUserMFAReset, "user", user.ID, "", nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkSecondFactor checks the code a user logged in with (after their password), and returns
+// the ways they authenticated.  Users without a second factor don't need a code.  Codes can be
+// a TOTP code or one of the user's recovery codes (which can only be used once).  Users with a
+// security key have to log in with it (see GetUserScopesWithWebAuthn), even if they also have TOTP
+func (store DBManager) checkSecondFactor(user User, code string) ([]string, error) {
+	//	A security key can't be skipped with a code
+	securityKey, err := store.hasSecurityKey(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if securityKey {
+		store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "security_key_required")
+		metrics.AuthFailures.WithLabelValues("security_key_required").Inc()
+		return nil, ErrSecurityKeyRequired
+	}
+
+	mfa, err := store.systemdb.GetUserMFA(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mfa.Enabled() == false {
+		return []string{AMRPassword}, nil
+	}
+
+	if code == "" {
+		store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "mfa_required")
+		metrics.AuthFailures.WithLabelValues("mfa_required").Inc()
+		return nil, ErrMFARequired
+	}
+
+	//	A TOTP code.  Codes are only used once:  if someone else used a code at
+	//	the same time, the code (or one after it) has already been used
+	if step, ok := mfa.checkTOTP(code, time.Now()); ok {
+		used := mfa
+		used.LastStep = step
+		replaced, err := store.systemdb.ReplaceUserMFA(mfa, used, user.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if replaced {
+			return []string{AMRPassword, AMROneTimePassword, AMRMultiFactor}, nil
+		}
+	}
+
+	//	A recovery code (which is also only used once)
+	recoveryCode := normalizeRecoveryCode(code)
+	for i, hash := range mfa.RecoveryCodes {
+		if len(recoveryCode) != recoveryCodeLength || verifySecret(hash, recoveryCode) != nil {
+			continue
+		}
+
+		used := mfa
+		used.RecoveryCodes = append(mfa.RecoveryCodes[:i:i], mfa.RecoveryCodes[i+1:]...)
+		replaced, err := store.systemdb.ReplaceUserMFA(mfa, used, user.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if replaced == false {
+			break
+		}
+
+		store.log().Warn("Recovery code used", "user", user.Name, logging.FieldUserID, user.ID, "remaining", len(used.RecoveryCodes))
+		store.audit(user.Name, AuditUserMFARecoveryUse, "user", user.ID, fmt.Sprintf("%v recovery codes left", len(used.RecoveryCodes)), nil, nil)
+
+		return []string{AMRPassword, AMRMultiFactor}, nil
+	}
+
+	store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_otp")
+	metrics.AuthFailures.WithLabelValues("incorrect_otp").Inc()
+	store.audit(user.Name, AuditLoginFailed, "user", user.ID, "incorrect one-time code", nil, nil)
+	store.loginFailed(user.Name, user.ID)
+	return nil, fmt.Errorf("The one-time code is incorrect")
+}
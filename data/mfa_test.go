@@ -0,0 +1,463 @@
+package data_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+//	Returns the TOTP code (RFC 6238) for a secret at a time step
+func totpCodeFor(t *testing.T, secret string, step int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Errorf("Decoding the TOTP secret failed: %s", err)
+	}
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+//	Sets up a TOTP second factor for a user, and returns its secret, the time step of the
+//	code it was confirmed with and the recovery codes
+func enrollTestTOTP(t *testing.T, db *data.DBManager, name, password string) (string, int64, []string) {
+	enrollment, err := db.EnrollTOTP(name, password)
+	if err != nil {
+		t.Errorf("EnrollTOTP failed: Should have started enrollment without error: %s", err)
+	}
+
+	step := time.Now().Unix() / 30
+	codes, err := db.ConfirmTOTP(name, password, totpCodeFor(t, enrollment.Secret, step))
+	if err != nil {
+		t.Errorf("ConfirmTOTP failed: Should have confirmed the enrollment without error: %s", err)
+	}
+
+	return enrollment.Secret, step, codes
+}
+
+func TestMFA_EnrollTOTP_RequiresCodeToLogIn(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+	db.SetTOTPIssuer("Test Issuer")
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA1"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, wrongPasswordErr := db.EnrollTOTP(newUser.Name, "notthepassword")
+	enrollment, err := db.EnrollTOTP(newUser.Name, "mfapassword")
+	pending, pendingErr := db.GetUserScopesWithCredentials(newUser.Name, "mfapassword")
+	step := time.Now().Unix() / 30
+	_, wrongCodeErr := db.ConfirmTOTP(newUser.Name, "mfapassword", "000000")
+	codes, confirmErr := db.ConfirmTOTP(newUser.Name, "mfapassword", totpCodeFor(t, enrollment.Secret, step))
+	_, noCodeErr := db.GetUserScopesWithCredentials(newUser.Name, "mfapassword")
+	scopeUser, codeErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, totpCodeFor(t, enrollment.Secret, step+1))
+	_, replayErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, totpCodeFor(t, enrollment.Secret, step+1))
+	_, reenrollErr := db.EnrollTOTP(newUser.Name, "mfapassword")
+
+	//	Assert
+	if wrongPasswordErr == nil {
+		t.Errorf("EnrollTOTP failed: Shouldn't have started enrollment without the right password")
+	}
+
+	if err != nil || strings.HasPrefix(enrollment.URI, "otpauth://totp/Test%20Issuer:TestMFA1?") != true || strings.Contains(enrollment.URI, "secret="+enrollment.Secret) != true {
+		t.Errorf("EnrollTOTP failed: Should have returned a provisioning uri with the secret, but got '%s' (%v)", enrollment.URI, err)
+	}
+
+	if pendingErr != nil || strings.Join(pending.AMR, " ") != "pwd" {
+		t.Errorf("GetUserScopesWithCredentials failed: Shouldn't need a code before the enrollment is confirmed, but got %v (%v)", pending.AMR, pendingErr)
+	}
+
+	if wrongCodeErr == nil {
+		t.Errorf("ConfirmTOTP failed: Shouldn't have confirmed the enrollment with the wrong code")
+	}
+
+	if confirmErr != nil || len(codes) != 10 {
+		t.Errorf("ConfirmTOTP failed: Should have returned 10 recovery codes, but got %v (%v)", len(codes), confirmErr)
+	}
+
+	if errors.Is(noCodeErr, data.ErrMFARequired) != true {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have needed a one-time code, but got: %v", noCodeErr)
+	}
+
+	if codeErr != nil || strings.Join(scopeUser.AMR, " ") != "pwd otp mfa" {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Should have logged in with the code, but got %v (%v)", scopeUser.AMR, codeErr)
+	}
+
+	if replayErr == nil {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Shouldn't have accepted a code that was already used")
+	}
+
+	if reenrollErr == nil {
+		t.Errorf("EnrollTOTP failed: Shouldn't have started enrollment for a user that already has a second factor")
+	}
+}
+
+func TestMFA_ConfirmTOTP_WrongCodes_LockOut(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA1"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	enrollment, err := db.EnrollTOTP(newUser.Name, "mfapassword")
+	if err != nil {
+		t.Errorf("EnrollTOTP failed: Should have started enrollment without error: %s", err)
+	}
+
+	//	Act
+	for i := 0; i < testLockoutPolicy.UserThreshold; i++ {
+		db.ConfirmTOTP(newUser.Name, "mfapassword", "000000")
+	}
+	attempts, attemptsErr := db.GetLoginAttempts(uctx, "user", newUser.Name)
+	_, confirmErr := db.ConfirmTOTP(newUser.Name, "mfapassword", totpCodeFor(t, enrollment.Secret, time.Now().Unix()/30))
+
+	//	Assert
+	if attemptsErr != nil || attempts.Locked() != true {
+		t.Errorf("GetLoginAttempts failed: Wrong codes should count as failed logins, but got %+v (%v)", attempts, attemptsErr)
+	}
+
+	if confirmErr == nil {
+		t.Errorf("ConfirmTOTP failed: Shouldn't have confirmed the enrollment for a user that's locked out")
+	}
+}
+
+func TestMFA_RecoveryCode_CanOnlyBeUsedOnce(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA2"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	secret, step, codes := enrollTestTOTP(t, db, newUser.Name, "mfapassword")
+	if len(codes) < 2 {
+		t.Fatalf("ConfirmTOTP failed: Should have returned recovery codes")
+	}
+
+	//	Act
+	scopeUser, recoveryErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, strings.ToUpper(codes[0]))
+	_, reuseErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, codes[0])
+	newCodes, regenerateErr := db.RegenerateRecoveryCodes(newUser.Name, "mfapassword", totpCodeFor(t, secret, step+1))
+	_, oldCodeErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, codes[1])
+	_, newCodeErr := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, newCodes[0])
+
+	//	Assert
+	if recoveryErr != nil || strings.Join(scopeUser.AMR, " ") != "pwd mfa" {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Should have logged in with a recovery code, but got %v (%v)", scopeUser.AMR, recoveryErr)
+	}
+
+	if reuseErr == nil {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Shouldn't have accepted a recovery code that was already used")
+	}
+
+	if regenerateErr != nil || len(newCodes) != 10 {
+		t.Errorf("RegenerateRecoveryCodes failed: Should have returned 10 new recovery codes, but got %v (%v)", len(newCodes), regenerateErr)
+	}
+
+	if oldCodeErr == nil || newCodeErr != nil {
+		t.Errorf("RegenerateRecoveryCodes failed: Should have replaced the old recovery codes (old code: %v, new code: %v)", oldCodeErr, newCodeErr)
+	}
+}
+
+func TestMFA_ResetMFA_RemovesSecondFactor(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA3"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	otherUser, err := db.AddUser(uctx, data.User{Name: "TestMFA4"}, "otherpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	enrollTestTOTP(t, db, newUser.Name, "mfapassword")
+
+	//	Act
+	forbiddenErr := db.ResetMFA(otherUser, newUser.ID)
+	resetErr := db.ResetMFA(uctx, newUser.ID)
+	scopeUser, loginErr := db.GetUserScopesWithCredentials(newUser.Name, "mfapassword")
+
+	//	Assert
+	if forbiddenErr == nil {
+		t.Errorf("ResetMFA failed: Users without permission shouldn't be able to reset second factors")
+	}
+
+	if resetErr != nil {
+		t.Errorf("ResetMFA failed: Should have reset the second factor without error: %s", resetErr)
+	}
+
+	if loginErr != nil || strings.Join(scopeUser.AMR, " ") != "pwd" {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged in with just the password after the reset, but got %v (%v)", scopeUser.AMR, loginErr)
+	}
+}
+
+func TestMFA_GetNewAuthenticatedToken_HasAMR(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	token, err := db.GetNewAuthenticatedToken(uctx, 5*time.Minute, data.Confirmation{}, []string{data.AMRPassword, data.AMROneTimePassword, data.AMRMultiFactor})
+	scopeUser, scopeErr := db.GetScopesForToken(token.ID)
+	introspectedToken, introspected, introspectErr := db.IntrospectToken(token.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetNewAuthenticatedToken failed: Should have gotten a token without error: %s", err)
+	}
+
+	if scopeErr != nil || strings.Join(scopeUser.AMR, " ") != "pwd otp mfa" {
+		t.Errorf("GetScopesForToken failed: Should have returned the token's authentication methods, but got %v (%v)", scopeUser.AMR, scopeErr)
+	}
+
+	if introspectErr != nil || introspected.ID != uctx.ID || strings.Join(introspectedToken.AMR, " ") != "pwd otp mfa" {
+		t.Errorf("IntrospectToken failed: Should have returned the token's authentication methods, but got %v (%v)", introspectedToken.AMR, introspectErr)
+	}
+}
+
+func TestMFA_ChangePassword_RequiresCode(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA6"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	secret, step, _ := enrollTestTOTP(t, db, newUser.Name, "mfapassword")
+
+	//	Act
+	_, noCodeErr := db.ChangePassword(newUser.Name, "mfapassword", "", "newmfapassword")
+	_, changeErr := db.ChangePassword(newUser.Name, "mfapassword", totpCodeFor(t, secret, step+1), "newmfapassword")
+
+	//	Assert
+	if errors.Is(noCodeErr, data.ErrMFARequired) != true {
+		t.Errorf("ChangePassword failed: Should have needed a one-time code, but got: %v", noCodeErr)
+	}
+
+	if changeErr != nil {
+		t.Errorf("ChangePassword failed: Should have changed the password with a one-time code, but got: %s", changeErr)
+	}
+}
+
+func TestMFA_ResetMFA_DelegateCantResetAdmin(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	adminUser, err := db.AddUser(uctx, data.User{Name: "TestMFA7"}, "adminpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	delegateUser, err := db.AddUser(uctx, data.User{Name: "TestMFA8"}, "delegatepassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	otherUser, err := db.AddUser(uctx, data.User{Name: "TestMFA9"}, "otherpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	if _, err := db.AddUserToResourceWithRole(uctx, adminUser, data.Resource{ID: data.BuiltIn.SystemResource}, data.Role{ID: data.BuiltIn.AdminRole}); err != nil {
+		t.Errorf("AddUserToResourceWithRole failed: Should have made the user a system admin, but got: %s", err)
+	}
+
+	if _, err := db.AddUserToResourceWithRole(uctx, delegateUser, data.Resource{ID: data.BuiltIn.SystemResource}, data.Role{ID: data.BuiltIn.ResourceDelegateRole}); err != nil {
+		t.Errorf("AddUserToResourceWithRole failed: Should have made the user a resource delegate, but got: %s", err)
+	}
+
+	enrollTestTOTP(t, db, adminUser.Name, "adminpassword")
+	enrollTestTOTP(t, db, otherUser.Name, "otherpassword")
+
+	//	Act
+	adminErr := db.ResetMFA(delegateUser, adminUser.ID)
+	_, passwordErr := db.ResetPassword(delegateUser, adminUser.ID, "takenoverpassword")
+	otherErr := db.ResetMFA(delegateUser, otherUser.ID)
+
+	//	Assert
+	if adminErr == nil || passwordErr == nil {
+		t.Errorf("ResetMFA failed: Resource delegates shouldn't be able to reset a system admin's second factor (%v) or password (%v)", adminErr, passwordErr)
+	}
+
+	if otherErr != nil {
+		t.Errorf("ResetMFA failed: Resource delegates should be able to reset other users' second factors, but got: %s", otherErr)
+	}
+}
+
+func TestMFA_ConcurrentCodeUse_OnlyOneLogsIn(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	policy := testLockoutPolicy
+	policy.UserThreshold = 0
+	db.SetLockoutPolicy(policy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestMFA10"}, "mfapassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	_, _, codes := enrollTestTOTP(t, db, newUser.Name, "mfapassword")
+	if len(codes) < 1 {
+		t.Fatalf("ConfirmTOTP failed: Should have returned recovery codes")
+	}
+
+	//	Act
+	mu, successes := sync.Mutex{}, 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.GetUserScopesWithSecondFactor(newUser.Name, "mfapassword", data.AuthMethodSecretBasic, codes[0]); err == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	//	Assert
+	if successes != 1 {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Should have only accepted the recovery code once, but it was accepted %v times", successes)
+	}
+}
@@ -0,0 +1,350 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+)
+
+// PasswordPolicy is what a user's password has to look like.  It's checked whenever a
+// password is set:  when a user is added, when they change their password and when it's reset
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password can have.  Passwords can never be blank
+	MinLength int
+
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol require at least one
+	// uppercase letter, lowercase letter, digit or symbol (anything else) in a password
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// MaxAge is how long a password can be used before it has to be changed (0 never expires).
+	// Passwords set before password history was kept don't expire
+	MaxAge time.Duration
+
+	// History is how many of a user's most recent passwords (including the current one)
+	// can't be reused (0 allows any password to be reused)
+	History int
+
+	// DenyList is the set of passwords that can't be used, like common or breached
+	// passwords (in lower case -- see ReadPasswordDenyList)
+	DenyList map[string]bool
+}
+
+// DefaultPasswordPolicy is the password policy used unless another one is set (see SetPasswordPolicy)
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 8,
+}
+
+// Password policy rules (see PasswordViolation)
+const (
+	PasswordRuleMinLength = "min_length"
+	PasswordRuleUpper     = "uppercase"
+	PasswordRuleLower     = "lowercase"
+	PasswordRuleDigit     = "digit"
+	PasswordRuleSymbol    = "symbol"
+	PasswordRuleDenyList  = "deny_list"
+	PasswordRuleHistory   = "history"
+)
+
+// PasswordViolation is a password policy rule that a password doesn't follow
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned when a password doesn't meet the password policy.
+// It has each of the rules the password doesn't follow
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+// Error implements error
+func (err PasswordPolicyError) Error() string {
+	messages := []string{}
+	for _, violation := range err.Violations {
+		messages = append(messages, violation.Message)
+	}
+
+	return "The password doesn't meet the password policy: " + strings.Join(messages, "; ")
+}
+
+// PasswordHistory is a password a user has had (the newest one is their current password)
+type PasswordHistory struct {
+	UserID     string    `json:"userid"`
+	SecretHash string    `json:"secrethash"`
+	Created    time.Time `json:"created"`
+}
+
+// violations returns the rules the password doesn't follow (not including the history rule)
+func (policy PasswordPolicy) violations(password string) []PasswordViolation {
+	retval := []PasswordViolation{}
+
+	minLength := policy.MinLength
+	if minLength < 1 {
+		minLength = 1
+	}
+
+	if utf8.RuneCountInString(password) < minLength {
+		retval = append(retval, PasswordViolation{PasswordRuleMinLength, fmt.Sprintf("The password needs to be at least %v characters long", minLength)})
+	}
+
+	upper, lower, digit, symbol := false, false, false, false
+	for _, character := range password {
+		switch {
+		case unicode.IsUpper(character):
+			upper = true
+		case unicode.IsLower(character):
+			lower = true
+		case unicode.IsDigit(character):
+			digit = true
+		case unicode.IsLetter(character) == false:
+			symbol = true
+		}
+	}
+
+	if policy.RequireUpper && upper == false {
+		retval = append(retval, PasswordViolation{PasswordRuleUpper, "The password needs an uppercase letter"})
+	}
+
+	if policy.RequireLower && lower == false {
+		retval = append(retval, PasswordViolation{PasswordRuleLower, "The password needs a lowercase letter"})
+	}
+
+	if policy.RequireDigit && digit == false {
+		retval = append(retval, PasswordViolation{PasswordRuleDigit, "The password needs a digit"})
+	}
+
+	if policy.RequireSymbol && symbol == false {
+		retval = append(retval, PasswordViolation{PasswordRuleSymbol, "The password needs a symbol (a character that isn't a letter or digit)"})
+	}
+
+	if policy.DenyList[strings.ToLower(password)] {
+		retval = append(retval, PasswordViolation{PasswordRuleDenyList, "The password is too common"})
+	}
+
+	return retval
+}
+
+// ReadPasswordDenyList reads a list of passwords that can't be used, one per line.
+// Blank lines and lines starting with # are skipped
+func ReadPasswordDenyList(r io.Reader) (map[string]bool, error) {
+	retval := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		retval[strings.ToLower(line)] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return retval, fmt.Errorf("Problem reading the password deny list: %s", err)
+	}
+
+	return retval, nil
+}
+
+// SetPasswordPolicy sets the policy passwords are checked against
+func (store *DBManager) SetPasswordPolicy(policy PasswordPolicy) {
+	store.password = policy
+}
+
+// checkPassword returns a PasswordPolicyError if the password doesn't meet the password
+// policy for the user.  The history rule is only checked for users that already exist
+func (store DBManager) checkPassword(user User, password string) error {
+	violations := store.password.violations(password)
+
+	if store.password.History > 0 && user.ID != "" {
+		history, err := store.systemdb.GetPasswordHistory(user.ID)
+		if err != nil {
+			return fmt.Errorf("Problem getting the password history for the user: %s", err)
+		}
+
+		//	Users' current passwords are usually the newest in their history (but not if they were set before it was kept)
+		hashes := []string{}
+		if user.SecretHash != "" && (len(history) == 0 || history[0].SecretHash != user.SecretHash) {
+			hashes = append(hashes, user.SecretHash)
+		}
+		for _, item := range history {
+			hashes = append(hashes, item.SecretHash)
+		}
+
+		for i, hash := range hashes {
+			if i >= store.password.History {
+				break
+			}
+
+			if verifySecret(hash, password) == nil {
+				violations = append(violations, PasswordViolation{PasswordRuleHistory, fmt.Sprintf("The password can't be one of the last %v passwords used", store.password.History)})
+				break
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// passwordExpired returns 'true' if the user's password is older than the password policy's max age
+func (store DBManager) passwordExpired(user User) bool {
+	if store.password.MaxAge <= 0 {
+		return false
+	}
+
+	history, err := store.systemdb.GetPasswordHistory(user.ID)
+	if err != nil {
+		store.log().Error("Problem checking for an expired password", logging.FieldUserID, user.ID, "error", err)
+		return false
+	}
+
+	return len(history) > 0 && time.Since(history[0].Created) > store.password.MaxAge
+}
+
+// setPassword checks the password against the password policy, and changes the user's password
+func (store DBManager) setPassword(user User, password, updatedBy string) (User, error) {
+	if err := store.checkPassword(user, password); err != nil {
+		return User{}, err
+	}
+
+	hashedPassword, err := store.hasher.Hash(password)
+	if err != nil {
+		return User{}, fmt.Errorf("Problem hashing user password: %s", err)
+	}
+
+	//	Keep enough history to check the history rule
+	keep := store.password.History
+	if keep < 1 {
+		keep = 1
+	}
+
+	return store.systemdb.SetUserSecretHash(user.ID, hashedPassword, updatedBy, keep)
+}
+
+// ChangePassword changes a user's password.  The user has to supply their current password
+// (even if it has expired), and a one-time code if they have a second factor.  Wrong passwords
+// and codes count as failed logins (see SetLockoutPolicy).  Users that log in with the
+// directory can't change their password (see SetAuthenticator)
+func (store DBManager) ChangePassword(name, currentPassword, code, newPassword string) (User, error) {
+	store, end := store.startSpan("ChangePassword")
+	defer end()
+
+	//	Find the user and check their current password (and second factor)
+	user, err := store.verifyUserSecret(name, currentPassword, code, "password change")
+	if err != nil {
+		return User{}, err
+	}
+
+	//	Directory users change their password in the directory
+	if store.usesAuthenticator(user, true) {
+		return User{}, fmt.Errorf("The password is managed by the directory -- it has to be changed there")
+	}
+
+	retval, err := store.setPassword(user, newPassword, name)
+	if err != nil {
+		return retval, err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(name, AuditUserPasswordChange, "user", user.ID, "", nil, nil); err != nil {
+		return retval, err
+	}
+
+	return retval, nil
+}
+
+// verifyUserSecret checks a user's current secret and second factor (the one-time code, for users
+// that have one) before they change their own settings (like their password), and returns the user
+func (store DBManager) verifyUserSecret(name, secret, code, purpose string) (User, error) {
+	user, err := store.checkUserSecret(name, secret, purpose)
+	if err != nil {
+		return User{}, err
+	}
+
+	if _, err := store.checkSecondFactor(user, code); err != nil {
+		return User{}, err
+	}
+	store.loginSucceeded(name)
+
+	return user, nil
+}
+
+// checkUserSecret checks a user's current secret (but not their second factor), and returns the
+// user.  Wrong secrets count as failed logins (see SetLockoutPolicy), and the purpose of the check
+// is noted in the log and audit log.  Failed logins aren't forgotten until the caller has checked
+// everything else it needs (see loginSucceeded), so the second factor can't be guessed forever
+func (store DBManager) checkUserSecret(name, secret, purpose string) (User, error) {
+	if store.lockedOut(name) {
+		store.log().Warn("Secret check failed", "purpose", purpose, "user", name, logging.FieldOutcome, "locked_out")
+		metrics.AuthFailures.WithLabelValues("locked_out").Inc()
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	user, err := store.systemdb.GetUserByName(name)
+	if store.usesAuthenticator(user, err == nil) {
+		return store.loginWithAuthenticator(name, secret, purpose)
+	}
+
+	if err != nil {
+		store.hashDummySecret(secret)
+
+		store.log().Warn("Secret check failed", "purpose", purpose, "user", name, logging.FieldOutcome, "unknown_user")
+		metrics.AuthFailures.WithLabelValues("unknown_user").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "unknown user ("+purpose+")", nil, nil)
+		store.loginFailed(name, "")
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	if err := verifySecret(user.SecretHash, secret); err != nil {
+		store.log().Warn("Secret check failed", "purpose", purpose, "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_secret")
+		metrics.AuthFailures.WithLabelValues("incorrect_secret").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "incorrect secret ("+purpose+")", nil, nil)
+		store.loginFailed(name, user.ID)
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	return user, nil
+}
+
+// ResetPassword sets a user's password (without needing their current one).  Only system
+// admins and resource delegates can reset passwords, and only system admins can reset a system admin's
+func (store DBManager) ResetPassword(context User, userID, newPassword string) (User, error) {
+	store, end := store.startSpan("ResetPassword")
+	defer end()
+
+	//	Validate:  Does the context user have permission to make the change?
+	if store.userCanManage(context.ID, userID) == false {
+		return User{}, fmt.Errorf("User '%s' does not have permission to reset the user's password", context.Name)
+	}
+
+	user, err := store.getUserForUserID(userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	retval, err := store.setPassword(user, newPassword, context.Name)
+	if err != nil {
+		return retval, err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditUserPasswordReset, "user", user.ID, "", nil, nil); err != nil {
+		return retval, err
+	}
+
+	return retval, nil
+}
@@ -0,0 +1,238 @@
+package data_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+)
+
+//	A password policy for tests:  requires every character class, and remembers the last 2 passwords
+var testPasswordPolicy = data.PasswordPolicy{
+	MinLength:     10,
+	RequireUpper:  true,
+	RequireLower:  true,
+	RequireDigit:  true,
+	RequireSymbol: true,
+	History:       2,
+	DenyList:      map[string]bool{"password123!a": true},
+}
+
+//	Returns the rules in a password policy error (or nil if it isn't one)
+func violatedRules(err error) []string {
+	policyErr := data.PasswordPolicyError{}
+	if errors.As(err, &policyErr) == false {
+		return nil
+	}
+
+	retval := []string{}
+	for _, violation := range policyErr.Violations {
+		retval = append(retval, violation.Rule)
+	}
+
+	return retval
+}
+
+func TestPassword_AddUser_EnforcesPolicy(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetPasswordPolicy(testPasswordPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	_, blankErr := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "")
+	_, weakErr := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "short")
+	_, deniedErr := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "Password123!A")
+	newUser, okErr := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "Str0ng!Passw0rd")
+
+	//	Assert
+	if rules := violatedRules(blankErr); len(rules) == 0 || rules[0] != data.PasswordRuleMinLength {
+		t.Errorf("AddUser failed: Should have rejected a blank password, but got: %v", blankErr)
+	}
+
+	if rules := strings.Join(violatedRules(weakErr), ","); rules != "min_length,uppercase,digit,symbol" {
+		t.Errorf("AddUser failed: Should have listed every rule the password breaks, but got '%s'", rules)
+	}
+
+	if rules := strings.Join(violatedRules(deniedErr), ","); rules != "deny_list" {
+		t.Errorf("AddUser failed: Should have rejected a password on the deny list (in any case), but got '%s'", rules)
+	}
+
+	if okErr != nil || newUser.ID == "" {
+		t.Errorf("AddUser failed: Should have added a user with a strong password, but got: %v", okErr)
+	}
+}
+
+func TestPassword_ResetPassword_PreventsReuse(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetPasswordPolicy(testPasswordPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "First!Passw0rd")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, currentErr := db.ResetPassword(uctx, newUser.ID, "First!Passw0rd")
+	_, secondErr := db.ResetPassword(uctx, newUser.ID, "Second!Passw0rd")
+	_, previousErr := db.ResetPassword(uctx, newUser.ID, "First!Passw0rd")
+	_, thirdErr := db.ResetPassword(uctx, newUser.ID, "Third!Passw0rd")
+	_, forgottenErr := db.ResetPassword(uctx, newUser.ID, "First!Passw0rd")
+	_, loginErr := db.GetUserScopesWithCredentials(newUser.Name, "First!Passw0rd")
+
+	//	Assert
+	if rules := strings.Join(violatedRules(currentErr), ","); rules != "history" {
+		t.Errorf("ResetPassword failed: Should have rejected the current password, but got '%s'", rules)
+	}
+
+	if secondErr != nil || thirdErr != nil {
+		t.Errorf("ResetPassword failed: Should have reset the password to new ones, but got: %v / %v", secondErr, thirdErr)
+	}
+
+	if rules := strings.Join(violatedRules(previousErr), ","); rules != "history" {
+		t.Errorf("ResetPassword failed: Should have rejected the previous password, but got '%s'", rules)
+	}
+
+	if forgottenErr != nil || loginErr != nil {
+		t.Errorf("ResetPassword failed: Should have allowed a password older than the history, but got: %v / %v", forgottenErr, loginErr)
+	}
+}
+
+func TestPassword_ChangePassword_NeedsCurrentPassword(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetLockoutPolicy(testLockoutPolicy)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "firstpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	_, wrongErr := db.ChangePassword(newUser.Name, "notthepassword", "", "secondpassword")
+	attempts, _ := db.GetLoginAttempts(uctx, "user", newUser.Name)
+	_, weakErr := db.ChangePassword(newUser.Name, "firstpassword", "", "short")
+	_, changeErr := db.ChangePassword(newUser.Name, "firstpassword", "", "secondpassword")
+	_, oldLoginErr := db.GetUserScopesWithCredentials(newUser.Name, "firstpassword")
+	_, newLoginErr := db.GetUserScopesWithCredentials(newUser.Name, "secondpassword")
+
+	//	Assert
+	if wrongErr == nil || violatedRules(wrongErr) != nil {
+		t.Errorf("ChangePassword failed: Should have rejected the wrong current password, but got: %v", wrongErr)
+	}
+
+	if violatedRules(weakErr) == nil {
+		t.Errorf("ChangePassword failed: Should have rejected a password that doesn't meet the policy, but got: %v", weakErr)
+	}
+
+	if changeErr != nil || oldLoginErr == nil || newLoginErr != nil {
+		t.Errorf("ChangePassword failed: Should have changed the password, but got: %v / %v / %v", changeErr, oldLoginErr, newLoginErr)
+	}
+
+	if attempts.Failures != 1 {
+		t.Errorf("ChangePassword failed: Wrong current passwords should count as failed logins, but got %+v", attempts)
+	}
+}
+
+func TestPassword_MaxAge_ExpiredPasswordCantLogIn(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetPasswordPolicy(data.PasswordPolicy{MinLength: 8, MaxAge: 500 * time.Millisecond})
+
+	uctx, adminSecret, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestPassword1"}, "firstpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	time.Sleep(600 * time.Millisecond)
+	_, expiredErr := db.GetUserScopesWithCredentials(newUser.Name, "firstpassword")
+	_, adminErr := db.GetUserScopesWithCredentials(uctx.Name, adminSecret)
+	_, changeErr := db.ChangePassword(newUser.Name, "firstpassword", "", "secondpassword")
+	_, loginErr := db.GetUserScopesWithCredentials(newUser.Name, "secondpassword")
+
+	//	Assert
+	if expiredErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have turned away an expired password")
+	}
+
+	if adminErr != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Passwords without history shouldn't expire, but got: %s", adminErr)
+	}
+
+	if changeErr != nil || loginErr != nil {
+		t.Errorf("ChangePassword failed: Should have been able to change an expired password and log in, but got: %v / %v", changeErr, loginErr)
+	}
+}
+
+func TestPassword_ReadPasswordDenyList_SkipsCommentsAndBlankLines(t *testing.T) {
+	//	Arrange
+	list := "# Common passwords\n\nPassword1\n  letmein  \n"
+
+	//	Act
+	denyList, err := data.ReadPasswordDenyList(strings.NewReader(list))
+
+	//	Assert
+	if err != nil {
+		t.Errorf("ReadPasswordDenyList failed: Should have read the list without error: %s", err)
+	}
+
+	if len(denyList) != 2 || denyList["password1"] != true || denyList["letmein"] != true {
+		t.Errorf("ReadPasswordDenyList failed: Should have read 2 lower case passwords, but got %v", denyList)
+	}
+}
@@ -25,6 +25,9 @@ type Role struct {
 
 // AddRole adds a role to the system
 func (store DBManager) AddRole(context User, role Role) (Role, error) {
+	store, end := store.startSpan("AddRole")
+	defer end()
+
 	//	Our return item
 	retval := Role{}
 
@@ -34,48 +37,18 @@ func (store DBManager) AddRole(context User, role Role) (Role, error) {
 		return retval, fmt.Errorf("User '%s' does not have permission to add a role to the system", context.Name)
 	}
 
-	//	Start a transaction:
-	tx, err := store.systemdb.Begin()
-	if err != nil {
-		return retval, fmt.Errorf("An error occurred starting a transaction for a role: %s", err)
-	}
-
 	//	Generate an id:
-	roleID := xid.New().String()
-
-	//	Insert the item
-	_, err = tx.Exec(`INSERT INTO 
-			role (id, name, description, created, createdby, updated, updatedby) 
-			VALUES ($1, $2, $3, now(), $4, now(), $4);`,
-		roleID,
-		role.Name,
-		role.Description,
-		context.Name)
-	if err != nil {
-		tx.Rollback()
-		return retval, fmt.Errorf("An error occurred adding a role: %s", err)
-	}
+	role.ID = xid.New().String()
 
-	//	Commit the transaction
-	err = tx.Commit()
+	//	Store the item (and get it back)
+	retval, err := store.systemdb.AddRole(role, context.Name)
 	if err != nil {
-		return retval, fmt.Errorf("An error occurred committing a transaction for a role: %s", err)
+		return retval, err
 	}
 
-	//	Get the role
-	err = store.systemdb.QueryRow(`select id, name, description, created, createdby, updated, updatedby, deleted, deletedby from role WHERE id=$1;`, roleID).Scan(
-		&retval.ID,
-		&retval.Name,
-		&retval.Description,
-		&retval.Created,
-		&retval.CreatedBy,
-		&retval.Updated,
-		&retval.UpdatedBy,
-		&retval.Deleted,
-		&retval.DeletedBy,
-	)
-	if err != nil {
-		return retval, fmt.Errorf("Problem fetching role: %s", err)
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditRoleCreate, "role", retval.ID, "", nil, retval); err != nil {
+		return retval, err
 	}
 
 	//	Return it:
@@ -84,57 +57,14 @@ func (store DBManager) AddRole(context User, role Role) (Role, error) {
 
 // GetAllRoles returns an array of all roles
 func (store DBManager) GetAllRoles(context User) ([]Role, error) {
-	retval := []Role{}
-
-	//	Get all the items:
-	rows, err := store.systemdb.Query("select id, name, description, created, createdby, updated, updatedby, deleted, deletedby from role")
-	if err != nil {
-		return retval, fmt.Errorf("Problem selecting all roles: %s", err)
-	}
-
-	for rows.Next() {
-		item := Role{}
+	store, end := store.startSpan("GetAllRoles")
+	defer end()
 
-		if err = rows.Scan(
-			&item.ID,
-			&item.Name,
-			&item.Description,
-			&item.Created,
-			&item.CreatedBy,
-			&item.Updated,
-			&item.UpdatedBy,
-			&item.Deleted,
-			&item.DeletedBy); err != nil {
-			rows.Close()
-			break
-		}
-
-		retval = append(retval, item)
-	}
-
-	if err = rows.Err(); err != nil {
-		return retval, fmt.Errorf("Problem scanning all roles: %s", err)
-	}
-
-	//	Return our slice:
-	return retval, nil
+	return store.systemdb.GetAllRoles()
 }
 
 // roleExists returns 'true' if the role can be found, 'false' if it can't be found
 func (store DBManager) roleExists(role Role) bool {
-	retval := false
-
-	item := Role{}
-	err := store.systemdb.QueryRow("SELECT id, name FROM role WHERE id=$1;", role.ID).Scan(
-		&item.ID,
-		&item.Name,
-	)
-	if err != nil {
-		return false
-	}
-
-	//	We've gotten this far -- we must have found something
-	retval = true
-
-	return retval
+	_, err := store.systemdb.GetRole(role.ID)
+	return err == nil
 }
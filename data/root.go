@@ -1,46 +1,157 @@
 package data
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
+	"log/slog"
+	"time"
 
-	// QL sql driver
-	_ "github.com/cznic/ql/driver"
-
+	"github.com/danesparza/authserver/metrics"
+	"github.com/danesparza/authserver/webauthn"
 	"github.com/rs/xid"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel"
 )
 
+// tracer is used for DBManager spans
+var tracer = otel.Tracer("github.com/danesparza/authserver/data")
+
 // DBManager is the database manager for
 // user/application/role storage
 // token storage
 type DBManager struct {
-	systemdb *sql.DB
-	tokendb  *sql.DB
+	systemdb SystemStore
+	tokendb  TokenStore
+
+	//	Where changes are coming from (for the audit log) -- see From
+	source auditSource
+
+	//	The key used to HMAC audit events and sign checkpoints -- see SetAuditKey
+	auditKey []byte
+
+	//	How failed logins are throttled and locked out -- see SetLockoutPolicy
+	lockout LockoutPolicy
+
+	//	What passwords have to look like -- see SetPasswordPolicy
+	password PasswordPolicy
+
+	//	How new secrets are hashed -- see SetSecretHasher
+	hasher SecretHasher
+
+	//	The issuer shown in authenticator apps -- see SetTOTPIssuer
+	totpIssuer string
+
+	//	The WebAuthn relying party -- see SetWebAuthnRelyingParty
+	relyingParty webauthn.RelyingParty
+
+	//	The directory users it added (and new users) log in with -- see SetAuthenticator
+	authenticator Authenticator
+
+	//	The roles members of directory groups get -- see SetGroupRoles
+	groupRoles []GroupRole
+
+	//	The logger for the request this DBManager is being used for -- see WithLogger
+	logger *slog.Logger
+
+	//	The context of the request this DBManager is being used for (spans
+	//	for DBManager calls are children of its span) -- see WithContext
+	ctx context.Context
+}
+
+// WithLogger returns a copy of the DBManager that logs with the passed logger
+// (so its log lines include the request id and client of the request it's serving)
+func (store DBManager) WithLogger(logger *slog.Logger) DBManager {
+	store.logger = logger
+	return store
+}
+
+// WithContext returns a copy of the DBManager whose traced calls are
+// children of the span in the passed (request) context
+func (store DBManager) WithContext(ctx context.Context) DBManager {
+	store.ctx = ctx
+	return store
+}
+
+// requestContext returns the DBManager's context (or an empty context if it doesn't have one)
+func (store DBManager) requestContext() context.Context {
+	if store.ctx == nil {
+		return context.Background()
+	}
+
+	return store.ctx
+}
+
+// startSpan starts a span for a DBManager call and returns a copy of the DBManager
+// to use for the rest of the call (so its spans are children of this one), along with
+// a function that ends the span and records the call's latency
+func (store DBManager) startSpan(method string) (DBManager, func()) {
+	started := time.Now()
+	ctx, span := tracer.Start(store.requestContext(), "DBManager."+method)
+	store.ctx = ctx
+
+	return store, func() {
+		span.End()
+		metrics.ObserveDB(method, started)
+	}
+}
+
+// log returns the DBManager's logger (or the default logger if it doesn't have one)
+func (store DBManager) log() *slog.Logger {
+	if store.logger == nil {
+		return slog.Default()
+	}
+
+	return store.logger
 }
 
-// NewDBManager creates a new instance of a SystemDB
+// NewDBManager creates a new instance of a SystemDB.  The system and token
+// datastores are QL database file paths, SQLite databases (sqlite://path)
+// or PostgreSQL connection urls (postgres://...)
 func NewDBManager(systemdbpath, tokendbpath string) (*DBManager, error) {
-	retval := new(DBManager)
+	retval := &DBManager{lockout: DefaultLockoutPolicy, password: DefaultPasswordPolicy, hasher: DefaultSecretHasher, totpIssuer: "authserver", relyingParty: DefaultRelyingParty}
 
 	//	Open the systemdb
-	db, err := sql.Open("ql", systemdbpath)
+	db, err := openSystemStore(systemdbpath)
 	if err != nil {
 		return nil, fmt.Errorf("An error occurred opening the SystemDB: %s", err)
 	}
 	retval.systemdb = db
 
 	//	Open the tokendb
-	tdb, err := sql.Open("ql", tokendbpath)
+	tdb, err := openTokenStore(tokendbpath)
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("An error occurred opening the TokenDB: %s", err)
 	}
 	retval.tokendb = tdb
 
+	//	Bring datastores from older versions up to date
+	if err := retval.Migrate(); err != nil {
+		retval.Close()
+		return nil, err
+	}
+
 	//	Return our systemdb reference
 	return retval, nil
 }
 
+// Migrate brings the schemas of system and token datastores bootstrapped by older versions of
+// authserver up to date (adding the tables and columns they're missing).  NewDBManager runs it,
+// so it's done at startup -- it's safe to run more than once
+func (store DBManager) Migrate() error {
+	store, end := store.startSpan("Migrate")
+	defer end()
+
+	if err := store.systemdb.Migrate(); err != nil {
+		return fmt.Errorf("An error occurred migrating the SystemDB: %s", err)
+	}
+
+	if err := store.tokendb.Migrate(); err != nil {
+		return fmt.Errorf("An error occurred migrating the TokenDB: %s", err)
+	}
+
+	return nil
+}
+
 // Close closes the SystemDB database
 func (store DBManager) Close() error {
 	syserr := store.systemdb.Close()
@@ -55,172 +166,118 @@ func (store DBManager) Close() error {
 
 // AuthSystemBootstrap initializes the SystemDB and creates any default admin users / roles / resources
 func (store DBManager) AuthSystemBootstrap() (User, string, error) {
+	store, end := store.startSpan("AuthSystemBootstrap")
+	defer end()
+
 	adminUser := User{}
-	adminPassword := ""
 
-	//	Start our database transaction
-	tx, err := store.systemdb.Begin()
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem starting a transaction to bootstrap auth system")
-	}
+	//	Generate a password for the admin user
+	adminPassword := xid.New().String()
 
-	//	Create our database schema and indices
-	//	Resource schema / indices
-	_, err = tx.Exec(resourceSchema)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding resource schema: %s", err)
-	}
-	_, err = tx.Exec(resourceIXSysID)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding resource id index: %s", err)
-	}
-	_, err = tx.Exec(resourceIXName)
+	//	Hash the password
+	hashedPassword, err := store.hasher.Hash(adminPassword)
 	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding resource name index: %s", err)
+		return adminUser, adminPassword, fmt.Errorf("Problem hashing admin password: %s", err)
 	}
 
-	//	Role schema / indices
-	_, err = tx.Exec(roleSchema)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding role schema: %s", err)
-	}
-	_, err = tx.Exec(roleIXSysID)
+	//	Create the system schema and default admin user / resources / roles
+	err = store.systemdb.Bootstrap(hashedPassword)
 	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding role id index: %s", err)
+		return adminUser, adminPassword, err
 	}
 
-	//	User schema / indices
-	_, err = tx.Exec(userSchema)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding user schema: %s", err)
-	}
-	_, err = tx.Exec(userIXSysID)
+	//	Create the token schema
+	err = store.tokendb.Bootstrap()
 	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding user id index: %s", err)
-	}
-	_, err = tx.Exec(userIXName)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding user name index: %s", err)
+		return adminUser, adminPassword, err
 	}
 
-	//	UserResourceRole schema / indices
-	_, err = tx.Exec(userResourceRoleSchema)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding user_resource_role schema: %s", err)
-	}
-	_, err = tx.Exec(userResourceRoleIXID)
+	//	Get our admin user from the database and create our return object:
+	adminUser, err = store.systemdb.GetUser(BuiltIn.AdminUser)
 	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding user_resource_role id index: %s", err)
+		return adminUser, adminPassword, fmt.Errorf("Problem selecting admin user: %s", err)
 	}
 
-	//	Generate a password for the admin user
-	adminPassword = xid.New().String()
+	return adminUser, adminPassword, nil
+}
 
-	//	Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem hashing admin password: %s", err)
-	}
+// GetAdminUser returns the built-in admin user.  This is the context user for
+// commands that manage the system directly (instead of through the API)
+func (store DBManager) GetAdminUser() (User, error) {
+	store, end := store.startSpan("GetAdminUser")
+	defer end()
 
-	//	Add our default admin user - the insert statement requires some parameters be passed:
-	_, err = tx.Exec(defaultAdminUser, BuiltIn.AdminUser, string(hashedPassword))
+	adminUser, err := store.systemdb.GetUser(BuiltIn.AdminUser)
 	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding admin user: %s", err)
+		return adminUser, fmt.Errorf("Problem selecting admin user -- has the system been bootstrapped? %s", err)
 	}
 
-	//	Create the default system resources:
-	_, err = tx.Exec(defaultSystemResource, BuiltIn.SystemResource)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding system resource: %s", err)
-	}
+	return adminUser, nil
+}
 
-	//	Create the default system roles (id/name/description):
-	_, err = tx.Exec(defaultSystemRole, BuiltIn.AdminRole, "sys_admin", "System admin role")
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding system role: %s", err)
-	}
+// PingSystemStore checks that the system datastore can be reached
+func (store DBManager) PingSystemStore() error {
+	store, end := store.startSpan("PingSystemStore")
+	defer end()
 
-	_, err = tx.Exec(defaultSystemRole, BuiltIn.ResourceDelegateRole, "sys_delegate", "Resource delegate role")
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding system role: %s", err)
+	return store.systemdb.Ping()
+}
+
+// PingTokenStore checks that the token datastore can be reached
+func (store DBManager) PingTokenStore() error {
+	store, end := store.startSpan("PingTokenStore")
+	defer end()
+
+	return store.tokendb.Ping()
+}
+
+// CheckBootstrap returns an error if the system hasn't been bootstrapped, or if a
+// datastore's schema is older than this version of authserver expects
+func (store DBManager) CheckBootstrap() error {
+	store, end := store.startSpan("CheckBootstrap")
+	defer end()
+
+	if _, err := store.systemdb.GetUser(BuiltIn.AdminUser); err != nil {
+		return fmt.Errorf("The system hasn't been bootstrapped: %s", err)
 	}
 
-	//	Create the default system credentials (user/resource/role):
-	//	-- Admins get the sysadmin role
-	_, err = tx.Exec(defaultSystemCredentials, BuiltIn.AdminUser, BuiltIn.SystemResource, BuiltIn.AdminRole)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding system credential: %s", err)
+	if _, err := store.systemdb.GetLastAuditEventID(); err != nil {
+		return fmt.Errorf("The system datastore's audit log is out of date (it couldn't be migrated): %s", err)
 	}
 
-	//	Commit our transaction
-	err = tx.Commit()
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem committing a transaction to bootstrap auth system")
+	if _, err := store.systemdb.GetClientAuth(BuiltIn.AdminUser); err != nil {
+		return fmt.Errorf("The system datastore doesn't have client authentication (it couldn't be migrated): %s", err)
 	}
 
-	//	Start our database transaction for the token database
-	tx, err = store.tokendb.Begin()
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem starting a transaction to bootstrap auth tokens")
+	if _, err := store.systemdb.GetPasswordHistory(BuiltIn.AdminUser); err != nil {
+		return fmt.Errorf("The system datastore doesn't have password history (it couldn't be migrated): %s", err)
 	}
 
-	//	Token schema / indices
-	_, err = tx.Exec(tokenSchema)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding token schema: %s", err)
+	if _, err := store.systemdb.GetUserMFA(BuiltIn.AdminUser); err != nil {
+		return fmt.Errorf("The system datastore doesn't have second factors (it couldn't be migrated): %s", err)
 	}
 
-	_, err = tx.Exec(tokenIXToken)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding token index: %s", err)
+	if _, err := store.systemdb.GetWebAuthnCredentialsForUser(BuiltIn.AdminUser); err != nil {
+		return fmt.Errorf("The system datastore doesn't have WebAuthn credentials (it couldn't be migrated): %s", err)
 	}
 
-	_, err = tx.Exec(tokenIXUserID)
-	if err != nil {
-		tx.Rollback()
-		return adminUser, adminPassword, fmt.Errorf("Problem adding token index: %s", err)
+	if _, err := store.tokendb.CountTokens(); err != nil {
+		return fmt.Errorf("The token datastore hasn't been bootstrapped: %s", err)
 	}
 
-	//	Commit our transaction for the token database
-	err = tx.Commit()
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem committing a transaction to bootstrap auth tokens")
+	if _, err := store.tokendb.GetTokensForUser(""); err != nil {
+		return fmt.Errorf("The token datastore doesn't have token confirmations (it couldn't be migrated): %s", err)
 	}
 
-	//	Get our admin user from the database and create our return object:
-	adminUser = User{}
-	err = store.systemdb.QueryRow("SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby FROM user WHERE id=$1;", BuiltIn.AdminUser).Scan(
-		&adminUser.ID,
-		&adminUser.Enabled,
-		&adminUser.Name,
-		&adminUser.Description,
-		&adminUser.SecretHash,
-		&adminUser.Created,
-		&adminUser.CreatedBy,
-		&adminUser.Updated,
-		&adminUser.UpdatedBy,
-		&adminUser.Deleted,
-		&adminUser.DeletedBy)
-	if err != nil {
-		return adminUser, adminPassword, fmt.Errorf("Problem selecting admin user: %s", err)
+	if _, err := store.tokendb.GetLoginAttempts(""); err != nil {
+		return fmt.Errorf("The token datastore doesn't have login attempt tracking (it couldn't be migrated): %s", err)
 	}
 
-	return adminUser, adminPassword, nil
+	return nil
+}
+
+// HasAuditKey returns 'true' if there is a key for HMACing audit
+// events and signing checkpoints (see SetAuditKey)
+func (store DBManager) HasAuditKey() bool {
+	return store.auditKey != nil
 }
@@ -1,15 +1,119 @@
 package data_test
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/danesparza/authserver/data"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+//	The SQLite test database files (and their WAL / shared memory files)
+var sqliteTestFiles = []string{
+	"testsystem.sqlite", "testsystem.sqlite-wal", "testsystem.sqlite-shm",
+	"testtoken.sqlite", "testtoken.sqlite-wal", "testtoken.sqlite-shm",
+}
+
+//	The SQLite databases that backups are restored into
+var sqliteRestoreTestFiles = []string{
+	"restoresystem.sqlite", "restoresystem.sqlite-wal", "restoresystem.sqlite-shm",
+	"restoretoken.sqlite", "restoretoken.sqlite-wal", "restoretoken.sqlite-shm",
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	//	Clean up after the SQLite tests (the files are reset at the start of each test)
+	if os.Getenv("AUTHSERVER_TEST_SQLITE") != "" {
+		removeSQLiteTestFiles()
+		removeFiles(sqliteRestoreTestFiles)
+	}
+
+	os.Exit(code)
+}
+
 //	Gets the database path for this environment:
+//	-- by default the tests use QL database files
+//	-- set AUTHSERVER_TEST_SQLITE to any value to run the tests against SQLite instead
+//	-- set AUTHSERVER_TEST_POSTGRES to a postgres:// url to run the tests against PostgreSQL instead
+//	-- each test resets the 'authserver_test' schema in that database
 func getTestFiles() (string, string) {
-	return "testsystem.db", "testtoken.db"
+	if os.Getenv("AUTHSERVER_TEST_SQLITE") != "" {
+		removeSQLiteTestFiles()
+		return "sqlite://testsystem.sqlite", "sqlite://testtoken.sqlite"
+	}
+
+	pgurl := os.Getenv("AUTHSERVER_TEST_POSTGRES")
+	if pgurl == "" {
+		return "testsystem.db", "testtoken.db"
+	}
+
+	dsn := resetTestPostgresSchema(pgurl, "authserver_test")
+	return dsn, dsn
+}
+
+//	Gets a second (empty) set of databases for this environment to restore backups into
+func getRestoreTestFiles() (string, string) {
+	if os.Getenv("AUTHSERVER_TEST_SQLITE") != "" {
+		removeFiles(sqliteRestoreTestFiles)
+		return "sqlite://restoresystem.sqlite", "sqlite://restoretoken.sqlite"
+	}
+
+	pgurl := os.Getenv("AUTHSERVER_TEST_POSTGRES")
+	if pgurl == "" {
+		return "restoresystem.db", "restoretoken.db"
+	}
+
+	dsn := resetTestPostgresSchema(pgurl, "authserver_restore_test")
+	return dsn, dsn
+}
+
+//	Removes any SQLite test database files
+func removeSQLiteTestFiles() {
+	removeFiles(sqliteTestFiles)
+}
+
+//	Removes the given files (if they exist)
+func removeFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+//	Drops and recreates the given schema and returns a connection url that uses it
+func resetTestPostgresSchema(pgurl, schema string) string {
+	db, err := sql.Open("postgres", pgurl)
+	if err != nil {
+		panic(fmt.Sprintf("Problem opening test postgres database: %s", err))
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schema)); err != nil {
+		panic(fmt.Sprintf("Problem dropping test postgres schema: %s", err))
+	}
+
+	if _, err = db.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema)); err != nil {
+		panic(fmt.Sprintf("Problem creating test postgres schema: %s", err))
+	}
+
+	u, err := url.Parse(pgurl)
+	if err != nil {
+		panic(fmt.Sprintf("Problem parsing test postgres url: %s", err))
+	}
+
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	return u.String()
 }
 
 func TestRoot_AuthSystemBootstrap_Successful(t *testing.T) {
@@ -44,3 +148,244 @@ func TestRoot_AuthSystemBootstrap_Successful(t *testing.T) {
 	t.Logf("New Admin user: %+v", response)
 	t.Logf("New Admin user secret: %s", secret)
 }
+
+func TestRoot_CheckBootstrap_NotBootstrapped_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Act
+	pingErr := db.PingSystemStore()
+	err = db.CheckBootstrap()
+
+	//	Assert
+	if pingErr != nil {
+		t.Errorf("PingSystemStore failed: Should have reached the datastore without error: %s", pingErr)
+	}
+
+	if err == nil {
+		t.Errorf("CheckBootstrap failed: Should have returned an error before the system was bootstrapped")
+	}
+}
+
+func TestRoot_CheckBootstrap_Bootstrapped_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	err = db.CheckBootstrap()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("CheckBootstrap failed: Should not have returned an error once the system was bootstrapped: %s", err)
+	}
+
+	if err := db.PingTokenStore(); err != nil {
+		t.Errorf("PingTokenStore failed: Should have reached the datastore without error: %s", err)
+	}
+}
+
+func TestRoot_Migrate_OldDatastores_Upgraded(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	A user the directory added before users had a source
+	directoryUser, err := db.AddUserWithSecretHash(uctx, data.User{Name: "directoryuser"})
+	if err != nil {
+		t.Errorf("AddUserWithSecretHash failed: Should have added an item without error: %s", err)
+	}
+
+	db.Close()
+
+	userTable := "user"
+	if strings.Contains(systemdbfilename, "://") {
+		userTable = `"user"`
+	}
+
+	//	Take the datastores back to the schema they had before anything was migrated
+	for _, statement := range []string{
+		"DROP TABLE IF EXISTS schema_version;",
+		"DROP TABLE audit;",
+		"DROP TABLE client_auth;",
+		"DROP TABLE password_history;",
+		"DROP TABLE user_mfa;",
+		"DROP TABLE webauthn_credential;",
+	} {
+		execTestSystemStatement(systemdbfilename, statement)
+	}
+
+	execTestSystemStatement(systemdbfilename, "UPDATE "+userTable+" SET createdby = $1;", "directory")
+
+	oldTokenSchema := "CREATE TABLE tokens (token string NOT NULL, userid string NOT NULL, created time NOT NULL, expires time NOT NULL, deleted time, deletedby string);"
+	if strings.Contains(tokendbfilename, "://") {
+		oldTokenSchema = "CREATE TABLE tokens (token text NOT NULL, userid text NOT NULL, created timestamp NOT NULL, expires timestamp NOT NULL, deleted timestamp, deletedby text);"
+	}
+
+	for _, statement := range []string{
+		"DROP TABLE IF EXISTS schema_version;",
+		"DROP TABLE login_attempts;",
+		"DROP TABLE used_ids;",
+		"DROP TABLE webauthn_ceremony;",
+		"DROP TABLE tokens;",
+		oldTokenSchema,
+	} {
+		execTestSystemStatement(tokendbfilename, statement)
+	}
+	execTestSystemStatement(tokendbfilename, "INSERT INTO tokens (token, userid, created, expires) VALUES ($1, $2, $3, $4);", "oldtoken", uctx.ID, time.Now().UTC(), time.Now().Add(time.Hour).UTC())
+
+	//	Act
+	migrated, migrateErr := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if migrateErr == nil {
+		migrated.Close()
+	}
+
+	db, err = data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: Should have opened the migrated datastores again without error: %s", err)
+	}
+	defer db.Close()
+
+	checkErr := db.CheckBootstrap()
+	backup, backupErr := db.Backup(true)
+	migratedUser, adminUser := data.User{}, data.User{}
+	for _, user := range backup.Users {
+		switch user.ID {
+		case directoryUser.ID:
+			migratedUser = user
+		case uctx.ID:
+			adminUser = user
+		}
+	}
+	_, tokenErr := db.GetNewToken(uctx, 5*time.Minute)
+	_, useErr := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+
+	//	Assert
+	if migrateErr != nil {
+		t.Errorf("NewDBManager failed: Should have migrated the datastores without error: %s", migrateErr)
+	}
+
+	if checkErr != nil {
+		t.Errorf("CheckBootstrap failed: Should have brought the datastores up to date: %s", checkErr)
+	}
+
+	if backupErr != nil || len(backup.Users) != 2 || len(backup.Tokens) != 1 || backup.Tokens[0].ID != "oldtoken" {
+		t.Errorf("Backup failed: Should have backed up the migrated datastores, but got %v users and %v tokens (%v)", len(backup.Users), len(backup.Tokens), backupErr)
+	}
+
+	if migratedUser.Source != data.UserSourceDirectory || adminUser.Source != "" {
+		t.Errorf("Backup failed: Should have marked only the user the directory added (without a password) as a directory user, but got %+v and %+v", migratedUser, adminUser)
+	}
+
+	if tokenErr != nil {
+		t.Errorf("GetNewToken failed: Should have gotten a token from the migrated datastore without error: %s", tokenErr)
+	}
+
+	if useErr != nil {
+		t.Errorf("UseOnce failed: Should have recorded a used id in the migrated datastore without error: %s", useErr)
+	}
+}
+
+func TestRoot_WithContext_SpansAreChildrenOfRequest(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+
+	//	Act
+	_, _, err = db.WithContext(ctx).AuthSystemBootstrap()
+	request.End()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	found := false
+	for _, span := range recorder.Ended() {
+		if span.Name() == "DBManager.AuthSystemBootstrap" {
+			found = true
+			if span.Parent().SpanID() != request.SpanContext().SpanID() {
+				t.Errorf("WithContext failed: The DBManager span should be a child of the request's span")
+			}
+		}
+	}
+
+	if found == false {
+		t.Errorf("WithContext failed: Should have recorded a span for the DBManager call")
+	}
+}
+
+//	Runs a statement directly against the given system (or token) datastore (bypassing the DBManager) --
+//	used to simulate someone tampering with the data.  Close any DBManager using the datastore first
+func execTestSystemStatement(systemdb, statement string, args ...interface{}) {
+	driver, dsn := "ql", systemdb
+	switch {
+	case strings.HasPrefix(systemdb, "sqlite://"):
+		driver, dsn = "sqlite3", strings.TrimPrefix(systemdb, "sqlite://")
+	case strings.HasPrefix(systemdb, "postgres://"), strings.HasPrefix(systemdb, "postgresql://"):
+		driver = "postgres"
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		panic(fmt.Sprintf("Problem opening test database: %s", err))
+	}
+	defer db.Close()
+
+	//	QL only allows changes inside a transaction
+	tx, err := db.Begin()
+	if err != nil {
+		panic(fmt.Sprintf("Problem starting transaction: %s", err))
+	}
+
+	if _, err = tx.Exec(statement, args...); err != nil {
+		tx.Rollback()
+		panic(fmt.Sprintf("Problem running statement against test database: %s", err))
+	}
+
+	if err = tx.Commit(); err != nil {
+		panic(fmt.Sprintf("Problem committing transaction: %s", err))
+	}
+}
@@ -3,7 +3,8 @@ package data
 import (
 	"fmt"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
 )
 
 // ScopeUser is a hierarchy of a user and the resource and role
@@ -13,6 +14,10 @@ type ScopeUser struct {
 	Name           string
 	Description    string
 	ScopeResources []ScopeResource
+
+	// AMR are the ways the user authenticated (RFC 8176):  when they log in, and for
+	// the token they were issued when their scopes are looked up with it
+	AMR []string `json:",omitempty"`
 }
 
 // ScopeResource is part of the user/resource/role scope hierarchy
@@ -32,45 +37,127 @@ type ScopeRole struct {
 
 // GetUserScopesWithCredentials - verifies credentials and returns the scopeuser hierarchy
 func (store DBManager) GetUserScopesWithCredentials(name, secret string) (ScopeUser, error) {
+	return store.GetUserScopesWithClientSecret(name, secret, AuthMethodSecretBasic)
+}
+
+// GetUserScopesWithClientSecret verifies credentials sent with the given method (client_secret_basic
+// or client_secret_post) and returns the scopeuser hierarchy.  The method has to be the one the
+// client is set up to use.  Users with a second factor can't log in this way -- see GetUserScopesWithSecondFactor
+func (store DBManager) GetUserScopesWithClientSecret(name, secret, method string) (ScopeUser, error) {
+	return store.GetUserScopesWithSecondFactor(name, secret, method, "")
+}
+
+// GetUserScopesWithSecondFactor verifies credentials like GetUserScopesWithClientSecret, along with
+// a one-time code for users that have a second factor (a TOTP code or a recovery code).  Users
+// without one don't need a code.  The returned scopeuser has the ways the user authenticated (AMR)
+func (store DBManager) GetUserScopesWithSecondFactor(name, secret, method, code string) (ScopeUser, error) {
+	store, end := store.startSpan("GetUserScopesWithSecondFactor")
+	defer end()
+
 	retUser := ScopeUser{}
 
+	//	Locked out user names (and ip addresses) are turned away without checking the secret.
+	//	Names that don't exist are locked out too, so the response is always the same
+	if store.lockedOut(name) {
+		store.log().Warn("Login failed", "user", name, logging.FieldOutcome, "locked_out")
+		metrics.AuthFailures.WithLabelValues("locked_out").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "locked out", nil, nil)
+		return retUser, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
 	//	First, find the user with the given name and get the hashed password
-	user := User{}
-	err := store.systemdb.QueryRow("SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby FROM user WHERE name=$1;", name).Scan(
-		&user.ID,
-		&user.Enabled,
-		&user.Name,
-		&user.Description,
-		&user.SecretHash,
-		&user.Created,
-		&user.CreatedBy,
-		&user.Updated,
-		&user.UpdatedBy,
-		&user.Deleted,
-		&user.DeletedBy,
-	)
+	user, err := store.systemdb.GetUserByName(name)
+	directory := store.usesAuthenticator(user, err == nil)
+	if err != nil && directory == false {
+		//	Take as long as checking a real secret would
+		store.hashDummySecret(secret)
+
+		store.log().Warn("Login failed", "user", name, logging.FieldOutcome, "unknown_user")
+		metrics.AuthFailures.WithLabelValues("unknown_user").Inc()
+		store.audit(name, AuditLoginFailed, "user", "", "unknown user", nil, nil)
+		store.loginFailed(name, "")
+		return retUser, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	//	Directory users (and new users) log in with the directory, which adds them the first time
+	if directory {
+		user, err = store.loginWithAuthenticator(name, secret, "login")
+		if err != nil {
+			return retUser, err
+		}
+	}
+
+	//	Clients set up to authenticate another way can't use a secret (or send it differently)
+	auth, err := store.GetClientAuth(user.ID)
 	if err != nil {
-		return retUser, fmt.Errorf("Problem selecting user: %s", err)
+		return retUser, err
+	}
+
+	if auth.Method != method {
+		//	Take as long as checking the secret would, so the method can't be told apart by timing
+		if directory == false {
+			store.hashDummySecret(secret)
+		}
+
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "wrong_method")
+		metrics.AuthFailures.WithLabelValues("wrong_method").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "client authenticates with "+auth.Method, nil, nil)
+		store.loginFailed(name, user.ID)
+		return retUser, fmt.Errorf("The user was not found or the password was incorrect")
 	}
 
 	// Compare the given password with the hash
-	err = bcrypt.CompareHashAndPassword([]byte(user.SecretHash), []byte(secret))
+	_, span := tracer.Start(store.requestContext(), "verifySecret")
+	if directory == false {
+		err = verifySecret(user.SecretHash, secret)
+	}
+	span.End()
 	if err != nil { // nil means it is a match
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "incorrect_secret")
+		metrics.AuthFailures.WithLabelValues("incorrect_secret").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "incorrect secret", nil, nil)
+		store.loginFailed(name, user.ID)
 		return retUser, fmt.Errorf("The user was not found or the password was incorrect")
 	}
 
+	//	Users with a second factor need a code too
+	amr, err := store.checkSecondFactor(user, code)
+	if err != nil {
+		return retUser, err
+	}
+
+	//	Hash the secret again if it was hashed with another algorithm or parameters
+	if directory == false {
+		store.rehashSecret(user, secret)
+	}
+
+	//	Expired passwords have to be changed before they can be used to log in
+	if store.passwordExpired(user) {
+		store.log().Warn("Login failed", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "password_expired")
+		metrics.AuthFailures.WithLabelValues("password_expired").Inc()
+		store.audit(name, AuditLoginFailed, "user", user.ID, "password expired", nil, nil)
+		return retUser, fmt.Errorf("The password has expired -- it needs to be changed")
+	}
+
 	//	If everything checks out, get the scopeuser information and return it:
 	retUser, err = store.getUserScopes(user)
 	if err != nil {
 		return retUser, fmt.Errorf("Problem fetching scopes for the user: %s", err)
 	}
 
+	retUser.AMR = amr
+
+	store.log().Debug("Login succeeded", "user", name, logging.FieldUserID, user.ID, logging.FieldOutcome, "ok")
+	store.loginSucceeded(name)
+
 	//	Return our user:
 	return retUser, nil
 }
 
 // getUserScopes gets the scope hierarchy for a given user
 func (store DBManager) getUserScopes(user User) (ScopeUser, error) {
+	_, span := tracer.Start(store.requestContext(), "DBManager.getUserScopes")
+	defer span.End()
 
 	//	First, copy the necessary properties from the passed user
 	retval := ScopeUser{
@@ -83,53 +170,21 @@ func (store DBManager) getUserScopes(user User) (ScopeUser, error) {
 	//	-- see what resources they have
 	//	-- see what roles they have on those resources
 	//	Build up the ScopeUser hierarchy
-	rows, err := store.systemdb.Query(getResourcesForUser, user.ID)
+	resources, err := store.systemdb.GetResourcesForUser(user.ID)
 	if err != nil {
 		return retval, fmt.Errorf("Problem getting resources for user %s / %v: %s", user.Name, user.ID, err)
 	}
 
-	for rows.Next() {
-		gres := ScopeResource{}
-
-		if err = rows.Scan(
-			&gres.ID,
-			&gres.Name,
-			&gres.Description); err != nil {
-			rows.Close()
-			break
-		}
-
+	for _, gres := range resources {
 		//	Now that we have a resource, see what roles we should add to it for this user:
-		rolesrows, err := store.systemdb.Query(getRolesForUserAndResources, user.ID, gres.ID)
+		roles, err := store.systemdb.GetRolesForUserAndResource(user.ID, gres.ID)
 		if err != nil {
-			return retval, fmt.Errorf("Problem getting resources for user %s / %v: %s", user.Name, user.ID, err)
-		}
-
-		for rolesrows.Next() {
-			grole := ScopeRole{}
-
-			if err = rolesrows.Scan(
-				&grole.ID,
-				&grole.Name,
-				&grole.Description); err != nil {
-				rolesrows.Close()
-				break
-			}
-
-			gres.ScopeRoles = append(gres.ScopeRoles, grole)
-
-		}
-
-		if err = rolesrows.Err(); err != nil {
-			return retval, fmt.Errorf("Problem scanning roles for user %s / %v & resource %s / %v: %s", user.Name, user.ID, gres.Name, gres.ID, err)
+			return retval, fmt.Errorf("Problem getting roles for user %s / %v & resource %s / %v: %s", user.Name, user.ID, gres.Name, gres.ID, err)
 		}
 
+		gres.ScopeRoles = append(gres.ScopeRoles, roles...)
 		retval.ScopeResources = append(retval.ScopeResources, gres)
 	}
 
-	if err = rows.Err(); err != nil {
-		return retval, fmt.Errorf("Problem scanning resources for user %s / %v: %s", user.Name, user.ID, err)
-	}
-
 	return retval, nil
 }
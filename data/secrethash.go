@@ -0,0 +1,273 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/danesparza/authserver/logging"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SecretHasher hashes user secrets with a particular algorithm and parameters.
+// Hashes are encoded with their algorithm and parameters, so a secret can be
+// checked against any hash no matter which hasher made it (see verifySecret)
+type SecretHasher interface {
+	// Algorithm is the name of the hasher's algorithm ('argon2id' or 'bcrypt')
+	Algorithm() string
+
+	// Hash returns the encoded hash of the secret
+	Hash(secret string) (string, error)
+
+	// Verify returns nil if the secret matches the encoded hash (which has to be
+	// one of the hasher's algorithm), or an error if it doesn't
+	Verify(encoded, secret string) error
+
+	// NeedsRehash returns 'true' if the encoded hash wasn't made by this hasher -- it uses
+	// another algorithm or different parameters -- so the secret should be hashed again
+	NeedsRehash(encoded string) bool
+}
+
+// Secret hashing algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// DefaultSecretHasher is the hasher used unless another one is set (see SetSecretHasher).
+// It uses the minimum Argon2id parameters recommended by OWASP
+var DefaultSecretHasher SecretHasher = Argon2idHasher{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher hashes secrets with Argon2id (RFC 9106).  Hashes are encoded in the
+// PHC string format:  $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2idHasher struct {
+	// Memory is how much memory hashing uses (in KiB)
+	Memory uint32
+
+	// Iterations is how many passes are made over the memory
+	Iterations uint32
+
+	// Parallelism is how many threads are used
+	Parallelism uint8
+
+	// SaltLength and KeyLength are the lengths (in bytes) of the random salt and the hash
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Algorithm implements SecretHasher
+func (hasher Argon2idHasher) Algorithm() string {
+	return HashArgon2id
+}
+
+// The largest Argon2id parameters we'll hash (or verify) with.  Hashes are checked against
+// these before they're used, so an imported hash can't make every login use gigabytes of
+// memory or minutes of cpu
+const (
+	maxArgon2idMemory      = 1024 * 1024
+	maxArgon2idIterations  = 64
+	maxArgon2idParallelism = 64
+	maxArgon2idSaltLength  = 64
+	maxArgon2idKeyLength   = 128
+)
+
+// validate returns an error if argon2 can't hash with the parameters, or they're too expensive
+func (hasher Argon2idHasher) validate() error {
+	if hasher.Iterations < 1 || hasher.Parallelism < 1 || hasher.Memory < 8*uint32(hasher.Parallelism) {
+		return fmt.Errorf("Argon2id needs at least 1 iteration and thread, and 8 KiB of memory per thread")
+	}
+
+	if hasher.SaltLength < 8 || hasher.KeyLength < 16 {
+		return fmt.Errorf("Argon2id needs a salt of at least 8 bytes and a key of at least 16 bytes")
+	}
+
+	if hasher.Memory > maxArgon2idMemory || hasher.Iterations > maxArgon2idIterations || hasher.Parallelism > maxArgon2idParallelism {
+		return fmt.Errorf("Argon2id can use at most %v KiB of memory, %v iterations and %v threads", maxArgon2idMemory, maxArgon2idIterations, maxArgon2idParallelism)
+	}
+
+	if hasher.SaltLength > maxArgon2idSaltLength || hasher.KeyLength > maxArgon2idKeyLength {
+		return fmt.Errorf("Argon2id can use a salt of at most %v bytes and a key of at most %v bytes", maxArgon2idSaltLength, maxArgon2idKeyLength)
+	}
+
+	return nil
+}
+
+// Hash implements SecretHasher
+func (hasher Argon2idHasher) Hash(secret string) (string, error) {
+	if err := hasher.validate(); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, hasher.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("Problem generating a salt: %s", err)
+	}
+
+	key := argon2.IDKey([]byte(secret), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, hasher.KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		HashArgon2id,
+		argon2.Version,
+		hasher.Memory,
+		hasher.Iterations,
+		hasher.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify implements SecretHasher
+func (hasher Argon2idHasher) Verify(encoded, secret string) error {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(key, argon2.IDKey([]byte(secret), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)) != 1 {
+		return fmt.Errorf("The secret doesn't match the hash")
+	}
+
+	return nil
+}
+
+// NeedsRehash implements SecretHasher
+func (hasher Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := decodeArgon2id(encoded)
+	return err != nil || params != hasher
+}
+
+// decodeArgon2id returns the parameters, salt and key of an encoded Argon2id hash
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	params := Argon2idHasher{}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != HashArgon2id {
+		return params, nil, nil, fmt.Errorf("The hash isn't an Argon2id hash")
+	}
+
+	version := 0
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("The Argon2id hash has an unsupported version (%s)", parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("The Argon2id hash has invalid parameters (%s)", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("The Argon2id hash has an invalid salt: %s", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("The Argon2id hash has an invalid key: %s", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	if err := params.validate(); err != nil {
+		return params, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes secrets with bcrypt.  Hashes are encoded in the usual
+// modular crypt format:  $2a$<cost>$<salt and hash>
+type BcryptHasher struct {
+	// Cost is the log2 of the number of rounds (between 4 and 31)
+	Cost int
+}
+
+// Algorithm implements SecretHasher
+func (hasher BcryptHasher) Algorithm() string {
+	return HashBcrypt
+}
+
+// Hash implements SecretHasher
+func (hasher BcryptHasher) Hash(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), hasher.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Verify implements SecretHasher
+func (hasher BcryptHasher) Verify(encoded, secret string) error {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(secret))
+}
+
+// NeedsRehash implements SecretHasher
+func (hasher BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != hasher.Cost
+}
+
+// hasherFor returns a hasher for the algorithm (and parameters) an encoded hash was made with
+func hasherFor(encoded string) (SecretHasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$"+HashArgon2id+"$"):
+		params, _, _, err := decodeArgon2id(encoded)
+		return params, err
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return BcryptHasher{Cost: cost}, err
+	}
+
+	return nil, fmt.Errorf("The hash isn't an Argon2id or bcrypt hash")
+}
+
+// verifySecret returns nil if the secret matches the encoded hash (made with any supported algorithm)
+func verifySecret(encoded, secret string) error {
+	hasher, err := hasherFor(encoded)
+	if err != nil {
+		return err
+	}
+
+	return hasher.Verify(encoded, secret)
+}
+
+// SetSecretHasher sets the hasher used for new secrets.  Existing secrets are
+// hashed again with it the next time they're used to log in
+func (store *DBManager) SetSecretHasher(hasher SecretHasher) {
+	store.hasher = hasher
+}
+
+// secretUpgraded returns 'true' if a stored secret hash could have been hashed again
+// from an older one at login:  the older hash was made with another algorithm or
+// different parameters, and the stored one with the current settings
+func (store DBManager) secretUpgraded(stored, older string) bool {
+	return store.hasher.NeedsRehash(older) && store.hasher.NeedsRehash(stored) == false
+}
+
+// rehashSecret hashes a user's secret again (after it has been checked) if it was hashed
+// with another algorithm or different parameters.  Problems are logged -- the secret
+// still works with its old hash
+func (store DBManager) rehashSecret(user User, secret string) {
+	if store.hasher.NeedsRehash(user.SecretHash) == false {
+		return
+	}
+
+	hashedSecret, err := store.hasher.Hash(secret)
+	if err == nil {
+		err = store.systemdb.ReplaceUserSecretHash(user.ID, user.SecretHash, hashedSecret)
+	}
+
+	if err != nil {
+		store.log().Error("Problem hashing a secret again", logging.FieldUserID, user.ID, "error", err)
+		return
+	}
+
+	store.log().Info("Secret hashed again", logging.FieldUserID, user.ID, "algorithm", store.hasher.Algorithm())
+}
@@ -0,0 +1,181 @@
+package data_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//	An Argon2id hasher for tests:  cheaper than the default, so tests run quickly
+var testArgon2idHasher = data.Argon2idHasher{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+//	Returns the secret hash of the user with the given id (or blank if it wasn't found)
+func secretHashFor(t *testing.T, db *data.DBManager, context data.User, userID string) string {
+	users, err := db.GetAllUsers(context)
+	if err != nil {
+		t.Errorf("GetAllUsers failed: %s", err)
+	}
+
+	for _, user := range users {
+		if user.ID == userID {
+			return user.SecretHash
+		}
+	}
+
+	return ""
+}
+
+func TestSecretHash_Argon2id_HashesAndVerifies(t *testing.T) {
+	//	Arrange
+	secret := "argon2idsecret"
+
+	//	Act
+	hash, err := testArgon2idHasher.Hash(secret)
+	otherHash, _ := testArgon2idHasher.Hash(secret)
+
+	//	Assert
+	if err != nil || strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") != true {
+		t.Errorf("Hash failed: Should have encoded the algorithm and parameters in the hash, but got '%s' (%v)", hash, err)
+	}
+
+	if hash == otherHash {
+		t.Errorf("Hash failed: Should have used a random salt for each hash")
+	}
+
+	if testArgon2idHasher.Verify(hash, secret) != nil || testArgon2idHasher.Verify(hash, "notthesecret") == nil {
+		t.Errorf("Verify failed: Should have only matched the right secret")
+	}
+
+	if testArgon2idHasher.Verify("$argon2id$v=19$m=0,t=0,p=0$c2FsdA$a2V5", secret) == nil {
+		t.Errorf("Verify failed: Should have rejected a hash with invalid parameters")
+	}
+}
+
+func TestSecretHash_Argon2id_RejectsExpensiveParameters(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	salt, key := "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	hashes := []string{
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=4294967295,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=255$" + salt + "$" + key,
+	}
+
+	cheap, _ := testArgon2idHasher.Hash("argon2idsecret")
+	if _, err := db.AddUserWithSecretHash(uctx, data.User{Name: "TestCheapHash", SecretHash: cheap}); err != nil {
+		t.Errorf("AddUserWithSecretHash failed: Should have added a user with a reasonable hash, but got: %s", err)
+	}
+
+	for _, hash := range hashes {
+		//	Act
+		verifyErr := testArgon2idHasher.Verify(hash, "argon2idsecret")
+		_, addErr := db.AddUserWithSecretHash(uctx, data.User{Name: "TestExpensiveHash", SecretHash: hash})
+
+		//	Assert
+		if verifyErr == nil || addErr == nil {
+			t.Errorf("Verify failed: Should have rejected a hash with expensive parameters: %s", hash)
+		}
+	}
+}
+
+func TestSecretHash_NeedsRehash_WhenAlgorithmOrParametersChange(t *testing.T) {
+	//	Arrange
+	argon2idHash, _ := testArgon2idHasher.Hash("rehashsecret")
+	bcryptHash, _ := data.BcryptHasher{Cost: bcrypt.MinCost}.Hash("rehashsecret")
+	stronger := testArgon2idHasher
+	stronger.Iterations = 2
+
+	//	Act
+	sameParams := testArgon2idHasher.NeedsRehash(argon2idHash)
+	newParams := stronger.NeedsRehash(argon2idHash)
+	fromBcrypt := testArgon2idHasher.NeedsRehash(bcryptHash)
+	newCost := data.BcryptHasher{Cost: bcrypt.MinCost + 1}.NeedsRehash(bcryptHash)
+	fromArgon2id := data.BcryptHasher{Cost: bcrypt.MinCost}.NeedsRehash(argon2idHash)
+
+	//	Assert
+	if sameParams != false {
+		t.Errorf("NeedsRehash failed: Shouldn't need to hash again with the same parameters")
+	}
+
+	if newParams != true || newCost != true {
+		t.Errorf("NeedsRehash failed: Should need to hash again when parameters change")
+	}
+
+	if fromBcrypt != true || fromArgon2id != true {
+		t.Errorf("NeedsRehash failed: Should need to hash again when the algorithm changes")
+	}
+}
+
+func TestSecretHash_Login_UpgradesHash(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetPasswordPolicy(data.PasswordPolicy{MinLength: 8, History: 2})
+	db.SetSecretHasher(data.BcryptHasher{Cost: bcrypt.MinCost})
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestSecretHash1"}, "upgradepassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	//	Act
+	db.SetSecretHasher(testArgon2idHasher)
+	_, wrongErr := db.GetUserScopesWithCredentials(newUser.Name, "notthepassword")
+	wrongHash := secretHashFor(t, db, uctx, newUser.ID)
+	_, loginErr := db.GetUserScopesWithCredentials(newUser.Name, "upgradepassword")
+	upgradedHash := secretHashFor(t, db, uctx, newUser.ID)
+	_, upgradedLoginErr := db.GetUserScopesWithCredentials(newUser.Name, "upgradepassword")
+	_, reuseErr := db.ResetPassword(uctx, newUser.ID, "upgradepassword")
+
+	//	Assert
+	if wrongErr == nil || strings.HasPrefix(wrongHash, "$2a$") != true {
+		t.Errorf("GetUserScopesWithCredentials failed: Shouldn't have changed the hash for a wrong password, but got '%s'", wrongHash)
+	}
+
+	if loginErr != nil || strings.HasPrefix(upgradedHash, "$argon2id$") != true {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have hashed the password again with Argon2id, but got '%s' (%v)", upgradedHash, loginErr)
+	}
+
+	if upgradedLoginErr != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have logged in with the upgraded hash, but got: %s", upgradedLoginErr)
+	}
+
+	if rules := strings.Join(violatedRules(reuseErr), ","); rules != "history" {
+		t.Errorf("ResetPassword failed: Should have found the upgraded hash in the password history, but got '%s'", rules)
+	}
+}
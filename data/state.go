@@ -0,0 +1,516 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// State is a declarative description of the resources, roles, users and
+// user/resource/role assignments in the system.  Items are matched by name.
+// The built-in admin user, system resource and system roles are never part of
+// a State, but assignments can refer to the system resource and roles by name
+type State struct {
+	Resources   []StateItem       `json:"resources" yaml:"resources"`
+	Roles       []StateItem       `json:"roles" yaml:"roles"`
+	Users       []StateUser       `json:"users" yaml:"users"`
+	Assignments []StateAssignment `json:"assignments" yaml:"assignments"`
+}
+
+// StateItem is a resource or role in a State
+type StateItem struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// StateUser is a user in a State.  The secret hash is optional -- users
+// created without one can't log in until a secret is set.  Directory users
+// (with a source of 'directory') never have one:  they log in with the directory
+type StateUser struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Source      string `json:"source,omitempty" yaml:"source,omitempty"`
+	SecretHash  string `json:"secrethash,omitempty" yaml:"secrethash,omitempty"`
+}
+
+// StateAssignment assigns a user a role within a resource (all by name)
+type StateAssignment struct {
+	User     string `json:"user" yaml:"user"`
+	Resource string `json:"resource" yaml:"resource"`
+	Role     string `json:"role" yaml:"role"`
+}
+
+// Plan actions
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanRemove = "remove"
+)
+
+// PlanChange is a single difference between the system and a State
+type PlanChange struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// String formats the change for display in a plan
+func (change PlanChange) String() string {
+	symbol := map[string]string{PlanCreate: "+", PlanUpdate: "~", PlanRemove: "-"}[change.Action]
+
+	retval := fmt.Sprintf("%s %s %s '%s'", symbol, change.Action, change.Kind, change.Name)
+	if change.Detail != "" {
+		retval += " (" + change.Detail + ")"
+	}
+
+	return retval
+}
+
+// String formats the assignment as user/resource/role
+func (assignment StateAssignment) String() string {
+	return assignment.User + "/" + assignment.Resource + "/" + assignment.Role
+}
+
+// ExportState returns the current State of the system.  User secret
+// hashes are only included if 'includeSecrets' is set
+func (store DBManager) ExportState(context User, includeSecrets bool) (State, error) {
+	store, end := store.startSpan("ExportState")
+	defer end()
+
+	retval := State{
+		Resources:   []StateItem{},
+		Roles:       []StateItem{},
+		Users:       []StateUser{},
+		Assignments: []StateAssignment{},
+	}
+
+	//	Validate:  Does the context user have permission to execute the request?
+	if store.userIsSystemAdmin(context.ID) == false {
+		return retval, fmt.Errorf("User '%s' does not have permission to export the system", context.Name)
+	}
+
+	snapshot, err := store.systemdb.ExportSystem()
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting the system: %s", err)
+	}
+
+	resourceNames := map[string]string{}
+	for _, resource := range snapshot.Resources {
+		resourceNames[resource.ID] = resource.Name
+		if resource.ID != BuiltIn.SystemResource {
+			retval.Resources = append(retval.Resources, StateItem{Name: resource.Name, Description: resource.Description})
+		}
+	}
+
+	roleNames := map[string]string{}
+	for _, role := range snapshot.Roles {
+		roleNames[role.ID] = role.Name
+		if role.ID != BuiltIn.AdminRole && role.ID != BuiltIn.ResourceDelegateRole {
+			retval.Roles = append(retval.Roles, StateItem{Name: role.Name, Description: role.Description})
+		}
+	}
+
+	userNames := map[string]string{}
+	for _, user := range snapshot.Users {
+		userNames[user.ID] = user.Name
+		if user.ID == BuiltIn.AdminUser {
+			continue
+		}
+
+		item := StateUser{Name: user.Name, Description: user.Description, Source: user.Source}
+		if includeSecrets {
+			item.SecretHash = user.SecretHash
+		}
+		retval.Users = append(retval.Users, item)
+	}
+
+	for _, urr := range snapshot.UserResourceRoles {
+		if urr.UserID == BuiltIn.AdminUser {
+			continue
+		}
+
+		retval.Assignments = append(retval.Assignments, StateAssignment{
+			User:     userNames[urr.UserID],
+			Resource: resourceNames[urr.ResourceID],
+			Role:     roleNames[urr.RoleID],
+		})
+	}
+
+	//	Sort everything, so exports can be diffed
+	sort.Slice(retval.Resources, func(i, j int) bool { return retval.Resources[i].Name < retval.Resources[j].Name })
+	sort.Slice(retval.Roles, func(i, j int) bool { return retval.Roles[i].Name < retval.Roles[j].Name })
+	sort.Slice(retval.Users, func(i, j int) bool { return retval.Users[i].Name < retval.Users[j].Name })
+	sort.Slice(retval.Assignments, func(i, j int) bool {
+		return retval.Assignments[i].String() < retval.Assignments[j].String()
+	})
+
+	return retval, nil
+}
+
+// PlanState returns the changes needed to make the system match the desired State
+func (store DBManager) PlanState(context User, desired State) ([]PlanChange, error) {
+	store, end := store.startSpan("PlanState")
+	defer end()
+
+	retval := []PlanChange{}
+
+	//	Get the current state (with secrets, so they can be compared)
+	current, err := store.ExportState(context, true)
+	if err != nil {
+		return retval, err
+	}
+
+	//	Make sure the desired state makes sense
+	if err := store.validateState(desired); err != nil {
+		return retval, err
+	}
+
+	//	Resources
+	currentResources := map[string]StateItem{}
+	for _, item := range current.Resources {
+		currentResources[item.Name] = item
+	}
+	retval = append(retval, planItems("resource", currentResources, desired.Resources)...)
+
+	//	Roles
+	currentRoles := map[string]StateItem{}
+	for _, item := range current.Roles {
+		currentRoles[item.Name] = item
+	}
+	retval = append(retval, planItems("role", currentRoles, desired.Roles)...)
+
+	//	Users
+	currentUsers := map[string]StateUser{}
+	for _, item := range current.Users {
+		currentUsers[item.Name] = item
+	}
+
+	desiredUsers := map[string]bool{}
+	for _, item := range desired.Users {
+		desiredUsers[item.Name] = true
+
+		existing, found := currentUsers[item.Name]
+		switch {
+		case found == false:
+			retval = append(retval, PlanChange{Action: PlanCreate, Kind: "user", Name: item.Name})
+		case existing.Description != item.Description:
+			retval = append(retval, PlanChange{Action: PlanUpdate, Kind: "user", Name: item.Name, Detail: "description"})
+		case existing.Source != item.Source:
+			retval = append(retval, PlanChange{Action: PlanUpdate, Kind: "user", Name: item.Name, Detail: "source"})
+		case item.SecretHash != "" && existing.SecretHash != item.SecretHash && store.secretUpgraded(existing.SecretHash, item.SecretHash) == false:
+			retval = append(retval, PlanChange{Action: PlanUpdate, Kind: "user", Name: item.Name, Detail: "secret"})
+		}
+	}
+
+	for _, item := range current.Users {
+		if desiredUsers[item.Name] == false {
+			retval = append(retval, PlanChange{Action: PlanRemove, Kind: "user", Name: item.Name})
+		}
+	}
+
+	//	Assignments
+	currentAssignments := map[StateAssignment]bool{}
+	for _, item := range current.Assignments {
+		currentAssignments[item] = true
+	}
+
+	desiredAssignments := map[StateAssignment]bool{}
+	for _, item := range desired.Assignments {
+		desiredAssignments[item] = true
+
+		if currentAssignments[item] == false {
+			retval = append(retval, PlanChange{Action: PlanCreate, Kind: "assignment", Name: item.String()})
+		}
+	}
+
+	for _, item := range current.Assignments {
+		if desiredAssignments[item] == false {
+			retval = append(retval, PlanChange{Action: PlanRemove, Kind: "assignment", Name: item.String()})
+		}
+	}
+
+	return retval, nil
+}
+
+// ApplyState creates the resources, roles, users and assignments in the desired State
+// that don't exist yet (using AddResource, AddRole, AddUserWithSecretHash -- keeping
+// directory users' source -- and AddUserToResourceWithRole) and returns the changes that were made.  Updates and
+// removals can't be applied, so if the plan has any, nothing is changed and an error
+// is returned (see NotApplied)
+func (store DBManager) ApplyState(context User, desired State) ([]PlanChange, error) {
+	store, end := store.startSpan("ApplyState")
+	defer end()
+
+	applied := []PlanChange{}
+
+	plan, err := store.PlanState(context, desired)
+	if err != nil {
+		return applied, err
+	}
+
+	//	Creating only part of the plan would leave the same updates and removals
+	//	to plan every time, so don't change anything
+	if notApplied := NotApplied(plan); len(notApplied) > 0 {
+		return applied, fmt.Errorf("The state would update or remove %v items, which can't be applied -- make those changes by hand (or change the state to match the system) and import it again", len(notApplied))
+	}
+
+	//	Find the items to create
+	creates := map[string]map[string]bool{"resource": {}, "role": {}, "user": {}, "assignment": {}}
+	for _, change := range plan {
+		creates[change.Kind][change.Name] = true
+	}
+
+	//	Resources
+	for _, item := range desired.Resources {
+		if creates["resource"][item.Name] == false {
+			continue
+		}
+
+		if _, err := store.AddResource(context, Resource{Name: item.Name, Description: item.Description}); err != nil {
+			return applied, fmt.Errorf("Problem creating resource '%s': %s", item.Name, err)
+		}
+		applied = append(applied, PlanChange{Action: PlanCreate, Kind: "resource", Name: item.Name})
+	}
+
+	//	Roles
+	for _, item := range desired.Roles {
+		if creates["role"][item.Name] == false {
+			continue
+		}
+
+		if _, err := store.AddRole(context, Role{Name: item.Name, Description: item.Description}); err != nil {
+			return applied, fmt.Errorf("Problem creating role '%s': %s", item.Name, err)
+		}
+		applied = append(applied, PlanChange{Action: PlanCreate, Kind: "role", Name: item.Name})
+	}
+
+	//	Users
+	for _, item := range desired.Users {
+		if creates["user"][item.Name] == false {
+			continue
+		}
+
+		user := User{Name: item.Name, Description: item.Description, Source: item.Source, SecretHash: item.SecretHash}
+		if _, err := store.addUserWithSecretHash(context, user); err != nil {
+			return applied, fmt.Errorf("Problem creating user '%s': %s", item.Name, err)
+		}
+		applied = append(applied, PlanChange{Action: PlanCreate, Kind: "user", Name: item.Name})
+	}
+
+	//	Assignments -- look up everything by name (including what we just created)
+	if len(creates["assignment"]) == 0 {
+		return applied, nil
+	}
+
+	snapshot, err := store.systemdb.ExportSystem()
+	if err != nil {
+		return applied, fmt.Errorf("Problem getting the system to create assignments: %s", err)
+	}
+
+	users, resources, roles := snapshotNameIndex(snapshot)
+	for _, item := range desired.Assignments {
+		if creates["assignment"][item.String()] == false {
+			continue
+		}
+
+		if _, err := store.AddUserToResourceWithRole(context, users[item.User], resources[item.Resource], roles[item.Role]); err != nil {
+			return applied, fmt.Errorf("Problem creating assignment '%s': %s", item, err)
+		}
+		applied = append(applied, PlanChange{Action: PlanCreate, Kind: "assignment", Name: item.String()})
+	}
+
+	return applied, nil
+}
+
+// NotApplied returns the changes in a plan that ApplyState can't make (updates and removals)
+func NotApplied(plan []PlanChange) []PlanChange {
+	retval := []PlanChange{}
+	for _, change := range plan {
+		if change.Action != PlanCreate {
+			retval = append(retval, change)
+		}
+	}
+
+	return retval
+}
+
+// validateState makes sure every item has a unique name and every assignment
+// refers to items that are either in the state or already in the system
+func (store DBManager) validateState(state State) error {
+	snapshot, err := store.systemdb.ExportSystem()
+	if err != nil {
+		return fmt.Errorf("Problem getting the system to validate the state: %s", err)
+	}
+	users, resources, roles := snapshotNameIndex(snapshot)
+
+	knownUsers := map[string]bool{}
+	for name := range users {
+		knownUsers[name] = true
+	}
+	knownResources := map[string]bool{}
+	for name := range resources {
+		knownResources[name] = true
+	}
+	knownRoles := map[string]bool{}
+	for name := range roles {
+		knownRoles[name] = true
+	}
+
+	//	The built-in items are managed by authserver, not by a state
+	builtIn := map[string]bool{}
+	for name, item := range users {
+		builtIn["user "+name] = item.ID == BuiltIn.AdminUser
+	}
+	for name, item := range resources {
+		builtIn["resource "+name] = item.ID == BuiltIn.SystemResource
+	}
+	for name, item := range roles {
+		builtIn["role "+name] = item.ID == BuiltIn.AdminRole || item.ID == BuiltIn.ResourceDelegateRole
+	}
+
+	//	Check for missing, duplicate and built-in names
+	seen := map[string]bool{}
+	for _, item := range state.Resources {
+		if item.Name == "" || seen[item.Name] {
+			return fmt.Errorf("Every resource needs a unique name -- found '%s'", item.Name)
+		}
+		if builtIn["resource "+item.Name] {
+			return fmt.Errorf("The resource '%s' is built in and can't be part of a state", item.Name)
+		}
+		seen[item.Name] = true
+		knownResources[item.Name] = true
+	}
+
+	seen = map[string]bool{}
+	for _, item := range state.Roles {
+		if item.Name == "" || seen[item.Name] {
+			return fmt.Errorf("Every role needs a unique name -- found '%s'", item.Name)
+		}
+		if builtIn["role "+item.Name] {
+			return fmt.Errorf("The role '%s' is built in and can't be part of a state", item.Name)
+		}
+		seen[item.Name] = true
+		knownRoles[item.Name] = true
+	}
+
+	seen = map[string]bool{}
+	for _, item := range state.Users {
+		if item.Name == "" || seen[item.Name] {
+			return fmt.Errorf("Every user needs a unique name -- found '%s'", item.Name)
+		}
+		if builtIn["user "+item.Name] {
+			return fmt.Errorf("The user '%s' is built in and can't be part of a state", item.Name)
+		}
+		if item.Source != "" && item.Source != UserSourceDirectory {
+			return fmt.Errorf("The user '%s' has an unknown source '%s' -- it has to be blank or '%s'", item.Name, item.Source, UserSourceDirectory)
+		}
+		if item.Source == UserSourceDirectory && item.SecretHash != "" {
+			return fmt.Errorf("The user '%s' is a directory user, so they can't have a secret hash", item.Name)
+		}
+		seen[item.Name] = true
+		knownUsers[item.Name] = true
+	}
+
+	//	Check the assignments
+	for _, item := range state.Assignments {
+		if knownUsers[item.User] == false || knownResources[item.Resource] == false || knownRoles[item.Role] == false {
+			return fmt.Errorf("The user, resource, and role for assignment '%s' must be in the state or already exist in the system", item)
+		}
+	}
+
+	return nil
+}
+
+// planItems returns the changes needed to make the current resources (or roles) match the desired ones
+func planItems(kind string, current map[string]StateItem, desired []StateItem) []PlanChange {
+	retval := []PlanChange{}
+
+	desiredNames := map[string]bool{}
+	for _, item := range desired {
+		desiredNames[item.Name] = true
+
+		existing, found := current[item.Name]
+		switch {
+		case found == false:
+			retval = append(retval, PlanChange{Action: PlanCreate, Kind: kind, Name: item.Name})
+		case existing.Description != item.Description:
+			retval = append(retval, PlanChange{Action: PlanUpdate, Kind: kind, Name: item.Name, Detail: "description"})
+		}
+	}
+
+	//	Sort the removals, so plans are stable
+	removed := []string{}
+	for name := range current {
+		if desiredNames[name] == false {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	for _, name := range removed {
+		retval = append(retval, PlanChange{Action: PlanRemove, Kind: kind, Name: name})
+	}
+
+	return retval
+}
+
+// snapshotNameIndex indexes the users, resources and roles in a snapshot by name
+func snapshotNameIndex(snapshot SystemSnapshot) (map[string]User, map[string]Resource, map[string]Role) {
+	users := map[string]User{}
+	for _, item := range snapshot.Users {
+		users[item.Name] = item
+	}
+
+	resources := map[string]Resource{}
+	for _, item := range snapshot.Resources {
+		resources[item.Name] = item
+	}
+
+	roles := map[string]Role{}
+	for _, item := range snapshot.Roles {
+		roles[item.Name] = item
+	}
+
+	return users, resources, roles
+}
+
+// ReadState reads a State document.  YAML is a superset of JSON, so this reads both
+func ReadState(r io.Reader) (State, error) {
+	retval := State{}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return retval, fmt.Errorf("Problem reading state: %s", err)
+	}
+
+	if err := yaml.UnmarshalStrict(contents, &retval); err != nil {
+		return retval, fmt.Errorf("Problem parsing state: %s", err)
+	}
+
+	return retval, nil
+}
+
+// WriteState writes a State document in the given format ('yaml' or 'json')
+func WriteState(w io.Writer, state State, format string) error {
+	switch format {
+	case "yaml", "yml":
+		contents, err := yaml.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("Problem writing state: %s", err)
+		}
+
+		_, err = w.Write(contents)
+		return err
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(state)
+	default:
+		return fmt.Errorf("Unknown state format '%s' -- use 'yaml' or 'json'", format)
+	}
+}
@@ -0,0 +1,316 @@
+package data_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//	A state document with a resource, role and user (with a pre-hashed secret) and an assignment
+func getTestState(t *testing.T) data.State {
+	hash, err := bcrypt.GenerateFromPassword([]byte("statepassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword failed: %s", err)
+	}
+
+	state, err := data.ReadState(strings.NewReader(`
+resources:
+  - name: TestResource1
+    description: Unit test resource
+roles:
+  - name: TestRole1
+    description: Unit test role
+users:
+  - name: TestUser1
+    description: Unit test user
+    secrethash: ` + string(hash) + `
+  - name: TestUser2
+assignments:
+  - user: TestUser1
+    resource: TestResource1
+    role: TestRole1
+  - user: TestUser2
+    resource: TestResource1
+    role: sys_delegate
+`))
+	if err != nil {
+		t.Fatalf("ReadState failed: Should have read the state without error: %s", err)
+	}
+
+	return state
+}
+
+func TestState_PlanState_NewItems_ReturnsCreates(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	state := getTestState(t)
+
+	//	Act
+	plan, err := db.PlanState(uctx, state)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("PlanState failed: Should have planned without error: %s", err)
+	}
+
+	if len(plan) != 6 {
+		t.Errorf("PlanState failed: Should have planned 6 changes, but got: %+v", plan)
+	}
+
+	for _, change := range plan {
+		if change.Action != data.PlanCreate {
+			t.Errorf("PlanState failed: Should have only planned creates, but got: %s", change)
+		}
+	}
+}
+
+func TestState_ApplyState_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	state := getTestState(t)
+
+	//	Act
+	applied, err := db.ApplyState(uctx, state)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("ApplyState failed: Should have applied without error: %s", err)
+	}
+
+	if len(applied) != 6 {
+		t.Errorf("ApplyState failed: Should have applied 6 changes, but got: %+v", applied)
+	}
+
+	//	-- the pre-hashed secret should work
+	scopes, err := db.GetUserScopesWithCredentials("TestUser1", "statepassword")
+	if err != nil {
+		t.Errorf("ApplyState failed: Should have created the user with the pre-hashed secret, but got: %s", err)
+	}
+
+	if len(scopes.ScopeResources) != 1 || scopes.ScopeResources[0].Name != "TestResource1" {
+		t.Errorf("ApplyState failed: Should have assigned the user to the resource, but got: %+v", scopes)
+	}
+
+	//	-- and there should be nothing left to do
+	plan, err := db.PlanState(uctx, state)
+	if err != nil {
+		t.Errorf("PlanState failed: Should have planned without error: %s", err)
+	}
+
+	if len(plan) != 0 {
+		t.Errorf("PlanState failed: Should have planned no changes after applying, but got: %+v", plan)
+	}
+}
+
+func TestState_PlanState_ChangedItems_ReturnsUpdatesAndRemoves(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	state := getTestState(t)
+	if _, err := db.ApplyState(uctx, state); err != nil {
+		t.Errorf("ApplyState failed: Should have applied without error: %s", err)
+	}
+
+	//	Change a description and drop the second user (and their assignment)
+	state.Resources[0].Description = "Changed description"
+	state.Users = state.Users[:1]
+	state.Assignments = state.Assignments[:1]
+
+	//	Act
+	plan, err := db.PlanState(uctx, state)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("PlanState failed: Should have planned without error: %s", err)
+	}
+
+	expected := []string{
+		"~ update resource 'TestResource1' (description)",
+		"- remove user 'TestUser2'",
+		"- remove assignment 'TestUser2/TestResource1/sys_delegate'",
+	}
+
+	if len(plan) != len(expected) {
+		t.Fatalf("PlanState failed: Should have planned %v changes, but got: %+v", len(expected), plan)
+	}
+
+	for i, change := range plan {
+		if change.String() != expected[i] {
+			t.Errorf("PlanState failed: Should have planned '%s', but got '%s'", expected[i], change)
+		}
+	}
+}
+
+func TestState_ApplyState_UpdatesAndRemoves_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	state := getTestState(t)
+	if _, err := db.ApplyState(uctx, state); err != nil {
+		t.Errorf("ApplyState failed: Should have applied without error: %s", err)
+	}
+
+	//	Add a role, and drop the second user (and their assignment)
+	state.Roles = append(state.Roles, data.StateItem{Name: "TestRole2"})
+	state.Users = state.Users[:1]
+	state.Assignments = state.Assignments[:1]
+
+	//	Act
+	applied, err := db.ApplyState(uctx, state)
+	plan, planErr := db.PlanState(uctx, state)
+
+	//	Assert
+	if err == nil || len(applied) != 0 {
+		t.Errorf("ApplyState failed: Shouldn't have applied a state with removals, but got %+v (%v)", applied, err)
+	}
+
+	if planErr != nil || len(plan) != 3 || len(data.NotApplied(plan)) != 2 {
+		t.Errorf("PlanState failed: Should have still planned the new role and the removals, but got %+v (%v)", plan, planErr)
+	}
+}
+
+func TestState_PlanState_UnknownAssignment_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	state := getTestState(t)
+	state.Assignments = append(state.Assignments, data.StateAssignment{User: "TestUser1", Resource: "NoSuchResource", Role: "TestRole1"})
+
+	//	Act
+	_, err = db.PlanState(uctx, state)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("PlanState failed: Should have returned an error for an assignment to an unknown resource")
+	}
+}
+
+func TestState_ExportState_RoundTrip_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	if _, err := db.ApplyState(uctx, getTestState(t)); err != nil {
+		t.Errorf("ApplyState failed: Should have applied without error: %s", err)
+	}
+
+	//	Act
+	exported, err := db.ExportState(uctx, false)
+	if err != nil {
+		t.Errorf("ExportState failed: Should have exported without error: %s", err)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := data.WriteState(buffer, exported, "json"); err != nil {
+		t.Errorf("WriteState failed: Should have written without error: %s", err)
+	}
+
+	state, err := data.ReadState(buffer)
+	if err != nil {
+		t.Errorf("ReadState failed: Should have read without error: %s", err)
+	}
+
+	plan, err := db.PlanState(uctx, state)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("PlanState failed: Should have planned without error: %s", err)
+	}
+
+	if len(exported.Users) != 2 || exported.Users[0].SecretHash != "" {
+		t.Errorf("ExportState failed: Should have exported 2 users without secrets, but got: %+v", exported.Users)
+	}
+
+	if len(plan) != 0 {
+		t.Errorf("PlanState failed: An exported state should plan no changes, but got: %+v", plan)
+	}
+}
@@ -0,0 +1,261 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SystemStore is a storage backend for users, resources, roles
+// and the user/resource/role assignments between them.  Permission checks
+// are done by the DBManager -- a SystemStore just persists and fetches items
+type SystemStore interface {
+	// Bootstrap creates the schema and adds the default admin user, system resource,
+	// system roles and admin credentials.  The admin user is created with the passed secret hash
+	Bootstrap(adminSecretHash string) error
+
+	// Migrate brings the schema of a store bootstrapped by an older version up to date.
+	// It's safe to run more than once, and does nothing if the store hasn't been bootstrapped
+	Migrate() error
+
+	// AddUser stores a new user with the given secret hash (adding it to their password
+	// history, if it isn't blank) and returns the stored user
+	AddUser(user User, secretHash, createdBy string) (User, error)
+
+	// SetUserSecretHash changes the user's secret hash and adds it to their password history,
+	// keeping the newest 'keep' entries.  It returns the updated user
+	SetUserSecretHash(userID, secretHash, updatedBy string, keep int) (User, error)
+
+	// ReplaceUserSecretHash swaps the user's secret hash for a new hash of the same secret (in
+	// their password history too), without changing when it was set.  If the user's secret
+	// hash isn't oldHash anymore, it's left alone
+	ReplaceUserSecretHash(userID, oldHash, newHash string) error
+
+	// GetPasswordHistory returns the user's password history, newest first
+	GetPasswordHistory(userID string) ([]PasswordHistory, error)
+
+	// GetUser returns the user with the given id
+	GetUser(userID string) (User, error)
+
+	// GetUserByName returns the user with the given name
+	GetUserByName(name string) (User, error)
+
+	// GetAllUsers returns all users
+	GetAllUsers() ([]User, error)
+
+	// AddResource stores a new resource and returns the stored resource
+	AddResource(resource Resource, createdBy string) (Resource, error)
+
+	// GetResource returns the resource with the given id
+	GetResource(resourceID string) (Resource, error)
+
+	// GetAllResources returns all resources
+	GetAllResources() ([]Resource, error)
+
+	// AddRole stores a new role and returns the stored role
+	AddRole(role Role, createdBy string) (Role, error)
+
+	// GetRole returns the role with the given id
+	GetRole(roleID string) (Role, error)
+
+	// GetAllRoles returns all roles
+	GetAllRoles() ([]Role, error)
+
+	// AddUserResourceRole assigns the user the role within the resource
+	AddUserResourceRole(userID, resourceID, roleID, createdBy string) (UserResourceRole, error)
+
+	// DeleteUserResourceRole removes the user's role within the resource
+	DeleteUserResourceRole(userID, resourceID, roleID string) error
+
+	// GetUserResourceRoles returns all resource/role assignments for the given user
+	GetUserResourceRoles(userID string) ([]UserResourceRole, error)
+
+	// GetResourcesForUser returns the distinct resources the given user has been assigned to
+	GetResourcesForUser(userID string) ([]ScopeResource, error)
+
+	// GetRolesForUserAndResource returns the distinct roles the given user has within the given resource
+	GetRolesForUserAndResource(userID, resourceID string) ([]ScopeRole, error)
+
+	// SetClientAuth stores how the user authenticates as a client (replacing what was there)
+	SetClientAuth(auth ClientAuth, updatedBy string) error
+
+	// GetClientAuth returns how the user authenticates as a client (a ClientAuth
+	// without a Method if that hasn't been set)
+	GetClientAuth(userID string) (ClientAuth, error)
+
+	// SetUserMFA stores the user's TOTP second factor (replacing what was there)
+	SetUserMFA(mfa UserMFA, updatedBy string) error
+
+	// ReplaceUserMFA stores the last code used and the recovery codes from 'after', if the user's
+	// second factor still has the ones from 'before'.  It returns 'false' (and changes nothing) if
+	// they've changed since -- someone else used a code at the same time
+	ReplaceUserMFA(before, after UserMFA, updatedBy string) (bool, error)
+
+	// GetUserMFA returns the user's TOTP second factor (a UserMFA without
+	// a Secret if they haven't set one up)
+	GetUserMFA(userID string) (UserMFA, error)
+
+	// DeleteUserMFA removes the user's TOTP second factor (and recovery codes)
+	DeleteUserMFA(userID string) error
+
+	// AddWebAuthnCredential stores a new WebAuthn credential for a user
+	AddWebAuthnCredential(credential WebAuthnCredential, createdBy string) error
+
+	// GetWebAuthnCredential returns the WebAuthn credential with the given (base64url) id
+	GetWebAuthnCredential(credentialID string) (WebAuthnCredential, error)
+
+	// GetWebAuthnCredentialsForUser returns the user's WebAuthn credentials, oldest first
+	GetWebAuthnCredentialsForUser(userID string) ([]WebAuthnCredential, error)
+
+	// UpdateWebAuthnCredentialUse records that a WebAuthn credential was used, and its new signature counter
+	UpdateWebAuthnCredentialUse(credentialID string, signCount uint32, used time.Time) error
+
+	// DeleteWebAuthnCredential removes a WebAuthn credential
+	DeleteWebAuthnCredential(credentialID string) error
+
+	// AddAuditEvent appends an event to the audit log, assigning it the next id.  It isn't
+	// chained to the events before it yet (see unchainedAuditEvent and SealAuditEvents)
+	AddAuditEvent(event AuditEvent, hmacKey []byte) (AuditEvent, error)
+
+	// SealAuditEvents chains the events added since the last chained event to the end of the
+	// log with chainAuditEvents (using the HMAC key, if there is one).  Only one writer chains
+	// events at a time:  if 'wait' isn't set and someone else is, it returns right away
+	SealAuditEvents(hmacKey []byte, wait bool) error
+
+	// GetAuditEvents returns up to 'limit' audit events with ids after 'afterID', oldest first
+	GetAuditEvents(afterID int64, limit int) ([]AuditEvent, error)
+
+	// GetLastAuditEventID returns the id of the newest chained audit event (0 if there aren't any)
+	GetLastAuditEventID() (int64, error)
+
+	// ExportSystem returns a consistent snapshot of all users, resources, roles and assignments
+	// (and everything else in the store but the audit log -- see GetAuditEvents)
+	ExportSystem() (SystemSnapshot, error)
+
+	// ImportSystem creates the schema and loads the snapshot (including its audit events) into an empty store
+	ImportSystem(snapshot SystemSnapshot) error
+
+	// Ping checks that the store can be reached
+	Ping() error
+
+	// Close closes the store
+	Close() error
+}
+
+// TokenStore is a storage backend for issued tokens
+type TokenStore interface {
+	// Bootstrap creates the token schema
+	Bootstrap() error
+
+	// Migrate brings the schema of a store bootstrapped by an older version up to date.
+	// It's safe to run more than once, and does nothing if the store hasn't been bootstrapped
+	Migrate() error
+
+	// AddToken expires any existing tokens for the token's user and stores the new token
+	AddToken(token Token) error
+
+	// GetToken returns the unexpired token with the given id
+	GetToken(tokenID string) (Token, error)
+
+	// RevokeToken expires the given token immediately
+	RevokeToken(tokenID, revokedBy string) error
+
+	// GetTokensForUser returns the unexpired tokens for the given user
+	GetTokensForUser(userID string) ([]Token, error)
+
+	// PurgeExpiredTokens removes tokens that expired before the given time (and login attempts,
+	// used ids and WebAuthn ceremonies forgotten before then) and returns the number of tokens removed
+	PurgeExpiredTokens(before time.Time) (int64, error)
+
+	// CountTokens returns the number of unexpired tokens
+	CountTokens() (int64, error)
+
+	// ExportTokens returns all unexpired tokens
+	ExportTokens() ([]Token, error)
+
+	// ImportTokens creates the schema (if needed) and loads the passed tokens
+	ImportTokens(tokens []Token) error
+
+	// AddLoginFailure records a failed login for the key ('user:<name>' or 'ip:<address>')
+	// and returns its login attempts.  The failures are forgotten once there hasn't been
+	// one for the window (and the key isn't locked out)
+	AddLoginFailure(key string, window time.Duration) (LoginAttempts, error)
+
+	// LockLogins locks out the key until the given time
+	LockLogins(key string, until time.Time) error
+
+	// GetLoginAttempts returns the login attempts for the key (with no failures if
+	// there haven't been any recently)
+	GetLoginAttempts(key string) (LoginAttempts, error)
+
+	// ResetLoginAttempts forgets the failed logins for the key (and ends any lockout)
+	ResetLoginAttempts(key string) error
+
+	// UseID records an id that can only be used once (like a DPoP proof's 'jti') until it
+	// expires.  It returns 'false' if the id has already been used (and hasn't expired)
+	UseID(id string, expires time.Time) (bool, error)
+
+	// AddWebAuthnCeremony keeps a WebAuthn ceremony until it's finished (or times out)
+	AddWebAuthnCeremony(ceremony WebAuthnCeremony) error
+
+	// TakeWebAuthnCeremony returns the unexpired ceremony for the challenge and forgets it, so
+	// it can only be finished once.  It returns 'false' if there isn't a ceremony for the challenge
+	TakeWebAuthnCeremony(challenge []byte) (WebAuthnCeremony, bool, error)
+
+	// Ping checks that the store can be reached
+	Ping() error
+
+	// Close closes the store
+	Close() error
+}
+
+// SystemSnapshot is everything stored in a SystemStore, with the items'
+// original ids, secret hashes and timestamps
+type SystemSnapshot struct {
+	Users               []User               `json:"users"`
+	Resources           []Resource           `json:"resources"`
+	Roles               []Role               `json:"roles"`
+	UserResourceRoles   []UserResourceRole   `json:"user_resource_roles"`
+	ClientAuth          []ClientAuth         `json:"client_auth,omitempty"`
+	PasswordHistory     []PasswordHistory    `json:"password_history,omitempty"`
+	UserMFA             []UserMFA            `json:"user_mfa,omitempty"`
+	WebAuthnCredentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"`
+	AuditEvents         []AuditEvent         `json:"audit_events,omitempty"` // only in backups
+}
+
+// openSystemStore opens the SystemStore described by the datastore.system setting.
+// Postgres DSNs (postgres://...) use PostgreSQL, sqlite://path uses SQLite --
+// anything else is treated as a QL database file
+func openSystemStore(dsn string) (SystemStore, error) {
+	switch {
+	case isRedisDSN(dsn):
+		return nil, fmt.Errorf("Redis can only be used as a token datastore")
+	case isPostgresDSN(dsn):
+		return newSQLSystemStore(postgresDialect, dsn)
+	case isSQLiteDSN(dsn):
+		return newSQLSystemStore(sqliteDialect, sqliteConnectionString(dsn))
+	default:
+		return newSQLSystemStore(qlDialect, dsn)
+	}
+}
+
+// openTokenStore opens the TokenStore described by the datastore.tokens setting.
+// Postgres DSNs (postgres://...) use PostgreSQL, sqlite://path uses SQLite,
+// redis://... uses Redis -- anything else is treated as a QL database file
+func openTokenStore(dsn string) (TokenStore, error) {
+	switch {
+	case isRedisDSN(dsn):
+		return newRedisTokenStore(dsn)
+	case isPostgresDSN(dsn):
+		return newSQLTokenStore(postgresDialect, dsn)
+	case isSQLiteDSN(dsn):
+		return newSQLTokenStore(sqliteDialect, sqliteConnectionString(dsn))
+	default:
+		return newSQLTokenStore(qlDialect, dsn)
+	}
+}
+
+// isPostgresDSN returns 'true' if the passed datastore setting is a PostgreSQL connection url
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
@@ -0,0 +1,394 @@
+package data
+
+import (
+	"database/sql"
+
+	// PostgreSQL sql driver
+	_ "github.com/lib/pq"
+)
+
+/* Tables */
+// pgSchemaVersionSchema defines the schema for the schema_version table
+var pgSchemaVersionSchema = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	store text NOT NULL,
+	version integer NOT NULL
+);`
+
+// pgResourceSchema defines the schema for the resource table
+var pgResourceSchema = `
+CREATE TABLE IF NOT EXISTS resource (
+	id text NOT NULL,
+	name text NOT NULL,
+	description text,
+	created timestamptz NOT NULL,
+	createdby text NOT NULL,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamptz,
+	deletedby text
+);`
+
+// pgRoleSchema defines the schema for the role table
+var pgRoleSchema = `
+CREATE TABLE IF NOT EXISTS role (
+	id text NOT NULL,
+	name text NOT NULL,
+	description text,
+	created timestamptz NOT NULL,
+	createdby text NOT NULL,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamptz,
+	deletedby text
+);`
+
+// pgUserSchema defines the schema for the user table.  'user' is
+// a reserved word in PostgreSQL, so the table name is always quoted
+var pgUserSchema = `
+CREATE TABLE IF NOT EXISTS "user" (
+	id text NOT NULL,
+	enabled boolean NOT NULL,
+	name text NOT NULL,
+	description text,
+	secrethash text,
+	created timestamptz NOT NULL,
+	createdby text NOT NULL,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamptz,
+	deletedby text,
+	source text
+);`
+
+// pgUserResourceRoleSchema defines the schema for the user_resource_role table
+var pgUserResourceRoleSchema = `
+CREATE TABLE IF NOT EXISTS user_resource_role (
+	userid text NOT NULL,
+	resourceid text NOT NULL,
+	roleid text NOT NULL,
+	created timestamptz NOT NULL,
+	createdby text NOT NULL,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamptz,
+	deletedby text
+);`
+
+// pgAuditSchema defines the schema for the audit table
+var pgAuditSchema = `
+CREATE TABLE IF NOT EXISTS audit (
+	id bigint NOT NULL,
+	created timestamptz NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	targettype text,
+	targetid text,
+	ip text,
+	clientid text,
+	detail text,
+	beforevalue text,
+	aftervalue text,
+	prevhash text,
+	hash text,
+	hmac text
+);`
+
+// pgTokenSchema defines the schema for the token table
+var pgTokenSchema = `
+CREATE TABLE IF NOT EXISTS tokens (
+	token text NOT NULL,
+	userid text NOT NULL,
+	created timestamptz NOT NULL,
+	expires timestamptz NOT NULL,
+	deleted timestamptz,
+	deletedby text,
+	x5ts256 text,
+	jkt text,
+	amr text
+);`
+
+// pgLoginAttemptsSchema defines the schema for the login_attempts table
+var pgLoginAttemptsSchema = `
+CREATE TABLE IF NOT EXISTS login_attempts (
+	attemptkey text NOT NULL,
+	failures integer NOT NULL,
+	lastfailure timestamptz NOT NULL,
+	lockeduntil timestamptz,
+	expires timestamptz NOT NULL
+);`
+
+// pgUsedIDSchema defines the schema for the used_ids table
+var pgUsedIDSchema = `
+CREATE TABLE IF NOT EXISTS used_ids (
+	usedid text NOT NULL,
+	expires timestamptz NOT NULL
+);`
+
+// pgWebAuthnCeremonySchema defines the schema for the webauthn_ceremony table
+var pgWebAuthnCeremonySchema = `
+CREATE TABLE IF NOT EXISTS webauthn_ceremony (
+	challenge text NOT NULL,
+	userid text,
+	registration boolean,
+	passkey boolean NOT NULL,
+	expires timestamptz NOT NULL
+);`
+
+// pgClientAuthSchema defines the schema for the client_auth table
+var pgClientAuthSchema = `
+CREATE TABLE IF NOT EXISTS client_auth (
+	userid text NOT NULL,
+	method text NOT NULL,
+	settings text,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL
+);`
+
+// pgPasswordHistorySchema defines the schema for the password_history table
+var pgPasswordHistorySchema = `
+CREATE TABLE IF NOT EXISTS password_history (
+	userid text NOT NULL,
+	secrethash text NOT NULL,
+	created timestamptz NOT NULL
+);`
+
+// pgUserMFASchema defines the schema for the user_mfa table
+var pgUserMFASchema = `
+CREATE TABLE IF NOT EXISTS user_mfa (
+	userid text NOT NULL,
+	secret text NOT NULL,
+	confirmed boolean NOT NULL,
+	laststep bigint NOT NULL,
+	recoverycodes text,
+	updated timestamptz NOT NULL,
+	updatedby text NOT NULL
+);`
+
+// pgWebAuthnCredentialSchema defines the schema for the webauthn_credential table
+var pgWebAuthnCredentialSchema = `
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+	id text NOT NULL,
+	userid text NOT NULL,
+	name text NOT NULL,
+	publickey text NOT NULL,
+	signcount bigint NOT NULL,
+	aaguid text,
+	transports text,
+	passkey boolean NOT NULL,
+	created timestamptz NOT NULL,
+	createdby text NOT NULL,
+	lastused timestamptz
+);`
+
+/* Indices */
+var pgUserIXSysID = `
+CREATE UNIQUE INDEX IF NOT EXISTS UserID ON "user" (id)`
+
+var pgUserIXName = `
+CREATE UNIQUE INDEX IF NOT EXISTS UserName ON "user" (name)`
+
+// pgResetAuditID moves the audit id sequence past the last event
+var pgResetAuditID = "SELECT setval('audit_id_seq', (SELECT COALESCE(max(id), 0) + 1 FROM audit), false);"
+
+// postgresDialect is the sqlDialect for PostgreSQL
+var postgresDialect = sqlDialect{
+	driver: "postgres",
+
+	//	Take export snapshots in a single read-only repeatable read transaction
+	exportTxOptions: &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+
+	systemSchema: []schemaStatement{
+		{"schema_version schema", pgSchemaVersionSchema},
+		{"resource schema", pgResourceSchema},
+		{"resource id index", resourceIXSysID},
+		{"resource name index", resourceIXName},
+		{"role schema", pgRoleSchema},
+		{"role id index", roleIXSysID},
+		{"user schema", pgUserSchema},
+		{"user id index", pgUserIXSysID},
+		{"user name index", pgUserIXName},
+		{"user_resource_role schema", pgUserResourceRoleSchema},
+		{"user_resource_role id index", userResourceRoleIXID},
+		{"audit schema", pgAuditSchema},
+		{"audit id index", auditIXID},
+		{"audit id sequence", "CREATE SEQUENCE IF NOT EXISTS audit_id_seq;"},
+		{"client_auth schema", pgClientAuthSchema},
+		{"client_auth user index", clientAuthIXUserID},
+		{"password_history schema", pgPasswordHistorySchema},
+		{"password_history user index", passwordHistoryIXUserID},
+		{"user_mfa schema", pgUserMFASchema},
+		{"user_mfa user index", userMFAIXUserID},
+		{"webauthn_credential schema", pgWebAuthnCredentialSchema},
+		{"webauthn_credential id index", webauthnCredentialIXID},
+		{"webauthn_credential user index", webauthnCredentialIXUserID},
+	},
+
+	tokenSchema: []schemaStatement{
+		{"schema_version schema", pgSchemaVersionSchema},
+		{"token schema", pgTokenSchema},
+		{"token index", tokenIXToken},
+		{"token user index", tokenIXUserID},
+		{"login_attempts schema", pgLoginAttemptsSchema},
+		{"login_attempts key index", loginAttemptsIXKey},
+		{"used_ids schema", pgUsedIDSchema},
+		{"used_ids id index", usedIDIXID},
+		{"webauthn_ceremony schema", pgWebAuthnCeremonySchema},
+		{"webauthn_ceremony challenge index", webauthnCeremonyIXChallenge},
+	},
+
+	systemMigrations: []migration{
+		{version: 1, name: "audit log", statements: []string{pgAuditSchema, auditIXID}},
+		{version: 2, name: "audit log chain", applied: "SELECT hmac FROM audit LIMIT 1;", statements: []string{
+			"ALTER TABLE audit ADD COLUMN IF NOT EXISTS prevhash text;",
+			"ALTER TABLE audit ADD COLUMN IF NOT EXISTS hash text;",
+			"ALTER TABLE audit ADD COLUMN IF NOT EXISTS hmac text;",
+		}},
+		{version: 3, name: "client authentication", statements: []string{pgClientAuthSchema, clientAuthIXUserID}},
+		{version: 4, name: "password history", statements: []string{pgPasswordHistorySchema, passwordHistoryIXUserID}},
+		{version: 5, name: "TOTP second factors", statements: []string{pgUserMFASchema, userMFAIXUserID}},
+		{version: 6, name: "WebAuthn credentials", statements: []string{pgWebAuthnCredentialSchema, webauthnCredentialIXID, webauthnCredentialIXUserID}},
+		{version: 7, name: "audit id sequence", statements: []string{
+			"CREATE SEQUENCE IF NOT EXISTS audit_id_seq;",
+			pgResetAuditID,
+		}},
+		{version: 8, name: "user sources", applied: `SELECT source FROM "user" LIMIT 1;`, statements: []string{`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS source text;`}},
+		{version: 9, name: "directory users", statements: []string{`UPDATE "user" SET source = 'directory' WHERE createdby = 'directory' and secrethash = '';`}},
+	},
+
+	tokenMigrations: []migration{
+		{version: 1, name: "certificate-bound tokens", applied: "SELECT x5ts256 FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS x5ts256 text;"}},
+		{version: 2, name: "DPoP-bound tokens", applied: "SELECT jkt FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS jkt text;"}},
+		{version: 3, name: "login attempts", statements: []string{pgLoginAttemptsSchema, loginAttemptsIXKey}},
+		{version: 4, name: "token authentication methods", applied: "SELECT amr FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS amr text;"}},
+		{version: 5, name: "used ids and WebAuthn ceremonies", statements: []string{pgUsedIDSchema, usedIDIXID, pgWebAuthnCeremonySchema, webauthnCeremonyIXChallenge}},
+		{version: 6, name: "WebAuthn registration ceremonies", applied: "SELECT registration FROM webauthn_ceremony LIMIT 1;", statements: []string{"ALTER TABLE webauthn_ceremony ADD COLUMN IF NOT EXISTS registration boolean;"}},
+	},
+
+	schemaVersionSchema: pgSchemaVersionSchema,
+	selectSchemaVersion: "SELECT version FROM schema_version WHERE store=$1 ORDER BY version DESC LIMIT 1;",
+	deleteSchemaVersion: "DELETE FROM schema_version WHERE store=$1;",
+	insertSchemaVersion: "INSERT INTO schema_version (store, version) VALUES ($1, $2);",
+
+	defaultAdminUser: `
+INSERT INTO
+	"user"(id, enabled, name, description, secrethash, created, createdby, updated, updatedby)
+	values($1, true, 'admin', 'Default admin user', $2, now(), 'system', now(), 'system');`,
+	defaultSystemResource: `
+INSERT INTO
+	resource(id, name, description, created, createdby, updated, updatedby)
+	values($1, 'system', 'Default authsystem resource', now(), 'system', now(), 'system');`,
+	defaultSystemRole: `
+	INSERT INTO
+		role(id, name, description, created, createdby, updated, updatedby)
+		values($1, $2, $3, now(), 'system', now(), 'system');`,
+	defaultSystemCredentials: `
+	INSERT INTO
+		user_resource_role(userid, resourceid, roleid, created, createdby, updated, updatedby)
+		values($1, $2, $3, now(), 'system', now(), 'system')`,
+
+	insertUser: `INSERT INTO
+			"user" (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, source)
+			VALUES ($1, true, $2, $3, $4, now(), $5, now(), $5, $6);`,
+	selectUserByID:   `SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM "user" WHERE id=$1;`,
+	selectUserByName: `SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM "user" WHERE name=$1;`,
+	selectAllUsers:   `SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM "user"`,
+
+	insertResource:     qlDialect.insertResource,
+	selectResourceByID: qlDialect.selectResourceByID,
+	selectAllResources: qlDialect.selectAllResources,
+
+	insertRole:     qlDialect.insertRole,
+	selectRoleByID: qlDialect.selectRoleByID,
+	selectAllRoles: qlDialect.selectAllRoles,
+
+	insertUserResourceRole:      qlDialect.insertUserResourceRole,
+	selectUserResourceRole:      qlDialect.selectUserResourceRole,
+	selectUserResourceRoles:     qlDialect.selectUserResourceRoles,
+	getResourcesForUser:         getResourcesForUser,
+	getRolesForUserAndResources: getRolesForUserAndResources,
+	selectAllUserResourceRoles:  qlDialect.selectAllUserResourceRoles,
+	deleteUserResourceRole:      qlDialect.deleteUserResourceRole,
+
+	restoreUser: `INSERT INTO
+			"user" (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);`,
+	restoreResource:         qlDialect.restoreResource,
+	restoreRole:             qlDialect.restoreRole,
+	restoreUserResourceRole: qlDialect.restoreUserResourceRole,
+	restoreClientAuth:       qlDialect.restoreClientAuth,
+	restoreToken:            qlDialect.restoreToken,
+
+	deleteClientAuth: qlDialect.deleteClientAuth,
+	insertClientAuth: `INSERT INTO
+		client_auth (userid, method, settings, updated, updatedby)
+		VALUES ($1, $2, $3, now(), $4);`,
+	selectClientAuth:    qlDialect.selectClientAuth,
+	selectAllClientAuth: qlDialect.selectAllClientAuth,
+
+	updateUserSecretHash: `UPDATE "user"
+		set secrethash = $1, updated = now(), updatedby = $2
+		where id = $3;`,
+	replaceUserSecretHash: `UPDATE "user"
+		set secrethash = $1
+		where id = $2 and secrethash = $3;`,
+	replacePasswordHistory:   qlDialect.replacePasswordHistory,
+	insertPasswordHistory:    qlDialect.insertPasswordHistory,
+	selectPasswordHistory:    qlDialect.selectPasswordHistory,
+	prunePasswordHistory:     qlDialect.prunePasswordHistory,
+	selectAllPasswordHistory: qlDialect.selectAllPasswordHistory,
+
+	deleteUserMFA:    qlDialect.deleteUserMFA,
+	insertUserMFA:    qlDialect.insertUserMFA,
+	replaceUserMFA:   qlDialect.replaceUserMFA,
+	selectUserMFA:    qlDialect.selectUserMFA,
+	selectAllUserMFA: qlDialect.selectAllUserMFA,
+
+	insertWebAuthnCredential:         qlDialect.insertWebAuthnCredential,
+	selectWebAuthnCredential:         qlDialect.selectWebAuthnCredential,
+	selectWebAuthnCredentialsForUser: qlDialect.selectWebAuthnCredentialsForUser,
+	selectAllWebAuthnCredentials:     qlDialect.selectAllWebAuthnCredentials,
+	updateWebAuthnCredentialUse:      qlDialect.updateWebAuthnCredentialUse,
+	deleteWebAuthnCredential:         qlDialect.deleteWebAuthnCredential,
+
+	//	Writers add events with ids from a sequence, and an advisory lock (its key
+	//	is 'audi') makes sure only one of them chains events at a time
+	nextAuditID:                 "SELECT nextval('audit_id_seq');",
+	lockAuditChain:              "SELECT pg_advisory_xact_lock(1635083369);",
+	tryLockAuditChain:           "SELECT pg_try_advisory_xact_lock(1635083369);",
+	selectLastAuditEvent:        qlDialect.selectLastAuditEvent,
+	selectLastChainedAuditEvent: "SELECT id, hash FROM audit WHERE hash <> '' ORDER BY id DESC LIMIT 1;",
+	insertAuditEvent:            qlDialect.insertAuditEvent,
+	chainAuditEvent:             qlDialect.chainAuditEvent,
+	selectAuditEvents:           qlDialect.selectAuditEvents,
+	resetAuditID:                pgResetAuditID,
+
+	expireUserTokens: `UPDATE tokens
+		set expires = now(), deleted = now(), deletedby = 'getNewToken'
+		where userid = $1;`,
+	insertToken:      qlDialect.insertToken,
+	selectToken:      qlDialect.selectToken,
+	revokeToken:      qlDialect.revokeToken,
+	selectUserTokens: qlDialect.selectUserTokens,
+	purgeTokens:      qlDialect.purgeTokens,
+	selectAllTokens:  qlDialect.selectAllTokens,
+	countTokens:      qlDialect.countTokens,
+
+	selectLoginAttempts:          qlDialect.selectLoginAttempts,
+	claimLoginAttempts:           "INSERT INTO login_attempts(attemptkey, failures, lastfailure, lockeduntil, expires) VALUES($1, 0, $2, NULL, $2) ON CONFLICT (attemptkey) DO NOTHING;",
+	selectLoginAttemptsForUpdate: `SELECT attemptkey, failures, lastfailure, lockeduntil, expires FROM login_attempts WHERE attemptkey=$1 FOR UPDATE;`,
+	deleteLoginAttempts:          qlDialect.deleteLoginAttempts,
+	insertLoginAttempts:          qlDialect.insertLoginAttempts,
+	updateLoginAttempts:          qlDialect.updateLoginAttempts,
+	purgeLoginAttempts:           qlDialect.purgeLoginAttempts,
+
+	selectUsedID: qlDialect.selectUsedID,
+	deleteUsedID: qlDialect.deleteUsedID,
+	insertUsedID: "INSERT INTO used_ids(usedid, expires) VALUES($1, $2) ON CONFLICT (usedid) DO NOTHING;",
+	purgeUsedIDs: qlDialect.purgeUsedIDs,
+
+	insertWebAuthnCeremony:  qlDialect.insertWebAuthnCeremony,
+	selectWebAuthnCeremony:  qlDialect.selectWebAuthnCeremony,
+	deleteWebAuthnCeremony:  qlDialect.deleteWebAuthnCeremony,
+	purgeWebAuthnCeremonies: qlDialect.purgeWebAuthnCeremonies,
+}
@@ -0,0 +1,259 @@
+package data
+
+import (
+	// QL sql driver
+	_ "github.com/cznic/ql/driver"
+)
+
+// qlDialect is the sqlDialect for the embedded QL database (https://github.com/cznic/ql)
+var qlDialect = sqlDialect{
+	driver: "ql",
+
+	systemSchema: []schemaStatement{
+		{"schema_version schema", schemaVersionSchema},
+		{"resource schema", resourceSchema},
+		{"resource id index", resourceIXSysID},
+		{"resource name index", resourceIXName},
+		{"role schema", roleSchema},
+		{"role id index", roleIXSysID},
+		{"user schema", userSchema},
+		{"user id index", userIXSysID},
+		{"user name index", userIXName},
+		{"user_resource_role schema", userResourceRoleSchema},
+		{"user_resource_role id index", userResourceRoleIXID},
+		{"audit schema", auditSchema},
+		{"audit id index", auditIXID},
+		{"client_auth schema", clientAuthSchema},
+		{"client_auth user index", clientAuthIXUserID},
+		{"password_history schema", passwordHistorySchema},
+		{"password_history user index", passwordHistoryIXUserID},
+		{"user_mfa schema", userMFASchema},
+		{"user_mfa user index", userMFAIXUserID},
+		{"webauthn_credential schema", webauthnCredentialSchema},
+		{"webauthn_credential id index", webauthnCredentialIXID},
+		{"webauthn_credential user index", webauthnCredentialIXUserID},
+	},
+
+	tokenSchema: []schemaStatement{
+		{"schema_version schema", schemaVersionSchema},
+		{"token schema", tokenSchema},
+		{"token index", tokenIXToken},
+		{"token user index", tokenIXUserID},
+		{"login_attempts schema", loginAttemptsSchema},
+		{"login_attempts key index", loginAttemptsIXKey},
+		{"used_ids schema", usedIDSchema},
+		{"used_ids id index", usedIDIXID},
+		{"webauthn_ceremony schema", webauthnCeremonySchema},
+		{"webauthn_ceremony challenge index", webauthnCeremonyIXChallenge},
+	},
+
+	systemMigrations: []migration{
+		{version: 1, name: "audit log", statements: []string{auditSchema, auditIXID}},
+		{version: 2, name: "audit log chain", applied: "SELECT hmac FROM audit LIMIT 1;", statements: []string{
+			"ALTER TABLE audit ADD prevhash string;",
+			"ALTER TABLE audit ADD hash string;",
+			"ALTER TABLE audit ADD hmac string;",
+		}},
+		{version: 3, name: "client authentication", statements: []string{clientAuthSchema, clientAuthIXUserID}},
+		{version: 4, name: "password history", statements: []string{passwordHistorySchema, passwordHistoryIXUserID}},
+		{version: 5, name: "TOTP second factors", statements: []string{userMFASchema, userMFAIXUserID}},
+		{version: 6, name: "WebAuthn credentials", statements: []string{webauthnCredentialSchema, webauthnCredentialIXID, webauthnCredentialIXUserID}},
+		{version: 7, name: "user sources", applied: "SELECT source FROM user LIMIT 1;", statements: []string{"ALTER TABLE user ADD source string;"}},
+		{version: 8, name: "directory users", statements: []string{`UPDATE user SET source = "directory" WHERE createdby = "directory" and secrethash = "";`}},
+	},
+
+	tokenMigrations: []migration{
+		{version: 1, name: "certificate-bound tokens", applied: "SELECT x5ts256 FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD x5ts256 string;"}},
+		{version: 2, name: "DPoP-bound tokens", applied: "SELECT jkt FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD jkt string;"}},
+		{version: 3, name: "login attempts", statements: []string{loginAttemptsSchema, loginAttemptsIXKey}},
+		{version: 4, name: "token authentication methods", applied: "SELECT amr FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD amr string;"}},
+		{version: 5, name: "used ids and WebAuthn ceremonies", statements: []string{usedIDSchema, usedIDIXID, webauthnCeremonySchema, webauthnCeremonyIXChallenge}},
+		{version: 6, name: "WebAuthn registration ceremonies", applied: "SELECT registration FROM webauthn_ceremony LIMIT 1;", statements: []string{"ALTER TABLE webauthn_ceremony ADD registration bool;"}},
+	},
+
+	schemaVersionSchema: schemaVersionSchema,
+	selectSchemaVersion: "SELECT version FROM schema_version WHERE store=$1 ORDER BY version DESC LIMIT 1;",
+	deleteSchemaVersion: "DELETE FROM schema_version WHERE store=$1;",
+	insertSchemaVersion: "INSERT INTO schema_version (store, version) VALUES ($1, $2);",
+
+	defaultAdminUser:         defaultAdminUser,
+	defaultSystemResource:    defaultSystemResource,
+	defaultSystemRole:        defaultSystemRole,
+	defaultSystemCredentials: defaultSystemCredentials,
+
+	insertUser: `INSERT INTO
+			user (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, source)
+			VALUES ($1, true, $2, $3, $4, now(), $5, now(), $5, $6);`,
+	selectUserByID:   "SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM user WHERE id=$1;",
+	selectUserByName: "SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM user WHERE name=$1;",
+	selectAllUsers:   "SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source FROM user",
+
+	insertResource: `INSERT INTO
+			resource (id, name, description, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, now(), $4, now(), $4);`,
+	selectResourceByID: "SELECT id, name, description, created, createdby, updated, updatedby, deleted, deletedby FROM resource WHERE id=$1;",
+	selectAllResources: "SELECT id, name, description, created, createdby, updated, updatedby, deleted, deletedby FROM resource",
+
+	insertRole: `INSERT INTO
+			role (id, name, description, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, now(), $4, now(), $4);`,
+	selectRoleByID: "SELECT id, name, description, created, createdby, updated, updatedby, deleted, deletedby FROM role WHERE id=$1;",
+	selectAllRoles: "SELECT id, name, description, created, createdby, updated, updatedby, deleted, deletedby FROM role",
+
+	insertUserResourceRole: `INSERT INTO
+		user_resource_role (userid, resourceid, roleid, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, now(), $4, now(), $4);`,
+	selectUserResourceRole:      "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1 and resourceid=$2 and roleid=$3;",
+	selectUserResourceRoles:     "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1;",
+	getResourcesForUser:         getResourcesForUser,
+	getRolesForUserAndResources: getRolesForUserAndResources,
+	selectAllUserResourceRoles:  "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role",
+	deleteUserResourceRole:      "DELETE FROM user_resource_role WHERE userid=$1 and resourceid=$2 and roleid=$3;",
+
+	restoreUser: `INSERT INTO
+			user (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);`,
+	restoreResource: `INSERT INTO
+			resource (id, name, description, created, createdby, updated, updatedby, deleted, deletedby)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+	restoreRole: `INSERT INTO
+			role (id, name, description, created, createdby, updated, updatedby, deleted, deletedby)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+	restoreUserResourceRole: `INSERT INTO
+			user_resource_role (userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+	restoreClientAuth: `INSERT INTO
+		client_auth (userid, method, settings, updated, updatedby)
+		VALUES ($1, $2, $3, $4, $5);`,
+	restoreToken: `INSERT INTO
+		tokens(token, userid, created, expires, deleted, deletedby, x5ts256, jkt, amr)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+
+	deleteClientAuth: "DELETE FROM client_auth WHERE userid=$1;",
+	insertClientAuth: `INSERT INTO
+		client_auth (userid, method, settings, updated, updatedby)
+		VALUES ($1, $2, $3, now(), $4);`,
+	selectClientAuth:    "SELECT userid, method, settings, updated, updatedby FROM client_auth WHERE userid=$1;",
+	selectAllClientAuth: "SELECT userid, method, settings, updated, updatedby FROM client_auth",
+
+	updateUserSecretHash: `UPDATE user
+		set secrethash = $1, updated = now(), updatedby = $2
+		where id = $3;`,
+	replaceUserSecretHash: `UPDATE user
+		set secrethash = $1
+		where id = $2 and secrethash = $3;`,
+	replacePasswordHistory: `UPDATE password_history
+		set secrethash = $1
+		where userid = $2 and secrethash = $3;`,
+	insertPasswordHistory: `INSERT INTO
+		password_history (userid, secrethash, created)
+		VALUES ($1, $2, $3);`,
+	selectPasswordHistory:    "SELECT userid, secrethash, created FROM password_history WHERE userid=$1 ORDER BY created DESC;",
+	prunePasswordHistory:     "DELETE FROM password_history WHERE userid=$1 and created < $2;",
+	selectAllPasswordHistory: "SELECT userid, secrethash, created FROM password_history",
+
+	deleteUserMFA: "DELETE FROM user_mfa WHERE userid=$1;",
+	insertUserMFA: `INSERT INTO
+		user_mfa (userid, secret, confirmed, laststep, recoverycodes, updated, updatedby)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+	replaceUserMFA: `UPDATE user_mfa
+		set laststep = $1, recoverycodes = $2, updated = $3, updatedby = $4
+		where userid = $5 and laststep = $6 and recoverycodes = $7;`,
+	selectUserMFA:    "SELECT userid, secret, confirmed, laststep, recoverycodes, updated, updatedby FROM user_mfa WHERE userid=$1;",
+	selectAllUserMFA: "SELECT userid, secret, confirmed, laststep, recoverycodes, updated, updatedby FROM user_mfa",
+
+	insertWebAuthnCredential: `INSERT INTO
+		webauthn_credential (id, userid, name, publickey, signcount, aaguid, transports, passkey, created, createdby, lastused)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`,
+	selectWebAuthnCredential:         "SELECT id, userid, name, publickey, signcount, aaguid, transports, passkey, created, createdby, lastused FROM webauthn_credential WHERE id=$1;",
+	selectWebAuthnCredentialsForUser: "SELECT id, userid, name, publickey, signcount, aaguid, transports, passkey, created, createdby, lastused FROM webauthn_credential WHERE userid=$1 ORDER BY created;",
+	selectAllWebAuthnCredentials:     "SELECT id, userid, name, publickey, signcount, aaguid, transports, passkey, created, createdby, lastused FROM webauthn_credential",
+	updateWebAuthnCredentialUse: `UPDATE webauthn_credential
+		set signcount = $1, lastused = $2
+		where id = $3;`,
+	deleteWebAuthnCredential: "DELETE FROM webauthn_credential WHERE id=$1;",
+
+	selectLastAuditEvent:        "SELECT id, hash FROM audit ORDER BY id DESC LIMIT 1;",
+	selectLastChainedAuditEvent: `SELECT id, hash FROM audit WHERE hash != "" ORDER BY id DESC LIMIT 1;`,
+	chainAuditEvent: `UPDATE audit
+		set prevhash = $1, hash = $2, hmac = $3
+		where id = $4;`,
+	insertAuditEvent: `INSERT INTO
+		audit (id, created, actor, action, targettype, targetid, ip, clientid, detail, beforevalue, aftervalue, prevhash, hash, hmac)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);`,
+	selectAuditEvents: `SELECT
+	id, created, actor, action, targettype, targetid, ip, clientid, detail, beforevalue, aftervalue, prevhash, hash, hmac
+	FROM audit
+	WHERE id > $1
+	ORDER BY id
+	LIMIT $2;`,
+
+	expireUserTokens: `UPDATE tokens
+		set expires = now(), deleted = now(), deletedby = "getNewToken"
+		where userid = $1;`,
+	insertToken: `INSERT INTO
+		tokens(token, userid, created, expires, x5ts256, jkt, amr)
+		VALUES($1, $2, $3, $4, $5, $6, $7);`,
+	selectToken: `SELECT
+	token, userid, created, expires, deleted, deletedby, x5ts256, jkt, amr
+	FROM tokens
+	WHERE token=$1 and expires > $2;`,
+	revokeToken: `UPDATE tokens
+		set deletedby = $1, expires = $2, deleted = $2
+		where token = $3 and expires > $2;`,
+	selectUserTokens: `SELECT
+	token, userid, created, expires, deleted, deletedby, x5ts256, jkt, amr
+	FROM tokens
+	WHERE userid=$1 and expires > $2;`,
+	purgeTokens: `DELETE FROM tokens
+		WHERE expires < $1;`,
+	selectAllTokens: `SELECT
+	token, userid, created, expires, deleted, deletedby, x5ts256, jkt, amr
+	FROM tokens
+	WHERE expires > $1;`,
+	countTokens: `SELECT count(*)
+	FROM tokens
+	WHERE expires > $1;`,
+
+	selectLoginAttempts: `SELECT
+	attemptkey, failures, lastfailure, lockeduntil, expires
+	FROM login_attempts
+	WHERE attemptkey=$1 and expires > $2;`,
+	selectLoginAttemptsForUpdate: `SELECT
+	attemptkey, failures, lastfailure, lockeduntil, expires
+	FROM login_attempts
+	WHERE attemptkey=$1;`,
+	deleteLoginAttempts: `DELETE FROM login_attempts
+		WHERE attemptkey = $1;`,
+	insertLoginAttempts: `INSERT INTO
+		login_attempts(attemptkey, failures, lastfailure, lockeduntil, expires)
+		VALUES($1, $2, $3, $4, $5);`,
+	updateLoginAttempts: `UPDATE login_attempts
+		set failures = $1, lastfailure = $2, lockeduntil = $3, expires = $4
+		where attemptkey = $5;`,
+	purgeLoginAttempts: `DELETE FROM login_attempts
+		WHERE expires < $1;`,
+
+	selectUsedID: `SELECT count(*)
+	FROM used_ids
+	WHERE usedid=$1 and expires > $2;`,
+	deleteUsedID: `DELETE FROM used_ids
+		WHERE usedid = $1;`,
+	insertUsedID: `INSERT INTO
+		used_ids(usedid, expires)
+		VALUES($1, $2);`,
+	purgeUsedIDs: `DELETE FROM used_ids
+		WHERE expires < $1;`,
+
+	insertWebAuthnCeremony: `INSERT INTO
+		webauthn_ceremony(challenge, userid, registration, passkey, expires)
+		VALUES($1, $2, $3, $4, $5);`,
+	selectWebAuthnCeremony: `SELECT
+	challenge, userid, registration, passkey, expires
+	FROM webauthn_ceremony
+	WHERE challenge=$1 and expires > $2;`,
+	deleteWebAuthnCeremony: `DELETE FROM webauthn_ceremony
+		WHERE challenge = $1;`,
+	purgeWebAuthnCeremonies: `DELETE FROM webauthn_ceremony
+		WHERE expires < $1;`,
+}
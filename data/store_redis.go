@@ -0,0 +1,522 @@
+package data
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisTokenStore is a TokenStore backed by Redis (or anything else that speaks the
+// Redis protocol).  Each token is a hash that Redis expires on its own when the
+// token expires, so there is nothing to clean up.  Each user also has a set of
+// their token ids, so existing tokens can be found (and expired) when a new one is issued
+//
+// Keys:
+// 	authserver:token:<tokenid> -> hash of userid / created / expires / x5ts256 / jkt / amr
+// 	authserver:usertokens:<userid> -> set of token ids
+// 	authserver:loginattempts:<key> -> hash of failures / lastfailure / lockeduntil / expires
+// 	authserver:usedid:<id> -> "1" (until the id expires)
+// 	authserver:webauthnceremony:<challenge> -> hash of userid / passkey / expires
+type redisTokenStore struct {
+	client *redis.Client
+}
+
+// isRedisDSN returns 'true' if the passed datastore setting is a Redis url (redis://...)
+func isRedisDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "redis://")
+}
+
+// newRedisTokenStore opens a TokenStore using a Redis url like redis://:password@localhost:6379/0
+func newRedisTokenStore(dsn string) (*redisTokenStore, error) {
+	options, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisTokenStore{client: redis.NewClient(options)}, nil
+}
+
+// redisTokenKey returns the key for the given token
+func redisTokenKey(tokenID string) string {
+	return "authserver:token:" + tokenID
+}
+
+// redisUserTokensKey returns the key for the set of tokens for the given user
+func redisUserTokensKey(userID string) string {
+	return "authserver:usertokens:" + userID
+}
+
+// redisLoginAttemptsKey returns the key for the login attempts for the given key
+func redisLoginAttemptsKey(key string) string {
+	return "authserver:loginattempts:" + key
+}
+
+// redisUsedIDKey returns the key for an id that can only be used once
+func redisUsedIDKey(id string) string {
+	return "authserver:usedid:" + id
+}
+
+// redisWebAuthnCeremonyKey returns the key for the WebAuthn ceremony with the given challenge
+func redisWebAuthnCeremonyKey(challenge []byte) string {
+	return "authserver:webauthnceremony:" + base64.RawURLEncoding.EncodeToString(challenge)
+}
+
+// Close implements TokenStore
+func (store redisTokenStore) Close() error {
+	return store.client.Close()
+}
+
+// Ping implements TokenStore
+func (store redisTokenStore) Ping() error {
+	if err := store.client.Ping().Err(); err != nil {
+		return fmt.Errorf("Problem connecting to the token store: %s", err)
+	}
+
+	return nil
+}
+
+// Bootstrap implements TokenStore.  There is no schema to create,
+// so this just makes sure the server can be reached
+func (store redisTokenStore) Bootstrap() error {
+	if err := store.client.Ping().Err(); err != nil {
+		return fmt.Errorf("Problem connecting to the token store: %s", err)
+	}
+
+	return nil
+}
+
+// Migrate implements TokenStore.  Tokens are hashes, so there's nothing to migrate
+// (fields added since a token was stored are just missing)
+func (store redisTokenStore) Migrate() error {
+	return nil
+}
+
+// AddToken implements TokenStore.  The user's token set is watched, so the existing tokens
+// are removed and the new one added in a single transaction (retried if another token is
+// issued for the user at the same time)
+func (store redisTokenStore) AddToken(token Token) error {
+	userTokensKey := redisUserTokensKey(token.UserID)
+
+	var err error
+	for retries := 0; retries < 10; retries++ {
+		err = store.client.Watch(func(tx *redis.Tx) error {
+			//	Find the existing tokens for the user
+			existing, err := tx.SMembers(userTokensKey).Result()
+			if err != nil {
+				return err
+			}
+
+			//	Remove them and add the new one
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				for _, tokenID := range existing {
+					pipe.Del(redisTokenKey(tokenID))
+				}
+				pipe.Del(userTokensKey)
+
+				pipe.HMSet(redisTokenKey(token.ID), redisTokenFields(token))
+				pipe.PExpireAt(redisTokenKey(token.ID), token.Expires)
+
+				pipe.SAdd(userTokensKey, token.ID)
+				pipe.PExpireAt(userTokensKey, token.Expires)
+
+				return nil
+			})
+			return err
+		}, userTokensKey)
+
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("An error occurred adding the token: %s", err)
+	}
+
+	return nil
+}
+
+// GetToken implements TokenStore
+func (store redisTokenStore) GetToken(tokenID string) (Token, error) {
+	retval := Token{}
+
+	fields, err := store.client.HGetAll(redisTokenKey(tokenID)).Result()
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting token: %s", err)
+	}
+
+	//	Expired tokens are removed by Redis, so an empty hash means the token isn't valid
+	if len(fields) == 0 {
+		return retval, fmt.Errorf("Problem selecting token: token not found or expired")
+	}
+
+	retval, err = redisToken(tokenID, fields)
+	if err != nil {
+		return retval, fmt.Errorf("Problem reading token: %s", err)
+	}
+
+	return retval, nil
+}
+
+// RevokeToken implements TokenStore
+func (store redisTokenStore) RevokeToken(tokenID, revokedBy string) error {
+	token, err := store.GetToken(tokenID)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(redisTokenKey(tokenID))
+		pipe.SRem(redisUserTokensKey(token.UserID), tokenID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("An error occurred revoking the token: %s", err)
+	}
+
+	return nil
+}
+
+// GetTokensForUser implements TokenStore
+func (store redisTokenStore) GetTokensForUser(userID string) ([]Token, error) {
+	retval := []Token{}
+
+	tokenIDs, err := store.client.SMembers(redisUserTokensKey(userID)).Result()
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting tokens for user: %s", err)
+	}
+
+	for _, tokenID := range tokenIDs {
+		fields, err := store.client.HGetAll(redisTokenKey(tokenID)).Result()
+		if err != nil {
+			return retval, fmt.Errorf("Problem selecting token: %s", err)
+		}
+
+		//	The token has expired since the set was last updated -- tidy up
+		if len(fields) == 0 {
+			store.client.SRem(redisUserTokensKey(userID), tokenID)
+			continue
+		}
+
+		token, err := redisToken(tokenID, fields)
+		if err != nil {
+			return retval, fmt.Errorf("Problem reading token: %s", err)
+		}
+
+		retval = append(retval, token)
+	}
+
+	return retval, nil
+}
+
+// PurgeExpiredTokens implements TokenStore.  Redis removes expired tokens
+// on its own, so there is never anything to purge
+func (store redisTokenStore) PurgeExpiredTokens(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// CountTokens implements TokenStore.  Redis removes expired tokens
+// on its own, so every token key is an unexpired token
+func (store redisTokenStore) CountTokens() (int64, error) {
+	retval := int64(0)
+
+	iter := store.client.Scan(0, redisTokenKey("*"), 100).Iterator()
+	for iter.Next() {
+		retval++
+	}
+
+	if err := iter.Err(); err != nil {
+		return retval, fmt.Errorf("Problem counting tokens: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ExportTokens implements TokenStore
+func (store redisTokenStore) ExportTokens() ([]Token, error) {
+	retval := []Token{}
+
+	//	Walk all of the token keys
+	iter := store.client.Scan(0, redisTokenKey("*"), 100).Iterator()
+	for iter.Next() {
+		tokenID := strings.TrimPrefix(iter.Val(), redisTokenKey(""))
+
+		fields, err := store.client.HGetAll(iter.Val()).Result()
+		if err != nil {
+			return retval, fmt.Errorf("Problem selecting token: %s", err)
+		}
+
+		//	The token expired while we were looking
+		if len(fields) == 0 {
+			continue
+		}
+
+		token, err := redisToken(tokenID, fields)
+		if err != nil {
+			return retval, fmt.Errorf("Problem reading token: %s", err)
+		}
+
+		retval = append(retval, token)
+	}
+
+	if err := iter.Err(); err != nil {
+		return retval, fmt.Errorf("Problem selecting tokens: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ImportTokens implements TokenStore.  Tokens that have already
+// expired are skipped, since Redis would remove them right away
+func (store redisTokenStore) ImportTokens(tokens []Token) error {
+	//	Each user's token set expires with their last token
+	userExpires := map[string]time.Time{}
+	for _, token := range tokens {
+		if token.Expires.After(userExpires[token.UserID]) {
+			userExpires[token.UserID] = token.Expires
+		}
+	}
+
+	_, err := store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, token := range tokens {
+			if token.Expires.After(time.Now()) == false {
+				continue
+			}
+
+			pipe.HMSet(redisTokenKey(token.ID), redisTokenFields(token))
+			pipe.PExpireAt(redisTokenKey(token.ID), token.Expires)
+			pipe.SAdd(redisUserTokensKey(token.UserID), token.ID)
+		}
+
+		for userID, expires := range userExpires {
+			if expires.After(time.Now()) {
+				pipe.PExpireAt(redisUserTokensKey(userID), expires)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("An error occurred importing tokens: %s", err)
+	}
+
+	return nil
+}
+
+// redisTokenFields returns the fields of the token hash for a Token
+func redisTokenFields(token Token) map[string]interface{} {
+	return map[string]interface{}{
+		"userid":  token.UserID,
+		"created": token.Created.UTC().Format(time.RFC3339Nano),
+		"expires": token.Expires.UTC().Format(time.RFC3339Nano),
+		"x5ts256": token.Confirmation.CertThumbprint,
+		"jkt":     token.Confirmation.KeyThumbprint,
+		"amr":     strings.Join(token.AMR, " "),
+	}
+}
+
+// redisToken creates a Token from the fields of a token hash
+func redisToken(tokenID string, fields map[string]string) (Token, error) {
+	retval := Token{ID: tokenID, UserID: fields["userid"], Confirmation: Confirmation{CertThumbprint: fields["x5ts256"], KeyThumbprint: fields["jkt"]}, AMR: strings.Fields(fields["amr"])}
+
+	created, err := time.Parse(time.RFC3339Nano, fields["created"])
+	if err != nil {
+		return retval, err
+	}
+	retval.Created = created
+
+	expires, err := time.Parse(time.RFC3339Nano, fields["expires"])
+	if err != nil {
+		return retval, err
+	}
+	retval.Expires = expires
+
+	return retval, nil
+}
+
+// AddLoginFailure implements TokenStore.  Redis expires the login attempts
+// on its own once they're forgotten
+func (store redisTokenStore) AddLoginFailure(key string, window time.Duration) (LoginAttempts, error) {
+	return store.updateLoginAttempts(key, func(attempts LoginAttempts) LoginAttempts {
+		return attempts.withFailure(time.Now(), window)
+	})
+}
+
+// LockLogins implements TokenStore
+func (store redisTokenStore) LockLogins(key string, until time.Time) error {
+	_, err := store.updateLoginAttempts(key, func(attempts LoginAttempts) LoginAttempts {
+		return attempts.withLock(until)
+	})
+	return err
+}
+
+// GetLoginAttempts implements TokenStore
+func (store redisTokenStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	fields, err := store.client.HGetAll(redisLoginAttemptsKey(key)).Result()
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("Problem selecting login attempts: %s", err)
+	}
+
+	retval, err := redisLoginAttempts(key, fields)
+	if err != nil {
+		return retval, fmt.Errorf("Problem reading login attempts: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ResetLoginAttempts implements TokenStore
+func (store redisTokenStore) ResetLoginAttempts(key string) error {
+	if err := store.client.Del(redisLoginAttemptsKey(key)).Err(); err != nil {
+		return fmt.Errorf("An error occurred resetting login attempts: %s", err)
+	}
+
+	return nil
+}
+
+// updateLoginAttempts replaces the login attempts for the key with the result of 'update'.
+// The key is watched, so concurrent updates are retried instead of being lost
+func (store redisTokenStore) updateLoginAttempts(key string, update func(attempts LoginAttempts) LoginAttempts) (LoginAttempts, error) {
+	attemptsKey := redisLoginAttemptsKey(key)
+	retval := LoginAttempts{}
+
+	var err error
+	for retries := 0; retries < 10; retries++ {
+		err = store.client.Watch(func(tx *redis.Tx) error {
+			fields, err := tx.HGetAll(attemptsKey).Result()
+			if err != nil {
+				return err
+			}
+
+			current, err := redisLoginAttempts(key, fields)
+			if err != nil {
+				return err
+			}
+
+			retval = update(current)
+
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.HMSet(attemptsKey, map[string]interface{}{
+					"failures":    retval.Failures,
+					"lastfailure": retval.LastFailure.UTC().Format(time.RFC3339Nano),
+					"lockeduntil": retval.LockedUntil.UTC().Format(time.RFC3339Nano),
+					"expires":     retval.Expires.UTC().Format(time.RFC3339Nano),
+				})
+				pipe.PExpireAt(attemptsKey, retval.Expires)
+				return nil
+			})
+			return err
+		}, attemptsKey)
+
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return retval, fmt.Errorf("An error occurred updating login attempts: %s", err)
+	}
+
+	return retval, nil
+}
+
+// UseID implements TokenStore.  The id is set only if it isn't there already, and
+// Redis forgets it on its own when it expires
+func (store redisTokenStore) UseID(id string, expires time.Time) (bool, error) {
+	ttl := time.Until(expires)
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	added, err := store.client.SetNX(redisUsedIDKey(id), "1", ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("An error occurred using an id: %s", err)
+	}
+
+	return added, nil
+}
+
+// AddWebAuthnCeremony implements TokenStore.  Redis forgets the ceremony on its own when it times out
+func (store redisTokenStore) AddWebAuthnCeremony(ceremony WebAuthnCeremony) error {
+	key := redisWebAuthnCeremonyKey(ceremony.Challenge)
+
+	_, err := store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, map[string]interface{}{
+			"userid":       ceremony.UserID,
+			"registration": strconv.FormatBool(ceremony.Registration),
+			"passkey":      strconv.FormatBool(ceremony.Passkey),
+			"expires":      ceremony.Expires.UTC().Format(time.RFC3339Nano),
+		})
+		pipe.PExpireAt(key, ceremony.Expires)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("An error occurred adding a WebAuthn ceremony: %s", err)
+	}
+
+	return nil
+}
+
+// TakeWebAuthnCeremony implements TokenStore.  The ceremony is read and removed in a
+// single transaction, so only one request gets it
+func (store redisTokenStore) TakeWebAuthnCeremony(challenge []byte) (WebAuthnCeremony, bool, error) {
+	key := redisWebAuthnCeremonyKey(challenge)
+
+	var fields *redis.StringStringMapCmd
+	_, err := store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(key)
+		pipe.Del(key)
+		return nil
+	})
+	if err != nil {
+		return WebAuthnCeremony{}, false, fmt.Errorf("Problem selecting WebAuthn ceremony: %s", err)
+	}
+
+	if len(fields.Val()) == 0 {
+		return WebAuthnCeremony{}, false, nil
+	}
+
+	expires, err := time.Parse(time.RFC3339Nano, fields.Val()["expires"])
+	if err != nil {
+		return WebAuthnCeremony{}, false, fmt.Errorf("Problem reading WebAuthn ceremony: %s", err)
+	}
+
+	if expires.Before(time.Now()) {
+		return WebAuthnCeremony{}, false, nil
+	}
+
+	return WebAuthnCeremony{
+		Challenge:    challenge,
+		UserID:       fields.Val()["userid"],
+		Registration: fields.Val()["registration"] == "true",
+		Passkey:      fields.Val()["passkey"] == "true",
+		Expires:      expires,
+	}, true, nil
+}
+
+// redisLoginAttempts creates LoginAttempts from the fields of a login attempts hash
+// (an empty hash means there haven't been any failures recently)
+func redisLoginAttempts(key string, fields map[string]string) (LoginAttempts, error) {
+	retval := LoginAttempts{Key: key}
+	if len(fields) == 0 {
+		return retval, nil
+	}
+
+	failures, err := strconv.Atoi(fields["failures"])
+	if err != nil {
+		return retval, err
+	}
+	retval.Failures = failures
+
+	for field, value := range map[string]*time.Time{"lastfailure": &retval.LastFailure, "lockeduntil": &retval.LockedUntil, "expires": &retval.Expires} {
+		parsed, err := time.Parse(time.RFC3339Nano, fields[field])
+		if err != nil {
+			return retval, err
+		}
+		*value = parsed
+	}
+
+	return retval, nil
+}
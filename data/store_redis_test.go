@@ -0,0 +1,421 @@
+package data_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/danesparza/authserver/data"
+)
+
+//	Starts a local Redis stand-in and returns a DBManager that uses it for tokens
+func getRedisTestDBManager(t *testing.T) (*data.DBManager, *miniredis.Miniredis) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis failed to start: %s", err)
+	}
+
+	systemdbfilename, _ := getTestFiles()
+	db, err := data.NewDBManager(systemdbfilename, "redis://"+redisServer.Addr())
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+
+	return db, redisServer
+}
+
+func TestRedis_GetScopesForToken_ValidToken_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	scopeInfo, err := db.GetScopesForToken(tokenResponse.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetScopesForToken failed: Should have gotten scope information without an error, but got: %s", err)
+	}
+
+	if scopeInfo.ID != uctx.ID || len(scopeInfo.ScopeResources) != 1 {
+		t.Errorf("GetScopesForToken failed: Should have gotten the admin user's scopes, but got: %+v", scopeInfo)
+	}
+}
+
+func TestRedis_GetScopesForToken_ExpiredToken_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	redisServer.FastForward(6 * time.Minute)
+	_, err = db.GetScopesForToken(tokenResponse.ID)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("GetScopesForToken failed: Should have returned an error for an expired token")
+	}
+
+	if redisServer.Exists("authserver:token:" + tokenResponse.ID) {
+		t.Errorf("Token store failed: The expired token should have been removed by Redis")
+	}
+}
+
+func TestRedis_GetNewToken_ExpiresPreviousToken(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	firstToken, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	secondToken, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten second token without an error, but got: %s", err)
+	}
+
+	//	Assert
+	if _, err := db.GetScopesForToken(firstToken.ID); err == nil {
+		t.Errorf("GetScopesForToken failed: The first token should have been expired by the second GetNewToken call")
+	}
+
+	tokens, err := db.GetTokensForUser(uctx, uctx.ID)
+	if err != nil {
+		t.Errorf("GetTokensForUser failed: Should have listed tokens without an error, but got: %s", err)
+	}
+
+	if len(tokens) != 1 || tokens[0].ID != secondToken.ID {
+		t.Errorf("GetTokensForUser failed: Should have only gotten the latest token, but got: %+v", tokens)
+	}
+}
+
+func TestRedis_RevokeToken_ValidToken_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	err = db.RevokeToken(uctx, tokenResponse.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("RevokeToken failed: Should have revoked the token without an error, but got: %s", err)
+	}
+
+	if _, err := db.GetScopesForToken(tokenResponse.ID); err == nil {
+		t.Errorf("GetScopesForToken failed: The token should not be valid after it has been revoked")
+	}
+
+	tokens, _ := db.GetTokensForUser(uctx, uctx.ID)
+	if len(tokens) != 0 {
+		t.Errorf("GetTokensForUser failed: Should not list revoked tokens, but got: %+v", tokens)
+	}
+}
+
+func TestRedis_BackupAndRestore_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Our restore target (with an empty Redis)
+	restoreRedis, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis failed to start: %s", err)
+	}
+	defer restoreRedis.Close()
+
+	restoresystemdb, _ := getRestoreTestFiles()
+	defer os.Remove(restoresystemdb)
+
+	restoredb, err := data.NewDBManager(restoresystemdb, "redis://"+restoreRedis.Addr())
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer restoredb.Close()
+
+	//	Act
+	backup, err := db.Backup(true)
+	if err != nil {
+		t.Errorf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	err = restoredb.Restore(backup)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("Restore failed: Should have restored without error: %s", err)
+	}
+
+	if len(backup.Tokens) != 1 {
+		t.Errorf("Backup failed: Should have exported 1 token, but got: %+v", backup.Tokens)
+	}
+
+	if _, err := restoredb.GetScopesForToken(tokenResponse.ID); err != nil {
+		t.Errorf("Restore failed: Should have restored the token, but got: %s", err)
+	}
+}
+
+func TestRedis_CountActiveTokens_CountsUnexpiredTokens(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetNewToken(uctx, 5*time.Minute); err != nil {
+			t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+		}
+	}
+
+	//	Act
+	count, err := db.CountActiveTokens()
+	redisServer.FastForward(6 * time.Minute)
+	expiredCount, _ := db.CountActiveTokens()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("CountActiveTokens failed: Should have counted tokens without an error, but got: %s", err)
+	}
+
+	if count != 1 || expiredCount != 0 {
+		t.Errorf("CountActiveTokens failed: Should have counted 1 active token (and none once it expired), but got: %v / %v", count, expiredCount)
+	}
+}
+
+func TestRedis_GetNewBoundToken_KeepsConfirmation(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	confirmation := data.Confirmation{CertThumbprint: "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2", KeyThumbprint: "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}
+
+	//	Act
+	tokenResponse, err := db.GetNewBoundToken(uctx, 5*time.Minute, confirmation)
+	if err != nil {
+		t.Fatalf("GetNewBoundToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	_, unboundErr := db.GetScopesForToken(tokenResponse.ID)
+	_, boundErr := db.GetScopesForBoundToken(tokenResponse.ID, confirmation)
+
+	//	Assert
+	if unboundErr == nil {
+		t.Errorf("GetScopesForToken failed: A bound token shouldn't be usable without the certificate it's bound to")
+	}
+
+	if boundErr != nil {
+		t.Errorf("GetScopesForBoundToken failed: A bound token should be usable with the certificate it's bound to, but got: %s", boundErr)
+	}
+}
+
+func TestRedis_LoginAttempts_LockoutExpires(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+	db.SetLockoutPolicy(data.LockoutPolicy{UserThreshold: 2, Window: time.Minute, Duration: 5 * time.Minute})
+
+	uctx, secret, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	db.GetUserScopesWithCredentials(uctx.Name, "notthepassword")
+	db.GetUserScopesWithCredentials(uctx.Name, "notthepassword")
+
+	_, lockedErr := db.GetUserScopesWithCredentials(uctx.Name, secret)
+	redisServer.FastForward(2 * time.Minute)
+	_, stillLockedErr := db.GetUserScopesWithCredentials(uctx.Name, secret)
+	redisServer.FastForward(4 * time.Minute)
+	attempts, attemptsErr := db.GetLoginAttempts(uctx, "user", uctx.Name)
+
+	//	Assert
+	if lockedErr == nil || stillLockedErr == nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have turned away a locked out user until the lockout ends")
+	}
+
+	if attemptsErr != nil || attempts.Failures != 0 {
+		t.Errorf("GetLoginAttempts failed: Should have forgotten the failures once the lockout ended, but got %+v (%v)", attempts, attemptsErr)
+	}
+}
+
+func TestRedis_Restore_UserTokensExpireWithLastToken(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	backup, err := db.Backup(true)
+	if err != nil {
+		t.Errorf("Backup failed: Should have backed up without error: %s", err)
+	}
+
+	//	The later token comes first, so its expiry would be shortened by the one after it
+	now := time.Now()
+	backup.Tokens = []data.Token{
+		{ID: "later", UserID: uctx.ID, Created: now, Expires: now.Add(10 * time.Minute)},
+		{ID: "sooner", UserID: uctx.ID, Created: now, Expires: now.Add(5 * time.Minute)},
+	}
+
+	restoreRedis, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis failed to start: %s", err)
+	}
+	defer restoreRedis.Close()
+
+	restoresystemdb, _ := getRestoreTestFiles()
+	defer os.Remove(restoresystemdb)
+
+	restoredb, err := data.NewDBManager(restoresystemdb, "redis://"+restoreRedis.Addr())
+	if err != nil {
+		t.Fatalf("NewSystemDB failed: %s", err)
+	}
+	defer restoredb.Close()
+
+	//	Act
+	err = restoredb.Restore(backup)
+	restoreRedis.FastForward(6 * time.Minute)
+	tokens, tokensErr := restoredb.GetTokensForUser(uctx, uctx.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("Restore failed: Should have restored without error: %s", err)
+	}
+
+	if tokensErr != nil || len(tokens) != 1 || tokens[0].ID != "later" {
+		t.Errorf("GetTokensForUser failed: Should have kept the user's tokens until the last one expires, but got: %+v (%v)", tokens, tokensErr)
+	}
+}
+
+func TestRedis_UseOnceAndCeremonies_OnlyOnce(t *testing.T) {
+	//	Arrange
+	systemdbfilename, _ := getTestFiles()
+	defer os.Remove(systemdbfilename)
+
+	db, redisServer := getRedisTestDBManager(t)
+	defer redisServer.Close()
+	defer db.Close()
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	ceremony := data.WebAuthnCeremony{Challenge: []byte("testchallenge1"), UserID: "testuser1", Expires: time.Now().Add(time.Minute)}
+
+	//	Act
+	first, firstErr := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+	replay, _ := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+	redisServer.FastForward(2 * time.Minute)
+	reused, _ := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+
+	saveErr := db.SaveWebAuthnCeremony(ceremony)
+	taken, found, takeErr := db.TakeWebAuthnCeremony(ceremony.Challenge)
+	_, foundAgain, _ := db.TakeWebAuthnCeremony(ceremony.Challenge)
+
+	//	Assert
+	if firstErr != nil || first != true || replay != false || reused != true {
+		t.Errorf("UseOnce failed: Should have used the id once until it expired, but got %v, %v, %v (%v)", first, replay, reused, firstErr)
+	}
+
+	if saveErr != nil || takeErr != nil || found != true || taken.UserID != "testuser1" || foundAgain {
+		t.Errorf("TakeWebAuthnCeremony failed: Should have found the ceremony once, but got %+v, %v, %v (%v, %v)", taken, found, foundAgain, saveErr, takeErr)
+	}
+}
@@ -0,0 +1,2394 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// sqlDialect is the set of statements a database/sql backed store
+// uses for a specific database engine.  Statements use $1, $2... parameters,
+// which need to first appear in numeric order (SQLite binds them by position)
+type sqlDialect struct {
+	// driver is the database/sql driver name
+	driver string
+
+	// exportTxOptions are the options for the transaction used to take a
+	// consistent snapshot of a store (nil for the driver's default)
+	exportTxOptions *sql.TxOptions
+
+	// systemSchema and tokenSchema are the tables / indices created on bootstrap (in order)
+	systemSchema []schemaStatement
+	tokenSchema  []schemaStatement
+
+	// systemMigrations and tokenMigrations bring stores bootstrapped by older versions up
+	// to date (in order -- see migrateSchema).  Bootstrapped and restored stores are recorded
+	// in the schema_version table as having all of them
+	systemMigrations []migration
+	tokenMigrations  []migration
+
+	// Schema versions (see migrateSchema)
+	schemaVersionSchema string
+	selectSchemaVersion string
+	deleteSchemaVersion string
+	insertSchemaVersion string
+
+	// Bootstrap data -- see defaults_system.go for the parameters each requires
+	defaultAdminUser         string
+	defaultSystemResource    string
+	defaultSystemRole        string
+	defaultSystemCredentials string
+
+	// Users
+	insertUser       string
+	selectUserByID   string
+	selectUserByName string
+	selectAllUsers   string
+
+	// Resources
+	insertResource     string
+	selectResourceByID string
+	selectAllResources string
+
+	// Roles
+	insertRole     string
+	selectRoleByID string
+	selectAllRoles string
+
+	// User / resource / role assignments
+	insertUserResourceRole      string
+	selectUserResourceRole      string
+	selectUserResourceRoles     string
+	getResourcesForUser         string
+	getRolesForUserAndResources string
+	selectAllUserResourceRoles  string
+	deleteUserResourceRole      string
+
+	// Client authentication
+	deleteClientAuth    string
+	insertClientAuth    string
+	selectClientAuth    string
+	selectAllClientAuth string
+
+	// Password history (see SetUserSecretHash).  insertPasswordHistory is used to restore it too
+	updateUserSecretHash     string
+	replaceUserSecretHash    string
+	replacePasswordHistory   string
+	insertPasswordHistory    string
+	selectPasswordHistory    string
+	prunePasswordHistory     string
+	selectAllPasswordHistory string
+
+	// TOTP second factors (see SetUserMFA).  insertUserMFA is used to restore them too
+	deleteUserMFA    string
+	insertUserMFA    string
+	replaceUserMFA   string
+	selectUserMFA    string
+	selectAllUserMFA string
+
+	// WebAuthn credentials.  insertWebAuthnCredential is used to restore them too
+	insertWebAuthnCredential         string
+	selectWebAuthnCredential         string
+	selectWebAuthnCredentialsForUser string
+	selectAllWebAuthnCredentials     string
+	updateWebAuthnCredentialUse      string
+	deleteWebAuthnCredential         string
+
+	// Restoring items with all of their columns (see ImportSystem / ImportTokens)
+	restoreUser             string
+	restoreResource         string
+	restoreRole             string
+	restoreUserResourceRole string
+	restoreClientAuth       string
+	restoreToken            string
+
+	// Audit events.  nextAuditID (if set) returns the next event id from a sequence --
+	// otherwise events get the last event's id + 1 (for databases with a single writer).
+	// lockAuditChain and tryLockAuditChain (if set) make sure only one writer at a time
+	// chains events (see SealAuditEvents), without holding up writers adding them
+	nextAuditID                 string
+	lockAuditChain              string
+	tryLockAuditChain           string
+	selectLastAuditEvent        string
+	selectLastChainedAuditEvent string
+	insertAuditEvent            string
+	chainAuditEvent             string
+	selectAuditEvents           string
+
+	// resetAuditID (if set) moves the audit id sequence past the restored events
+	resetAuditID string
+
+	// Tokens
+	expireUserTokens string
+	insertToken      string
+	selectToken      string
+	revokeToken      string
+	selectUserTokens string
+	purgeTokens      string
+	selectAllTokens  string
+	countTokens      string
+
+	// Failed logins (see AddLoginFailure).  claimLoginAttempts makes sure there's a row for the key
+	// (so selectLoginAttemptsForUpdate can lock it) where the database can do that in one statement
+	selectLoginAttempts          string
+	claimLoginAttempts           string
+	selectLoginAttemptsForUpdate string
+	deleteLoginAttempts          string
+	insertLoginAttempts          string
+	updateLoginAttempts          string
+	purgeLoginAttempts           string
+
+	// Used ids (insertUsedID does nothing if the id is already there, where the database can say so)
+	selectUsedID string
+	deleteUsedID string
+	insertUsedID string
+	purgeUsedIDs string
+
+	// WebAuthn ceremonies
+	insertWebAuthnCeremony  string
+	selectWebAuthnCeremony  string
+	deleteWebAuthnCeremony  string
+	purgeWebAuthnCeremonies string
+}
+
+// schemaStatement is a named DDL statement used when bootstrapping a store
+type schemaStatement struct {
+	name      string
+	statement string
+}
+
+// migration is a change made to a store's schema after it was first released
+type migration struct {
+	version int
+	name    string
+
+	// applied (if it's set) is a query that succeeds if the change has already been
+	// made (like selecting the column the migration adds), so it isn't made twice
+	applied string
+
+	statements []string
+}
+
+// Names of the stores in the schema_version table (the system and token
+// stores can share a database)
+const (
+	systemStoreName = "system"
+	tokenStoreName  = "tokens"
+)
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlSystemStore is a SystemStore backed by a database/sql database
+type sqlSystemStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// newSQLSystemStore opens a SystemStore using the passed dialect and connection string
+func newSQLSystemStore(dialect sqlDialect, dsn string) (*sqlSystemStore, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlSystemStore{db: db, dialect: dialect}, nil
+}
+
+// Close implements SystemStore
+func (store sqlSystemStore) Close() error {
+	return store.db.Close()
+}
+
+// Ping implements SystemStore
+func (store sqlSystemStore) Ping() error {
+	return pingDB(store.db)
+}
+
+// Bootstrap implements SystemStore
+func (store sqlSystemStore) Bootstrap(adminSecretHash string) error {
+	//	Start our database transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Problem starting a transaction to bootstrap auth system")
+	}
+
+	//	Create our database schema and indices (it's already up to date)
+	if err = execSchema(tx, store.dialect.systemSchema); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = setSchemaVersion(tx, store.dialect, systemStoreName, latestVersion(store.dialect.systemMigrations)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	//	Add our default admin user - the insert statement requires some parameters be passed:
+	_, err = tx.Exec(store.dialect.defaultAdminUser, BuiltIn.AdminUser, adminSecretHash)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem adding admin user: %s", err)
+	}
+
+	//	Create the default system resources:
+	_, err = tx.Exec(store.dialect.defaultSystemResource, BuiltIn.SystemResource)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem adding system resource: %s", err)
+	}
+
+	//	Create the default system roles (id/name/description):
+	_, err = tx.Exec(store.dialect.defaultSystemRole, BuiltIn.AdminRole, "sys_admin", "System admin role")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem adding system role: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.defaultSystemRole, BuiltIn.ResourceDelegateRole, "sys_delegate", "Resource delegate role")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem adding system role: %s", err)
+	}
+
+	//	Create the default system credentials (user/resource/role):
+	//	-- Admins get the sysadmin role
+	_, err = tx.Exec(store.dialect.defaultSystemCredentials, BuiltIn.AdminUser, BuiltIn.SystemResource, BuiltIn.AdminRole)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem adding system credential: %s", err)
+	}
+
+	//	Commit our transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Problem committing a transaction to bootstrap auth system")
+	}
+
+	return nil
+}
+
+// Migrate implements SystemStore
+func (store sqlSystemStore) Migrate() error {
+	return migrateSchema(store.db, store.dialect, systemStoreName, "SELECT count(*) FROM resource;", store.dialect.systemMigrations)
+}
+
+// AddUser implements SystemStore
+func (store sqlSystemStore) AddUser(user User, secretHash, createdBy string) (User, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return User{}, fmt.Errorf("An error occurred starting a transaction for a user: %s", err)
+	}
+
+	//	Insert the item
+	_, err = tx.Exec(store.dialect.insertUser,
+		user.ID,
+		user.Name,
+		user.Description,
+		secretHash,
+		createdBy,
+		zero.StringFrom(user.Source))
+	if err != nil {
+		tx.Rollback()
+		return User{}, fmt.Errorf("An error occurred adding a user: %s", err)
+	}
+
+	//	Start the user's password history
+	if secretHash != "" {
+		if _, err = tx.Exec(store.dialect.insertPasswordHistory, user.ID, secretHash, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return User{}, fmt.Errorf("An error occurred adding the user's password history: %s", err)
+		}
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return User{}, fmt.Errorf("An error occurred committing a transaction for a user: %s", err)
+	}
+
+	return store.GetUser(user.ID)
+}
+
+// SetUserSecretHash implements SystemStore
+func (store sqlSystemStore) SetUserSecretHash(userID, secretHash, updatedBy string, keep int) (User, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return User{}, fmt.Errorf("An error occurred starting a transaction for a user's secret: %s", err)
+	}
+
+	//	Update the user and add the secret to their history
+	if _, err = tx.Exec(store.dialect.updateUserSecretHash, secretHash, updatedBy, userID); err != nil {
+		tx.Rollback()
+		return User{}, fmt.Errorf("An error occurred updating a user's secret: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.insertPasswordHistory, userID, secretHash, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return User{}, fmt.Errorf("An error occurred adding to a user's password history: %s", err)
+	}
+
+	//	Forget the history we don't need to keep
+	history := []PasswordHistory{}
+	err = queryRows(tx, store.dialect.selectPasswordHistory, func(row rowScanner) error {
+		item, err := scanPasswordHistory(row)
+		history = append(history, item)
+		return err
+	}, userID)
+	if err != nil {
+		tx.Rollback()
+		return User{}, fmt.Errorf("An error occurred getting a user's password history: %s", err)
+	}
+
+	if keep > 0 && len(history) > keep {
+		if _, err = tx.Exec(store.dialect.prunePasswordHistory, userID, history[keep-1].Created.UTC()); err != nil {
+			tx.Rollback()
+			return User{}, fmt.Errorf("An error occurred removing old password history: %s", err)
+		}
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return User{}, fmt.Errorf("An error occurred committing a transaction for a user's secret: %s", err)
+	}
+
+	return store.GetUser(userID)
+}
+
+// ReplaceUserSecretHash implements SystemStore
+func (store sqlSystemStore) ReplaceUserSecretHash(userID, oldHash, newHash string) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a user's secret: %s", err)
+	}
+
+	//	Replace the hash on the user and in their history
+	if _, err = tx.Exec(store.dialect.replaceUserSecretHash, newHash, userID, oldHash); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred replacing a user's secret: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.replacePasswordHistory, newHash, userID, oldHash); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred replacing a user's password history: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a user's secret: %s", err)
+	}
+
+	return nil
+}
+
+// GetPasswordHistory implements SystemStore
+func (store sqlSystemStore) GetPasswordHistory(userID string) ([]PasswordHistory, error) {
+	retval := []PasswordHistory{}
+
+	rows, err := store.db.Query(store.dialect.selectPasswordHistory, userID)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting password history: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanPasswordHistory(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning password history: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning password history: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetUser implements SystemStore
+func (store sqlSystemStore) GetUser(userID string) (User, error) {
+	retval, err := scanUser(store.db.QueryRow(store.dialect.selectUserByID, userID))
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting user: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetUserByName implements SystemStore
+func (store sqlSystemStore) GetUserByName(name string) (User, error) {
+	retval, err := scanUser(store.db.QueryRow(store.dialect.selectUserByName, name))
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting user: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetAllUsers implements SystemStore
+func (store sqlSystemStore) GetAllUsers() ([]User, error) {
+	retval := []User{}
+
+	//	Get all the items:
+	rows, err := store.db.Query(store.dialect.selectAllUsers)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting all users: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanUser(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning all users: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning all users: %s", err)
+	}
+
+	//	Return our slice:
+	return retval, nil
+}
+
+// AddResource implements SystemStore
+func (store sqlSystemStore) AddResource(resource Resource, createdBy string) (Resource, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return Resource{}, fmt.Errorf("An error occurred starting a transaction for a resource: %s", err)
+	}
+
+	//	Insert the item
+	_, err = tx.Exec(store.dialect.insertResource,
+		resource.ID,
+		resource.Name,
+		resource.Description,
+		createdBy)
+	if err != nil {
+		tx.Rollback()
+		return Resource{}, fmt.Errorf("An error occurred adding a resource: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return Resource{}, fmt.Errorf("An error occurred committing a transaction for a resource: %s", err)
+	}
+
+	return store.GetResource(resource.ID)
+}
+
+// GetResource implements SystemStore
+func (store sqlSystemStore) GetResource(resourceID string) (Resource, error) {
+	retval, err := scanResource(store.db.QueryRow(store.dialect.selectResourceByID, resourceID))
+	if err != nil {
+		return retval, fmt.Errorf("Problem fetching resource: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetAllResources implements SystemStore
+func (store sqlSystemStore) GetAllResources() ([]Resource, error) {
+	retval := []Resource{}
+
+	//	Get all the items:
+	rows, err := store.db.Query(store.dialect.selectAllResources)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting all resources: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanResource(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning all resources: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning all resources: %s", err)
+	}
+
+	//	Return our slice:
+	return retval, nil
+}
+
+// AddRole implements SystemStore
+func (store sqlSystemStore) AddRole(role Role, createdBy string) (Role, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return Role{}, fmt.Errorf("An error occurred starting a transaction for a role: %s", err)
+	}
+
+	//	Insert the item
+	_, err = tx.Exec(store.dialect.insertRole,
+		role.ID,
+		role.Name,
+		role.Description,
+		createdBy)
+	if err != nil {
+		tx.Rollback()
+		return Role{}, fmt.Errorf("An error occurred adding a role: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return Role{}, fmt.Errorf("An error occurred committing a transaction for a role: %s", err)
+	}
+
+	return store.GetRole(role.ID)
+}
+
+// GetRole implements SystemStore
+func (store sqlSystemStore) GetRole(roleID string) (Role, error) {
+	retval, err := scanRole(store.db.QueryRow(store.dialect.selectRoleByID, roleID))
+	if err != nil {
+		return retval, fmt.Errorf("Problem fetching role: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetAllRoles implements SystemStore
+func (store sqlSystemStore) GetAllRoles() ([]Role, error) {
+	retval := []Role{}
+
+	//	Get all the items:
+	rows, err := store.db.Query(store.dialect.selectAllRoles)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting all roles: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanRole(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning all roles: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning all roles: %s", err)
+	}
+
+	//	Return our slice:
+	return retval, nil
+}
+
+// AddUserResourceRole implements SystemStore
+func (store sqlSystemStore) AddUserResourceRole(userID, resourceID, roleID, createdBy string) (UserResourceRole, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return UserResourceRole{}, fmt.Errorf("An error occurred starting a transaction for a user/resource/role: %s", err)
+	}
+
+	//	Insert the item
+	_, err = tx.Exec(store.dialect.insertUserResourceRole,
+		userID,
+		resourceID,
+		roleID,
+		createdBy,
+	)
+	if err != nil {
+		tx.Rollback()
+		return UserResourceRole{}, fmt.Errorf("An error occurred adding the user/resource/role: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return UserResourceRole{}, fmt.Errorf("An error occurred committing a transaction for a user/resource/role: %s", err)
+	}
+
+	//	Get the user/resource/role
+	retval, err := scanUserResourceRole(store.db.QueryRow(store.dialect.selectUserResourceRole, userID, resourceID, roleID))
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting user/resource/role object: %s", err)
+	}
+
+	return retval, nil
+}
+
+// DeleteUserResourceRole implements SystemStore
+func (store sqlSystemStore) DeleteUserResourceRole(userID, resourceID, roleID string) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a user/resource/role: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.deleteUserResourceRole, userID, resourceID, roleID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred removing the user/resource/role: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a user/resource/role: %s", err)
+	}
+
+	return nil
+}
+
+// GetUserResourceRoles implements SystemStore
+func (store sqlSystemStore) GetUserResourceRoles(userID string) ([]UserResourceRole, error) {
+	retval := []UserResourceRole{}
+
+	rows, err := store.db.Query(store.dialect.selectUserResourceRoles, userID)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting user/resource/roles: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanUserResourceRole(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning user/resource/roles: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning user/resource/roles: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetResourcesForUser implements SystemStore
+func (store sqlSystemStore) GetResourcesForUser(userID string) ([]ScopeResource, error) {
+	retval := []ScopeResource{}
+
+	rows, err := store.db.Query(store.dialect.getResourcesForUser, userID)
+	if err != nil {
+		return retval, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		gres := ScopeResource{}
+
+		if err = rows.Scan(
+			&gres.ID,
+			&gres.Name,
+			&gres.Description); err != nil {
+			return retval, err
+		}
+
+		retval = append(retval, gres)
+	}
+
+	return retval, rows.Err()
+}
+
+// GetRolesForUserAndResource implements SystemStore
+func (store sqlSystemStore) GetRolesForUserAndResource(userID, resourceID string) ([]ScopeRole, error) {
+	retval := []ScopeRole{}
+
+	rows, err := store.db.Query(store.dialect.getRolesForUserAndResources, userID, resourceID)
+	if err != nil {
+		return retval, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		grole := ScopeRole{}
+
+		if err = rows.Scan(
+			&grole.ID,
+			&grole.Name,
+			&grole.Description); err != nil {
+			return retval, err
+		}
+
+		retval = append(retval, grole)
+	}
+
+	return retval, rows.Err()
+}
+
+// SetClientAuth implements SystemStore
+func (store sqlSystemStore) SetClientAuth(auth ClientAuth, updatedBy string) error {
+	settings, err := json.Marshal(auth.ClientAuthSettings)
+	if err != nil {
+		return fmt.Errorf("Problem encoding client authentication settings: %s", err)
+	}
+
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for client authentication: %s", err)
+	}
+
+	//	Replace the existing item
+	if _, err = tx.Exec(store.dialect.deleteClientAuth, auth.UserID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred removing client authentication: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.insertClientAuth,
+		auth.UserID,
+		auth.Method,
+		string(settings),
+		updatedBy)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred adding client authentication: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for client authentication: %s", err)
+	}
+
+	return nil
+}
+
+// GetClientAuth implements SystemStore
+func (store sqlSystemStore) GetClientAuth(userID string) (ClientAuth, error) {
+	retval, err := scanClientAuth(store.db.QueryRow(store.dialect.selectClientAuth, userID))
+	if err == sql.ErrNoRows {
+		return ClientAuth{UserID: userID}, nil
+	}
+
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting client authentication: %s", err)
+	}
+
+	return retval, nil
+}
+
+// SetUserMFA implements SystemStore
+func (store sqlSystemStore) SetUserMFA(mfa UserMFA, updatedBy string) error {
+	recoveryCodes, err := json.Marshal(mfa.RecoveryCodes)
+	if err != nil {
+		return fmt.Errorf("Problem encoding recovery codes: %s", err)
+	}
+
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a user's second factor: %s", err)
+	}
+
+	//	Replace the existing item
+	if _, err = tx.Exec(store.dialect.deleteUserMFA, mfa.UserID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred removing a user's second factor: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.insertUserMFA,
+		mfa.UserID,
+		mfa.Secret,
+		mfa.Confirmed,
+		mfa.LastStep,
+		string(recoveryCodes),
+		time.Now().UTC(),
+		updatedBy)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred adding a user's second factor: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a user's second factor: %s", err)
+	}
+
+	return nil
+}
+
+// ReplaceUserMFA implements SystemStore
+func (store sqlSystemStore) ReplaceUserMFA(before, after UserMFA, updatedBy string) (bool, error) {
+	beforeCodes, err := json.Marshal(before.RecoveryCodes)
+	if err != nil {
+		return false, fmt.Errorf("Problem encoding recovery codes: %s", err)
+	}
+
+	afterCodes, err := json.Marshal(after.RecoveryCodes)
+	if err != nil {
+		return false, fmt.Errorf("Problem encoding recovery codes: %s", err)
+	}
+
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("An error occurred starting a transaction for a user's second factor: %s", err)
+	}
+
+	result, err := tx.Exec(store.dialect.replaceUserMFA,
+		after.LastStep,
+		string(afterCodes),
+		time.Now().UTC(),
+		updatedBy,
+		before.UserID,
+		before.LastStep,
+		string(beforeCodes))
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("An error occurred updating a user's second factor: %s", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("An error occurred updating a user's second factor: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("An error occurred committing a transaction for a user's second factor: %s", err)
+	}
+
+	return updated > 0, nil
+}
+
+// GetUserMFA implements SystemStore
+func (store sqlSystemStore) GetUserMFA(userID string) (UserMFA, error) {
+	retval, err := scanUserMFA(store.db.QueryRow(store.dialect.selectUserMFA, userID))
+	if err == sql.ErrNoRows {
+		return UserMFA{UserID: userID}, nil
+	}
+
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting a user's second factor: %s", err)
+	}
+
+	return retval, nil
+}
+
+// DeleteUserMFA implements SystemStore
+func (store sqlSystemStore) DeleteUserMFA(userID string) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a user's second factor: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.deleteUserMFA, userID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred removing a user's second factor: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a user's second factor: %s", err)
+	}
+
+	return nil
+}
+
+// AddWebAuthnCredential implements SystemStore
+func (store sqlSystemStore) AddWebAuthnCredential(credential WebAuthnCredential, createdBy string) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a WebAuthn credential: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.insertWebAuthnCredential,
+		credential.ID,
+		credential.UserID,
+		credential.Name,
+		credential.PublicKey,
+		int64(credential.SignCount),
+		credential.AAGUID,
+		strings.Join(credential.Transports, " "),
+		credential.Passkey,
+		time.Now().UTC(),
+		createdBy,
+		zero.Time{})
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred adding a WebAuthn credential: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a WebAuthn credential: %s", err)
+	}
+
+	return nil
+}
+
+// GetWebAuthnCredential implements SystemStore
+func (store sqlSystemStore) GetWebAuthnCredential(credentialID string) (WebAuthnCredential, error) {
+	retval, err := scanWebAuthnCredential(store.db.QueryRow(store.dialect.selectWebAuthnCredential, credentialID))
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting a WebAuthn credential: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetWebAuthnCredentialsForUser implements SystemStore
+func (store sqlSystemStore) GetWebAuthnCredentialsForUser(userID string) ([]WebAuthnCredential, error) {
+	retval := []WebAuthnCredential{}
+
+	rows, err := store.db.Query(store.dialect.selectWebAuthnCredentialsForUser, userID)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting a user's WebAuthn credentials: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning a user's WebAuthn credentials: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning a user's WebAuthn credentials: %s", err)
+	}
+
+	return retval, nil
+}
+
+// UpdateWebAuthnCredentialUse implements SystemStore
+func (store sqlSystemStore) UpdateWebAuthnCredentialUse(credentialID string, signCount uint32, used time.Time) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a WebAuthn credential: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.updateWebAuthnCredentialUse, int64(signCount), zero.TimeFrom(used.UTC()), credentialID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred updating a WebAuthn credential: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a WebAuthn credential: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteWebAuthnCredential implements SystemStore
+func (store sqlSystemStore) DeleteWebAuthnCredential(credentialID string) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a WebAuthn credential: %s", err)
+	}
+
+	if _, err = tx.Exec(store.dialect.deleteWebAuthnCredential, credentialID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred removing a WebAuthn credential: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a WebAuthn credential: %s", err)
+	}
+
+	return nil
+}
+
+// AddAuditEvent implements SystemStore
+func (store sqlSystemStore) AddAuditEvent(event AuditEvent, hmacKey []byte) (AuditEvent, error) {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return event, fmt.Errorf("An error occurred starting a transaction for an audit event: %s", err)
+	}
+
+	//	Find the next id
+	id := int64(0)
+	if store.dialect.nextAuditID != "" {
+		err = tx.QueryRow(store.dialect.nextAuditID).Scan(&id)
+	} else {
+		id, _, err = lastAuditEvent(tx.QueryRow(store.dialect.selectLastAuditEvent))
+		id++
+	}
+	if err != nil {
+		tx.Rollback()
+		return event, fmt.Errorf("An error occurred getting the next audit event id: %s", err)
+	}
+
+	event = unchainedAuditEvent(event, id, hmacKey)
+
+	//	Insert the item
+	_, err = tx.Exec(store.dialect.insertAuditEvent,
+		event.ID,
+		event.Created.UTC(),
+		event.Actor,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.ClientID,
+		event.Detail,
+		event.Before,
+		event.After,
+		event.PrevHash,
+		event.Hash,
+		event.HMAC)
+	if err != nil {
+		tx.Rollback()
+		return event, fmt.Errorf("An error occurred adding an audit event: %s", err)
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return event, fmt.Errorf("An error occurred committing a transaction for an audit event: %s", err)
+	}
+
+	return event, nil
+}
+
+// SealAuditEvents implements SystemStore
+func (store sqlSystemStore) SealAuditEvents(hmacKey []byte, wait bool) error {
+	//	Start a transaction:
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction to chain audit events: %s", err)
+	}
+
+	//	Make sure no one else is chaining events
+	switch {
+	case wait && store.dialect.lockAuditChain != "":
+		if _, err = tx.Exec(store.dialect.lockAuditChain); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("An error occurred locking the audit log: %s", err)
+		}
+
+	case wait == false && store.dialect.tryLockAuditChain != "":
+		locked := false
+		if err = tx.QueryRow(store.dialect.tryLockAuditChain).Scan(&locked); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("An error occurred locking the audit log: %s", err)
+		}
+
+		//	Someone else is chaining them
+		if locked == false {
+			tx.Rollback()
+			return nil
+		}
+	}
+
+	lastID, lastHash, err := lastAuditEvent(tx.QueryRow(store.dialect.selectLastChainedAuditEvent))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred getting the last chained audit event: %s", err)
+	}
+
+	events := []AuditEvent{}
+	err = queryRows(tx, store.dialect.selectAuditEvents, func(row rowScanner) error {
+		item, err := scanAuditEvent(row)
+		events = append(events, item)
+		return err
+	}, lastID, 1000)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred getting the audit events to chain: %s", err)
+	}
+
+	for _, event := range chainAuditEvents(events, lastID, lastHash, hmacKey, time.Now()) {
+		if _, err = tx.Exec(store.dialect.chainAuditEvent, event.PrevHash, event.Hash, event.HMAC, event.ID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("An error occurred chaining an audit event: %s", err)
+		}
+	}
+
+	//	Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction to chain audit events: %s", err)
+	}
+
+	return nil
+}
+
+// GetAuditEvents implements SystemStore
+func (store sqlSystemStore) GetAuditEvents(afterID int64, limit int) ([]AuditEvent, error) {
+	retval := []AuditEvent{}
+
+	rows, err := store.db.Query(store.dialect.selectAuditEvents, afterID, limit)
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting audit events: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanAuditEvent(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning audit events: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning audit events: %s", err)
+	}
+
+	return retval, nil
+}
+
+// GetLastAuditEventID implements SystemStore
+func (store sqlSystemStore) GetLastAuditEventID() (int64, error) {
+	lastID, _, err := lastAuditEvent(store.db.QueryRow(store.dialect.selectLastChainedAuditEvent))
+	if err != nil {
+		return 0, fmt.Errorf("Problem selecting the last audit event: %s", err)
+	}
+
+	return lastID, nil
+}
+
+// ExportSystem implements SystemStore.  Everything is read in a single
+// transaction, so the snapshot is consistent even while the server is running
+func (store sqlSystemStore) ExportSystem() (SystemSnapshot, error) {
+	retval := SystemSnapshot{
+		Users:               []User{},
+		Resources:           []Resource{},
+		Roles:               []Role{},
+		UserResourceRoles:   []UserResourceRole{},
+		ClientAuth:          []ClientAuth{},
+		PasswordHistory:     []PasswordHistory{},
+		UserMFA:             []UserMFA{},
+		WebAuthnCredentials: []WebAuthnCredential{},
+	}
+
+	//	Start a transaction:
+	tx, err := store.db.BeginTx(context.Background(), store.dialect.exportTxOptions)
+	if err != nil {
+		return retval, fmt.Errorf("An error occurred starting a transaction for the export: %s", err)
+	}
+	defer tx.Rollback()
+
+	//	Users
+	err = queryRows(tx, store.dialect.selectAllUsers, func(row rowScanner) error {
+		item, err := scanUser(row)
+		retval.Users = append(retval.Users, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting users: %s", err)
+	}
+
+	//	Resources
+	err = queryRows(tx, store.dialect.selectAllResources, func(row rowScanner) error {
+		item, err := scanResource(row)
+		retval.Resources = append(retval.Resources, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting resources: %s", err)
+	}
+
+	//	Roles
+	err = queryRows(tx, store.dialect.selectAllRoles, func(row rowScanner) error {
+		item, err := scanRole(row)
+		retval.Roles = append(retval.Roles, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting roles: %s", err)
+	}
+
+	//	User / resource / role assignments
+	err = queryRows(tx, store.dialect.selectAllUserResourceRoles, func(row rowScanner) error {
+		item, err := scanUserResourceRole(row)
+		retval.UserResourceRoles = append(retval.UserResourceRoles, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting user/resource/roles: %s", err)
+	}
+
+	//	Client authentication
+	err = queryRows(tx, store.dialect.selectAllClientAuth, func(row rowScanner) error {
+		item, err := scanClientAuth(row)
+		retval.ClientAuth = append(retval.ClientAuth, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting client authentication: %s", err)
+	}
+
+	//	Password history
+	err = queryRows(tx, store.dialect.selectAllPasswordHistory, func(row rowScanner) error {
+		item, err := scanPasswordHistory(row)
+		retval.PasswordHistory = append(retval.PasswordHistory, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting password history: %s", err)
+	}
+
+	//	TOTP second factors
+	err = queryRows(tx, store.dialect.selectAllUserMFA, func(row rowScanner) error {
+		item, err := scanUserMFA(row)
+		retval.UserMFA = append(retval.UserMFA, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting second factors: %s", err)
+	}
+
+	//	WebAuthn credentials
+	err = queryRows(tx, store.dialect.selectAllWebAuthnCredentials, func(row rowScanner) error {
+		item, err := scanWebAuthnCredential(row)
+		retval.WebAuthnCredentials = append(retval.WebAuthnCredentials, item)
+		return err
+	})
+	if err != nil {
+		return retval, fmt.Errorf("Problem exporting WebAuthn credentials: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ImportSystem implements SystemStore
+func (store sqlSystemStore) ImportSystem(snapshot SystemSnapshot) error {
+	//	Start our database transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for the import: %s", err)
+	}
+
+	//	Create our database schema and indices (it's already up to date)
+	if err = execSchema(tx, store.dialect.systemSchema); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = setSchemaVersion(tx, store.dialect, systemStoreName, latestVersion(store.dialect.systemMigrations)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	//	Make sure we're importing into an empty store
+	existing := 0
+	err = queryRows(tx, store.dialect.selectAllUsers, func(row rowScanner) error {
+		existing++
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Problem checking for existing users: %s", err)
+	}
+
+	if existing > 0 {
+		tx.Rollback()
+		return fmt.Errorf("The system datastore already has users -- it needs to be empty to import into it")
+	}
+
+	for _, item := range snapshot.Users {
+		_, err = tx.Exec(store.dialect.restoreUser,
+			item.ID,
+			item.Enabled,
+			item.Name,
+			item.Description,
+			item.SecretHash,
+			item.Created.UTC(),
+			item.CreatedBy,
+			item.Updated.UTC(),
+			item.UpdatedBy,
+			item.Deleted,
+			item.DeletedBy,
+			zero.StringFrom(item.Source))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing user %s: %s", item.Name, err)
+		}
+	}
+
+	for _, item := range snapshot.Resources {
+		_, err = tx.Exec(store.dialect.restoreResource,
+			item.ID,
+			item.Name,
+			item.Description,
+			item.Created.UTC(),
+			item.CreatedBy,
+			item.Updated.UTC(),
+			item.UpdatedBy,
+			item.Deleted,
+			item.DeletedBy)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing resource %s: %s", item.Name, err)
+		}
+	}
+
+	for _, item := range snapshot.Roles {
+		_, err = tx.Exec(store.dialect.restoreRole,
+			item.ID,
+			item.Name,
+			item.Description,
+			item.Created.UTC(),
+			item.CreatedBy,
+			item.Updated.UTC(),
+			item.UpdatedBy,
+			item.Deleted,
+			item.DeletedBy)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing role %s: %s", item.Name, err)
+		}
+	}
+
+	for _, item := range snapshot.UserResourceRoles {
+		_, err = tx.Exec(store.dialect.restoreUserResourceRole,
+			item.UserID,
+			item.ResourceID,
+			item.RoleID,
+			item.Created.UTC(),
+			item.CreatedBy,
+			item.Updated.UTC(),
+			item.UpdatedBy,
+			item.Deleted,
+			item.DeletedBy)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing user/resource/role: %s", err)
+		}
+	}
+
+	for _, item := range snapshot.ClientAuth {
+		settings, err := json.Marshal(item.ClientAuthSettings)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem encoding client authentication settings: %s", err)
+		}
+
+		_, err = tx.Exec(store.dialect.restoreClientAuth,
+			item.UserID,
+			item.Method,
+			string(settings),
+			item.Updated.UTC(),
+			item.UpdatedBy)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing client authentication: %s", err)
+		}
+	}
+
+	for _, item := range snapshot.PasswordHistory {
+		_, err = tx.Exec(store.dialect.insertPasswordHistory,
+			item.UserID,
+			item.SecretHash,
+			item.Created.UTC())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing password history: %s", err)
+		}
+	}
+
+	for _, item := range snapshot.UserMFA {
+		recoveryCodes, err := json.Marshal(item.RecoveryCodes)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem encoding recovery codes: %s", err)
+		}
+
+		_, err = tx.Exec(store.dialect.insertUserMFA,
+			item.UserID,
+			item.Secret,
+			item.Confirmed,
+			item.LastStep,
+			string(recoveryCodes),
+			item.Updated.UTC(),
+			item.UpdatedBy)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing second factor: %s", err)
+		}
+	}
+
+	for _, item := range snapshot.WebAuthnCredentials {
+		_, err = tx.Exec(store.dialect.insertWebAuthnCredential,
+			item.ID,
+			item.UserID,
+			item.Name,
+			item.PublicKey,
+			int64(item.SignCount),
+			item.AAGUID,
+			strings.Join(item.Transports, " "),
+			item.Passkey,
+			item.Created.UTC(),
+			item.CreatedBy,
+			item.LastUsed)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing WebAuthn credential: %s", err)
+		}
+	}
+
+	//	Audit events keep their ids and hashes, so the restored log still verifies
+	for _, item := range snapshot.AuditEvents {
+		_, err = tx.Exec(store.dialect.insertAuditEvent,
+			item.ID,
+			item.Created.UTC(),
+			item.Actor,
+			item.Action,
+			item.TargetType,
+			item.TargetID,
+			item.IP,
+			item.ClientID,
+			item.Detail,
+			item.Before,
+			item.After,
+			item.PrevHash,
+			item.Hash,
+			item.HMAC)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing audit event: %s", err)
+		}
+	}
+
+	if store.dialect.resetAuditID != "" {
+		if _, err = tx.Exec(store.dialect.resetAuditID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem resetting the audit id sequence: %s", err)
+		}
+	}
+
+	//	Commit our transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for the import: %s", err)
+	}
+
+	return nil
+}
+
+// sqlTokenStore is a TokenStore backed by a database/sql database
+type sqlTokenStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// newSQLTokenStore opens a TokenStore using the passed dialect and connection string
+func newSQLTokenStore(dialect sqlDialect, dsn string) (*sqlTokenStore, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTokenStore{db: db, dialect: dialect}, nil
+}
+
+// Close implements TokenStore
+func (store sqlTokenStore) Close() error {
+	return store.db.Close()
+}
+
+// Ping implements TokenStore
+func (store sqlTokenStore) Ping() error {
+	return pingDB(store.db)
+}
+
+// Bootstrap implements TokenStore
+func (store sqlTokenStore) Bootstrap() error {
+	//	Start our database transaction for the token database
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Problem starting a transaction to bootstrap auth tokens")
+	}
+
+	//	Token schema / indices (it's already up to date)
+	if err = execSchema(tx, store.dialect.tokenSchema); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = setSchemaVersion(tx, store.dialect, tokenStoreName, latestVersion(store.dialect.tokenMigrations)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	//	Commit our transaction for the token database
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Problem committing a transaction to bootstrap auth tokens")
+	}
+
+	return nil
+}
+
+// Migrate implements TokenStore
+func (store sqlTokenStore) Migrate() error {
+	return migrateSchema(store.db, store.dialect, tokenStoreName, "SELECT count(*) FROM tokens;", store.dialect.tokenMigrations)
+}
+
+// AddToken implements TokenStore
+func (store sqlTokenStore) AddToken(token Token) error {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for updating existing tokens: %s", err)
+	}
+
+	//	-- update existing items
+	_, err = tx.Exec(store.dialect.expireUserTokens, token.UserID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred updating existing tokens: %s", err)
+	}
+
+	//	Persist the token in the database
+	_, err = tx.Exec(store.dialect.insertToken,
+		token.ID,
+		token.UserID,
+		token.Created.UTC(),
+		token.Expires.UTC(),
+		token.Confirmation.CertThumbprint,
+		token.Confirmation.KeyThumbprint,
+		strings.Join(token.AMR, " "))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred adding the token: %s", err)
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for updating existing tokens: %s", err)
+	}
+
+	return nil
+}
+
+// GetToken implements TokenStore
+func (store sqlTokenStore) GetToken(tokenID string) (Token, error) {
+	//	Get the token (as long as it's not expired)
+	retval, err := scanToken(store.db.QueryRow(store.dialect.selectToken, tokenID, time.Now().UTC()))
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting token: %s", err)
+	}
+
+	return retval, nil
+}
+
+// RevokeToken implements TokenStore
+func (store sqlTokenStore) RevokeToken(tokenID, revokedBy string) error {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for revoking a token: %s", err)
+	}
+
+	result, err := tx.Exec(store.dialect.revokeToken, revokedBy, time.Now().UTC(), tokenID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred revoking the token: %s", err)
+	}
+
+	//	If nothing was updated, the token doesn't exist (or is already expired)
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		tx.Rollback()
+		return fmt.Errorf("Problem revoking token: token not found or expired")
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for revoking a token: %s", err)
+	}
+
+	return nil
+}
+
+// GetTokensForUser implements TokenStore
+func (store sqlTokenStore) GetTokensForUser(userID string) ([]Token, error) {
+	retval := []Token{}
+
+	rows, err := store.db.Query(store.dialect.selectUserTokens, userID, time.Now().UTC())
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting tokens for user: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanToken(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning tokens for user: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning tokens for user: %s", err)
+	}
+
+	return retval, nil
+}
+
+// PurgeExpiredTokens implements TokenStore
+func (store sqlTokenStore) PurgeExpiredTokens(before time.Time) (int64, error) {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("An error occurred starting a transaction for purging tokens: %s", err)
+	}
+
+	result, err := tx.Exec(store.dialect.purgeTokens, before.UTC())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("An error occurred purging tokens: %s", err)
+	}
+
+	//	-- forgotten login attempts, used ids and ceremonies go too
+	_, err = tx.Exec(store.dialect.purgeLoginAttempts, before.UTC())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("An error occurred purging login attempts: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.purgeUsedIDs, before.UTC())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("An error occurred purging used ids: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.purgeWebAuthnCeremonies, before.UTC())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("An error occurred purging WebAuthn ceremonies: %s", err)
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("An error occurred committing a transaction for purging tokens: %s", err)
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Problem getting the number of purged tokens: %s", err)
+	}
+
+	return removed, nil
+}
+
+// CountTokens implements TokenStore
+func (store sqlTokenStore) CountTokens() (int64, error) {
+	retval := int64(0)
+
+	if err := store.db.QueryRow(store.dialect.countTokens, time.Now().UTC()).Scan(&retval); err != nil {
+		return retval, fmt.Errorf("Problem counting tokens: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ExportTokens implements TokenStore
+func (store sqlTokenStore) ExportTokens() ([]Token, error) {
+	retval := []Token{}
+
+	rows, err := store.db.Query(store.dialect.selectAllTokens, time.Now().UTC())
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting tokens: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanToken(rows)
+		if err != nil {
+			return retval, fmt.Errorf("Problem scanning tokens: %s", err)
+		}
+
+		retval = append(retval, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retval, fmt.Errorf("Problem scanning tokens: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ImportTokens implements TokenStore
+func (store sqlTokenStore) ImportTokens(tokens []Token) error {
+	//	Start our database transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for the token import: %s", err)
+	}
+
+	//	Token schema / indices (it's already up to date)
+	if err = execSchema(tx, store.dialect.tokenSchema); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = setSchemaVersion(tx, store.dialect, tokenStoreName, latestVersion(store.dialect.tokenMigrations)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, item := range tokens {
+		_, err = tx.Exec(store.dialect.restoreToken,
+			item.ID,
+			item.UserID,
+			item.Created.UTC(),
+			item.Expires.UTC(),
+			item.Deleted,
+			item.DeletedBy,
+			item.Confirmation.CertThumbprint,
+			item.Confirmation.KeyThumbprint,
+			strings.Join(item.AMR, " "))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Problem importing token: %s", err)
+		}
+	}
+
+	//	Commit our transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for the token import: %s", err)
+	}
+
+	return nil
+}
+
+// AddLoginFailure implements TokenStore
+func (store sqlTokenStore) AddLoginFailure(key string, window time.Duration) (LoginAttempts, error) {
+	return store.updateLoginAttempts(key, func(attempts LoginAttempts) LoginAttempts {
+		return attempts.withFailure(time.Now(), window)
+	})
+}
+
+// LockLogins implements TokenStore
+func (store sqlTokenStore) LockLogins(key string, until time.Time) error {
+	_, err := store.updateLoginAttempts(key, func(attempts LoginAttempts) LoginAttempts {
+		return attempts.withLock(until)
+	})
+	return err
+}
+
+// GetLoginAttempts implements TokenStore
+func (store sqlTokenStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	retval, err := scanLoginAttempts(store.db.QueryRow(store.dialect.selectLoginAttempts, key, time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		return LoginAttempts{Key: key}, nil
+	}
+	if err != nil {
+		return retval, fmt.Errorf("Problem selecting login attempts: %s", err)
+	}
+
+	return retval, nil
+}
+
+// ResetLoginAttempts implements TokenStore
+func (store sqlTokenStore) ResetLoginAttempts(key string) error {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for resetting login attempts: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.deleteLoginAttempts, key)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred resetting login attempts: %s", err)
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for resetting login attempts: %s", err)
+	}
+
+	return nil
+}
+
+// updateLoginAttempts replaces the (unexpired) login attempts for the key with the
+// result of 'update' in a single transaction, and returns the updated attempts.  The
+// row is locked while it's updated, so concurrent failures for a key are all counted
+func (store sqlTokenStore) updateLoginAttempts(key string, update func(attempts LoginAttempts) LoginAttempts) (LoginAttempts, error) {
+	now := time.Now().UTC()
+
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("An error occurred starting a transaction for updating login attempts: %s", err)
+	}
+
+	//	-- make sure there's a row to lock (an expired one, if it's new)
+	if store.dialect.claimLoginAttempts != "" {
+		if _, err := tx.Exec(store.dialect.claimLoginAttempts, key, now); err != nil {
+			tx.Rollback()
+			return LoginAttempts{}, fmt.Errorf("An error occurred updating login attempts: %s", err)
+		}
+	}
+
+	current, err := scanLoginAttempts(tx.QueryRow(store.dialect.selectLoginAttemptsForUpdate, key))
+	found := err == nil
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return current, fmt.Errorf("Problem selecting login attempts: %s", err)
+	}
+
+	//	Expired failures are forgotten
+	if found == false || current.Expires.After(now) == false {
+		current = LoginAttempts{Key: key}
+	}
+
+	retval := update(current)
+
+	if found {
+		_, err = tx.Exec(store.dialect.updateLoginAttempts,
+			int64(retval.Failures),
+			retval.LastFailure.UTC(),
+			zero.TimeFrom(retval.LockedUntil.UTC()),
+			retval.Expires.UTC(),
+			retval.Key)
+	} else {
+		_, err = tx.Exec(store.dialect.insertLoginAttempts,
+			retval.Key,
+			int64(retval.Failures),
+			retval.LastFailure.UTC(),
+			zero.TimeFrom(retval.LockedUntil.UTC()),
+			retval.Expires.UTC())
+	}
+	if err != nil {
+		tx.Rollback()
+		return retval, fmt.Errorf("An error occurred updating login attempts: %s", err)
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return retval, fmt.Errorf("An error occurred committing a transaction for updating login attempts: %s", err)
+	}
+
+	return retval, nil
+}
+
+// UseID implements TokenStore
+func (store sqlTokenStore) UseID(id string, expires time.Time) (bool, error) {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("An error occurred starting a transaction for using an id: %s", err)
+	}
+
+	used := int64(0)
+	if err := tx.QueryRow(store.dialect.selectUsedID, id, time.Now().UTC()).Scan(&used); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("Problem selecting used id: %s", err)
+	}
+
+	if used > 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	//	-- replace any expired row, and record the id
+	_, err = tx.Exec(store.dialect.deleteUsedID, id)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("An error occurred using an id: %s", err)
+	}
+
+	result, err := tx.Exec(store.dialect.insertUsedID, id, expires.UTC())
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("An error occurred using an id: %s", err)
+	}
+
+	//	-- another request that used the id at the same time got there first
+	if inserted, err := result.RowsAffected(); err == nil && inserted == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("An error occurred committing a transaction for using an id: %s", err)
+	}
+
+	return true, nil
+}
+
+// AddWebAuthnCeremony implements TokenStore
+func (store sqlTokenStore) AddWebAuthnCeremony(ceremony WebAuthnCeremony) error {
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("An error occurred starting a transaction for a WebAuthn ceremony: %s", err)
+	}
+
+	_, err = tx.Exec(store.dialect.insertWebAuthnCeremony,
+		base64.RawURLEncoding.EncodeToString(ceremony.Challenge),
+		ceremony.UserID,
+		ceremony.Registration,
+		ceremony.Passkey,
+		ceremony.Expires.UTC())
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("An error occurred adding a WebAuthn ceremony: %s", err)
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("An error occurred committing a transaction for a WebAuthn ceremony: %s", err)
+	}
+
+	return nil
+}
+
+// TakeWebAuthnCeremony implements TokenStore
+func (store sqlTokenStore) TakeWebAuthnCeremony(challenge []byte) (WebAuthnCeremony, bool, error) {
+	key := base64.RawURLEncoding.EncodeToString(challenge)
+
+	//	-- start a transaction
+	tx, err := store.db.Begin()
+	if err != nil {
+		return WebAuthnCeremony{}, false, fmt.Errorf("An error occurred starting a transaction for a WebAuthn ceremony: %s", err)
+	}
+
+	retval := WebAuthnCeremony{}
+	encoded, userID, registration := "", zero.String{}, zero.Bool{}
+	err = tx.QueryRow(store.dialect.selectWebAuthnCeremony, key, time.Now().UTC()).Scan(&encoded, &userID, &registration, &retval.Passkey, &retval.Expires)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return retval, false, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return retval, false, fmt.Errorf("Problem selecting WebAuthn ceremony: %s", err)
+	}
+	retval.Challenge, _ = base64.RawURLEncoding.DecodeString(encoded)
+	retval.UserID = userID.String
+	retval.Registration = registration.Bool
+
+	//	-- only the request that removes the ceremony gets to finish it
+	result, err := tx.Exec(store.dialect.deleteWebAuthnCeremony, key)
+	if err != nil {
+		tx.Rollback()
+		return retval, false, fmt.Errorf("An error occurred removing a WebAuthn ceremony: %s", err)
+	}
+
+	if removed, err := result.RowsAffected(); err == nil && removed == 0 {
+		tx.Rollback()
+		return WebAuthnCeremony{}, false, nil
+	}
+
+	//	-- commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		return retval, false, fmt.Errorf("An error occurred committing a transaction for a WebAuthn ceremony: %s", err)
+	}
+
+	return retval, true, nil
+}
+
+// pingDB checks that the database can be reached (giving up after a few seconds)
+func pingDB(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("Problem connecting to the database: %s", err)
+	}
+
+	return nil
+}
+
+// queryRows runs the query (with the passed args) in the passed transaction and calls 'scan' for each row
+func queryRows(tx *sql.Tx, query string, scan func(row rowScanner) error, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// execSchema executes each of the schema statements in order
+func execSchema(tx *sql.Tx, statements []schemaStatement) error {
+	for _, s := range statements {
+		if _, err := tx.Exec(s.statement); err != nil {
+			return fmt.Errorf("Problem adding %s: %s", s.name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateSchema makes the migrations the store (named 'storeName' in the schema_version table)
+// hasn't had yet, in order, recording each one as it's made.  Stores that haven't been bootstrapped
+// (the 'bootstrapped' query fails) are left alone.  Stores bootstrapped before there were schema
+// versions start at version 0 -- the migrations' 'applied' queries skip the changes they already have
+func migrateSchema(db *sql.DB, dialect sqlDialect, storeName, bootstrapped string, migrations []migration) error {
+	count := int64(0)
+	if err := db.QueryRow(bootstrapped).Scan(&count); err != nil {
+		return nil
+	}
+
+	//	Make sure there's somewhere to record the schema version
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Problem starting a transaction to migrate the %s datastore: %s", storeName, err)
+	}
+
+	if err = execSchema(tx, []schemaStatement{{"schema_version schema", dialect.schemaVersionSchema}}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Problem committing a transaction to migrate the %s datastore: %s", storeName, err)
+	}
+
+	version := 0
+	err = db.QueryRow(dialect.selectSchemaVersion, storeName).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("Problem selecting the %s datastore's schema version: %s", storeName, err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		//	Check for the change first (outside of the transaction, since a failed
+		//	statement aborts a PostgreSQL transaction)
+		applied := false
+		if m.applied != "" {
+			if rows, err := db.Query(m.applied); err == nil {
+				//	Read the rows out before closing them, so the driver is done with
+				//	the table before it's altered
+				for rows.Next() {
+				}
+				applied = rows.Err() == nil
+				rows.Close()
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Problem starting a transaction to migrate the %s datastore: %s", storeName, err)
+		}
+
+		if applied == false {
+			for _, statement := range m.statements {
+				if _, err = tx.Exec(statement); err != nil {
+					tx.Rollback()
+					return fmt.Errorf("Problem migrating the %s datastore (%s): %s", storeName, m.name, err)
+				}
+			}
+		}
+
+		if err = setSchemaVersion(tx, dialect, storeName, m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("Problem committing the %s datastore migration (%s): %s", storeName, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// setSchemaVersion records the version of the store's schema (named 'storeName' in the schema_version table)
+func setSchemaVersion(tx *sql.Tx, dialect sqlDialect, storeName string, version int) error {
+	if _, err := tx.Exec(dialect.deleteSchemaVersion, storeName); err != nil {
+		return fmt.Errorf("Problem removing the %s datastore's schema version: %s", storeName, err)
+	}
+
+	if _, err := tx.Exec(dialect.insertSchemaVersion, storeName, version); err != nil {
+		return fmt.Errorf("Problem recording the %s datastore's schema version: %s", storeName, err)
+	}
+
+	return nil
+}
+
+// latestVersion returns the version of the last migration (0 if there aren't any)
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].version
+}
+
+// scanUser scans a full user row
+func scanUser(row rowScanner) (User, error) {
+	item := User{}
+	source := zero.String{}
+	err := row.Scan(
+		&item.ID,
+		&item.Enabled,
+		&item.Name,
+		&item.Description,
+		&item.SecretHash,
+		&item.Created,
+		&item.CreatedBy,
+		&item.Updated,
+		&item.UpdatedBy,
+		&item.Deleted,
+		&item.DeletedBy,
+		&source,
+	)
+	item.Source = source.String
+	return item, err
+}
+
+// scanResource scans a full resource row
+func scanResource(row rowScanner) (Resource, error) {
+	item := Resource{}
+	err := row.Scan(
+		&item.ID,
+		&item.Name,
+		&item.Description,
+		&item.Created,
+		&item.CreatedBy,
+		&item.Updated,
+		&item.UpdatedBy,
+		&item.Deleted,
+		&item.DeletedBy,
+	)
+	return item, err
+}
+
+// scanRole scans a full role row
+func scanRole(row rowScanner) (Role, error) {
+	item := Role{}
+	err := row.Scan(
+		&item.ID,
+		&item.Name,
+		&item.Description,
+		&item.Created,
+		&item.CreatedBy,
+		&item.Updated,
+		&item.UpdatedBy,
+		&item.Deleted,
+		&item.DeletedBy,
+	)
+	return item, err
+}
+
+// scanUserResourceRole scans a full user_resource_role row
+func scanUserResourceRole(row rowScanner) (UserResourceRole, error) {
+	item := UserResourceRole{}
+	err := row.Scan(
+		&item.UserID,
+		&item.ResourceID,
+		&item.RoleID,
+		&item.Created,
+		&item.CreatedBy,
+		&item.Updated,
+		&item.UpdatedBy,
+		&item.Deleted,
+		&item.DeletedBy,
+	)
+	return item, err
+}
+
+// scanAuditEvent scans a full audit row
+func scanAuditEvent(row rowScanner) (AuditEvent, error) {
+	item := AuditEvent{}
+	prevHash, hash, hmac := zero.String{}, zero.String{}, zero.String{}
+	err := row.Scan(
+		&item.ID,
+		&item.Created,
+		&item.Actor,
+		&item.Action,
+		&item.TargetType,
+		&item.TargetID,
+		&item.IP,
+		&item.ClientID,
+		&item.Detail,
+		&item.Before,
+		&item.After,
+		&prevHash,
+		&hash,
+		&hmac,
+	)
+	item.PrevHash = prevHash.String
+	item.Hash = hash.String
+	item.HMAC = hmac.String
+	return item, err
+}
+
+// lastAuditEvent scans the id and hash of the last audit event
+// (or returns zero values if there aren't any events yet)
+func lastAuditEvent(row *sql.Row) (int64, string, error) {
+	var lastID int64
+	lastHash := zero.String{}
+
+	err := row.Scan(&lastID, &lastHash)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+
+	return lastID, lastHash.String, err
+}
+
+// scanClientAuth scans a full client_auth row
+func scanClientAuth(row rowScanner) (ClientAuth, error) {
+	item := ClientAuth{}
+	settings := ""
+	err := row.Scan(
+		&item.UserID,
+		&item.Method,
+		&settings,
+		&item.Updated,
+		&item.UpdatedBy,
+	)
+	if err != nil {
+		return item, err
+	}
+
+	if settings != "" {
+		err = json.Unmarshal([]byte(settings), &item.ClientAuthSettings)
+	}
+	return item, err
+}
+
+// scanUserMFA scans a full user_mfa row
+func scanUserMFA(row rowScanner) (UserMFA, error) {
+	item := UserMFA{}
+	recoveryCodes := zero.String{}
+	err := row.Scan(
+		&item.UserID,
+		&item.Secret,
+		&item.Confirmed,
+		&item.LastStep,
+		&recoveryCodes,
+		&item.Updated,
+		&item.UpdatedBy,
+	)
+	if err != nil {
+		return item, err
+	}
+
+	if recoveryCodes.String != "" {
+		err = json.Unmarshal([]byte(recoveryCodes.String), &item.RecoveryCodes)
+	}
+	return item, err
+}
+
+// scanWebAuthnCredential scans a full webauthn_credential row
+func scanWebAuthnCredential(row rowScanner) (WebAuthnCredential, error) {
+	item := WebAuthnCredential{}
+	signCount := int64(0)
+	aaguid, transports := zero.String{}, zero.String{}
+	err := row.Scan(
+		&item.ID,
+		&item.UserID,
+		&item.Name,
+		&item.PublicKey,
+		&signCount,
+		&aaguid,
+		&transports,
+		&item.Passkey,
+		&item.Created,
+		&item.CreatedBy,
+		&item.LastUsed,
+	)
+	item.SignCount = uint32(signCount)
+	item.AAGUID = aaguid.String
+	item.Transports = strings.Fields(transports.String)
+	return item, err
+}
+
+// scanPasswordHistory scans a full password_history row
+func scanPasswordHistory(row rowScanner) (PasswordHistory, error) {
+	item := PasswordHistory{}
+	err := row.Scan(
+		&item.UserID,
+		&item.SecretHash,
+		&item.Created,
+	)
+	return item, err
+}
+
+// scanToken scans a full tokens row
+func scanToken(row rowScanner) (Token, error) {
+	item := Token{}
+	thumbprint, keyThumbprint, amr := zero.String{}, zero.String{}, zero.String{}
+	err := row.Scan(
+		&item.ID,
+		&item.UserID,
+		&item.Created,
+		&item.Expires,
+		&item.Deleted,
+		&item.DeletedBy,
+		&thumbprint,
+		&keyThumbprint,
+		&amr,
+	)
+	item.AMR = strings.Fields(amr.String)
+	item.Confirmation.CertThumbprint = thumbprint.String
+	item.Confirmation.KeyThumbprint = keyThumbprint.String
+	return item, err
+}
+
+// scanLoginAttempts scans a full login_attempts row
+func scanLoginAttempts(row rowScanner) (LoginAttempts, error) {
+	item := LoginAttempts{}
+	failures, lockedUntil := int64(0), zero.Time{}
+	err := row.Scan(
+		&item.Key,
+		&failures,
+		&item.LastFailure,
+		&lockedUntil,
+		&item.Expires,
+	)
+	item.Failures = int(failures)
+	item.LockedUntil = lockedUntil.Time
+	return item, err
+}
@@ -0,0 +1,394 @@
+package data
+
+import (
+	"strings"
+
+	// SQLite sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteOptions are the connection options used for every SQLite database:
+// WAL journaling (so readers don't block the writer), a busy timeout instead
+// of failing immediately on a locked database, and write transactions that
+// take the write lock up front
+var sqliteOptions = "_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+
+/* Tables */
+// sqliteResourceSchema defines the schema for the resource table
+var sqliteResourceSchema = `
+CREATE TABLE IF NOT EXISTS resource (
+	id text NOT NULL,
+	name text NOT NULL,
+	description text,
+	created timestamp NOT NULL,
+	createdby text NOT NULL,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamp,
+	deletedby text
+);`
+
+// sqliteRoleSchema defines the schema for the role table
+var sqliteRoleSchema = `
+CREATE TABLE IF NOT EXISTS role (
+	id text NOT NULL,
+	name text NOT NULL,
+	description text,
+	created timestamp NOT NULL,
+	createdby text NOT NULL,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamp,
+	deletedby text
+);`
+
+// sqliteUserSchema defines the schema for the user table
+var sqliteUserSchema = `
+CREATE TABLE IF NOT EXISTS "user" (
+	id text NOT NULL,
+	enabled boolean NOT NULL,
+	name text NOT NULL,
+	description text,
+	secrethash text,
+	created timestamp NOT NULL,
+	createdby text NOT NULL,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamp,
+	deletedby text,
+	source text
+);`
+
+// sqliteUserResourceRoleSchema defines the schema for the user_resource_role table
+var sqliteUserResourceRoleSchema = `
+CREATE TABLE IF NOT EXISTS user_resource_role (
+	userid text NOT NULL,
+	resourceid text NOT NULL,
+	roleid text NOT NULL,
+	created timestamp NOT NULL,
+	createdby text NOT NULL,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL,
+	deleted timestamp,
+	deletedby text
+);`
+
+// sqliteAuditSchema defines the schema for the audit table
+var sqliteAuditSchema = `
+CREATE TABLE IF NOT EXISTS audit (
+	id bigint NOT NULL,
+	created timestamp NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	targettype text,
+	targetid text,
+	ip text,
+	clientid text,
+	detail text,
+	beforevalue text,
+	aftervalue text,
+	prevhash text,
+	hash text,
+	hmac text
+);`
+
+// sqliteTokenSchema defines the schema for the token table
+var sqliteTokenSchema = `
+CREATE TABLE IF NOT EXISTS tokens (
+	token text NOT NULL,
+	userid text NOT NULL,
+	created timestamp NOT NULL,
+	expires timestamp NOT NULL,
+	deleted timestamp,
+	deletedby text,
+	x5ts256 text,
+	jkt text,
+	amr text
+);`
+
+// sqliteLoginAttemptsSchema defines the schema for the login_attempts table
+var sqliteLoginAttemptsSchema = `
+CREATE TABLE IF NOT EXISTS login_attempts (
+	attemptkey text NOT NULL,
+	failures integer NOT NULL,
+	lastfailure timestamp NOT NULL,
+	lockeduntil timestamp,
+	expires timestamp NOT NULL
+);`
+
+// sqliteUsedIDSchema defines the schema for the used_ids table
+var sqliteUsedIDSchema = `
+CREATE TABLE IF NOT EXISTS used_ids (
+	usedid text NOT NULL,
+	expires timestamp NOT NULL
+);`
+
+// sqliteWebAuthnCeremonySchema defines the schema for the webauthn_ceremony table
+var sqliteWebAuthnCeremonySchema = `
+CREATE TABLE IF NOT EXISTS webauthn_ceremony (
+	challenge text NOT NULL,
+	userid text,
+	registration boolean,
+	passkey boolean NOT NULL,
+	expires timestamp NOT NULL
+);`
+
+// sqliteClientAuthSchema defines the schema for the client_auth table
+var sqliteClientAuthSchema = `
+CREATE TABLE IF NOT EXISTS client_auth (
+	userid text NOT NULL,
+	method text NOT NULL,
+	settings text,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL
+);`
+
+// sqlitePasswordHistorySchema defines the schema for the password_history table
+var sqlitePasswordHistorySchema = `
+CREATE TABLE IF NOT EXISTS password_history (
+	userid text NOT NULL,
+	secrethash text NOT NULL,
+	created timestamp NOT NULL
+);`
+
+// sqliteUserMFASchema defines the schema for the user_mfa table
+var sqliteUserMFASchema = `
+CREATE TABLE IF NOT EXISTS user_mfa (
+	userid text NOT NULL,
+	secret text NOT NULL,
+	confirmed boolean NOT NULL,
+	laststep integer NOT NULL,
+	recoverycodes text,
+	updated timestamp NOT NULL,
+	updatedby text NOT NULL
+);`
+
+// sqliteWebAuthnCredentialSchema defines the schema for the webauthn_credential table
+var sqliteWebAuthnCredentialSchema = `
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+	id text NOT NULL,
+	userid text NOT NULL,
+	name text NOT NULL,
+	publickey text NOT NULL,
+	signcount integer NOT NULL,
+	aaguid text,
+	transports text,
+	passkey boolean NOT NULL,
+	created timestamp NOT NULL,
+	createdby text NOT NULL,
+	lastused timestamp
+);`
+
+// sqliteDialect is the sqlDialect for SQLite.  SQLite has no now() function, so
+// CURRENT_TIMESTAMP (UTC) is used instead -- times passed as parameters are
+// always UTC as well, so stored timestamps compare correctly as text
+var sqliteDialect = sqlDialect{
+	driver: "sqlite3",
+
+	systemSchema: []schemaStatement{
+		{"schema_version schema", pgSchemaVersionSchema},
+		{"resource schema", sqliteResourceSchema},
+		{"resource id index", resourceIXSysID},
+		{"resource name index", resourceIXName},
+		{"role schema", sqliteRoleSchema},
+		{"role id index", roleIXSysID},
+		{"user schema", sqliteUserSchema},
+		{"user id index", pgUserIXSysID},
+		{"user name index", pgUserIXName},
+		{"user_resource_role schema", sqliteUserResourceRoleSchema},
+		{"user_resource_role id index", userResourceRoleIXID},
+		{"audit schema", sqliteAuditSchema},
+		{"audit id index", auditIXID},
+		{"client_auth schema", sqliteClientAuthSchema},
+		{"client_auth user index", clientAuthIXUserID},
+		{"password_history schema", sqlitePasswordHistorySchema},
+		{"password_history user index", passwordHistoryIXUserID},
+		{"user_mfa schema", sqliteUserMFASchema},
+		{"user_mfa user index", userMFAIXUserID},
+		{"webauthn_credential schema", sqliteWebAuthnCredentialSchema},
+		{"webauthn_credential id index", webauthnCredentialIXID},
+		{"webauthn_credential user index", webauthnCredentialIXUserID},
+	},
+
+	tokenSchema: []schemaStatement{
+		{"schema_version schema", pgSchemaVersionSchema},
+		{"token schema", sqliteTokenSchema},
+		{"token index", tokenIXToken},
+		{"token user index", tokenIXUserID},
+		{"login_attempts schema", sqliteLoginAttemptsSchema},
+		{"login_attempts key index", loginAttemptsIXKey},
+		{"used_ids schema", sqliteUsedIDSchema},
+		{"used_ids id index", usedIDIXID},
+		{"webauthn_ceremony schema", sqliteWebAuthnCeremonySchema},
+		{"webauthn_ceremony challenge index", webauthnCeremonyIXChallenge},
+	},
+
+	systemMigrations: []migration{
+		{version: 1, name: "audit log", statements: []string{sqliteAuditSchema, auditIXID}},
+		{version: 2, name: "audit log chain", applied: "SELECT hmac FROM audit LIMIT 1;", statements: []string{
+			"ALTER TABLE audit ADD COLUMN prevhash text;",
+			"ALTER TABLE audit ADD COLUMN hash text;",
+			"ALTER TABLE audit ADD COLUMN hmac text;",
+		}},
+		{version: 3, name: "client authentication", statements: []string{sqliteClientAuthSchema, clientAuthIXUserID}},
+		{version: 4, name: "password history", statements: []string{sqlitePasswordHistorySchema, passwordHistoryIXUserID}},
+		{version: 5, name: "TOTP second factors", statements: []string{sqliteUserMFASchema, userMFAIXUserID}},
+		{version: 6, name: "WebAuthn credentials", statements: []string{sqliteWebAuthnCredentialSchema, webauthnCredentialIXID, webauthnCredentialIXUserID}},
+		{version: 7, name: "user sources", applied: `SELECT source FROM "user" LIMIT 1;`, statements: []string{`ALTER TABLE "user" ADD COLUMN source text;`}},
+		{version: 8, name: "directory users", statements: []string{`UPDATE "user" SET source = 'directory' WHERE createdby = 'directory' and secrethash = '';`}},
+	},
+
+	tokenMigrations: []migration{
+		{version: 1, name: "certificate-bound tokens", applied: "SELECT x5ts256 FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN x5ts256 text;"}},
+		{version: 2, name: "DPoP-bound tokens", applied: "SELECT jkt FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN jkt text;"}},
+		{version: 3, name: "login attempts", statements: []string{sqliteLoginAttemptsSchema, loginAttemptsIXKey}},
+		{version: 4, name: "token authentication methods", applied: "SELECT amr FROM tokens LIMIT 1;", statements: []string{"ALTER TABLE tokens ADD COLUMN amr text;"}},
+		{version: 5, name: "used ids and WebAuthn ceremonies", statements: []string{sqliteUsedIDSchema, usedIDIXID, sqliteWebAuthnCeremonySchema, webauthnCeremonyIXChallenge}},
+		{version: 6, name: "WebAuthn registration ceremonies", applied: "SELECT registration FROM webauthn_ceremony LIMIT 1;", statements: []string{"ALTER TABLE webauthn_ceremony ADD COLUMN registration boolean;"}},
+	},
+
+	schemaVersionSchema: pgSchemaVersionSchema,
+	selectSchemaVersion: "SELECT version FROM schema_version WHERE store=$1 ORDER BY version DESC LIMIT 1;",
+	deleteSchemaVersion: "DELETE FROM schema_version WHERE store=$1;",
+	insertSchemaVersion: "INSERT INTO schema_version (store, version) VALUES ($1, $2);",
+
+	defaultAdminUser: `
+INSERT INTO
+	"user"(id, enabled, name, description, secrethash, created, createdby, updated, updatedby)
+	values($1, true, 'admin', 'Default admin user', $2, CURRENT_TIMESTAMP, 'system', CURRENT_TIMESTAMP, 'system');`,
+	defaultSystemResource: `
+INSERT INTO
+	resource(id, name, description, created, createdby, updated, updatedby)
+	values($1, 'system', 'Default authsystem resource', CURRENT_TIMESTAMP, 'system', CURRENT_TIMESTAMP, 'system');`,
+	defaultSystemRole: `
+	INSERT INTO
+		role(id, name, description, created, createdby, updated, updatedby)
+		values($1, $2, $3, CURRENT_TIMESTAMP, 'system', CURRENT_TIMESTAMP, 'system');`,
+	defaultSystemCredentials: `
+	INSERT INTO
+		user_resource_role(userid, resourceid, roleid, created, createdby, updated, updatedby)
+		values($1, $2, $3, CURRENT_TIMESTAMP, 'system', CURRENT_TIMESTAMP, 'system')`,
+
+	insertUser: `INSERT INTO
+			"user" (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, source)
+			VALUES ($1, true, $2, $3, $4, CURRENT_TIMESTAMP, $5, CURRENT_TIMESTAMP, $5, $6);`,
+	selectUserByID:   postgresDialect.selectUserByID,
+	selectUserByName: postgresDialect.selectUserByName,
+	selectAllUsers:   postgresDialect.selectAllUsers,
+
+	insertResource: `INSERT INTO
+			resource (id, name, description, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4, CURRENT_TIMESTAMP, $4);`,
+	selectResourceByID: qlDialect.selectResourceByID,
+	selectAllResources: qlDialect.selectAllResources,
+
+	insertRole: `INSERT INTO
+			role (id, name, description, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4, CURRENT_TIMESTAMP, $4);`,
+	selectRoleByID: qlDialect.selectRoleByID,
+	selectAllRoles: qlDialect.selectAllRoles,
+
+	insertUserResourceRole: `INSERT INTO
+		user_resource_role (userid, resourceid, roleid, created, createdby, updated, updatedby)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4, CURRENT_TIMESTAMP, $4);`,
+	selectUserResourceRole:      qlDialect.selectUserResourceRole,
+	selectUserResourceRoles:     qlDialect.selectUserResourceRoles,
+	getResourcesForUser:         getResourcesForUser,
+	getRolesForUserAndResources: getRolesForUserAndResources,
+	selectAllUserResourceRoles:  qlDialect.selectAllUserResourceRoles,
+	deleteUserResourceRole:      qlDialect.deleteUserResourceRole,
+
+	restoreUser: `INSERT INTO
+			"user" (id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);`,
+	restoreResource:         qlDialect.restoreResource,
+	restoreRole:             qlDialect.restoreRole,
+	restoreUserResourceRole: qlDialect.restoreUserResourceRole,
+	restoreClientAuth:       qlDialect.restoreClientAuth,
+	restoreToken:            qlDialect.restoreToken,
+
+	deleteClientAuth: qlDialect.deleteClientAuth,
+	insertClientAuth: `INSERT INTO
+		client_auth (userid, method, settings, updated, updatedby)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4);`,
+	selectClientAuth:    qlDialect.selectClientAuth,
+	selectAllClientAuth: qlDialect.selectAllClientAuth,
+
+	updateUserSecretHash: `UPDATE "user"
+		set secrethash = $1, updated = CURRENT_TIMESTAMP, updatedby = $2
+		where id = $3;`,
+	replaceUserSecretHash: `UPDATE "user"
+		set secrethash = $1
+		where id = $2 and secrethash = $3;`,
+	replacePasswordHistory:   qlDialect.replacePasswordHistory,
+	insertPasswordHistory:    qlDialect.insertPasswordHistory,
+	selectPasswordHistory:    qlDialect.selectPasswordHistory,
+	prunePasswordHistory:     qlDialect.prunePasswordHistory,
+	selectAllPasswordHistory: qlDialect.selectAllPasswordHistory,
+
+	deleteUserMFA:    qlDialect.deleteUserMFA,
+	insertUserMFA:    qlDialect.insertUserMFA,
+	replaceUserMFA:   qlDialect.replaceUserMFA,
+	selectUserMFA:    qlDialect.selectUserMFA,
+	selectAllUserMFA: qlDialect.selectAllUserMFA,
+
+	insertWebAuthnCredential:         qlDialect.insertWebAuthnCredential,
+	selectWebAuthnCredential:         qlDialect.selectWebAuthnCredential,
+	selectWebAuthnCredentialsForUser: qlDialect.selectWebAuthnCredentialsForUser,
+	selectAllWebAuthnCredentials:     qlDialect.selectAllWebAuthnCredentials,
+	updateWebAuthnCredentialUse:      qlDialect.updateWebAuthnCredentialUse,
+	deleteWebAuthnCredential:         qlDialect.deleteWebAuthnCredential,
+
+	selectLastAuditEvent:        qlDialect.selectLastAuditEvent,
+	selectLastChainedAuditEvent: "SELECT id, hash FROM audit WHERE hash <> '' ORDER BY id DESC LIMIT 1;",
+	insertAuditEvent:            qlDialect.insertAuditEvent,
+	chainAuditEvent:             qlDialect.chainAuditEvent,
+	selectAuditEvents:           qlDialect.selectAuditEvents,
+
+	expireUserTokens: `UPDATE tokens
+		set expires = CURRENT_TIMESTAMP, deleted = CURRENT_TIMESTAMP, deletedby = 'getNewToken'
+		where userid = $1;`,
+	insertToken:      qlDialect.insertToken,
+	selectToken:      qlDialect.selectToken,
+	revokeToken:      qlDialect.revokeToken,
+	selectUserTokens: qlDialect.selectUserTokens,
+	purgeTokens:      qlDialect.purgeTokens,
+	selectAllTokens:  qlDialect.selectAllTokens,
+	countTokens:      qlDialect.countTokens,
+
+	selectLoginAttempts:          qlDialect.selectLoginAttempts,
+	claimLoginAttempts:           "INSERT INTO login_attempts(attemptkey, failures, lastfailure, lockeduntil, expires) VALUES($1, 0, $2, NULL, $2) ON CONFLICT (attemptkey) DO NOTHING;",
+	selectLoginAttemptsForUpdate: qlDialect.selectLoginAttemptsForUpdate,
+	deleteLoginAttempts:          qlDialect.deleteLoginAttempts,
+	insertLoginAttempts:          qlDialect.insertLoginAttempts,
+	updateLoginAttempts:          qlDialect.updateLoginAttempts,
+	purgeLoginAttempts:           qlDialect.purgeLoginAttempts,
+
+	selectUsedID: qlDialect.selectUsedID,
+	deleteUsedID: qlDialect.deleteUsedID,
+	insertUsedID: "INSERT INTO used_ids(usedid, expires) VALUES($1, $2) ON CONFLICT (usedid) DO NOTHING;",
+	purgeUsedIDs: qlDialect.purgeUsedIDs,
+
+	insertWebAuthnCeremony:  qlDialect.insertWebAuthnCeremony,
+	selectWebAuthnCeremony:  qlDialect.selectWebAuthnCeremony,
+	deleteWebAuthnCeremony:  qlDialect.deleteWebAuthnCeremony,
+	purgeWebAuthnCeremonies: qlDialect.purgeWebAuthnCeremonies,
+}
+
+// isSQLiteDSN returns 'true' if the passed datastore setting is a SQLite database (sqlite://path)
+func isSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "sqlite://")
+}
+
+// sqliteConnectionString converts a sqlite://path datastore setting
+// to a go-sqlite3 connection string with our connection options
+func sqliteConnectionString(dsn string) string {
+	path := strings.TrimPrefix(dsn, "sqlite://")
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	return "file:" + path + separator + sqliteOptions
+}
@@ -1,9 +1,12 @@
 package data
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/danesparza/authserver/metrics"
 	"github.com/rs/xid"
 	null "gopkg.in/guregu/null.v3"
 	"gopkg.in/guregu/null.v3/zero"
@@ -11,62 +14,106 @@ import (
 
 // Token represents an auth token
 type Token struct {
-	ID        string `json:"token"`
-	UserID    string
-	Created   time.Time
-	Expires   time.Time `json:"expires"`
-	Deleted   zero.Time
-	DeletedBy null.String
+	ID           string `json:"token"`
+	UserID       string
+	Created      time.Time
+	Expires      time.Time `json:"expires"`
+	Deleted      zero.Time
+	DeletedBy    null.String
+	Confirmation Confirmation `json:"cnf"`
+
+	// AMR are the ways the user authenticated to get the token (the 'amr' claim -- see
+	// RFC 8176 and the AMR constants), like a password and a one-time code
+	AMR []string `json:"amr,omitempty"`
+}
+
+// Confirmation is what a token is bound to (its 'cnf' claim -- see RFC 7800).  A bound
+// token can only be used by a client that presents the same confirmation
+type Confirmation struct {
+	// CertThumbprint is the thumbprint of the client certificate the token was
+	// issued to (RFC 8705, section 3) -- see CertThumbprint
+	CertThumbprint string `json:"x5t#S256,omitempty"`
+
+	// KeyThumbprint is the JWK thumbprint of the key the client proved possession of
+	// with a DPoP proof when the token was issued (RFC 9449, section 6)
+	KeyThumbprint string `json:"jkt,omitempty"`
+}
+
+// IsZero returns 'true' if the token isn't bound to anything
+func (confirmation Confirmation) IsZero() bool {
+	return confirmation.CertThumbprint == "" && confirmation.KeyThumbprint == ""
+}
+
+// IsDPoP returns 'true' if the token is bound to a DPoP key (and is a 'DPoP' token, not a 'Bearer' one)
+func (confirmation Confirmation) IsDPoP() bool {
+	return confirmation.KeyThumbprint != ""
+}
+
+// check returns an error if the token is bound to something that wasn't presented
+func (confirmation Confirmation) check(presented Confirmation) error {
+	if confirmation.CertThumbprint != "" && subtle.ConstantTimeCompare([]byte(confirmation.CertThumbprint), []byte(presented.CertThumbprint)) != 1 {
+		return fmt.Errorf("The token is bound to a client certificate that wasn't presented")
+	}
+
+	if confirmation.KeyThumbprint != "" && subtle.ConstantTimeCompare([]byte(confirmation.KeyThumbprint), []byte(presented.KeyThumbprint)) != 1 {
+		return fmt.Errorf("The token is bound to a DPoP key that wasn't proven")
+	}
+
+	return nil
 }
 
 // GetNewToken gets a token for the given user.  If a token already exists it expires the existing token,
 // generates a new token, stores it, and returns it.  If a token doesn't already exist (or it has expired)
 // it generates a new token, stores it, and returns it
 func (store DBManager) GetNewToken(user User, expiresafter time.Duration) (Token, error) {
+	return store.GetNewBoundToken(user, expiresafter, Confirmation{})
+}
+
+// GetNewBoundToken gets a token for the given user (like GetNewToken) that's bound to the
+// passed confirmation -- it can only be used along with the same client certificate
+// and/or a DPoP proof signed with the same key
+func (store DBManager) GetNewBoundToken(user User, expiresafter time.Duration, confirmation Confirmation) (Token, error) {
+	return store.GetNewAuthenticatedToken(user, expiresafter, confirmation, nil)
+}
+
+// GetNewAuthenticatedToken gets a bound token for the given user (like GetNewBoundToken) that
+// records how the user authenticated to get it (see ScopeUser.AMR)
+func (store DBManager) GetNewAuthenticatedToken(user User, expiresafter time.Duration, confirmation Confirmation, amr []string) (Token, error) {
+	store, end := store.startSpan("GetNewToken")
+	defer end()
 
 	//	Create our default return value
 	retval := Token{
-		ID:      xid.New().String(), // Generate a new token
-		UserID:  user.ID,
-		Created: time.Now(),
-		Expires: time.Now().Add(expiresafter),
+		ID:           xid.New().String(), // Generate a new token
+		UserID:       user.ID,
+		Created:      time.Now(),
+		Expires:      time.Now().Add(expiresafter),
+		Confirmation: confirmation,
+		AMR:          amr,
 	}
 
-	//	Next, set existing tokens for the user to 'expired':
-	//	-- start a transaction
-	tx, err := store.tokendb.Begin()
+	//	Expire existing tokens for the user and store the new one
+	err := store.tokendb.AddToken(retval)
 	if err != nil {
-		return retval, fmt.Errorf("An error occurred starting a transaction for updating existing tokens: %s", err)
+		return retval, err
 	}
 
-	//	-- update existing items
-	_, err = tx.Exec(`UPDATE tokens 
-		set expires = now(), deleted = now(), deletedby = "getNewToken" 
-		where userid = $1;`,
-		user.ID)
-	if err != nil {
-		tx.Rollback()
-		return retval, fmt.Errorf("An error occurred updating existing tokens: %s", err)
-	}
-
-	//	Persist the token in the database
-	_, err = tx.Exec(`INSERT INTO 
-		tokens(token, userid, created, expires)
-		VALUES($1, $2, $3, $4);`,
-		retval.ID,
-		retval.UserID,
-		retval.Created,
-		retval.Expires)
-	if err != nil {
-		tx.Rollback()
-		return retval, fmt.Errorf("An error occurred updating existing tokens: %s", err)
+	//	Record it in the audit log (by fingerprint -- the token itself is a secret)
+	actor := user.Name
+	if actor == "" {
+		actor = user.ID
 	}
-
-	//	-- commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		return retval, fmt.Errorf("An error occurred committing a transaction for updating existing tokens: %s", err)
+	detail := "user " + user.ID + ", expires " + retval.Expires.UTC().Format(time.RFC3339)
+	if confirmation.CertThumbprint != "" {
+		detail += ", bound to certificate " + confirmation.CertThumbprint
+	}
+	if confirmation.KeyThumbprint != "" {
+		detail += ", bound to DPoP key " + confirmation.KeyThumbprint
+	}
+	if len(amr) > 0 {
+		detail += ", authenticated with " + strings.Join(amr, "+")
 	}
+	store.audit(actor, AuditTokenIssue, "token", tokenFingerprint(retval.ID), detail, nil, nil)
 
 	//	Return the token
 	return retval, nil
@@ -75,30 +122,28 @@ func (store DBManager) GetNewToken(user User, expiresafter time.Duration) (Token
 // getTokenInfo returns token information for a given unexpired tokenID (or an error if it can't be found)
 func (store DBManager) getTokenInfo(tokenID string) (Token, error) {
 
-	retval := Token{}
-
 	//	Get the token (as long as it's not expired)
-	err := store.tokendb.QueryRow(`SELECT 
-	token, userid, created, expires, deleted, deletedby 
-	FROM tokens 
-	WHERE token=$1 and expires > now();`, tokenID).Scan(
-		&retval.ID,
-		&retval.UserID,
-		&retval.Created,
-		&retval.Expires,
-		&retval.Deleted,
-		&retval.DeletedBy,
-	)
+	retval, err := store.tokendb.GetToken(tokenID)
 	if err != nil {
-		return retval, fmt.Errorf("Problem selecting token: %s", err)
+		return retval, err
 	}
 
 	//	Return what we found:
 	return retval, nil
 }
 
-// GetScopesForToken gets scope information for a given token
+// GetScopesForToken gets scope information for a given token.  Tokens that are bound to
+// a client certificate or DPoP key can't be used this way -- see GetScopesForBoundToken
 func (store DBManager) GetScopesForToken(tokenID string) (ScopeUser, error) {
+	return store.GetScopesForBoundToken(tokenID, Confirmation{})
+}
+
+// GetScopesForBoundToken gets scope information for a given token, presented along with
+// the passed confirmation (like the thumbprint of the client's TLS certificate, or of the
+// key that signed its DPoP proof).  If the token is bound, the confirmation has to match
+func (store DBManager) GetScopesForBoundToken(tokenID string, presented Confirmation) (ScopeUser, error) {
+	store, end := store.startSpan("GetScopesForToken")
+	defer end()
 
 	//	Create our default return value
 	retval := ScopeUser{}
@@ -110,6 +155,11 @@ func (store DBManager) GetScopesForToken(tokenID string) (ScopeUser, error) {
 		return retval, fmt.Errorf("There was a problem getting token information for the token: %s", err)
 	}
 
+	//	Make sure it's being used by the client it's bound to
+	if err := tokenInfo.Confirmation.check(presented); err != nil {
+		return retval, err
+	}
+
 	//	Then get the user information for the given userID:
 	userInfo, err := store.getUserForUserID(tokenInfo.UserID)
 
@@ -125,7 +175,111 @@ func (store DBManager) GetScopesForToken(tokenID string) (ScopeUser, error) {
 	}
 
 	retval = scopeInfo
+	retval.AMR = tokenInfo.AMR
 
 	//	Return the scope information
 	return retval, nil
 }
+
+// IntrospectToken returns the token and the user it was issued to (RFC 7662), or an
+// error if the token isn't active (it doesn't exist, has expired or has been revoked)
+func (store DBManager) IntrospectToken(tokenID string) (Token, User, error) {
+	store, end := store.startSpan("IntrospectToken")
+	defer end()
+
+	tokenInfo, err := store.getTokenInfo(tokenID)
+	if err != nil {
+		return tokenInfo, User{}, fmt.Errorf("There was a problem getting token information for the token: %s", err)
+	}
+
+	userInfo, err := store.getUserForUserID(tokenInfo.UserID)
+	if err != nil {
+		return tokenInfo, userInfo, fmt.Errorf("There was a problem getting user information for the token: %s", err)
+	}
+
+	return tokenInfo, userInfo, nil
+}
+
+// RevokeToken expires the given token immediately.  Users can revoke their own tokens --
+// system admins can revoke any token
+func (store DBManager) RevokeToken(context User, tokenID string) error {
+	store, end := store.startSpan("RevokeToken")
+	defer end()
+
+	//	Find the token (so we know who it belongs to)
+	tokenInfo, err := store.getTokenInfo(tokenID)
+	if err != nil {
+		return fmt.Errorf("There was a problem getting token information for the token: %s", err)
+	}
+
+	//	Validate:  Does the context user have permission to make the change?
+	if tokenInfo.UserID != context.ID && store.userIsSystemAdmin(context.ID) == false {
+		return fmt.Errorf("User '%s' does not have permission to revoke the token", context.Name)
+	}
+
+	if err := store.tokendb.RevokeToken(tokenID, context.Name); err != nil {
+		return err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditTokenRevoke, "token", tokenFingerprint(tokenID), "user "+tokenInfo.UserID, nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTokensForUser returns the unexpired tokens for the given user.  Users can list their own
+// tokens -- system admins can list anyone's tokens
+func (store DBManager) GetTokensForUser(context User, userID string) ([]Token, error) {
+	store, end := store.startSpan("GetTokensForUser")
+	defer end()
+
+	//	Validate:  Does the context user have permission to see the tokens?
+	if userID != context.ID && store.userIsSystemAdmin(context.ID) == false {
+		return []Token{}, fmt.Errorf("User '%s' does not have permission to list tokens for the user", context.Name)
+	}
+
+	return store.tokendb.GetTokensForUser(userID)
+}
+
+// PurgeExpiredTokens removes tokens that expired more than 'retention' ago and
+// returns the number of tokens removed
+func (store DBManager) PurgeExpiredTokens(retention time.Duration) (int64, error) {
+	store, end := store.startSpan("PurgeExpiredTokens")
+	defer end()
+
+	removed, err := store.tokendb.PurgeExpiredTokens(time.Now().Add(-retention))
+	if err != nil {
+		return removed, err
+	}
+
+	//	Update our metrics
+	metrics.TokenPurgeRuns.Inc()
+	metrics.TokensPurged.Add(float64(removed))
+
+	//	Record it in the audit log (if anything was removed)
+	if removed > 0 {
+		store.audit("system", AuditTokenPurge, "token", "", fmt.Sprintf("%v expired tokens removed", removed), nil, nil)
+	}
+
+	return removed, nil
+}
+
+// CountActiveTokens returns the number of unexpired tokens
+func (store DBManager) CountActiveTokens() (int64, error) {
+	store, end := store.startSpan("CountActiveTokens")
+	defer end()
+
+	return store.tokendb.CountTokens()
+}
+
+// UseOnce records an id that can only be used once (like a DPoP proof's 'jti', or a client
+// assertion's) until it expires.  It's kept in the token datastore, so every instance of the
+// service sees it.  It returns 'false' if the id has already been used (and hasn't expired)
+func (store DBManager) UseOnce(id string, expires time.Time) (bool, error) {
+	store, end := store.startSpan("UseOnce")
+	defer end()
+
+	return store.tokendb.UseID(id, expires)
+}
@@ -112,3 +112,424 @@ func TestToken_GetScopesForToken_ValidToken_Successful(t *testing.T) {
 	}
 
 }
+
+func TestToken_GetNewToken_ExpiresPreviousToken(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	firstToken, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	secondToken, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten second token without an error, but got: %s", err)
+	}
+
+	//	Assert
+	if _, err := db.GetScopesForToken(firstToken.ID); err == nil {
+		t.Errorf("GetScopesForToken failed: The first token should have been expired by the second GetNewToken call")
+	}
+
+	if _, err := db.GetScopesForToken(secondToken.ID); err != nil {
+		t.Errorf("GetScopesForToken failed: The second token should be valid, but got: %s", err)
+	}
+}
+
+func TestToken_RevokeToken_ValidToken_Successful(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	err = db.RevokeToken(uctx, tokenResponse.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("RevokeToken failed: Should have revoked the token without an error, but got: %s", err)
+	}
+
+	if _, err := db.GetScopesForToken(tokenResponse.ID); err == nil {
+		t.Errorf("GetScopesForToken failed: The token should not be valid after it has been revoked")
+	}
+
+	if err := db.RevokeToken(uctx, tokenResponse.ID); err == nil {
+		t.Errorf("RevokeToken failed: Revoking an already revoked token should return an error")
+	}
+}
+
+func TestToken_RevokeToken_NoPermission_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Add a user without any roles:
+	newUser1, err := db.AddUser(uctx, data.User{
+		Name:        "TestUser1",
+		Description: "Unit test user 1",
+	}, "newpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have created user1 without issue, but got error: %s", err)
+	}
+
+	adminToken, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	err = db.RevokeToken(newUser1, adminToken.ID)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("RevokeToken failed: A user without the admin role should not be able to revoke someone else's token")
+	}
+}
+
+func TestToken_GetTokensForUser_ValidUser_ReturnsTokens(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Get a couple of tokens (the second expires the first)
+	_, err = db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	tokens, err := db.GetTokensForUser(uctx, uctx.ID)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetTokensForUser failed: Should have listed tokens without an error, but got: %s", err)
+	}
+
+	if len(tokens) != 1 || tokens[0].ID != tokenResponse.ID {
+		t.Errorf("GetTokensForUser failed: Should have only gotten the latest token, but got: %+v", tokens)
+	}
+}
+
+func TestToken_PurgeExpiredTokens_ExpiredTokens_RemovesTokens(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Get a couple of tokens (the second expires the first)
+	_, err = db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	tokenResponse, err := db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Make sure the first token's expiry is in the past
+	time.Sleep(1 * time.Second)
+
+	//	Act
+	removed, err := db.PurgeExpiredTokens(0)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("PurgeExpiredTokens failed: Should have purged tokens without an error, but got: %s", err)
+	}
+
+	if removed != 1 {
+		t.Errorf("PurgeExpiredTokens failed: Should have removed 1 expired token, but removed: %v", removed)
+	}
+
+	if _, err := db.GetScopesForToken(tokenResponse.ID); err != nil {
+		t.Errorf("GetScopesForToken failed: The unexpired token should still be valid, but got: %s", err)
+	}
+}
+
+func TestToken_PurgeExpiredTokens_WithinRetention_KeepsTokens(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Get a couple of tokens (the second expires the first)
+	_, err = db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	_, err = db.GetNewToken(uctx, 5*time.Minute)
+	if err != nil {
+		t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	//	Act
+	removed, err := db.PurgeExpiredTokens(1 * time.Hour)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("PurgeExpiredTokens failed: Should have purged tokens without an error, but got: %s", err)
+	}
+
+	if removed != 0 {
+		t.Errorf("PurgeExpiredTokens failed: Should have kept tokens expired within the retention window, but removed: %v", removed)
+	}
+}
+
+func TestToken_CountActiveTokens_CountsUnexpiredTokens(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	//	Bootstrap
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Get a couple of tokens (the second expires the first)
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetNewToken(uctx, 5*time.Minute); err != nil {
+			t.Errorf("GetNewToken failed: Should have gotten token without an error, but got: %s", err)
+		}
+	}
+
+	//	Act
+	count, err := db.CountActiveTokens()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("CountActiveTokens failed: Should have counted tokens without an error, but got: %s", err)
+	}
+
+	if count != 1 {
+		t.Errorf("CountActiveTokens failed: Should have counted 1 active token, but got: %v", count)
+	}
+}
+
+func TestToken_GetNewBoundToken_OnlyUsableWithConfirmation(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	confirmation := data.Confirmation{CertThumbprint: "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2"}
+
+	//	Act
+	token, err := db.GetNewBoundToken(uctx, 5*time.Minute, confirmation)
+	if err != nil {
+		t.Fatalf("GetNewBoundToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	_, unboundErr := db.GetScopesForToken(token.ID)
+	_, otherErr := db.GetScopesForBoundToken(token.ID, data.Confirmation{CertThumbprint: "someothercertificate"})
+	_, boundErr := db.GetScopesForBoundToken(token.ID, confirmation)
+	introspected, user, introspectErr := db.IntrospectToken(token.ID)
+
+	//	Assert
+	if unboundErr == nil || otherErr == nil {
+		t.Errorf("GetScopesForBoundToken failed: A bound token shouldn't be usable without the certificate it's bound to")
+	}
+
+	if boundErr != nil {
+		t.Errorf("GetScopesForBoundToken failed: A bound token should be usable with the certificate it's bound to, but got: %s", boundErr)
+	}
+
+	if introspectErr != nil || introspected.Confirmation != confirmation || user.ID != uctx.ID {
+		t.Errorf("IntrospectToken failed: Should have returned the token's binding and user, but got %+v / %s (%v)", introspected.Confirmation, user.ID, introspectErr)
+	}
+}
+
+func TestToken_GetNewBoundToken_DPoPKey_OnlyUsableWithProvenKey(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	confirmation := data.Confirmation{KeyThumbprint: "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}
+
+	//	Act
+	token, err := db.GetNewBoundToken(uctx, 5*time.Minute, confirmation)
+	if err != nil {
+		t.Fatalf("GetNewBoundToken failed: Should have gotten token without an error, but got: %s", err)
+	}
+
+	_, bearerErr := db.GetScopesForToken(token.ID)
+	_, otherKeyErr := db.GetScopesForBoundToken(token.ID, data.Confirmation{KeyThumbprint: "someotherkey"})
+	_, provenErr := db.GetScopesForBoundToken(token.ID, confirmation)
+	introspected, _, introspectErr := db.IntrospectToken(token.ID)
+
+	//	Assert
+	if bearerErr == nil || otherKeyErr == nil {
+		t.Errorf("GetScopesForBoundToken failed: A DPoP token shouldn't be usable without a proof from the key it's bound to")
+	}
+
+	if provenErr != nil {
+		t.Errorf("GetScopesForBoundToken failed: A DPoP token should be usable with a proof from its key, but got: %s", provenErr)
+	}
+
+	if introspectErr != nil || introspected.Confirmation != confirmation || introspected.Confirmation.IsDPoP() == false {
+		t.Errorf("IntrospectToken failed: Should have returned the token's DPoP key binding, but got %+v (%v)", introspected.Confirmation, introspectErr)
+	}
+}
+
+func TestToken_UseOnce_SecondUseRejected(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	//	Act
+	first, firstErr := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+	replay, replayErr := db.UseOnce("dpop:key:proof1", time.Now().Add(time.Minute))
+	other, otherErr := db.UseOnce("dpop:key:proof2", time.Now().Add(time.Minute))
+
+	expired, _ := db.UseOnce("dpop:key:proof3", time.Now().Add(-time.Second))
+	reused, reusedErr := db.UseOnce("dpop:key:proof3", time.Now().Add(time.Minute))
+
+	//	Assert
+	if firstErr != nil || first != true {
+		t.Errorf("UseOnce failed: Should have used the id the first time, but got %v (%v)", first, firstErr)
+	}
+
+	if replayErr != nil || replay != false {
+		t.Errorf("UseOnce failed: Should have turned away the id the second time, but got %v (%v)", replay, replayErr)
+	}
+
+	if otherErr != nil || other != true {
+		t.Errorf("UseOnce failed: Should have used another id, but got %v (%v)", other, otherErr)
+	}
+
+	if expired != true || reusedErr != nil || reused != true {
+		t.Errorf("UseOnce failed: Should have let an expired id be used again, but got %v (%v)", reused, reusedErr)
+	}
+}
@@ -2,11 +2,9 @@ package data
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/rs/xid"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/guregu/null.v3"
 
 	"gopkg.in/guregu/null.v3/zero"
@@ -28,8 +26,15 @@ type User struct {
 	UpdatedBy   string      `json:"updated_by"`
 	Deleted     zero.Time   `json:"deleted"`
 	DeletedBy   null.String `json:"deleted_by"`
+
+	// Source is where the user came from:  blank for local users, or UserSourceDirectory
+	// for users the Authenticator added (see SetAuthenticator)
+	Source string `json:"source,omitempty"`
 }
 
+// UserSourceDirectory is the Source of users added by the Authenticator.  Only they log in with it
+const UserSourceDirectory = "directory"
+
 // UserResourceRole defines a relationship between a user,
 // a resource (application/service), and the roles that user has
 // been assigned within the resource (application/service)
@@ -47,6 +52,9 @@ type UserResourceRole struct {
 
 // AddUser adds a user to the system
 func (store DBManager) AddUser(context User, user User, userPassword string) (User, error) {
+	store, end := store.startSpan("AddUser")
+	defer end()
+
 	//	Our return item
 	retval := User{}
 
@@ -56,221 +64,161 @@ func (store DBManager) AddUser(context User, user User, userPassword string) (Us
 		return retval, fmt.Errorf("User '%s' does not have permission to add a user to the system", context.Name)
 	}
 
-	//	Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userPassword), bcrypt.DefaultCost)
-	if err != nil {
-		return retval, fmt.Errorf("Problem hashing user password: %s", err)
+	//	Validate:  Does the password meet the password policy?
+	if err := store.checkPassword(user, userPassword); err != nil {
+		return retval, err
 	}
 
-	//	Generate an id:
-	userID := xid.New().String()
-
-	//	Start a transaction:
-	tx, err := store.systemdb.Begin()
+	//	Hash the password
+	hashedPassword, err := store.hasher.Hash(userPassword)
 	if err != nil {
-		return retval, fmt.Errorf("An error occurred starting a transaction for a user: %s", err)
+		return retval, fmt.Errorf("Problem hashing user password: %s", err)
 	}
 
-	//	Insert the item
-	_, err = tx.Exec(`INSERT INTO 
-			user (id, enabled, name, description, secrethash, created, createdby, updated, updatedby) 
-			VALUES ($1, true, $2, $3, $4, now(), $5, now(), $5);`,
-		userID,
-		user.Name,
-		user.Description,
-		string(hashedPassword),
-		context.Name)
-	if err != nil {
-		tx.Rollback()
-		return retval, fmt.Errorf("An error occurred adding a user: %s", err)
-	}
+	//	Generate an id (users added here are local users):
+	user.ID = xid.New().String()
+	user.Source = ""
 
-	//	Commit the transaction
-	err = tx.Commit()
+	//	Store the item (and get it back)
+	retval, err = store.systemdb.AddUser(user, hashedPassword, context.Name)
 	if err != nil {
-		return retval, fmt.Errorf("An error occurred committing a transaction for a user: %s", err)
+		return retval, err
 	}
 
-	//	Get the user
-	err = store.systemdb.QueryRow("SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby FROM user WHERE id=$1;", userID).Scan(
-		&retval.ID,
-		&retval.Enabled,
-		&retval.Name,
-		&retval.Description,
-		&retval.SecretHash,
-		&retval.Created,
-		&retval.CreatedBy,
-		&retval.Updated,
-		&retval.UpdatedBy,
-		&retval.Deleted,
-		&retval.DeletedBy,
-	)
-	if err != nil {
-		return retval, fmt.Errorf("Problem selecting user: %s", err)
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditUserCreate, "user", retval.ID, "", nil, retval); err != nil {
+		return retval, err
 	}
 
 	//	Return it:
 	return retval, nil
 }
 
-// GetAllUsers returns an array of all users
-func (store DBManager) GetAllUsers(context User) ([]User, error) {
-	retval := []User{}
+// AddUserWithSecretHash adds a user to the system using the user's SecretHash
+// as-is (an Argon2id or bcrypt hash, like the ones in an export).  If the SecretHash is blank, the user
+// is added without a secret and can't log in until one is set
+func (store DBManager) AddUserWithSecretHash(context User, user User) (User, error) {
+	store, end := store.startSpan("AddUserWithSecretHash")
+	defer end()
 
-	//	Get all the items:
-	rows, err := store.systemdb.Query("SELECT id, enabled, name, description, secrethash, created, createdby, updated, updatedby, deleted, deletedby FROM user")
-	if err != nil {
-		return retval, fmt.Errorf("Problem selecting all users: %s", err)
+	//	Users added here are local users
+	user.Source = ""
+	return store.addUserWithSecretHash(context, user)
+}
+
+// addUserWithSecretHash adds a user with the user's SecretHash as-is, keeping their Source (so
+// ApplyState can add directory users, after checking the State)
+func (store DBManager) addUserWithSecretHash(context User, user User) (User, error) {
+	//	Our return item
+	retval := User{}
+
+	//	Validate:  Does the context user have permission to make the change?
+	if store.userIsSystemAdmin(context.ID) == false && store.userIsResourceDelegate(context.ID) == false {
+		//	Return an error:
+		return retval, fmt.Errorf("User '%s' does not have permission to add a user to the system", context.Name)
 	}
 
-	for rows.Next() {
-		item := User{}
-
-		if err = rows.Scan(
-			&item.ID,
-			&item.Enabled,
-			&item.Name,
-			&item.Description,
-			&item.SecretHash,
-			&item.Created,
-			&item.CreatedBy,
-			&item.Updated,
-			&item.UpdatedBy,
-			&item.Deleted,
-			&item.DeletedBy); err != nil {
-			rows.Close()
-			break
+	//	Validate:  Is the secret hash something we can check passwords against?
+	if user.SecretHash != "" {
+		if _, err := hasherFor(user.SecretHash); err != nil {
+			return retval, fmt.Errorf("The secret hash for user '%s' isn't valid: %s", user.Name, err)
 		}
+	}
 
-		retval = append(retval, item)
+	//	Generate an id:
+	user.ID = xid.New().String()
+
+	//	Store the item (and get it back)
+	retval, err := store.systemdb.AddUser(user, user.SecretHash, context.Name)
+	if err != nil {
+		return retval, err
 	}
 
-	if err = rows.Err(); err != nil {
-		return retval, fmt.Errorf("Problem scanning all users: %s", err)
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditUserCreate, "user", retval.ID, "", nil, retval); err != nil {
+		return retval, err
 	}
 
-	//	Return our slice:
+	//	Return it:
 	return retval, nil
 }
 
+// GetAllUsers returns an array of all users
+func (store DBManager) GetAllUsers(context User) ([]User, error) {
+	store, end := store.startSpan("GetAllUsers")
+	defer end()
+
+	return store.systemdb.GetAllUsers()
+}
+
 // userIsSystemAdmin returns 'true' if the passed user is a system admin
 func (store DBManager) userIsSystemAdmin(userID string) bool {
-	retval := false
-
-	urr := UserResourceRole{}
-
-	//	Create the base query and suffix:
-	query := "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1 and resourceid = $2 and roleid = $3;"
-	err := store.systemdb.QueryRow(query, userID, BuiltIn.SystemResource, BuiltIn.AdminRole).Scan(
-		&urr.UserID,
-		&urr.ResourceID,
-		&urr.RoleID,
-		&urr.Created,
-		&urr.CreatedBy,
-		&urr.Updated,
-		&urr.UpdatedBy,
-		&urr.Deleted,
-		&urr.DeletedBy,
-	)
-	if err != nil {
-		return retval
-	}
+	return store.userHasResourceRole(userID, BuiltIn.SystemResource, BuiltIn.AdminRole)
+}
 
-	//	If we got this far, we must have found the item:
-	retval = true
+// userCanManage returns 'true' if the context user can manage another user's credentials (their
+// password and second factors).  System admins can manage anyone's, and resource delegates can
+// manage anyone's but a system admin's -- otherwise a delegate could take over an admin
+func (store DBManager) userCanManage(contextID, userID string) bool {
+	if store.userIsSystemAdmin(contextID) {
+		return true
+	}
 
-	return retval
+	return store.userIsResourceDelegate(contextID) && store.userIsSystemAdmin(userID) == false
 }
 
 // userIsResourceDelegate returns 'true' if the passed user is a resource delegate
 func (store DBManager) userIsResourceDelegate(userID string) bool {
-	retval := false
-
-	urr := UserResourceRole{}
-
-	//	Create the base query and suffix:
-	query := "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1 and roleid = $2;"
-	err := store.systemdb.QueryRow(query, userID, BuiltIn.ResourceDelegateRole).Scan(
-		&urr.UserID,
-		&urr.ResourceID,
-		&urr.RoleID,
-		&urr.Created,
-		&urr.CreatedBy,
-		&urr.Updated,
-		&urr.UpdatedBy,
-		&urr.Deleted,
-		&urr.DeletedBy,
-	)
+	//	Get the user's assignments
+	urrs, err := store.systemdb.GetUserResourceRoles(userID)
 	if err != nil {
-		return retval
+		return false
 	}
 
-	//	If we got this far, we must have found the item:
-	retval = true
+	//	See if they are a delegate for any resource:
+	for _, urr := range urrs {
+		if urr.RoleID == BuiltIn.ResourceDelegateRole {
+			return true
+		}
+	}
 
-	return retval
+	return false
 }
 
 // userHasResourceRole returns 'true' if a given user has a given resource role, false if they don't
 func (store DBManager) userHasResourceRole(userID, resourceID string, roleIDs ...string) bool {
-	retval := false
-
 	//	Sanity check -- there needs to be at least one item in roleIDs
 	if len(roleIDs) < 1 {
 		return false
 	}
 
-	urr := UserResourceRole{}
-
-	//	Create our variable list of args to pass to the query
-	args := []string{userID, resourceID}
-	args = append(args, roleIDs...)
-
-	//	Convert back to []interface{} (for the call to QueryRow)
-	//	-- from https://stackoverflow.com/a/27689178/19020
-	qrargs := make([]interface{}, len(args))
-	for i, v := range args {
-		qrargs[i] = v
+	//	Get the user's assignments
+	urrs, err := store.systemdb.GetUserResourceRoles(userID)
+	if err != nil {
+		return false
 	}
 
-	//	Create the base query and suffix:
-	query := "SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1 and resourceid = $2 and ("
-	queryroles := []string{}
-	querySuffix := ");"
-
-	//	Loop through each item in roleIDs...
-	for ri := 0; ri < len(roleIDs); ri++ {
-		formattedRoleIDIndex := 3 + ri
-		queryroles = append(queryroles, fmt.Sprintf("roleid = $%v", formattedRoleIDIndex))
-	}
+	//	Look for any of the roles in the given resource:
+	for _, urr := range urrs {
+		if urr.ResourceID != resourceID {
+			continue
+		}
 
-	//	Append our suffix
-	query = query + strings.Join(queryroles, " or ") + querySuffix
-
-	err := store.systemdb.QueryRow(query, qrargs...).Scan(
-		&urr.UserID,
-		&urr.ResourceID,
-		&urr.RoleID,
-		&urr.Created,
-		&urr.CreatedBy,
-		&urr.Updated,
-		&urr.UpdatedBy,
-		&urr.Deleted,
-		&urr.DeletedBy,
-	)
-	if err != nil {
-		return retval
+		for _, roleID := range roleIDs {
+			if urr.RoleID == roleID {
+				return true
+			}
+		}
 	}
 
-	//	If we got this far, we must have found the item:
-	retval = true
-
-	return retval
+	return false
 }
 
 // AddUserToResourceWithRole adds the specified user to the resource and assigns the given role.
 // Returns an error if the user, resource, or role don't already exist
 func (store DBManager) AddUserToResourceWithRole(context, user User, resource Resource, role Role) (UserResourceRole, error) {
+	store, end := store.startSpan("AddUserToResourceWithRole")
+	defer end()
 
 	//	Our return item
 	retval := UserResourceRole{}
@@ -288,47 +236,14 @@ func (store DBManager) AddUserToResourceWithRole(context, user User, resource Re
 	}
 
 	//	If they all exist, then add the item in the system...
-
-	//	Start a transaction:
-	tx, err := store.systemdb.Begin()
-	if err != nil {
-		return retval, fmt.Errorf("An error occurred starting a transaction for a user/resource/role: %s", err)
-	}
-
-	//	Insert the item
-	_, err = tx.Exec(`INSERT INTO 
-		user_resource_role (userid, resourceid, roleid, created, createdby, updated, updatedby) 
-			VALUES ($1, $2, $3, now(), $4, now(), $4);`,
-		user.ID,
-		resource.ID,
-		role.ID,
-		context.Name,
-	)
-	if err != nil {
-		tx.Rollback()
-		return retval, fmt.Errorf("An error occurred adding the user/resource/role: %s", err)
-	}
-
-	//	Commit the transaction
-	err = tx.Commit()
+	retval, err := store.systemdb.AddUserResourceRole(user.ID, resource.ID, role.ID, context.Name)
 	if err != nil {
-		return retval, fmt.Errorf("An error occurred committing a transaction for a user/resource/role: %s", err)
+		return retval, err
 	}
 
-	//	Get the user/resource/role
-	err = store.systemdb.QueryRow("SELECT userid, resourceid, roleid, created, createdby, updated, updatedby, deleted, deletedby FROM user_resource_role WHERE userid=$1 and resourceid=$2 and roleid=$3;", user.ID, resource.ID, role.ID).Scan(
-		&retval.UserID,
-		&retval.ResourceID,
-		&retval.RoleID,
-		&retval.Created,
-		&retval.CreatedBy,
-		&retval.Updated,
-		&retval.UpdatedBy,
-		&retval.Deleted,
-		&retval.DeletedBy,
-	)
-	if err != nil {
-		return retval, fmt.Errorf("Problem selecting user/resource/role object: %s", err)
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditAssignmentCreate, "assignment", user.ID+"/"+resource.ID+"/"+role.ID, "", nil, retval); err != nil {
+		return retval, err
 	}
 
 	//	Return our result
@@ -337,42 +252,13 @@ func (store DBManager) AddUserToResourceWithRole(context, user User, resource Re
 
 // userExists returns 'true' if the user can be found, 'false' if it can't be found
 func (store DBManager) userExists(user User) bool {
-	retval := false
-
-	item := User{}
-	err := store.systemdb.QueryRow("SELECT id, name FROM user WHERE id=$1;", user.ID).Scan(
-		&item.ID,
-		&item.Name,
-	)
-	if err != nil {
-		return false
-	}
-
-	//	We've gotten this far -- we must have found something
-	retval = true
-
-	return retval
+	_, err := store.systemdb.GetUser(user.ID)
+	return err == nil
 }
 
 // getUserForUserID returns the user information for the given userID
 func (store DBManager) getUserForUserID(userID string) (User, error) {
-	item := User{}
-
-	err := store.systemdb.QueryRow(`SELECT 
-		id, enabled, name, description, created, createdby, updated, updatedby, deleted, deletedby 
-		FROM user 
-		WHERE id=$1;`, userID).Scan(
-		&item.ID,
-		&item.Enabled,
-		&item.Name,
-		&item.Description,
-		&item.Created,
-		&item.CreatedBy,
-		&item.Updated,
-		&item.UpdatedBy,
-		&item.Deleted,
-		&item.DeletedBy,
-	)
+	item, err := store.systemdb.GetUser(userID)
 	if err != nil {
 		return item, fmt.Errorf("There was an error getting the user: %s", err)
 	}
@@ -0,0 +1,481 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/danesparza/authserver/webauthn"
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// ErrSecurityKeyRequired is returned when a user that has a security key as their second factor
+// logs in with just their password.  They have to log in with the key on the UI service instead
+var ErrSecurityKeyRequired = errors.New("A security key is required -- log in with your password and security key on the UI service (/webauthn/login)")
+
+// DefaultRelyingParty is the WebAuthn relying party used unless another one is set (see SetWebAuthnRelyingParty)
+var DefaultRelyingParty = webauthn.RelyingParty{
+	ID:      "localhost",
+	Name:    "authserver",
+	Origins: []string{"https://localhost:3001"},
+}
+
+// WebAuthnCredential is a WebAuthn credential a user has registered.  Passkeys
+// (discoverable credentials that verify the user) can be used to log in without a
+// password.  Other credentials (security keys) are a second factor after a password
+type WebAuthnCredential struct {
+	// ID is the credential id (base64url encoded, without padding)
+	ID     string `json:"id"`
+	UserID string `json:"userid"`
+
+	// Name is what the user calls the authenticator (like 'YubiKey' or 'Laptop')
+	Name string `json:"name"`
+
+	// PublicKey is the credential's COSE key (base64url encoded, without padding)
+	PublicKey string `json:"public_key"`
+
+	// SignCount is the authenticator's signature counter when the credential was last used
+	SignCount uint32 `json:"sign_count"`
+
+	// AAGUID identifies the authenticator's model (hex encoded)
+	AAGUID string `json:"aaguid,omitempty"`
+
+	// Transports are how the browser can reach the authenticator (like 'usb' or 'internal')
+	Transports []string `json:"transports,omitempty"`
+
+	Passkey   bool      `json:"passkey"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	LastUsed  zero.Time `json:"last_used"`
+}
+
+// WebAuthnCeremony is a WebAuthn ceremony that has been started.  The caller keeps it until
+// the browser's response comes back (finding it by its challenge), and uses it to finish the
+// ceremony -- see FinishWebAuthnRegistration and GetUserScopesWithWebAuthn
+type WebAuthnCeremony struct {
+	Challenge []byte
+
+	// UserID is the user registering a credential, or the user that's logging in with their
+	// password and a security key.  It's blank for passkey logins (the passkey says who the user is)
+	UserID string
+
+	// Registration is 'true' for registration ceremonies (and 'false' for logins), so a login
+	// can't be used to register a credential
+	Registration bool
+
+	// Passkey is 'true' if a passkey is being registered
+	Passkey bool
+
+	// Expires is when the ceremony times out
+	Expires time.Time
+}
+
+// WebAuthnVerification shows a user changing their own WebAuthn credentials is who they say they
+// are:  the authentication methods of their token (if it was issued with a second factor, that's
+// enough), or their password and one-time code (users without a second factor don't need a code)
+type WebAuthnVerification struct {
+	AMR      []string
+	Password string
+	Code     string
+}
+
+// SetWebAuthnRelyingParty sets the WebAuthn relying party:  the domain credentials are
+// registered for, and the origins the ceremonies can run on
+func (store *DBManager) SetWebAuthnRelyingParty(rp webauthn.RelyingParty) {
+	store.relyingParty = rp
+}
+
+// newWebAuthnCeremony starts a ceremony with a new challenge
+func (store DBManager) newWebAuthnCeremony(userID string, registration, passkey bool) (WebAuthnCeremony, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return WebAuthnCeremony{}, err
+	}
+
+	timeout := store.relyingParty.Timeout
+	if timeout <= 0 {
+		timeout = webauthn.DefaultTimeout
+	}
+
+	return WebAuthnCeremony{Challenge: challenge, UserID: userID, Registration: registration, Passkey: passkey, Expires: time.Now().Add(timeout)}, nil
+}
+
+// SaveWebAuthnCeremony keeps a ceremony that has been started (see BeginWebAuthnRegistration and
+// BeginWebAuthnLogin) in the token datastore until it's finished or times out, so the browser's
+// response can go to any instance of the service
+func (store DBManager) SaveWebAuthnCeremony(ceremony WebAuthnCeremony) error {
+	store, end := store.startSpan("SaveWebAuthnCeremony")
+	defer end()
+
+	return store.tokendb.AddWebAuthnCeremony(ceremony)
+}
+
+// TakeWebAuthnCeremony returns the saved ceremony for the challenge and forgets it, so each
+// ceremony can only be finished once.  It returns 'false' if there isn't a ceremony for the
+// challenge (or it has already been finished, or has timed out)
+func (store DBManager) TakeWebAuthnCeremony(challenge []byte) (WebAuthnCeremony, bool, error) {
+	store, end := store.startSpan("TakeWebAuthnCeremony")
+	defer end()
+
+	return store.tokendb.TakeWebAuthnCeremony(challenge)
+}
+
+// credentialDescriptors returns the descriptors of a user's credentials
+func credentialDescriptors(credentials []WebAuthnCredential) []webauthn.CredentialDescriptor {
+	retval := []webauthn.CredentialDescriptor{}
+	for _, credential := range credentials {
+		id, _ := base64.RawURLEncoding.DecodeString(credential.ID)
+		retval = append(retval, webauthn.CredentialDescriptor{Type: "public-key", ID: id, Transports: credential.Transports})
+	}
+
+	return retval
+}
+
+// verifyWebAuthnOwner returns the context user if they've shown they're who they say they are
+// (see WebAuthnVerification), so a token on its own can't be used to add or remove a credential
+func (store DBManager) verifyWebAuthnOwner(context User, verification WebAuthnVerification, purpose string) (User, error) {
+	for _, method := range verification.AMR {
+		if method == AMRMultiFactor {
+			return store.getUserForUserID(context.ID)
+		}
+	}
+
+	if verification.Password == "" {
+		return User{}, fmt.Errorf("Pass your password (and one-time code, if you have one), or log in with your second factor first")
+	}
+
+	user, err := store.verifyUserSecret(context.Name, verification.Password, verification.Code, purpose)
+	if err != nil {
+		return User{}, err
+	}
+
+	if user.ID != context.ID {
+		return User{}, fmt.Errorf("The user was not found or the password was incorrect")
+	}
+
+	return user, nil
+}
+
+// BeginWebAuthnRegistration starts registering a WebAuthn credential for the context user, and
+// returns the options for the browser along with the ceremony.  The user has to verify who they
+// are first (see WebAuthnVerification).  Passkeys have to verify the user (with a PIN or
+// biometric), since they're used without a password -- and directory users can't have them,
+// since they'd keep working after the user was disabled in the directory
+func (store DBManager) BeginWebAuthnRegistration(context User, verification WebAuthnVerification, passkey bool) (webauthn.CreationOptions, WebAuthnCeremony, error) {
+	store, end := store.startSpan("BeginWebAuthnRegistration")
+	defer end()
+
+	user, err := store.verifyWebAuthnOwner(context, verification, "webauthn registration")
+	if err != nil {
+		return webauthn.CreationOptions{}, WebAuthnCeremony{}, err
+	}
+
+	//	Passkeys log in without the directory, so directory users can only use security keys
+	//	(after their directory password)
+	if passkey && user.Source == UserSourceDirectory {
+		return webauthn.CreationOptions{}, WebAuthnCeremony{}, fmt.Errorf("User '%s' logs in with the directory -- they can register a security key, but not a passkey", user.Name)
+	}
+
+	//	Don't register the same authenticator twice
+	existing, err := store.systemdb.GetWebAuthnCredentialsForUser(user.ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, WebAuthnCeremony{}, err
+	}
+
+	ceremony, err := store.newWebAuthnCeremony(user.ID, true, passkey)
+	if err != nil {
+		return webauthn.CreationOptions{}, WebAuthnCeremony{}, err
+	}
+
+	displayName := user.Description
+	if displayName == "" {
+		displayName = user.Name
+	}
+
+	entity := webauthn.UserEntity{ID: []byte(user.ID), Name: user.Name, DisplayName: displayName}
+	return store.relyingParty.CreationOptions(ceremony.Challenge, entity, credentialDescriptors(existing), passkey), ceremony, nil
+}
+
+// FinishWebAuthnRegistration checks the browser's response to a registration ceremony
+// started by the context user, and stores the new credential under the passed name
+func (store DBManager) FinishWebAuthnRegistration(context User, ceremony WebAuthnCeremony, name string, response webauthn.RegistrationResponse) (WebAuthnCredential, error) {
+	store, end := store.startSpan("FinishWebAuthnRegistration")
+	defer end()
+
+	if ceremony.Registration == false || ceremony.UserID != context.ID || ceremony.Expires.Before(time.Now()) {
+		return WebAuthnCredential{}, fmt.Errorf("The registration has expired -- start it again")
+	}
+
+	verified, err := store.relyingParty.VerifyRegistration(ceremony.Challenge, response, ceremony.Passkey)
+	if err != nil {
+		store.log().Warn("WebAuthn registration failed", logging.FieldUserID, context.ID, "error", err)
+		return WebAuthnCredential{}, fmt.Errorf("Problem registering the credential: %s", err)
+	}
+
+	credential := WebAuthnCredential{
+		ID:         base64.RawURLEncoding.EncodeToString(verified.ID),
+		UserID:     context.ID,
+		Name:       name,
+		PublicKey:  base64.RawURLEncoding.EncodeToString(verified.PublicKey),
+		SignCount:  verified.SignCount,
+		AAGUID:     hex.EncodeToString(verified.AAGUID),
+		Transports: verified.Transports,
+		Passkey:    ceremony.Passkey,
+	}
+
+	if credential.Name == "" {
+		credential.Name = "Security key"
+		if credential.Passkey {
+			credential.Name = "Passkey"
+		}
+	}
+
+	if _, err := store.systemdb.GetWebAuthnCredential(credential.ID); err == nil {
+		return WebAuthnCredential{}, fmt.Errorf("The credential is already registered")
+	}
+
+	if err := store.systemdb.AddWebAuthnCredential(credential, context.Name); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	//	Record it in the audit log
+	kind := "security key"
+	if credential.Passkey {
+		kind = "passkey"
+	}
+	if err := store.audit(context.Name, AuditUserWebAuthnRegister, "user", context.ID, fmt.Sprintf("%s '%s' (%s)", kind, credential.Name, credential.ID), nil, nil); err != nil {
+		return credential, err
+	}
+
+	return store.systemdb.GetWebAuthnCredential(credential.ID)
+}
+
+// BeginWebAuthnLogin starts a WebAuthn login, and returns the options for the browser along with
+// the ceremony.  Without a name, the user logs in with a passkey.  With a name, the user's password
+// is checked first, and then they log in with one of their registered credentials as a second factor
+func (store DBManager) BeginWebAuthnLogin(name, secret string) (webauthn.RequestOptions, WebAuthnCeremony, error) {
+	store, end := store.startSpan("BeginWebAuthnLogin")
+	defer end()
+
+	if name == "" {
+		ceremony, err := store.newWebAuthnCeremony("", false, false)
+		if err != nil {
+			return webauthn.RequestOptions{}, WebAuthnCeremony{}, err
+		}
+
+		return store.relyingParty.RequestOptions(ceremony.Challenge, nil, webauthn.VerificationRequired), ceremony, nil
+	}
+
+	//	The security key is the second factor
+	user, err := store.checkUserSecret(name, secret, "security key login")
+	if err != nil {
+		return webauthn.RequestOptions{}, WebAuthnCeremony{}, err
+	}
+
+	credentials, err := store.systemdb.GetWebAuthnCredentialsForUser(user.ID)
+	if err != nil {
+		return webauthn.RequestOptions{}, WebAuthnCeremony{}, err
+	}
+
+	if len(credentials) == 0 {
+		return webauthn.RequestOptions{}, WebAuthnCeremony{}, fmt.Errorf("User '%s' doesn't have a security key", name)
+	}
+
+	ceremony, err := store.newWebAuthnCeremony(user.ID, false, false)
+	if err != nil {
+		return webauthn.RequestOptions{}, WebAuthnCeremony{}, err
+	}
+
+	return store.relyingParty.RequestOptions(ceremony.Challenge, credentialDescriptors(credentials), webauthn.VerificationDiscouraged), ceremony, nil
+}
+
+// GetUserScopesWithWebAuthn checks the browser's response to a login ceremony (see BeginWebAuthnLogin)
+// and returns the user's scopes.  Passkey logins have to verify the user, so (like a password and a
+// security key) they count as multi-factor:  the authentication methods are 'hwk' and 'mfa', plus
+// 'pwd' if the user entered their password.  Directory users can't log in with a passkey
+func (store DBManager) GetUserScopesWithWebAuthn(ceremony WebAuthnCeremony, response webauthn.AuthenticationResponse) (ScopeUser, error) {
+	store, end := store.startSpan("GetUserScopesWithWebAuthn")
+	defer end()
+
+	retUser := ScopeUser{}
+	failed := fmt.Errorf("The security key or passkey couldn't be used to log in")
+
+	if ceremony.Registration || ceremony.Expires.Before(time.Now()) {
+		return retUser, fmt.Errorf("The login has expired -- start it again")
+	}
+
+	//	Find the credential (and its user)
+	credentialID := base64.RawURLEncoding.EncodeToString(response.RawID)
+	credential, err := store.systemdb.GetWebAuthnCredential(credentialID)
+	if err != nil {
+		store.log().Warn("Login failed", "credential", credentialID, logging.FieldOutcome, "unknown_credential")
+		metrics.AuthFailures.WithLabelValues("unknown_credential").Inc()
+		store.audit("", AuditLoginFailed, "user", ceremony.UserID, "unknown WebAuthn credential", nil, nil)
+		return retUser, failed
+	}
+
+	user, err := store.getUserForUserID(credential.UserID)
+	if err != nil {
+		return retUser, failed
+	}
+
+	if store.lockedOut(user.Name) {
+		store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "locked_out")
+		metrics.AuthFailures.WithLabelValues("locked_out").Inc()
+		store.audit(user.Name, AuditLoginFailed, "user", user.ID, "locked out", nil, nil)
+		return retUser, failed
+	}
+
+	//	Second factor logins have to use one of the user's credentials.  Passkey logins
+	//	have to use a passkey, and the user handle (if there is one) has to be the user's
+	passwordLogin := ceremony.UserID != ""
+	outcome, detail := "", ""
+	switch {
+	case passwordLogin && credential.UserID != ceremony.UserID:
+		outcome, detail = "wrong_credential", "another user's WebAuthn credential"
+	case passwordLogin == false && credential.Passkey == false:
+		outcome, detail = "not_passkey", "security key used without a password"
+	case passwordLogin == false && user.Source == UserSourceDirectory:
+		outcome, detail = "directory_user", "passkey used by a directory user"
+	case passwordLogin == false && len(response.Response.UserHandle) != 0 && string(response.Response.UserHandle) != user.ID:
+		outcome, detail = "wrong_user_handle", "WebAuthn user handle doesn't match"
+	}
+
+	if outcome == "" {
+		publicKey, _ := base64.RawURLEncoding.DecodeString(credential.PublicKey)
+		authData, err := store.relyingParty.VerifyAuthentication(ceremony.Challenge, response, publicKey, credential.SignCount, passwordLogin == false)
+		if err != nil {
+			outcome, detail = "invalid_assertion", "invalid WebAuthn assertion: "+err.Error()
+		} else if err := store.systemdb.UpdateWebAuthnCredentialUse(credential.ID, authData.SignCount, time.Now()); err != nil {
+			return retUser, err
+		}
+	}
+
+	if outcome != "" {
+		store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, "credential", credential.ID, logging.FieldOutcome, outcome)
+		metrics.AuthFailures.WithLabelValues(outcome).Inc()
+		store.audit(user.Name, AuditLoginFailed, "user", user.ID, detail, nil, nil)
+		store.loginFailed(user.Name, user.ID)
+		return retUser, failed
+	}
+
+	//	Expired passwords have to be changed before they can be used to log in
+	amr := []string{AMRHardwareKey, AMRMultiFactor}
+	if passwordLogin {
+		amr = []string{AMRPassword, AMRHardwareKey, AMRMultiFactor}
+
+		if store.passwordExpired(user) {
+			store.log().Warn("Login failed", "user", user.Name, logging.FieldUserID, user.ID, logging.FieldOutcome, "password_expired")
+			metrics.AuthFailures.WithLabelValues("password_expired").Inc()
+			store.audit(user.Name, AuditLoginFailed, "user", user.ID, "password expired", nil, nil)
+			return retUser, fmt.Errorf("The password has expired -- it needs to be changed")
+		}
+	}
+
+	retUser, err = store.getUserScopes(user)
+	if err != nil {
+		return retUser, fmt.Errorf("Problem fetching scopes for the user: %s", err)
+	}
+	retUser.AMR = amr
+
+	store.log().Debug("Login succeeded", "user", user.Name, logging.FieldUserID, user.ID, "credential", credential.ID, logging.FieldOutcome, "ok")
+	store.loginSucceeded(user.Name)
+
+	return retUser, nil
+}
+
+// canManageWebAuthn returns an error if the context user can't manage the user's
+// WebAuthn credentials.  Users can manage their own, and system admins and resource
+// delegates can manage other users' (see userCanManage)
+func (store DBManager) canManageWebAuthn(context User, userID string) error {
+	if context.ID != userID && store.userCanManage(context.ID, userID) == false {
+		return fmt.Errorf("User '%s' does not have permission to manage the user's WebAuthn credentials", context.Name)
+	}
+
+	return nil
+}
+
+// GetWebAuthnCredentials returns a user's WebAuthn credentials
+func (store DBManager) GetWebAuthnCredentials(context User, userID string) ([]WebAuthnCredential, error) {
+	store, end := store.startSpan("GetWebAuthnCredentials")
+	defer end()
+
+	if err := store.canManageWebAuthn(context, userID); err != nil {
+		return []WebAuthnCredential{}, err
+	}
+
+	if _, err := store.getUserForUserID(userID); err != nil {
+		return []WebAuthnCredential{}, err
+	}
+
+	return store.systemdb.GetWebAuthnCredentialsForUser(userID)
+}
+
+// RemoveWebAuthnCredential removes one of a user's WebAuthn credentials (like when they've lost the
+// authenticator).  Only system admins and resource delegates can remove them -- users remove their
+// own with RemoveOwnWebAuthnCredential
+func (store DBManager) RemoveWebAuthnCredential(context User, userID, credentialID string) error {
+	store, end := store.startSpan("RemoveWebAuthnCredential")
+	defer end()
+
+	if store.userCanManage(context.ID, userID) == false {
+		return fmt.Errorf("User '%s' does not have permission to remove the user's WebAuthn credentials", context.Name)
+	}
+
+	return store.removeWebAuthnCredential(context, userID, credentialID)
+}
+
+// RemoveOwnWebAuthnCredential removes one of the context user's WebAuthn credentials.  The user
+// has to verify who they are first (see WebAuthnVerification)
+func (store DBManager) RemoveOwnWebAuthnCredential(context User, verification WebAuthnVerification, credentialID string) error {
+	store, end := store.startSpan("RemoveOwnWebAuthnCredential")
+	defer end()
+
+	user, err := store.verifyWebAuthnOwner(context, verification, "webauthn removal")
+	if err != nil {
+		return err
+	}
+
+	return store.removeWebAuthnCredential(context, user.ID, credentialID)
+}
+
+// removeWebAuthnCredential removes one of a user's WebAuthn credentials, once the caller has
+// checked the context user can
+func (store DBManager) removeWebAuthnCredential(context User, userID, credentialID string) error {
+	credential, err := store.systemdb.GetWebAuthnCredential(credentialID)
+	if err != nil || credential.UserID != userID {
+		return fmt.Errorf("The user doesn't have a WebAuthn credential with id '%s'", credentialID)
+	}
+
+	if err := store.systemdb.DeleteWebAuthnCredential(credential.ID); err != nil {
+		return err
+	}
+
+	//	Record it in the audit log
+	if err := store.audit(context.Name, AuditUserWebAuthnRemove, "user", userID, fmt.Sprintf("'%s' (%s)", credential.Name, credential.ID), nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hasSecurityKey returns 'true' if the user has registered a security key (a
+// WebAuthn credential that isn't a passkey) to use as a second factor
+func (store DBManager) hasSecurityKey(userID string) (bool, error) {
+	credentials, err := store.systemdb.GetWebAuthnCredentialsForUser(userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, credential := range credentials {
+		if credential.Passkey == false {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
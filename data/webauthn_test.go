@@ -0,0 +1,432 @@
+package data_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/data"
+	"github.com/danesparza/authserver/webauthn/webauthntest"
+)
+
+//	Registers a credential with a new test authenticator for a user, and returns
+//	the authenticator along with the credential
+func registerTestWebAuthn(t *testing.T, db *data.DBManager, user data.User, passkey bool) (*webauthntest.Authenticator, data.WebAuthnCredential) {
+	options, ceremony, err := db.BeginWebAuthnRegistration(user, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, passkey)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration failed: Should have started registration without error: %s", err)
+	}
+
+	authenticator := webauthntest.NewAuthenticator(data.DefaultRelyingParty.Origins[0])
+	response, err := authenticator.Register(options)
+	if err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+
+	credential, err := db.FinishWebAuthnRegistration(user, ceremony, "", response)
+	if err != nil {
+		t.Fatalf("FinishWebAuthnRegistration failed: Should have registered the credential without error: %s", err)
+	}
+
+	return authenticator, credential
+}
+
+func TestWebAuthn_Passkey_LogsInWithoutPassword(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestWebAuthn1"}, "webauthnpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	authenticator, credential := registerTestWebAuthn(t, db, newUser, true)
+
+	//	Act
+	options, ceremony, err := db.BeginWebAuthnLogin("", "")
+	response, _ := authenticator.Authenticate(options)
+	scopeUser, loginErr := db.GetUserScopesWithWebAuthn(ceremony, response)
+	_, replayErr := db.GetUserScopesWithWebAuthn(ceremony, response)
+	_, passwordErr := db.GetUserScopesWithCredentials(newUser.Name, "webauthnpassword")
+	credentials, _ := db.GetWebAuthnCredentials(newUser, newUser.ID)
+
+	//	Assert
+	if err != nil || len(options.AllowCredentials) != 0 || options.UserVerification != "required" {
+		t.Errorf("BeginWebAuthnLogin failed: Should have started a passkey login that verifies the user, but got %+v (%v)", options, err)
+	}
+
+	if credential.Passkey != true || credential.Name != "Passkey" || credential.UserID != newUser.ID {
+		t.Errorf("FinishWebAuthnRegistration failed: Should have registered a passkey for the user, but got %+v", credential)
+	}
+
+	if loginErr != nil || scopeUser.Name != newUser.Name {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have logged the user in with the passkey, but got %+v (%v)", scopeUser, loginErr)
+	}
+
+	if len(scopeUser.AMR) != 2 || scopeUser.AMR[0] != data.AMRHardwareKey || scopeUser.AMR[1] != data.AMRMultiFactor {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have returned 'hwk' and 'mfa' as the authentication methods, but got %v", scopeUser.AMR)
+	}
+
+	if replayErr == nil {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have rejected a replayed assertion")
+	}
+
+	if passwordErr != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: A passkey shouldn't be needed with the password: %s", passwordErr)
+	}
+
+	if len(credentials) != 1 || credentials[0].SignCount != 1 || credentials[0].LastUsed.IsZero() {
+		t.Errorf("GetWebAuthnCredentials failed: Should have recorded the credential's use, but got %+v", credentials)
+	}
+}
+
+func TestWebAuthn_SecurityKey_RequiredAfterPassword(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	newUser, err := db.AddUser(uctx, data.User{Name: "TestWebAuthn2"}, "webauthnpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	authenticator, credential := registerTestWebAuthn(t, db, newUser, false)
+
+	//	Act
+	_, passwordErr := db.GetUserScopesWithCredentials(newUser.Name, "webauthnpassword")
+	_, _, wrongPasswordErr := db.BeginWebAuthnLogin(newUser.Name, "notthepassword")
+	options, ceremony, beginErr := db.BeginWebAuthnLogin(newUser.Name, "webauthnpassword")
+	response, _ := authenticator.Authenticate(options)
+	scopeUser, loginErr := db.GetUserScopesWithWebAuthn(ceremony, response)
+
+	passkeyOptions, passkeyCeremony, _ := db.BeginWebAuthnLogin("", "")
+	passkeyResponse, _ := authenticator.Authenticate(passkeyOptions)
+	_, passkeyErr := db.GetUserScopesWithWebAuthn(passkeyCeremony, passkeyResponse)
+
+	//	Assert
+	if credential.Passkey != false || credential.Name != "Security key" {
+		t.Errorf("FinishWebAuthnRegistration failed: Should have registered a security key, but got %+v", credential)
+	}
+
+	if errors.Is(passwordErr, data.ErrSecurityKeyRequired) != true {
+		t.Errorf("GetUserScopesWithCredentials failed: Should have required the security key, but got %v", passwordErr)
+	}
+
+	if wrongPasswordErr == nil {
+		t.Errorf("BeginWebAuthnLogin failed: Should have checked the password")
+	}
+
+	if beginErr != nil || len(options.AllowCredentials) != 1 {
+		t.Errorf("BeginWebAuthnLogin failed: Should have allowed the user's security key, but got %+v (%v)", options, beginErr)
+	}
+
+	if loginErr != nil || scopeUser.Name != newUser.Name || len(scopeUser.AMR) != 3 || scopeUser.AMR[0] != data.AMRPassword || scopeUser.AMR[1] != data.AMRHardwareKey {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have logged the user in with 'pwd', 'hwk' and 'mfa', but got %+v (%v)", scopeUser, loginErr)
+	}
+
+	if passkeyErr == nil {
+		t.Errorf("GetUserScopesWithWebAuthn failed: A security key shouldn't log in without the password")
+	}
+}
+
+func TestWebAuthn_OtherUsersCredential_ReturnsError(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	user1, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn3"}, "webauthnpassword")
+	user2, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn4"}, "webauthnpassword")
+	registerTestWebAuthn(t, db, user1, false)
+	otherAuthenticator, _ := registerTestWebAuthn(t, db, user2, true)
+
+	//	Act
+	options, ceremony, _ := db.BeginWebAuthnLogin(user1.Name, "webauthnpassword")
+	response, _ := otherAuthenticator.Authenticate(options)
+	_, otherCredentialErr := db.GetUserScopesWithWebAuthn(ceremony, response)
+
+	passkeyOptions, passkeyCeremony, _ := db.BeginWebAuthnLogin("", "")
+	passkeyResponse, _ := otherAuthenticator.Authenticate(passkeyOptions)
+	passkeyResponse.Response.UserHandle = []byte(user1.ID)
+	_, userHandleErr := db.GetUserScopesWithWebAuthn(passkeyCeremony, passkeyResponse)
+
+	_, _, registerErr := db.BeginWebAuthnRegistration(data.User{ID: "notauser"}, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, true)
+	registerOptions, registerCeremony, _ := db.BeginWebAuthnRegistration(user1, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, true)
+	registerResponse, _ := webauthntest.NewAuthenticator(data.DefaultRelyingParty.Origins[0]).Register(registerOptions)
+	_, otherCeremonyErr := db.FinishWebAuthnRegistration(user2, registerCeremony, "", registerResponse)
+
+	//	Assert
+	if otherCredentialErr == nil {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have rejected another user's credential after the password")
+	}
+
+	if userHandleErr == nil {
+		t.Errorf("GetUserScopesWithWebAuthn failed: Should have rejected a passkey with another user's handle")
+	}
+
+	if registerErr == nil || otherCeremonyErr == nil {
+		t.Errorf("FinishWebAuthnRegistration failed: Should have rejected registration for an unknown user, or another user's ceremony")
+	}
+}
+
+func TestWebAuthn_RemoveWebAuthnCredential_ChecksPermissions(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	user1, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn5"}, "webauthnpassword")
+	user2, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn6"}, "webauthnpassword")
+	_, credential1 := registerTestWebAuthn(t, db, user1, false)
+	_, credential2 := registerTestWebAuthn(t, db, user1, true)
+
+	//	Act
+	_, otherListErr := db.GetWebAuthnCredentials(user2, user1.ID)
+	otherRemoveErr := db.RemoveWebAuthnCredential(user2, user1.ID, credential1.ID)
+	wrongUserErr := db.RemoveWebAuthnCredential(uctx, user2.ID, credential1.ID)
+	selfAdminRemoveErr := db.RemoveWebAuthnCredential(user1, user1.ID, credential1.ID)
+	selfTokenRemoveErr := db.RemoveOwnWebAuthnCredential(user1, data.WebAuthnVerification{AMR: []string{data.AMRPassword}}, credential1.ID)
+	selfRemoveErr := db.RemoveOwnWebAuthnCredential(user1, data.WebAuthnVerification{AMR: []string{data.AMRHardwareKey, data.AMRMultiFactor}}, credential1.ID)
+	adminRemoveErr := db.RemoveWebAuthnCredential(uctx, user1.ID, credential2.ID)
+	credentials, listErr := db.GetWebAuthnCredentials(uctx, user1.ID)
+	_, passwordErr := db.GetUserScopesWithCredentials(user1.Name, "webauthnpassword")
+
+	//	Assert
+	if otherListErr == nil || otherRemoveErr == nil {
+		t.Errorf("RemoveWebAuthnCredential failed: Users shouldn't be able to manage another user's credentials")
+	}
+
+	if selfAdminRemoveErr == nil || selfTokenRemoveErr == nil {
+		t.Errorf("RemoveOwnWebAuthnCredential failed: Users should have to verify who they are to remove their own credentials")
+	}
+
+	if wrongUserErr == nil {
+		t.Errorf("RemoveWebAuthnCredential failed: Should have rejected a credential that belongs to another user")
+	}
+
+	if selfRemoveErr != nil || adminRemoveErr != nil {
+		t.Errorf("RemoveWebAuthnCredential failed: The user and an admin should be able to remove credentials (%v / %v)", selfRemoveErr, adminRemoveErr)
+	}
+
+	if listErr != nil || len(credentials) != 0 {
+		t.Errorf("GetWebAuthnCredentials failed: Should have removed the credentials, but got %+v (%v)", credentials, listErr)
+	}
+
+	if passwordErr != nil {
+		t.Errorf("GetUserScopesWithCredentials failed: Shouldn't need a security key once it's removed: %s", passwordErr)
+	}
+}
+
+func TestWebAuthn_TakeWebAuthnCeremony_OnlyOnce(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+
+	if _, _, err := db.AuthSystemBootstrap(); err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	ceremony := data.WebAuthnCeremony{Challenge: []byte("testchallenge1"), UserID: "testuser1", Passkey: true, Expires: time.Now().Add(time.Minute)}
+	expired := data.WebAuthnCeremony{Challenge: []byte("testchallenge2"), Expires: time.Now().Add(-time.Second)}
+
+	//	Act
+	saveErr := db.SaveWebAuthnCeremony(ceremony)
+	db.SaveWebAuthnCeremony(expired)
+
+	taken, found, takeErr := db.TakeWebAuthnCeremony(ceremony.Challenge)
+	_, foundAgain, _ := db.TakeWebAuthnCeremony(ceremony.Challenge)
+	_, foundExpired, _ := db.TakeWebAuthnCeremony(expired.Challenge)
+
+	//	Assert
+	if saveErr != nil || takeErr != nil || found != true {
+		t.Errorf("TakeWebAuthnCeremony failed: Should have found the saved ceremony, but got %v (%v, %v)", found, saveErr, takeErr)
+	}
+
+	if string(taken.Challenge) != "testchallenge1" || taken.UserID != "testuser1" || taken.Passkey != true || taken.Expires.Sub(ceremony.Expires).Abs() > time.Second {
+		t.Errorf("TakeWebAuthnCeremony failed: Should have returned the saved ceremony, but got %+v", taken)
+	}
+
+	if foundAgain || foundExpired {
+		t.Errorf("TakeWebAuthnCeremony failed: Should only find a ceremony once, and not after it times out")
+	}
+}
+
+func TestWebAuthn_SecurityKey_CantBeBypassedWithTOTP(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	keyUser, err := db.AddUser(uctx, data.User{Name: "TestWebAuthn6"}, "webauthnpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	laterKeyUser, err := db.AddUser(uctx, data.User{Name: "TestWebAuthn7"}, "webauthnpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	totpUser, err := db.AddUser(uctx, data.User{Name: "TestWebAuthn8"}, "webauthnpassword")
+	if err != nil {
+		t.Errorf("AddUser failed: Should have added an item without error: %s", err)
+	}
+
+	registerTestWebAuthn(t, db, keyUser, false)
+	totpSecret, totpStep, _ := enrollTestTOTP(t, db, totpUser.Name, "webauthnpassword")
+
+	//	Act -- set up TOTP after registering a security key, and before confirming it (and
+	//	register a security key after setting up TOTP)
+	_, enrollErr := db.EnrollTOTP(keyUser.Name, "webauthnpassword")
+	enrollment, laterEnrollErr := db.EnrollTOTP(laterKeyUser.Name, "webauthnpassword")
+	registerTestWebAuthn(t, db, laterKeyUser, false)
+	code := totpCodeFor(t, enrollment.Secret, time.Now().Unix()/30)
+	_, confirmErr := db.ConfirmTOTP(laterKeyUser.Name, "webauthnpassword", code)
+	_, keyLoginErr := db.GetUserScopesWithSecondFactor(keyUser.Name, "webauthnpassword", data.AuthMethodSecretBasic, "")
+	_, laterKeyLoginErr := db.GetUserScopesWithSecondFactor(laterKeyUser.Name, "webauthnpassword", data.AuthMethodSecretBasic, code)
+	registerTestWebAuthn(t, db, totpUser, false)
+	_, totpLoginErr := db.GetUserScopesWithSecondFactor(totpUser.Name, "webauthnpassword", data.AuthMethodSecretBasic, totpCodeFor(t, totpSecret, totpStep+1))
+
+	//	Assert
+	if enrollErr == nil {
+		t.Errorf("EnrollTOTP failed: Shouldn't have set up TOTP for a user with a security key")
+	}
+
+	if laterEnrollErr != nil || confirmErr == nil {
+		t.Errorf("ConfirmTOTP failed: Shouldn't have confirmed TOTP for a user who registered a security key since enrolling (%v)", laterEnrollErr)
+	}
+
+	if errors.Is(keyLoginErr, data.ErrSecurityKeyRequired) != true || errors.Is(laterKeyLoginErr, data.ErrSecurityKeyRequired) != true {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Should have needed the security key, but got: %v / %v", keyLoginErr, laterKeyLoginErr)
+	}
+
+	if errors.Is(totpLoginErr, data.ErrSecurityKeyRequired) != true {
+		t.Errorf("GetUserScopesWithSecondFactor failed: Should have needed the security key registered after TOTP, but got: %v", totpLoginErr)
+	}
+}
+
+func TestWebAuthn_Registration_RequiresPasswordOrSecondFactor(t *testing.T) {
+	//	Arrange
+	systemdbfilename, tokendbfilename := getTestFiles()
+	defer os.Remove(systemdbfilename)
+	defer os.Remove(tokendbfilename)
+
+	db, err := data.NewDBManager(systemdbfilename, tokendbfilename)
+	if err != nil {
+		t.Errorf("NewSystemDB failed: %s", err)
+	}
+	defer db.Close()
+	db.SetSecretHasher(testArgon2idHasher)
+
+	uctx, _, err := db.AuthSystemBootstrap()
+	if err != nil {
+		t.Errorf("AuthSystemBootstrap failed: Should have bootstrapped without error: %s", err)
+	}
+
+	user1, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn11"}, "webauthnpassword")
+	user2, _ := db.AddUser(uctx, data.User{Name: "TestWebAuthn12"}, "webauthnpassword")
+	registerTestWebAuthn(t, db, user2, false)
+
+	//	Act
+	_, _, tokenOnlyErr := db.BeginWebAuthnRegistration(user1, data.WebAuthnVerification{AMR: []string{data.AMRPassword}}, true)
+	_, _, wrongPasswordErr := db.BeginWebAuthnRegistration(user1, data.WebAuthnVerification{AMR: []string{data.AMRPassword}, Password: "notthepassword"}, true)
+	_, _, passwordErr := db.BeginWebAuthnRegistration(user1, data.WebAuthnVerification{AMR: []string{data.AMRPassword}, Password: "webauthnpassword"}, true)
+
+	//	A user with a security key has to use it
+	_, _, keyUserPasswordErr := db.BeginWebAuthnRegistration(user2, data.WebAuthnVerification{AMR: []string{data.AMRPassword}, Password: "webauthnpassword"}, true)
+
+	//	A login ceremony can't be used to register a credential
+	_, loginCeremony, _ := db.BeginWebAuthnLogin(user2.Name, "webauthnpassword")
+	registerOptions, _, _ := db.BeginWebAuthnRegistration(user2, data.WebAuthnVerification{AMR: []string{data.AMRMultiFactor}}, false)
+	registerOptions.Challenge = loginCeremony.Challenge
+	response, _ := webauthntest.NewAuthenticator(data.DefaultRelyingParty.Origins[0]).Register(registerOptions)
+	_, loginCeremonyErr := db.FinishWebAuthnRegistration(user2, loginCeremony, "", response)
+
+	//	Assert
+	if tokenOnlyErr == nil || wrongPasswordErr == nil {
+		t.Errorf("BeginWebAuthnRegistration failed: Should have needed the password with a token issued without a second factor")
+	}
+
+	if passwordErr != nil {
+		t.Errorf("BeginWebAuthnRegistration failed: Should have started registration with the password: %s", passwordErr)
+	}
+
+	if keyUserPasswordErr == nil {
+		t.Errorf("BeginWebAuthnRegistration failed: Should have needed the security key for a user that has one")
+	}
+
+	if loginCeremonyErr == nil {
+		t.Errorf("FinishWebAuthnRegistration failed: Should have refused to register a credential with a login ceremony")
+	}
+}
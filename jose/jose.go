@@ -0,0 +1,382 @@
+// Package jose parses, verifies and signs compact JSON Web Signatures (RFC 7515) and
+// reads JSON Web Keys (RFC 7517).  It supports the algorithms clients use for DPoP proofs
+// and signed client assertions:  ES256/384/512, RS256/384/512, PS256/384/512 and EdDSA
+// (Ed25519).  HS256/384/512 can only be signed (for tests), never verified, and 'none' is never accepted
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for the SHA-384 / SHA-512 algorithms
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Header is a JWS protected header
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	JWK *JWK   `json:"jwk,omitempty"`
+}
+
+// JWS is a parsed (but not yet verified) compact JWS
+type JWS struct {
+	Header  Header
+	Payload []byte
+
+	signingInput string
+	signature    []byte
+}
+
+// Parse parses a compact JWS (header.payload.signature)
+func Parse(compact string) (JWS, error) {
+	retval := JWS{}
+
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return retval, fmt.Errorf("Problem parsing JWS: it should have 3 parts, but has %v", len(parts))
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return retval, fmt.Errorf("Problem decoding JWS header: %s", err)
+	}
+
+	if err := json.Unmarshal(header, &retval.Header); err != nil {
+		return retval, fmt.Errorf("Problem reading JWS header: %s", err)
+	}
+
+	retval.Payload, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return retval, fmt.Errorf("Problem decoding JWS payload: %s", err)
+	}
+
+	retval.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return retval, fmt.Errorf("Problem decoding JWS signature: %s", err)
+	}
+
+	retval.signingInput = parts[0] + "." + parts[1]
+
+	return retval, nil
+}
+
+// Claims decodes the payload (as JSON) into v
+func (jws JWS) Claims(v interface{}) error {
+	if err := json.Unmarshal(jws.Payload, v); err != nil {
+		return fmt.Errorf("Problem reading JWS claims: %s", err)
+	}
+
+	return nil
+}
+
+// Verify checks the signature with the public key.  The header's algorithm has to
+// be an asymmetric one that matches the type of key
+func (jws JWS) Verify(key crypto.PublicKey) error {
+	hash, err := algorithmHash(jws.Header.Alg)
+	if err != nil {
+		return err
+	}
+
+	digest := func() []byte {
+		h := hash.New()
+		h.Write([]byte(jws.signingInput))
+		return h.Sum(nil)
+	}
+
+	switch alg := jws.Header.Alg; {
+	case strings.HasPrefix(alg, "ES"):
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if ok == false || publicKey.Curve != algorithmCurve(alg) {
+			return fmt.Errorf("Problem verifying JWS: %s needs a %s EC key", alg, algorithmCurve(alg).Params().Name)
+		}
+
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(jws.signature) != 2*size {
+			return fmt.Errorf("Problem verifying JWS: the signature is the wrong length")
+		}
+
+		r := new(big.Int).SetBytes(jws.signature[:size])
+		s := new(big.Int).SetBytes(jws.signature[size:])
+		if ecdsa.Verify(publicKey, digest(), r, s) == false {
+			return fmt.Errorf("Problem verifying JWS: the signature is invalid")
+		}
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		publicKey, ok := key.(*rsa.PublicKey)
+		if ok == false {
+			return fmt.Errorf("Problem verifying JWS: %s needs an RSA key", alg)
+		}
+
+		if publicKey.N.BitLen() < 2048 {
+			return fmt.Errorf("Problem verifying JWS: RSA keys need to be at least 2048 bits")
+		}
+
+		if strings.HasPrefix(alg, "RS") {
+			err = rsa.VerifyPKCS1v15(publicKey, hash, digest(), jws.signature)
+		} else {
+			err = rsa.VerifyPSS(publicKey, hash, digest(), jws.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return fmt.Errorf("Problem verifying JWS: the signature is invalid")
+		}
+	case alg == "EdDSA":
+		publicKey, ok := key.(ed25519.PublicKey)
+		if ok == false {
+			return fmt.Errorf("Problem verifying JWS: EdDSA needs an Ed25519 key")
+		}
+
+		if ed25519.Verify(publicKey, []byte(jws.signingInput), jws.signature) == false {
+			return fmt.Errorf("Problem verifying JWS: the signature is invalid")
+		}
+	default:
+		return fmt.Errorf("Problem verifying JWS: %s isn't an asymmetric algorithm", alg)
+	}
+
+	return nil
+}
+
+// Sign creates a compact JWS of the claims (encoded as JSON) using the header's algorithm.
+// The key is a private key (*ecdsa.PrivateKey, *rsa.PrivateKey or ed25519.PrivateKey)
+// or, for the HMAC algorithms, the shared secret ([]byte)
+func Sign(header Header, claims interface{}, key interface{}) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("Problem encoding JWS header: %s", err)
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("Problem encoding JWS claims: %s", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hash, err := algorithmHash(header.Alg)
+	if err != nil {
+		return "", err
+	}
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	switch privateKey := key.(type) {
+	case []byte:
+		if strings.HasPrefix(header.Alg, "HS") == false {
+			return "", fmt.Errorf("Problem signing JWS: a shared secret can't be used with %s", header.Alg)
+		}
+
+		mac := hmac.New(hash.New, privateKey)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest)
+		if err != nil {
+			return "", fmt.Errorf("Problem signing JWS: %s", err)
+		}
+
+		size := (privateKey.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(header.Alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, privateKey, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, hash, digest)
+		}
+		if err != nil {
+			return "", fmt.Errorf("Problem signing JWS: %s", err)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(privateKey, []byte(signingInput))
+	default:
+		return "", fmt.Errorf("Problem signing JWS: unsupported key type %T", key)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// algorithmHash returns the hash used by the algorithm
+func algorithmHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "ES256", "RS256", "PS256", "HS256", "EdDSA":
+		return crypto.SHA256, nil
+	case "ES384", "RS384", "PS384", "HS384":
+		return crypto.SHA384, nil
+	case "ES512", "RS512", "PS512", "HS512":
+		return crypto.SHA512, nil
+	}
+
+	return 0, fmt.Errorf("Problem verifying JWS: unsupported algorithm '%s'", alg)
+}
+
+// algorithmCurve returns the curve used by an ES algorithm
+func algorithmCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	default:
+		return elliptic.P256()
+	}
+}
+
+// JWK is a JSON Web Key (RFC 7517).  Only public keys are used
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// EC and OKP keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// D is the private part of an EC or OKP key (and RSA's private exponent).  Keys
+	// with it set are rejected -- a client should never send its private key
+	D string `json:"d,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK returns the JWK for a public key (*ecdsa.PublicKey, *rsa.PublicKey or ed25519.PublicKey)
+func NewJWK(key crypto.PublicKey) (JWK, error) {
+	switch publicKey := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: publicKey.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(publicKey)}, nil
+	}
+
+	return JWK{}, fmt.Errorf("Problem creating JWK: unsupported key type %T", key)
+}
+
+// PublicKey returns the key as a *ecdsa.PublicKey, *rsa.PublicKey or ed25519.PublicKey
+func (key JWK) PublicKey() (crypto.PublicKey, error) {
+	if key.D != "" {
+		return nil, fmt.Errorf("Problem reading JWK: it's a private key")
+	}
+
+	switch key.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Problem reading JWK: unsupported curve '%s'", key.Crv)
+		}
+
+		x, xerr := base64.RawURLEncoding.DecodeString(key.X)
+		y, yerr := base64.RawURLEncoding.DecodeString(key.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if xerr != nil || yerr != nil || len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("Problem reading JWK: invalid EC coordinates")
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if curve.IsOnCurve(publicKey.X, publicKey.Y) == false {
+			return nil, fmt.Errorf("Problem reading JWK: the point isn't on the curve")
+		}
+
+		return publicKey, nil
+	case "RSA":
+		n, nerr := base64.RawURLEncoding.DecodeString(key.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(key.E)
+		if nerr != nil || eerr != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("Problem reading JWK: invalid RSA modulus or exponent")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if key.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Problem reading JWK: only Ed25519 OKP keys are supported")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("Problem reading JWK: unsupported key type '%s'", key.Kty)
+}
+
+// Thumbprint returns the key's SHA-256 JWK thumbprint (RFC 7638), base64url
+// encoded without padding -- the 'jkt' DPoP tokens are bound to
+func (key JWK) Thumbprint() (string, error) {
+	//	The thumbprint is the hash of the required members, in lexicographic order
+	var members string
+	switch key.Kty {
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Crv, key.X, key.Y)
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, key.Crv, key.X)
+	default:
+		return "", fmt.Errorf("Problem getting JWK thumbprint: unsupported key type '%s'", key.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Match returns the keys in the set that could have signed a JWS with the key id:
+// the keys with that id, or all of them if the id is blank
+func (set JWKSet) Match(kid string) []JWK {
+	if kid == "" {
+		return set.Keys
+	}
+
+	retval := []JWK{}
+	for _, key := range set.Keys {
+		if key.Kid == kid {
+			retval = append(retval, key)
+		}
+	}
+
+	return retval
+}
+
+// HashClaim returns the base64url encoded SHA-256 hash of the value, like
+// the 'ath' (access token hash) claim of a DPoP proof
+func HashClaim(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package jose_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/jose"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+}
+
+func TestSign_Verify_SupportedAlgorithms(t *testing.T) {
+	//	Arrange
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		alg    string
+		key    interface{}
+		public interface{}
+	}{
+		{"ES256", ecKey, &ecKey.PublicKey},
+		{"ES384", ec384Key, &ec384Key.PublicKey},
+		{"RS256", rsaKey, &rsaKey.PublicKey},
+		{"PS256", rsaKey, &rsaKey.PublicKey},
+		{"EdDSA", edKey, edPublic},
+	}
+
+	for _, test := range tests {
+		//	Act
+		compact, err := jose.Sign(jose.Header{Alg: test.alg}, testClaims{Subject: "client1"}, test.key)
+		if err != nil {
+			t.Fatalf("Sign failed: Should have signed with %s without error: %s", test.alg, err)
+		}
+
+		jws, err := jose.Parse(compact)
+		if err != nil {
+			t.Fatalf("Parse failed: Should have parsed the %s JWS without error: %s", test.alg, err)
+		}
+
+		claims := testClaims{}
+		verifyErr := jws.Verify(test.public)
+		claimsErr := jws.Claims(&claims)
+
+		//	Assert
+		if verifyErr != nil {
+			t.Errorf("Verify failed: Should have verified the %s signature, but got: %s", test.alg, verifyErr)
+		}
+
+		if claimsErr != nil || claims.Subject != "client1" {
+			t.Errorf("Claims failed: Should have read the %s claims, but got %+v (%v)", test.alg, claims, claimsErr)
+		}
+	}
+}
+
+func TestVerify_TamperedOrWrongKey_ReturnsError(t *testing.T) {
+	//	Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	compact, err := jose.Sign(jose.Header{Alg: "ES256"}, testClaims{Subject: "client1"}, key)
+	if err != nil {
+		t.Fatalf("Sign failed: %s", err)
+	}
+
+	tamperedClaims, _ := jose.Sign(jose.Header{Alg: "ES256"}, testClaims{Subject: "admin"}, otherKey)
+	parts := strings.Split(compact, ".")
+	tampered := parts[0] + "." + strings.Split(tamperedClaims, ".")[1] + "." + parts[2]
+
+	jws, _ := jose.Parse(compact)
+	tamperedJWS, _ := jose.Parse(tampered)
+
+	//	Act
+	otherKeyErr := jws.Verify(&otherKey.PublicKey)
+	tamperedErr := tamperedJWS.Verify(&key.PublicKey)
+
+	//	Assert
+	if otherKeyErr == nil {
+		t.Errorf("Verify failed: Should have rejected a signature from another key")
+	}
+
+	if tamperedErr == nil {
+		t.Errorf("Verify failed: Should have rejected a JWS with changed claims")
+	}
+}
+
+func TestVerify_NoneAndHMACWithPublicKey_ReturnsError(t *testing.T) {
+	//	Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	noneJWS, err := jose.Parse("eyJhbGciOiJub25lIn0.eyJzdWIiOiJjbGllbnQxIn0.")
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	compact, err := jose.Sign(jose.Header{Alg: "HS256"}, testClaims{Subject: "client1"}, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Sign failed: %s", err)
+	}
+	hmacJWS, _ := jose.Parse(compact)
+
+	//	Act
+	noneErr := noneJWS.Verify(&key.PublicKey)
+	hmacAsPublicErr := hmacJWS.Verify(&key.PublicKey)
+
+	//	Assert
+	if noneErr == nil {
+		t.Errorf("Verify failed: Should never accept 'none'")
+	}
+
+	if hmacAsPublicErr == nil {
+		t.Errorf("Verify failed: Should have rejected an HMAC JWS when verifying with a public key")
+	}
+}
+
+func TestJWK_PublicKeyAndThumbprint_RoundTrip(t *testing.T) {
+	//	Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwk, err := jose.NewJWK(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("NewJWK failed: %s", err)
+	}
+
+	//	Act
+	publicKey, err := jwk.PublicKey()
+	thumbprint, thumbprintErr := jwk.Thumbprint()
+
+	jwk.D = "c2VjcmV0"
+	_, privateErr := jwk.PublicKey()
+
+	//	Assert
+	if err != nil || key.PublicKey.Equal(publicKey) == false {
+		t.Errorf("PublicKey failed: Should have gotten the original public key back, but got: %v", err)
+	}
+
+	if thumbprintErr != nil || len(thumbprint) != 43 {
+		t.Errorf("Thumbprint failed: Should have gotten a base64url SHA-256 thumbprint, but got '%s' (%v)", thumbprint, thumbprintErr)
+	}
+
+	if privateErr == nil {
+		t.Errorf("PublicKey failed: Should have rejected a private key")
+	}
+}
+
+func TestJWK_Thumbprint_RFC7638Example(t *testing.T) {
+	//	Arrange -- the example key from RFC 7638, section 3.1
+	jwk := jose.JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: "RS256",
+		Kid: "2011-04-29",
+	}
+
+	//	Act
+	thumbprint, err := jwk.Thumbprint()
+
+	//	Assert
+	if err != nil || thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("Thumbprint failed: Should have matched the RFC 7638 example, but got '%s' (%v)", thumbprint, err)
+	}
+}
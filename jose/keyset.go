@@ -0,0 +1,91 @@
+package jose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxKeySetSize is the largest JWK set KeySetCache will read
+const maxKeySetSize = 1 << 20
+
+// KeySetCache fetches JWK sets from their URIs (like a client's jwks_uri) and caches
+// them, so keys aren't fetched for every request.  It's safe for concurrent use
+type KeySetCache struct {
+	// Client is used to fetch key sets
+	Client *http.Client
+
+	// TTL is how long a fetched key set is used before it's fetched again
+	TTL time.Duration
+
+	mu   sync.Mutex
+	sets map[string]cachedKeySet
+}
+
+// cachedKeySet is a key set and when it was fetched
+type cachedKeySet struct {
+	set     JWKSet
+	fetched time.Time
+}
+
+// NewKeySetCache returns a key set cache that keeps key sets for the TTL
+func NewKeySetCache(ttl time.Duration) *KeySetCache {
+	return &KeySetCache{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		TTL:    ttl,
+		sets:   make(map[string]cachedKeySet),
+	}
+}
+
+// Get returns the key set at the URI -- from the cache, if it was fetched within the TTL
+func (cache *KeySetCache) Get(ctx context.Context, uri string) (JWKSet, error) {
+	cache.mu.Lock()
+	cached, ok := cache.sets[uri]
+	cache.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < cache.TTL {
+		return cached.set, nil
+	}
+
+	set, err := cache.fetch(ctx, uri)
+	if err != nil {
+		return set, err
+	}
+
+	cache.mu.Lock()
+	cache.sets[uri] = cachedKeySet{set: set, fetched: time.Now()}
+	cache.mu.Unlock()
+
+	return set, nil
+}
+
+// fetch gets the key set at the URI
+func (cache *KeySetCache) fetch(ctx context.Context, uri string) (JWKSet, error) {
+	retval := JWKSet{}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return retval, fmt.Errorf("Problem fetching the key set %s: %s", uri, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := cache.Client.Do(req)
+	if err != nil {
+		return retval, fmt.Errorf("Problem fetching the key set %s: %s", uri, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return retval, fmt.Errorf("Problem fetching the key set %s: %s", uri, resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxKeySetSize)).Decode(&retval); err != nil {
+		return retval, fmt.Errorf("Problem reading the key set %s: %s", uri, err)
+	}
+
+	return retval, nil
+}
@@ -0,0 +1,69 @@
+package jose_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/jose"
+)
+
+func TestKeySetCache_Get_FetchesAndCaches(t *testing.T) {
+	//	Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jose.NewJWK(&key.PublicKey)
+	jwk.Kid = "key1"
+
+	fetches := atomic.Int32{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(rw).Encode(jose.JWKSet{Keys: []jose.JWK{jwk}})
+	}))
+	defer server.Close()
+
+	cache := jose.NewKeySetCache(time.Hour)
+	cache.Client = server.Client()
+
+	//	Act
+	first, firstErr := cache.Get(context.Background(), server.URL+"/jwks.json")
+	_, secondErr := cache.Get(context.Background(), server.URL+"/jwks.json")
+
+	//	Assert
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("Get failed: Should have fetched the key set without error: %v / %v", firstErr, secondErr)
+	}
+
+	if matched := first.Match("key1"); len(matched) != 1 || matched[0] != jwk {
+		t.Errorf("Get failed: Should have returned the published key, but got %+v", first)
+	}
+
+	if fetches.Load() != 1 {
+		t.Errorf("Get failed: Should have fetched the key set once (and then used the cache), but fetched it %v times", fetches.Load())
+	}
+}
+
+func TestKeySetCache_Get_ServerError_ReturnsError(t *testing.T) {
+	//	Arrange
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "not here", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	cache := jose.NewKeySetCache(time.Hour)
+	cache.Client = server.Client()
+
+	//	Act
+	_, err := cache.Get(context.Background(), server.URL+"/jwks.json")
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Get failed: Should have returned an error when the key set can't be fetched")
+	}
+}
@@ -0,0 +1,238 @@
+// Package ber encodes and decodes the subset of ASN.1 BER (X.690) that LDAP messages use:
+// definite lengths and single octet identifiers (tag numbers below 31)
+package ber
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Universal tags (with the constructed bit for sequences and sets)
+const (
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x30
+	TagSet         byte = 0x31
+)
+
+// Identifier octet classes and the constructed bit
+const (
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+	Constructed      byte = 0x20
+)
+
+// maxLengthOctets is the most octets a (long form) length can have
+const maxLengthOctets = 4
+
+// Element is a decoded BER element:  its identifier octet and its contents
+type Element struct {
+	Tag   byte
+	Value []byte
+}
+
+// Encode returns the element with the tag and contents
+func Encode(tag byte, value []byte) []byte {
+	encoded := []byte{tag}
+
+	switch length := len(value); {
+	case length < 0x80:
+		encoded = append(encoded, byte(length))
+	case length <= 0xff:
+		encoded = append(encoded, 0x81, byte(length))
+	case length <= 0xffff:
+		encoded = binary.BigEndian.AppendUint16(append(encoded, 0x82), uint16(length))
+	default:
+		encoded = binary.BigEndian.AppendUint32(append(encoded, 0x84), uint32(length))
+	}
+
+	return append(encoded, value...)
+}
+
+// Sequence returns a constructed element (like a sequence or set) with the encoded children
+func Sequence(tag byte, children ...[]byte) []byte {
+	value := []byte{}
+	for _, child := range children {
+		value = append(value, child...)
+	}
+
+	return Encode(tag, value)
+}
+
+// Integer returns an integer (or enumerated) element
+func Integer(tag byte, value int64) []byte {
+	//	Two's complement, in as few octets as it takes
+	encoded := []byte{}
+	for {
+		encoded = append([]byte{byte(value)}, encoded...)
+		value >>= 8
+		if (value == 0 && encoded[0]&0x80 == 0) || (value == -1 && encoded[0]&0x80 != 0) {
+			break
+		}
+	}
+
+	return Encode(tag, encoded)
+}
+
+// OctetString returns an octet string element
+func OctetString(tag byte, value string) []byte {
+	return Encode(tag, []byte(value))
+}
+
+// Boolean returns a boolean element
+func Boolean(tag byte, value bool) []byte {
+	if value {
+		return Encode(tag, []byte{0xff})
+	}
+
+	return Encode(tag, []byte{0x00})
+}
+
+// Parse decodes the first element, and returns it along with the rest of the data
+func Parse(data []byte) (Element, []byte, error) {
+	if len(data) < 2 {
+		return Element{}, nil, fmt.Errorf("The element is truncated")
+	}
+
+	tag := data[0]
+	if tag&0x1f == 0x1f {
+		return Element{}, nil, fmt.Errorf("The element's tag number is too big")
+	}
+
+	length, header, err := parseLength(data[1:])
+	if err != nil {
+		return Element{}, nil, err
+	}
+
+	data = data[1+header:]
+	if length > len(data) {
+		return Element{}, nil, fmt.Errorf("The element is truncated")
+	}
+
+	return Element{Tag: tag, Value: data[:length]}, data[length:], nil
+}
+
+// parseLength decodes a definite length, and returns it along with the number of octets it took
+func parseLength(data []byte) (int, int, error) {
+	if len(data) < 1 {
+		return 0, 0, fmt.Errorf("The element is truncated")
+	}
+
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+
+	octets := int(data[0] & 0x7f)
+	if octets == 0 {
+		return 0, 0, fmt.Errorf("Indefinite lengths aren't supported")
+	}
+
+	if octets > maxLengthOctets {
+		return 0, 0, fmt.Errorf("The element is too long")
+	}
+
+	if len(data) < 1+octets {
+		return 0, 0, fmt.Errorf("The element is truncated")
+	}
+
+	length := 0
+	for _, octet := range data[1 : 1+octets] {
+		length = length<<8 | int(octet)
+	}
+
+	if length < 0 {
+		return 0, 0, fmt.Errorf("The element is too long")
+	}
+
+	return length, 1 + octets, nil
+}
+
+// Read reads a whole element from the reader, and returns its encoding.  Elements
+// longer than maxLength are rejected
+func Read(reader *bufio.Reader, maxLength int) ([]byte, error) {
+	header, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	//	Peek at the length octets too, if it's a long form length
+	size := 2
+	if header[1] >= 0x80 {
+		size += int(header[1] & 0x7f)
+		if size-2 > maxLengthOctets {
+			return nil, fmt.Errorf("The element is too long")
+		}
+
+		if header, err = reader.Peek(size); err != nil {
+			return nil, err
+		}
+	}
+
+	length, _, err := parseLength(header[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if length > maxLength {
+		return nil, fmt.Errorf("The element is longer than %v bytes", maxLength)
+	}
+
+	encoded := make([]byte, size+length)
+	if _, err := io.ReadFull(reader, encoded); err != nil {
+		return nil, err
+	}
+
+	return encoded, nil
+}
+
+// Children decodes the element's contents as a list of elements (the contents of a
+// sequence or set, say)
+func (element Element) Children() ([]Element, error) {
+	retval := []Element{}
+
+	data := element.Value
+	for len(data) > 0 {
+		child, rest, err := Parse(data)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, child)
+		data = rest
+	}
+
+	return retval, nil
+}
+
+// Int decodes the element's contents as an integer (or enumerated value)
+func (element Element) Int() (int64, error) {
+	if len(element.Value) == 0 || len(element.Value) > 8 {
+		return 0, fmt.Errorf("The integer has %v octets", len(element.Value))
+	}
+
+	//	Sign extend from the first octet
+	value := int64(int8(element.Value[0]))
+	for _, octet := range element.Value[1:] {
+		value = value<<8 | int64(octet)
+	}
+
+	return value, nil
+}
+
+// Bool decodes the element's contents as a boolean
+func (element Element) Bool() (bool, error) {
+	if len(element.Value) != 1 {
+		return false, fmt.Errorf("The boolean has %v octets", len(element.Value))
+	}
+
+	return element.Value[0] != 0, nil
+}
+
+// String returns the element's contents as a string (for octet strings)
+func (element Element) String() string {
+	return string(element.Value)
+}
@@ -0,0 +1,95 @@
+package ber_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/ldap/ber"
+)
+
+func TestInteger_Values_RoundTrip(t *testing.T) {
+	//	Arrange
+	tests := []struct {
+		value   int64
+		encoded []byte
+	}{
+		{0, []byte{0x02, 0x01, 0x00}},
+		{127, []byte{0x02, 0x01, 0x7f}},
+		{128, []byte{0x02, 0x02, 0x00, 0x80}},
+		{256, []byte{0x02, 0x02, 0x01, 0x00}},
+		{-1, []byte{0x02, 0x01, 0xff}},
+		{-129, []byte{0x02, 0x02, 0xff, 0x7f}},
+	}
+
+	for _, test := range tests {
+		//	Act
+		encoded := ber.Integer(ber.TagInteger, test.value)
+		element, rest, err := ber.Parse(encoded)
+		value, valueErr := element.Int()
+
+		//	Assert
+		if bytes.Equal(encoded, test.encoded) != true {
+			t.Errorf("Integer failed: Should have encoded %v as %x, but got %x", test.value, test.encoded, encoded)
+		}
+
+		if err != nil || valueErr != nil || len(rest) != 0 || value != test.value {
+			t.Errorf("Int failed: Should have decoded %v, but got %v (%v / %v)", test.value, value, err, valueErr)
+		}
+	}
+}
+
+func TestSequence_LongContents_UsesLongFormLength(t *testing.T) {
+	//	Arrange
+	value := strings.Repeat("x", 300)
+
+	//	Act
+	encoded := ber.Sequence(ber.TagSequence, ber.OctetString(ber.TagOctetString, value), ber.Boolean(ber.TagBoolean, true))
+	read, readErr := ber.Read(bufio.NewReader(bytes.NewReader(append(encoded, 0x00))), 1000)
+	element, _, err := ber.Parse(encoded)
+	children, childrenErr := element.Children()
+
+	//	Assert
+	if encoded[1] != 0x82 || readErr != nil || bytes.Equal(read, encoded) != true {
+		t.Errorf("Read failed: Should have read the whole element (with a long form length), but got %x... (%v)", read[:4], readErr)
+	}
+
+	if err != nil || childrenErr != nil || len(children) != 2 || children[0].String() != value {
+		t.Errorf("Children failed: Should have decoded the sequence's children (%v / %v)", err, childrenErr)
+	}
+
+	if flag, err := children[1].Bool(); err != nil || flag != true {
+		t.Errorf("Bool failed: Should have decoded 'true', but got %v (%v)", flag, err)
+	}
+}
+
+func TestParse_InvalidData_ReturnsError(t *testing.T) {
+	//	Arrange
+	tests := map[string][]byte{
+		"empty":              {},
+		"truncated contents": {0x04, 0x03, 'a'},
+		"truncated length":   {0x04, 0x82, 0x01},
+		"indefinite length":  {0x30, 0x80, 0x00, 0x00},
+		"huge length":        {0x04, 0x85, 0x01, 0x00, 0x00, 0x00, 0x00},
+		"high tag number":    {0x1f, 0x81, 0x01, 0x00},
+	}
+
+	for name, encoded := range tests {
+		//	Act
+		_, _, err := ber.Parse(encoded)
+
+		//	Assert
+		if err == nil {
+			t.Errorf("Parse failed: Should have rejected invalid data (%s)", name)
+		}
+	}
+
+	//	Act
+	_, readErr := ber.Read(bufio.NewReader(bytes.NewReader(ber.OctetString(ber.TagOctetString, strings.Repeat("x", 200)))), 100)
+
+	//	Assert
+	if readErr == nil {
+		t.Errorf("Read failed: Should have rejected an element over the maximum length")
+	}
+}
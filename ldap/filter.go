@@ -0,0 +1,268 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/danesparza/authserver/ldap/ber"
+)
+
+// Filter choices (RFC 4511, section 4.5.1)
+const (
+	filterAnd             = ber.ClassContext | ber.Constructed | 0
+	filterOr              = ber.ClassContext | ber.Constructed | 1
+	filterNot             = ber.ClassContext | ber.Constructed | 2
+	filterEquality        = ber.ClassContext | ber.Constructed | 3
+	filterSubstrings      = ber.ClassContext | ber.Constructed | 4
+	filterGreaterOrEqual  = ber.ClassContext | ber.Constructed | 5
+	filterLessOrEqual     = ber.ClassContext | ber.Constructed | 6
+	filterPresent         = ber.ClassContext | 7
+	filterApproximate     = ber.ClassContext | ber.Constructed | 8
+	filterExtensibleMatch = ber.ClassContext | ber.Constructed | 9
+)
+
+// maxFilterDepth is how deeply filters can be nested
+const maxFilterDepth = 16
+
+// EscapeFilter escapes a value for use in a search filter (RFC 4515, section 3), so
+// it matches the value exactly.  Use it for anything a user typed (like their name)
+func EscapeFilter(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// CompileFilter encodes a search filter in its string form (RFC 4515, like
+// '(&(objectClass=person)(uid=jdoe))') for a search request
+func CompileFilter(filter string) ([]byte, error) {
+	encoded, rest, err := compileFilter(filter, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading the filter '%s': %s", filter, err)
+	}
+
+	if rest != "" {
+		return nil, fmt.Errorf("Problem reading the filter '%s': unexpected '%s' at the end", filter, rest)
+	}
+
+	return encoded, nil
+}
+
+// compileFilter encodes the parenthesized filter at the start of the string, and returns the rest of it
+func compileFilter(filter string, depth int) ([]byte, string, error) {
+	if depth > maxFilterDepth {
+		return nil, "", fmt.Errorf("filters are nested too deeply")
+	}
+
+	if strings.HasPrefix(filter, "(") == false {
+		return nil, "", fmt.Errorf("expected '('")
+	}
+	filter = filter[1:]
+
+	if filter == "" {
+		return nil, "", fmt.Errorf("unexpected end")
+	}
+
+	var encoded []byte
+	switch filter[0] {
+	case '&', '|':
+		tag := filterAnd
+		if filter[0] == '|' {
+			tag = filterOr
+		}
+
+		filters := [][]byte{}
+		filter = filter[1:]
+		for strings.HasPrefix(filter, "(") {
+			child, rest, err := compileFilter(filter, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			filters = append(filters, child)
+			filter = rest
+		}
+
+		if len(filters) == 0 {
+			return nil, "", fmt.Errorf("'&' and '|' need at least one filter")
+		}
+		encoded = ber.Sequence(tag, filters...)
+
+	case '!':
+		child, rest, err := compileFilter(filter[1:], depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		encoded = ber.Sequence(filterNot, child)
+		filter = rest
+
+	default:
+		end := strings.IndexByte(filter, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("expected ')'")
+		}
+
+		item, err := compileItem(filter[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		encoded = item
+		filter = filter[end:]
+	}
+
+	if strings.HasPrefix(filter, ")") == false {
+		return nil, "", fmt.Errorf("expected ')'")
+	}
+
+	return encoded, filter[1:], nil
+}
+
+// compileItem encodes a simple filter (like 'uid=jdoe', 'cn=J*' or 'mail=*')
+func compileItem(item string) ([]byte, error) {
+	equals := strings.IndexByte(item, '=')
+	if equals < 1 {
+		return nil, fmt.Errorf("expected an attribute and a value in '%s'", item)
+	}
+
+	attribute, value := item[:equals], item[equals+1:]
+
+	tag := filterEquality
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	case '~':
+		tag = filterApproximate
+	case ':':
+		return compileExtensibleMatch(attribute[:len(attribute)-1], value)
+	}
+
+	if tag != filterEquality {
+		attribute = attribute[:len(attribute)-1]
+		if attribute == "" {
+			return nil, fmt.Errorf("expected an attribute in '%s'", item)
+		}
+	}
+
+	if tag == filterEquality && value == "*" {
+		return ber.OctetString(filterPresent, attribute), nil
+	}
+
+	if tag == filterEquality && strings.Contains(value, "*") {
+		return compileSubstrings(attribute, value)
+	}
+
+	unescaped, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return ber.Sequence(tag, ber.OctetString(ber.TagOctetString, attribute), ber.OctetString(ber.TagOctetString, unescaped)), nil
+}
+
+// compileSubstrings encodes a substring filter (like 'cn=J*n D*')
+func compileSubstrings(attribute, value string) ([]byte, error) {
+	parts := strings.Split(value, "*")
+	substrings := [][]byte{}
+
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		unescaped, err := unescapeValue(part)
+		if err != nil {
+			return nil, err
+		}
+
+		//	initial [0], any [1] and final [2]
+		tag := ber.ClassContext | 1
+		switch i {
+		case 0:
+			tag = ber.ClassContext | 0
+		case len(parts) - 1:
+			tag = ber.ClassContext | 2
+		}
+		substrings = append(substrings, ber.OctetString(tag, unescaped))
+	}
+
+	return ber.Sequence(filterSubstrings, ber.OctetString(ber.TagOctetString, attribute), ber.Sequence(ber.TagSequence, substrings...)), nil
+}
+
+// compileExtensibleMatch encodes an extensible match filter (like 'member:1.2.840.113556.1.4.1941:=cn=...').
+// The part before ':=' is the attribute, ':dn' and the matching rule (in that order, each optional)
+func compileExtensibleMatch(description, value string) ([]byte, error) {
+	parts := strings.Split(description, ":")
+	attribute, dnAttributes, rule := parts[0], false, ""
+
+	for _, part := range parts[1:] {
+		switch {
+		case strings.EqualFold(part, "dn") && dnAttributes == false && rule == "":
+			dnAttributes = true
+		case part != "" && rule == "":
+			rule = part
+		default:
+			return nil, fmt.Errorf("unexpected '%s' in the extensible match '%s'", part, description)
+		}
+	}
+
+	if attribute == "" && rule == "" {
+		return nil, fmt.Errorf("an extensible match needs an attribute or a matching rule")
+	}
+
+	unescaped, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	//	matchingRule [1], type [2], matchValue [3] and dnAttributes [4]
+	items := [][]byte{}
+	if rule != "" {
+		items = append(items, ber.OctetString(ber.ClassContext|1, rule))
+	}
+	if attribute != "" {
+		items = append(items, ber.OctetString(ber.ClassContext|2, attribute))
+	}
+	items = append(items, ber.OctetString(ber.ClassContext|3, unescaped))
+	if dnAttributes {
+		items = append(items, ber.Boolean(ber.ClassContext|4, true))
+	}
+
+	return ber.Sequence(filterExtensibleMatch, items...), nil
+}
+
+// unescapeValue decodes the '\XX' escapes in a filter value
+func unescapeValue(value string) (string, error) {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+3 > len(value) {
+				return "", fmt.Errorf("the escape at the end of '%s' is incomplete", value)
+			}
+
+			decoded, err := hex.DecodeString(value[i+1 : i+3])
+			if err != nil {
+				return "", fmt.Errorf("the escape '%s' isn't valid", value[i:i+3])
+			}
+			unescaped.Write(decoded)
+			i += 2
+
+		case '(', ')', '*':
+			return "", fmt.Errorf("'%c' has to be escaped in '%s'", value[i], value)
+
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+
+	return unescaped.String(), nil
+}
@@ -0,0 +1,85 @@
+package ldap_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/danesparza/authserver/ldap"
+)
+
+func TestCompileFilter_ValidFilters_ReturnsEncoding(t *testing.T) {
+	//	Arrange
+	tests := []struct {
+		filter  string
+		encoded []byte
+	}{
+		{"(uid=jdoe)", []byte{0xa3, 0x0b, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x04, 'j', 'd', 'o', 'e'}},
+		{"(mail=*)", []byte{0x87, 0x04, 'm', 'a', 'i', 'l'}},
+		{"(cn=a*b)", []byte{0xa4, 0x0c, 0x04, 0x02, 'c', 'n', 0x30, 0x06, 0x80, 0x01, 'a', 0x82, 0x01, 'b'}},
+		{"(!(uid=a))", []byte{0xa2, 0x0a, 0xa3, 0x08, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x01, 'a'}},
+		{"(uid=a\\2ab)", []byte{0xa3, 0x0a, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x03, 'a', '*', 'b'}},
+		{"(member:1.2:=x)", []byte{0xa9, 0x10, 0x81, 0x03, '1', '.', '2', 0x82, 0x06, 'm', 'e', 'm', 'b', 'e', 'r', 0x83, 0x01, 'x'}},
+	}
+
+	for _, test := range tests {
+		//	Act
+		encoded, err := ldap.CompileFilter(test.filter)
+
+		//	Assert
+		if err != nil || bytes.Equal(encoded, test.encoded) != true {
+			t.Errorf("CompileFilter failed: Should have encoded '%s' as %x, but got %x (%v)", test.filter, test.encoded, encoded, err)
+		}
+	}
+
+	//	Act
+	encoded, err := ldap.CompileFilter("(&(objectClass=person)(|(uid=a)(cn>=b)))")
+
+	//	Assert
+	if err != nil || len(encoded) == 0 || encoded[0] != 0xa0 {
+		t.Errorf("CompileFilter failed: Should have encoded nested filters, but got %x (%v)", encoded, err)
+	}
+}
+
+func TestCompileFilter_InvalidFilters_ReturnsError(t *testing.T) {
+	//	Arrange
+	tests := []string{
+		"",
+		"uid=jdoe",
+		"(uid=jdoe",
+		"(uid=jdoe))",
+		"(=jdoe)",
+		"(&)",
+		"(uid=a\\2)",
+		"(uid=a\\zz)",
+		"(uid=a(b)",
+		"(>=a)",
+	}
+
+	for _, filter := range tests {
+		//	Act
+		_, err := ldap.CompileFilter(filter)
+
+		//	Assert
+		if err == nil {
+			t.Errorf("CompileFilter failed: Should have rejected '%s'", filter)
+		}
+	}
+}
+
+func TestEscapeFilter_SpecialCharacters_MatchesExactly(t *testing.T) {
+	//	Arrange
+	name := "*)(uid=*"
+
+	//	Act
+	escaped := ldap.EscapeFilter(name)
+	encoded, err := ldap.CompileFilter("(uid=" + escaped + ")")
+
+	//	Assert
+	if escaped != "\\2a\\29\\28uid=\\2a" {
+		t.Errorf("EscapeFilter failed: Should have escaped the special characters, but got '%s'", escaped)
+	}
+
+	if err != nil || bytes.Contains(encoded, []byte(name)) != true || encoded[0] != 0xa3 {
+		t.Errorf("CompileFilter failed: Should have matched the escaped value exactly, but got %x (%v)", encoded, err)
+	}
+}
@@ -0,0 +1,405 @@
+// Package ldap is a small LDAPv3 client (RFC 4511):  simple binds, searches and StartTLS.
+// It's just what's needed to check passwords against a directory and look up group memberships
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danesparza/authserver/ldap/ber"
+)
+
+// Protocol operations (RFC 4511, section 4.2 onward)
+const (
+	OpBindRequest      = ber.ClassApplication | ber.Constructed | 0
+	OpBindResponse     = ber.ClassApplication | ber.Constructed | 1
+	OpUnbindRequest    = ber.ClassApplication | 2
+	OpSearchRequest    = ber.ClassApplication | ber.Constructed | 3
+	OpSearchEntry      = ber.ClassApplication | ber.Constructed | 4
+	OpSearchDone       = ber.ClassApplication | ber.Constructed | 5
+	OpSearchReference  = ber.ClassApplication | ber.Constructed | 19
+	OpExtendedRequest  = ber.ClassApplication | ber.Constructed | 23
+	OpExtendedResponse = ber.ClassApplication | ber.Constructed | 24
+)
+
+// StartTLSOID is the name of the StartTLS extended operation (RFC 4511, section 4.14)
+const StartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Search scopes
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// Result codes (RFC 4511, appendix A)
+const (
+	ResultSuccess            = 0
+	ResultSizeLimitExceeded  = 4
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+	ResultUnwillingToPerform = 53
+)
+
+// MaxMessageLength is the longest message the client reads from the server
+const MaxMessageLength = 1 << 20
+
+// Error is an LDAP result that wasn't a success
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("LDAP result code %v", err.Code)
+	}
+
+	return fmt.Sprintf("LDAP result code %v: %s", err.Code, err.Message)
+}
+
+// IsResult returns 'true' if the error is an LDAP result with the code
+func IsResult(err error, code int) bool {
+	var result *Error
+	return errors.As(err, &result) && result.Code == code
+}
+
+// Entry is a directory entry found by a search
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of the entry's attribute (attribute names aren't case sensitive)
+func (entry Entry) Values(attribute string) []string {
+	for name, values := range entry.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+
+	return nil
+}
+
+// Value returns the first value of the entry's attribute, or a blank string if it doesn't have one
+func (entry Entry) Value(attribute string) string {
+	if values := entry.Values(attribute); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// SearchRequest is a search for directory entries
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+
+	// SizeLimit is the most entries to return (0 is the server's limit)
+	SizeLimit int
+}
+
+// Conn is a connection to an LDAP server.  Requests are made one at a time
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	host      string
+	timeout   time.Duration
+	messageID int64
+}
+
+// Dial connects to the LDAP server at the url:  ldap://host[:port] or ldaps://host[:port] (for
+// TLS from the start).  Each request has to finish within the timeout.  The TLS config is used
+// for ldaps urls, and its ServerName defaults to the url's host
+func Dial(rawURL string, timeout time.Duration, config *tls.Config) (*Conn, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading the LDAP url: %s", err)
+	}
+
+	port := parsed.Port()
+	switch strings.ToLower(parsed.Scheme) {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("The LDAP url has to start with ldap:// or ldaps://, not '%s'", parsed.Scheme)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(parsed.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("Problem connecting to the LDAP server: %s", err)
+	}
+
+	retval := &Conn{conn: conn, reader: bufio.NewReader(conn), host: parsed.Hostname(), timeout: timeout}
+
+	if strings.EqualFold(parsed.Scheme, "ldaps") {
+		if err := retval.startTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return retval, nil
+}
+
+// StartTLS upgrades the connection to TLS (RFC 4511, section 4.14).  The TLS config's
+// ServerName defaults to the host the connection was made to
+func (conn *Conn) StartTLS(config *tls.Config) error {
+	request := ber.Sequence(OpExtendedRequest, ber.OctetString(ber.ClassContext|0, StartTLSOID))
+	if _, err := conn.request(request, OpExtendedResponse); err != nil {
+		return fmt.Errorf("Problem starting TLS: %s", err)
+	}
+
+	return conn.startTLS(config)
+}
+
+// startTLS does the TLS handshake on the connection
+func (conn *Conn) startTLS(config *tls.Config) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = conn.host
+	}
+
+	tlsConn := tls.Client(conn.conn, config)
+	tlsConn.SetDeadline(time.Now().Add(conn.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("Problem with the LDAP server's TLS handshake: %s", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	conn.conn = tlsConn
+	conn.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind authenticates the connection with a DN and password (a simple bind).  Blank
+// passwords are rejected, since servers treat them as an unauthenticated bind that succeeds
+func (conn *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "a password is required"}
+	}
+
+	request := ber.Sequence(OpBindRequest,
+		ber.Integer(ber.TagInteger, 3),
+		ber.OctetString(ber.TagOctetString, dn),
+		ber.OctetString(ber.ClassContext|0, password),
+	)
+
+	_, err := conn.request(request, OpBindResponse)
+	return err
+}
+
+// Search returns the entries that match the search request
+func (conn *Conn) Search(search SearchRequest) ([]Entry, error) {
+	filter, err := CompileFilter(search.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := [][]byte{}
+	for _, attribute := range search.Attributes {
+		attributes = append(attributes, ber.OctetString(ber.TagOctetString, attribute))
+	}
+
+	request := ber.Sequence(OpSearchRequest,
+		ber.OctetString(ber.TagOctetString, search.BaseDN),
+		ber.Integer(ber.TagEnumerated, int64(search.Scope)),
+		ber.Integer(ber.TagEnumerated, 0), // neverDerefAliases
+		ber.Integer(ber.TagInteger, int64(search.SizeLimit)),
+		ber.Integer(ber.TagInteger, int64(conn.timeout/time.Second)),
+		ber.Boolean(ber.TagBoolean, false),
+		filter,
+		ber.Sequence(ber.TagSequence, attributes...),
+	)
+
+	id, err := conn.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := []Entry{}
+	for {
+		op, err := conn.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.Tag {
+		case OpSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, entry)
+
+		case OpSearchReference:
+			//	Referrals to other servers aren't followed
+
+		case OpSearchDone:
+			if err := parseResult(op); err != nil {
+				return retval, err
+			}
+			return retval, nil
+
+		default:
+			return nil, fmt.Errorf("Unexpected response (0x%x) to a search", op.Tag)
+		}
+	}
+}
+
+// Close unbinds and closes the connection
+func (conn *Conn) Close() error {
+	conn.send(ber.Encode(OpUnbindRequest, nil))
+	return conn.conn.Close()
+}
+
+// request sends the request and reads its response, which should be the passed protocol operation
+func (conn *Conn) request(request []byte, responseOp byte) (ber.Element, error) {
+	id, err := conn.send(request)
+	if err != nil {
+		return ber.Element{}, err
+	}
+
+	op, err := conn.receive(id)
+	if err != nil {
+		return ber.Element{}, err
+	}
+
+	if op.Tag != responseOp {
+		return ber.Element{}, fmt.Errorf("Unexpected response (0x%x) to a request", op.Tag)
+	}
+
+	return op, parseResult(op)
+}
+
+// send sends the protocol operation in a new message, and returns the message id
+func (conn *Conn) send(op []byte) (int64, error) {
+	conn.messageID++
+	message := ber.Sequence(ber.TagSequence, ber.Integer(ber.TagInteger, conn.messageID), op)
+
+	conn.conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	if _, err := conn.conn.Write(message); err != nil {
+		return 0, fmt.Errorf("Problem sending a request to the LDAP server: %s", err)
+	}
+
+	return conn.messageID, nil
+}
+
+// receive reads the next message from the server, and returns its protocol operation.  It has
+// to be a response to the message id, or a notice of disconnection (which is returned as an error)
+func (conn *Conn) receive(id int64) (ber.Element, error) {
+	conn.conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	encoded, err := ber.Read(conn.reader, MaxMessageLength)
+	if err != nil {
+		return ber.Element{}, fmt.Errorf("Problem reading a response from the LDAP server: %s", err)
+	}
+
+	messageID, op, err := ParseMessage(encoded)
+	if err != nil {
+		return ber.Element{}, err
+	}
+
+	if messageID == 0 && op.Tag == OpExtendedResponse {
+		if err := parseResult(op); err != nil {
+			return ber.Element{}, fmt.Errorf("The LDAP server closed the connection: %s", err)
+		}
+		return ber.Element{}, fmt.Errorf("The LDAP server closed the connection")
+	}
+
+	if messageID != id {
+		return ber.Element{}, fmt.Errorf("Unexpected response for message %v (expected %v)", messageID, id)
+	}
+
+	return op, nil
+}
+
+// ParseMessage decodes an LDAP message, and returns its message id and protocol operation
+func ParseMessage(encoded []byte) (int64, ber.Element, error) {
+	message, _, err := ber.Parse(encoded)
+	if err != nil || message.Tag != ber.TagSequence {
+		return 0, ber.Element{}, fmt.Errorf("The LDAP message isn't valid (%v)", err)
+	}
+
+	parts, err := message.Children()
+	if err != nil || len(parts) < 2 || parts[0].Tag != ber.TagInteger {
+		return 0, ber.Element{}, fmt.Errorf("The LDAP message isn't valid (%v)", err)
+	}
+
+	messageID, err := parts[0].Int()
+	if err != nil {
+		return 0, ber.Element{}, fmt.Errorf("The LDAP message id isn't valid: %s", err)
+	}
+
+	return messageID, parts[1], nil
+}
+
+// parseResult returns an error if the LDAPResult in the response isn't a success
+func parseResult(op ber.Element) error {
+	parts, err := op.Children()
+	if err != nil || len(parts) < 3 || parts[0].Tag != ber.TagEnumerated {
+		return fmt.Errorf("The LDAP result isn't valid (%v)", err)
+	}
+
+	code, err := parts[0].Int()
+	if err != nil {
+		return fmt.Errorf("The LDAP result code isn't valid: %s", err)
+	}
+
+	if code != ResultSuccess {
+		return &Error{Code: int(code), Message: parts[2].String()}
+	}
+
+	return nil
+}
+
+// parseEntry decodes a search result entry
+func parseEntry(op ber.Element) (Entry, error) {
+	parts, err := op.Children()
+	if err != nil || len(parts) != 2 {
+		return Entry{}, fmt.Errorf("The search result entry isn't valid (%v)", err)
+	}
+
+	attributes, err := parts[1].Children()
+	if err != nil {
+		return Entry{}, fmt.Errorf("The search result entry's attributes aren't valid: %s", err)
+	}
+
+	retval := Entry{DN: parts[0].String(), Attributes: map[string][]string{}}
+	for _, attribute := range attributes {
+		description, err := attribute.Children()
+		if err != nil || len(description) != 2 {
+			return Entry{}, fmt.Errorf("The search result entry's attributes aren't valid (%v)", err)
+		}
+
+		values, err := description[1].Children()
+		if err != nil {
+			return Entry{}, fmt.Errorf("The search result entry's attribute values aren't valid: %s", err)
+		}
+
+		name := description[0].String()
+		for _, value := range values {
+			retval.Attributes[name] = append(retval.Attributes[name], value.String())
+		}
+	}
+
+	return retval, nil
+}
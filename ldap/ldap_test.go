@@ -0,0 +1,178 @@
+package ldap_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danesparza/authserver/ldap"
+	"github.com/danesparza/authserver/ldap/ldaptest"
+)
+
+//	Returns a self-signed certificate for 127.0.0.1, and a pool that trusts it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ldap test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+
+	certificate, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+//	Starts a test directory with a couple of people in it
+func startTestDirectory(t *testing.T) (*ldaptest.Server, string) {
+	server := ldaptest.NewServer()
+	server.AddEntry("dc=example,dc=com", "")
+	server.AddEntry("ou=people,dc=example,dc=com", "")
+	server.AddEntry("uid=jdoe,ou=people,dc=example,dc=com", "jdoepassword", "objectClass", "person", "uid", "jdoe", "cn", "Jane Doe", "memberOf", "cn=staff,ou=groups,dc=example,dc=com")
+	server.AddEntry("uid=jsmith,ou=people,dc=example,dc=com", "jsmithpassword", "objectClass", "person", "uid", "jsmith", "cn", "John Smith")
+
+	url, err := server.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+
+	return server, url
+}
+
+func TestSearch_Filter_ReturnsMatchingEntries(t *testing.T) {
+	//	Arrange
+	server, url := startTestDirectory(t)
+	defer server.Close()
+
+	conn, err := ldap.Dial(url, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: Should have connected without error: %s", err)
+	}
+	defer conn.Close()
+
+	//	Act
+	people, peopleErr := conn.Search(ldap.SearchRequest{BaseDN: "ou=people,dc=example,dc=com", Scope: ldap.ScopeWholeSubtree, Filter: "(objectClass=person)"})
+	jane, janeErr := conn.Search(ldap.SearchRequest{BaseDN: "dc=example,dc=com", Scope: ldap.ScopeWholeSubtree, Filter: "(&(uid=JDOE)(cn=J*e))", Attributes: []string{"cn", "memberOf"}})
+	_, limitErr := conn.Search(ldap.SearchRequest{BaseDN: "dc=example,dc=com", Scope: ldap.ScopeWholeSubtree, Filter: "(uid=*)", SizeLimit: 1})
+	level, levelErr := conn.Search(ldap.SearchRequest{BaseDN: "dc=example,dc=com", Scope: ldap.ScopeSingleLevel, Filter: "(!(uid=*))"})
+
+	//	Assert
+	if peopleErr != nil || len(people) != 2 {
+		t.Errorf("Search failed: Should have found both people, but got %v (%v)", len(people), peopleErr)
+	}
+
+	if janeErr != nil || len(jane) != 1 || jane[0].DN != "uid=jdoe,ou=people,dc=example,dc=com" || jane[0].Value("CN") != "Jane Doe" || jane[0].Value("uid") != "" {
+		t.Errorf("Search failed: Should have found Jane with just the requested attributes, but got %+v (%v)", jane, janeErr)
+	}
+
+	if len(jane) == 1 && len(jane[0].Values("memberof")) != 1 {
+		t.Errorf("Values failed: Should have returned the group, but got %v", jane[0].Values("memberof"))
+	}
+
+	if ldap.IsResult(limitErr, ldap.ResultSizeLimitExceeded) != true {
+		t.Errorf("Search failed: Should have returned the size limit result, but got %v", limitErr)
+	}
+
+	if levelErr != nil || len(level) != 1 || level[0].DN != "ou=people,dc=example,dc=com" {
+		t.Errorf("Search failed: Should have only searched one level, but got %+v (%v)", level, levelErr)
+	}
+}
+
+func TestBind_Passwords_ChecksCredentials(t *testing.T) {
+	//	Arrange
+	server, url := startTestDirectory(t)
+	defer server.Close()
+
+	conn, err := ldap.Dial(url, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: Should have connected without error: %s", err)
+	}
+	defer conn.Close()
+
+	//	Act
+	wrongErr := conn.Bind("uid=jdoe,ou=people,dc=example,dc=com", "notthepassword")
+	blankErr := conn.Bind("uid=jdoe,ou=people,dc=example,dc=com", "")
+	rightErr := conn.Bind("uid=jdoe,ou=people,dc=example,dc=com", "jdoepassword")
+
+	//	Assert
+	if ldap.IsResult(wrongErr, ldap.ResultInvalidCredentials) != true || ldap.IsResult(blankErr, ldap.ResultInvalidCredentials) != true {
+		t.Errorf("Bind failed: Should have rejected the wrong (or a blank) password, but got %v / %v", wrongErr, blankErr)
+	}
+
+	if rightErr != nil {
+		t.Errorf("Bind failed: Should have bound with the right password: %s", rightErr)
+	}
+
+	if bound := server.BoundDNs(); len(bound) != 1 {
+		t.Errorf("Bind failed: Should have sent one successful bind, but got %v", bound)
+	}
+}
+
+func TestStartTLS_TrustedCertificate_Upgrades(t *testing.T) {
+	//	Arrange
+	server, url := startTestDirectory(t)
+	defer server.Close()
+
+	certificate, pool := testCertificate(t)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.RequireTLS = true
+
+	plain, err := ldap.Dial(url, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: Should have connected without error: %s", err)
+	}
+	defer plain.Close()
+
+	untrusted, err := ldap.Dial(url, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: Should have connected without error: %s", err)
+	}
+	defer untrusted.Close()
+
+	secure, err := ldap.Dial(url, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: Should have connected without error: %s", err)
+	}
+	defer secure.Close()
+
+	//	Act
+	plainErr := plain.Bind("uid=jdoe,ou=people,dc=example,dc=com", "jdoepassword")
+	untrustedErr := untrusted.StartTLS(&tls.Config{})
+	startErr := secure.StartTLS(&tls.Config{RootCAs: pool})
+	secureErr := secure.Bind("uid=jdoe,ou=people,dc=example,dc=com", "jdoepassword")
+
+	//	Assert
+	if plainErr == nil {
+		t.Errorf("Bind failed: Should have been rejected without TLS")
+	}
+
+	if untrustedErr == nil {
+		t.Errorf("StartTLS failed: Should have rejected an untrusted certificate")
+	}
+
+	if startErr != nil || secureErr != nil {
+		t.Errorf("StartTLS failed: Should have bound over TLS without error (%v / %v)", startErr, secureErr)
+	}
+}
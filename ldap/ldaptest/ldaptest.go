@@ -0,0 +1,392 @@
+// Package ldaptest provides an in-memory LDAP server for testing directory logins.  It
+// answers simple binds, searches (with equality, presence, substring, and, or and not
+// filters) and StartTLS
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/danesparza/authserver/ldap"
+	"github.com/danesparza/authserver/ldap/ber"
+)
+
+// Server is an in-memory LDAP server
+type Server struct {
+	// Entries are the directory's entries
+	Entries []ldap.Entry
+
+	// Passwords are the passwords entries can bind with (by DN)
+	Passwords map[string]string
+
+	// TLS is the config for StartTLS.  If it isn't set, StartTLS isn't supported
+	TLS *tls.Config
+
+	// RequireTLS rejects binds and searches until StartTLS is used
+	RequireTLS bool
+
+	listener net.Listener
+	conns    map[net.Conn]bool
+	binds    []string
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a server with no entries
+func NewServer() *Server {
+	return &Server{Passwords: map[string]string{}, conns: map[net.Conn]bool{}}
+}
+
+// AddEntry adds an entry to the directory, with a password to bind with (if it isn't blank).
+// Attributes are passed as name/value pairs, like AddEntry(dn, password, "uid", "jdoe", "cn", "J Doe")
+func (server *Server) AddEntry(dn, password string, attributes ...string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	entry := ldap.Entry{DN: dn, Attributes: map[string][]string{}}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		entry.Attributes[attributes[i]] = append(entry.Attributes[attributes[i]], attributes[i+1])
+	}
+
+	server.Entries = append(server.Entries, entry)
+	if password != "" {
+		server.Passwords[dn] = password
+	}
+}
+
+// SetAttribute replaces the values of an entry's attribute (removing it, if there aren't any values)
+func (server *Server) SetAttribute(dn, attribute string, values ...string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for _, entry := range server.Entries {
+		if strings.EqualFold(entry.DN, dn) == false {
+			continue
+		}
+
+		for name := range entry.Attributes {
+			if strings.EqualFold(name, attribute) {
+				delete(entry.Attributes, name)
+			}
+		}
+
+		if len(values) > 0 {
+			entry.Attributes[attribute] = append([]string{}, values...)
+		}
+	}
+}
+
+// Start listens on a local port, and returns the server's ldap:// url
+func (server *Server) Start() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server.listener = listener
+
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mu.Lock()
+			server.conns[conn] = true
+			server.mu.Unlock()
+
+			server.wg.Add(1)
+			go func() {
+				defer server.wg.Done()
+				server.serve(conn)
+			}()
+		}
+	}()
+
+	return "ldap://" + listener.Addr().String(), nil
+}
+
+// Close stops the server, closes its connections and waits for them to finish
+func (server *Server) Close() {
+	if server.listener != nil {
+		server.listener.Close()
+	}
+
+	server.mu.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mu.Unlock()
+
+	server.wg.Wait()
+}
+
+// BoundDNs returns the DNs that have bound successfully, in order
+func (server *Server) BoundDNs() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return append([]string{}, server.binds...)
+}
+
+// serve answers the requests on a connection until it's closed (or the client unbinds)
+func (server *Server) serve(conn net.Conn) {
+	plain := conn
+	defer func() {
+		conn.Close()
+
+		server.mu.Lock()
+		delete(server.conns, plain)
+		server.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	secure := false
+
+	for {
+		encoded, err := ber.Read(reader, ldap.MaxMessageLength)
+		if err != nil {
+			return
+		}
+
+		id, op, err := ldap.ParseMessage(encoded)
+		if err != nil {
+			return
+		}
+
+		respond := func(responses ...[]byte) {
+			for _, response := range responses {
+				conn.Write(ber.Sequence(ber.TagSequence, ber.Integer(ber.TagInteger, id), response))
+			}
+		}
+
+		switch op.Tag {
+		case ldap.OpUnbindRequest:
+			return
+
+		case ldap.OpExtendedRequest:
+			parts, _ := op.Children()
+			if len(parts) == 0 || parts[0].String() != ldap.StartTLSOID || server.TLS == nil || secure {
+				respond(result(ldap.OpExtendedResponse, 2, "unsupported extended operation")) // protocolError
+				continue
+			}
+
+			respond(result(ldap.OpExtendedResponse, ldap.ResultSuccess, ""))
+			tlsConn := tls.Server(conn, server.TLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader, secure = tlsConn, bufio.NewReader(tlsConn), true
+
+		case ldap.OpBindRequest:
+			if server.RequireTLS && secure == false {
+				respond(result(ldap.OpBindResponse, 13, "TLS is required")) // confidentialityRequired
+				continue
+			}
+			respond(server.bind(op))
+
+		case ldap.OpSearchRequest:
+			if server.RequireTLS && secure == false {
+				respond(result(ldap.OpSearchDone, 13, "TLS is required"))
+				continue
+			}
+			respond(server.search(op)...)
+
+		default:
+			respond(result(ldap.OpExtendedResponse, 2, "unsupported operation"))
+		}
+	}
+}
+
+// bind checks a simple bind request
+func (server *Server) bind(op ber.Element) []byte {
+	parts, err := op.Children()
+	if err != nil || len(parts) != 3 || parts[2].Tag != ber.ClassContext|0 {
+		return result(ldap.OpBindResponse, 2, "only simple binds are supported")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	dn, password := parts[1].String(), parts[2].String()
+	for knownDN, knownPassword := range server.Passwords {
+		if strings.EqualFold(knownDN, dn) && password != "" && password == knownPassword {
+			server.binds = append(server.binds, knownDN)
+			return result(ldap.OpBindResponse, ldap.ResultSuccess, "")
+		}
+	}
+
+	return result(ldap.OpBindResponse, ldap.ResultInvalidCredentials, "invalid credentials")
+}
+
+// search returns the entries (and the result) for a search request
+func (server *Server) search(op ber.Element) [][]byte {
+	parts, err := op.Children()
+	if err != nil || len(parts) != 8 {
+		return [][]byte{result(ldap.OpSearchDone, 2, "invalid search request")}
+	}
+
+	baseDN := strings.ToLower(parts[0].String())
+	scope, _ := parts[1].Int()
+	sizeLimit, _ := parts[3].Int()
+
+	requested := map[string]bool{}
+	attributes, _ := parts[7].Children()
+	for _, attribute := range attributes {
+		requested[strings.ToLower(attribute.String())] = true
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	responses := [][]byte{}
+	for _, entry := range server.Entries {
+		if inScope(strings.ToLower(entry.DN), baseDN, scope) == false || matches(entry, parts[6]) == false {
+			continue
+		}
+
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, result(ldap.OpSearchDone, ldap.ResultSizeLimitExceeded, "size limit exceeded"))
+		}
+
+		values := [][]byte{}
+		for name, attributeValues := range entry.Attributes {
+			if len(requested) > 0 && requested[strings.ToLower(name)] == false {
+				continue
+			}
+
+			encoded := [][]byte{}
+			for _, value := range attributeValues {
+				encoded = append(encoded, ber.OctetString(ber.TagOctetString, value))
+			}
+			values = append(values, ber.Sequence(ber.TagSequence, ber.OctetString(ber.TagOctetString, name), ber.Sequence(ber.TagSet, encoded...)))
+		}
+
+		responses = append(responses, ber.Sequence(ldap.OpSearchEntry, ber.OctetString(ber.TagOctetString, entry.DN), ber.Sequence(ber.TagSequence, values...)))
+	}
+
+	return append(responses, result(ldap.OpSearchDone, ldap.ResultSuccess, ""))
+}
+
+// inScope returns 'true' if the (lowercase) DN is in the search's scope
+func inScope(dn, baseDN string, scope int64) bool {
+	switch {
+	case dn == baseDN:
+		return scope != ldap.ScopeSingleLevel
+	case baseDN != "" && strings.HasSuffix(dn, ","+baseDN) == false:
+		return false
+	case scope == ldap.ScopeBaseObject:
+		return false
+	case scope == ldap.ScopeSingleLevel:
+		relative := dn
+		if baseDN != "" {
+			relative = strings.TrimSuffix(dn, ","+baseDN)
+		}
+		return strings.Contains(relative, ",") == false
+	}
+
+	return true
+}
+
+// matches evaluates a search filter against an entry.  Values are compared without case
+func matches(entry ldap.Entry, filter ber.Element) bool {
+	children, _ := filter.Children()
+
+	switch filter.Tag {
+	case ber.ClassContext | ber.Constructed | 0: // and
+		for _, child := range children {
+			if matches(entry, child) == false {
+				return false
+			}
+		}
+		return true
+
+	case ber.ClassContext | ber.Constructed | 1: // or
+		for _, child := range children {
+			if matches(entry, child) {
+				return true
+			}
+		}
+		return false
+
+	case ber.ClassContext | ber.Constructed | 2: // not
+		return len(children) == 1 && matches(entry, children[0]) == false
+
+	case ber.ClassContext | ber.Constructed | 3: // equality
+		if len(children) != 2 {
+			return false
+		}
+		for _, value := range entryValues(entry, children[0].String()) {
+			if strings.EqualFold(value, children[1].String()) {
+				return true
+			}
+		}
+		return false
+
+	case ber.ClassContext | ber.Constructed | 4: // substrings
+		if len(children) != 2 {
+			return false
+		}
+		substrings, _ := children[1].Children()
+		for _, value := range entryValues(entry, children[0].String()) {
+			if matchesSubstrings(strings.ToLower(value), substrings) {
+				return true
+			}
+		}
+		return false
+
+	case ber.ClassContext | 7: // present
+		return len(entryValues(entry, filter.String())) > 0
+	}
+
+	return false
+}
+
+// entryValues returns an entry's values for an attribute.  The DN counts as 'distinguishedName'
+func entryValues(entry ldap.Entry, attribute string) []string {
+	if strings.EqualFold(attribute, "distinguishedName") {
+		return []string{entry.DN}
+	}
+
+	return entry.Values(attribute)
+}
+
+// matchesSubstrings returns 'true' if the (lowercase) value matches the initial, any and final substrings
+func matchesSubstrings(value string, substrings []ber.Element) bool {
+	for _, substring := range substrings {
+		part := strings.ToLower(substring.String())
+		switch substring.Tag {
+		case ber.ClassContext | 0:
+			if strings.HasPrefix(value, part) == false {
+				return false
+			}
+			value = value[len(part):]
+		case ber.ClassContext | 1:
+			index := strings.Index(value, part)
+			if index < 0 {
+				return false
+			}
+			value = value[index+len(part):]
+		case ber.ClassContext | 2:
+			if strings.HasSuffix(value, part) == false {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// result returns an LDAPResult protocol operation
+func result(op byte, code int, message string) []byte {
+	return ber.Sequence(op,
+		ber.Integer(ber.TagEnumerated, int64(code)),
+		ber.OctetString(ber.TagOctetString, ""),
+		ber.OctetString(ber.TagOctetString, message),
+	)
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// RequestIDHeader is the header used to pass request ids in and out
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches request ids we'll accept from a caller
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Middleware gives each request an id (the caller's X-Request-ID if it sent a sensible
+// one), sends it back in the X-Request-ID response header, puts a logger that includes it
+// in the request context (see FromContext), and logs each request when it's done
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(RequestIDHeader)
+		if validRequestID.MatchString(requestID) == false {
+			requestID = xid.New().String()
+		}
+		rw.Header().Set(RequestIDHeader, requestID)
+
+		logger := slog.Default().With(FieldRequestID, requestID)
+		recorder := NewStatusRecorder(rw)
+		started := time.Now()
+
+		next.ServeHTTP(recorder, req.WithContext(WithContext(req.Context(), logger)))
+
+		logger.Debug("Request handled",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", recorder.Status(),
+			"duration", time.Since(started).String(),
+			"remote_addr", req.RemoteAddr,
+		)
+	})
+}
+
+// ForwardedFor returns middleware that sets each request's RemoteAddr to the client's address
+// when the request came through one of the trusted proxies.  The X-Forwarded-For header is read
+// from the right, skipping trusted proxies:  the first address that isn't one is the client (the
+// entries to its left could have been sent by the client, so they aren't believed).  Requests
+// from anywhere else keep the address they came from, whatever headers they send
+func ForwardedFor(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(trusted) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if client := forwardedClient(req, trusted); client != "" {
+				req = req.Clone(req.Context())
+				req.RemoteAddr = client
+			}
+
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// forwardedClient returns the client's address from the X-Forwarded-For header, or "" if
+// the request didn't come from a trusted proxy (or the header doesn't have a valid address)
+func forwardedClient(req *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if isTrusted(net.ParseIP(host), trusted) == false {
+		return ""
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return ""
+		}
+
+		if isTrusted(ip, trusted) == false {
+			return ip.String()
+		}
+	}
+
+	return ""
+}
+
+// isTrusted returns 'true' if the ip address is in one of the trusted networks
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StatusRecorder remembers the status code written to the response.  It's shared by the
+// logging, metrics and tracing middleware, and passes Flush and Hijack through to the
+// ResponseWriter it wraps (so streaming responses and upgraded connections still work)
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// NewStatusRecorder wraps the ResponseWriter.  The status is 200 until one is written
+func NewStatusRecorder(rw http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: rw, status: http.StatusOK}
+}
+
+// Status returns the status code written to the response
+func (recorder *StatusRecorder) Status() int {
+	return recorder.status
+}
+
+// WriteHeader records the status code before writing it
+func (recorder *StatusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends any buffered data to the client, if the ResponseWriter supports it
+func (recorder *StatusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, if the ResponseWriter supports it
+func (recorder *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if ok == false {
+		return nil, nil, fmt.Errorf("The response doesn't support hijacking the connection")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter (for http.ResponseController)
+func (recorder *StatusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
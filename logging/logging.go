@@ -0,0 +1,325 @@
+// Package logging sets up authserver's structured logging.  Log lines are written with the
+// standard 'log' package (using "[LEVEL] message" prefixes) or with log/slog, and come out
+// as plain text, JSON or logfmt -- with secrets redacted
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats
+const (
+	// FormatText is the classic "2006/01/02 15:04:05 [LEVEL] message key=value" format
+	FormatText = "text"
+
+	// FormatJSON writes each log line as a JSON object
+	FormatJSON = "json"
+
+	// FormatLogfmt writes each log line as logfmt (time=... level=... msg=... key=value)
+	FormatLogfmt = "logfmt"
+)
+
+// Common log fields
+const (
+	FieldRequestID = "request_id"
+	FieldClientID  = "client_id"
+	FieldUserID    = "user_id"
+	FieldGrantType = "grant_type"
+	FieldOutcome   = "outcome"
+)
+
+// redacted replaces secrets in log lines
+const redacted = "[REDACTED]"
+
+// level is the minimum level logged by the handler Setup installs.  SetLevel changes it
+var level = new(slog.LevelVar)
+
+// Setup sends everything logged with the standard 'log' package and log/slog to 'w' in the
+// given format, dropping anything below the given level (DEBUG, INFO, WARN or ERROR)
+func Setup(w io.Writer, format, minLevel string) error {
+	if err := SetLevel(minLevel); err != nil {
+		return err
+	}
+
+	handler, err := NewHandler(w, format, level)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// ParseLevel returns the slog level for DEBUG, INFO, WARN or ERROR
+func ParseLevel(name string) (slog.Level, error) {
+	var retval slog.Level
+	if err := retval.UnmarshalText([]byte(name)); err != nil {
+		return retval, fmt.Errorf("Problem setting the log level: '%s' isn't one of DEBUG/INFO/WARN/ERROR", name)
+	}
+
+	return retval, nil
+}
+
+// SetLevel changes the minimum level logged by the handler Setup installed.  It can be
+// called while the service is running (when the config is reloaded, for example)
+func SetLevel(name string) error {
+	parsed, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+
+	level.Set(parsed)
+	return nil
+}
+
+// NewHandler returns a slog.Handler that writes to 'w' in the given format.  Messages with a
+// "[LEVEL] " prefix (like the ones from the standard 'log' package) are logged at that level,
+// and anything that looks like a secret is redacted
+func NewHandler(w io.Writer, format string, minLevel slog.Leveler) (slog.Handler, error) {
+	//	The level is checked after the "[LEVEL] " prefix has been read, so let everything through here
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var next slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		next = &textHandler{w: w, mu: &sync.Mutex{}}
+	case FormatJSON:
+		next = slog.NewJSONHandler(w, options)
+	case FormatLogfmt:
+		next = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("Problem setting the log format: '%s' isn't one of %s/%s/%s", format, FormatText, FormatJSON, FormatLogfmt)
+	}
+
+	return &handler{next: next, minLevel: minLevel}, nil
+}
+
+// WithContext returns a copy of the context that carries the logger
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by the context (or the default logger if there isn't one)
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// loggerKey is the context key for the request logger
+type loggerKey struct{}
+
+// handler reads the level from "[LEVEL] " message prefixes, filters by level,
+// and redacts secrets before passing records on to the format handler
+type handler struct {
+	next     slog.Handler
+	minLevel slog.Leveler
+}
+
+// Enabled always returns true -- lines from the 'log' package are all
+// logged at INFO until we've seen their "[LEVEL] " prefix
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Handle logs the record (if it's at or above the minimum level)
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	level, message := parseLevel(record.Level, record.Message)
+	if level < h.minLevel.Level() {
+		return nil
+	}
+
+	retval := slog.NewRecord(record.Time, level, Redact(message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		retval.AddAttrs(redactAttr(attr))
+		return true
+	})
+
+	return h.next.Handle(ctx, retval)
+}
+
+// WithAttrs returns a handler that includes the (redacted) attributes
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redactedAttrs[i] = redactAttr(attr)
+	}
+
+	return &handler{next: h.next.WithAttrs(redactedAttrs), minLevel: h.minLevel}
+}
+
+// WithGroup returns a handler that puts attributes in the group
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name), minLevel: h.minLevel}
+}
+
+// parseLevel returns the level and message from a "[LEVEL] message" log line.
+// Lines without a prefix keep the level they were logged with
+func parseLevel(level slog.Level, message string) (slog.Level, string) {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "[") == false {
+		return level, message
+	}
+
+	end := strings.Index(message, "]")
+	if end < 0 {
+		return level, message
+	}
+
+	parsed := level
+	if err := parsed.UnmarshalText([]byte(message[1:end])); err != nil {
+		return level, message
+	}
+
+	return parsed, strings.TrimSpace(message[end+1:])
+}
+
+// textHandler writes records in the classic "2006/01/02 15:04:05 [LEVEL] message" format,
+// followed by any attributes as key=value pairs
+type textHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	attrs  string
+	prefix string
+}
+
+// Enabled always returns true -- filtering is done by handler
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Handle writes the record
+func (h *textHandler) Handle(ctx context.Context, record slog.Record) error {
+	line := &strings.Builder{}
+	line.WriteString(record.Time.Format("2006/01/02 15:04:05"))
+	line.WriteString(" [" + record.Level.String() + "] ")
+	line.WriteString(record.Message)
+	line.WriteString(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		writeTextAttr(line, h.prefix, attr)
+		return true
+	})
+	line.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line.String())
+	return err
+}
+
+// WithAttrs returns a handler that includes the attributes
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	line := &strings.Builder{}
+	line.WriteString(h.attrs)
+	for _, attr := range attrs {
+		writeTextAttr(line, h.prefix, attr)
+	}
+
+	return &textHandler{w: h.w, mu: h.mu, attrs: line.String(), prefix: h.prefix}
+}
+
+// WithGroup returns a handler that prefixes attribute keys with the group name
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	return &textHandler{w: h.w, mu: h.mu, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// writeTextAttr writes the attribute as " key=value" (quoting the value if needed)
+func writeTextAttr(line *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, groupAttr := range attr.Value.Group() {
+			writeTextAttr(line, prefix+attr.Key+".", groupAttr)
+		}
+		return
+	}
+
+	value := attr.Value.String()
+	if attr.Value.Kind() == slog.KindTime {
+		value = attr.Value.Time().Format(time.RFC3339)
+	}
+
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		value = strconv.Quote(value)
+	}
+
+	line.WriteString(" " + prefix + attr.Key + "=" + value)
+}
+
+// secretKeys are attribute keys whose values are always redacted
+var secretKeys = map[string]bool{
+	"authorization": true,
+	"client_secret": true,
+	"secret":        true,
+	"secrethash":    true,
+	"password":      true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"code":          true,
+}
+
+// secretPatterns find secrets in free text (like a log message or an error)
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	//	Authorization headers
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`), "$1 " + redacted},
+
+	//	key=value pairs (like form posts and query strings)
+	{regexp.MustCompile(`(?i)\b(client_secret|password|secret|access_token|refresh_token|token)=[^\s"&,;]+`), "$1=" + redacted},
+
+	//	"key":"value" pairs (like JSON)
+	{regexp.MustCompile(`(?i)"(client_secret|password|secret|access_token|refresh_token|token)"\s*:\s*"[^"]*"`), `"$1":"` + redacted + `"`},
+}
+
+// Redact replaces anything that looks like a secret (an Authorization header value,
+// or the value of a client_secret/password/token field) in the text
+func Redact(text string) string {
+	for _, secret := range secretPatterns {
+		text = secret.pattern.ReplaceAllString(text, secret.replacement)
+	}
+
+	return text
+}
+
+// redactAttr redacts the attribute's value if its key names a secret (or if its text contains one)
+func redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+
+	if secretKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindGroup:
+		groupAttrs := attr.Value.Group()
+		redactedAttrs := make([]slog.Attr, len(groupAttrs))
+		for i, groupAttr := range groupAttrs {
+			redactedAttrs[i] = redactAttr(groupAttr)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redactedAttrs...)}
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, Redact(err.Error()))
+		}
+	}
+
+	return attr
+}
@@ -0,0 +1,151 @@
+// Package metrics has authserver's Prometheus metrics.  They are
+// served at /metrics on their own listener (see Handler)
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics namespace (all metric names start with this)
+const namespace = "authserver"
+
+var (
+	// TokensIssued counts the tokens issued, by grant type and client
+	TokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Number of tokens issued, by grant type and client",
+	}, []string{"grant_type", "client_id"})
+
+	// AuthFailures counts failed authentication attempts, by reason
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentication attempts, by reason",
+	}, []string{"reason"})
+
+	// Lockouts counts the user names and ip addresses locked out after too many failed logins
+	Lockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lockouts_total",
+		Help:      "Number of lockouts after too many failed logins, by target (user or ip)",
+	}, []string{"target"})
+
+	// RateLimited counts requests turned away by rate limiting, by service and limit (client, ip or route)
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests turned away by rate limiting, by service and limit (client, ip or route)",
+	}, []string{"service", "limit"})
+
+	// TokenChecks counts calls that check a token (like /oauth/authorize), by endpoint and outcome
+	TokenChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_checks_total",
+		Help:      "Number of token introspection / authorize calls, by endpoint and outcome",
+	}, []string{"endpoint", "outcome"})
+
+	// TokenPurgeRuns counts the times expired tokens have been purged
+	TokenPurgeRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_purge_runs_total",
+		Help:      "Number of times expired tokens have been purged",
+	})
+
+	// TokensPurged counts expired tokens removed from the token datastore
+	TokensPurged = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_purged_total",
+		Help:      "Number of expired tokens removed from the token datastore",
+	})
+
+	// HTTPDuration tracks how long HTTP requests take, by service, route, method and status code
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by service, route, method and status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "route", "method", "code"})
+
+	// DBDuration tracks how long DBManager calls take, by method
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_duration_seconds",
+		Help:      "Datastore latency, by DBManager method",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"method"})
+)
+
+// Handler returns the handler for the /metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterActiveTokens registers the active tokens gauge.  'count' is called
+// each time the metrics are collected.  A problem counting reports -1
+func RegisterActiveTokens(count func() (int64, error)) error {
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tokens",
+		Help:      "Number of unexpired tokens",
+	}, func() float64 {
+		retval, err := count()
+		if err != nil {
+			return -1
+		}
+
+		return float64(retval)
+	}))
+}
+
+// ObserveDB records how long a DBManager call took.  Use it with defer
+// at the top of the method:  defer metrics.ObserveDB("GetNewToken", time.Now())
+func ObserveDB(method string, started time.Time) {
+	DBDuration.WithLabelValues(method).Observe(time.Since(started).Seconds())
+}
+
+// Middleware returns router middleware that records request latency for the named service.
+// Requests are labelled with the route's path template, so ids in paths don't create new series
+func Middleware(service string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			route := "unknown"
+			if current := mux.CurrentRoute(req); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			recorder := logging.NewStatusRecorder(rw)
+			started := time.Now()
+
+			next.ServeHTTP(recorder, req)
+
+			HTTPDuration.WithLabelValues(service, route, methodLabel(req.Method), strconv.Itoa(recorder.Status())).Observe(time.Since(started).Seconds())
+		})
+	}
+}
+
+// knownMethods are the request methods recorded by name -- any others are
+// recorded as "other", so made up methods don't create new series
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// methodLabel returns the label for a request method
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+
+	return "other"
+}
@@ -0,0 +1,77 @@
+package metrics_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/metrics"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware_Request_RecordsLatencyByRouteTemplate(t *testing.T) {
+	//	Arrange
+	router := mux.NewRouter()
+	router.Use(metrics.Middleware("test"))
+	router.HandleFunc("/users/{id}", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+
+	//	Act
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+
+	//	Assert
+	count := testutil.CollectAndCount(metrics.HTTPDuration, "authserver_http_request_duration_seconds")
+	if count != 1 {
+		t.Errorf("Middleware failed: Should have recorded both requests in 1 series, but got %v series", count)
+	}
+
+	rw := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `authserver_http_request_duration_seconds_count{code="404",method="GET",route="/users/{id}",service="test"} 2`
+	if strings.Contains(rw.Body.String(), expected) == false {
+		t.Errorf("Middleware failed: Should have recorded the requests by route template, but got: %s", rw.Body.String())
+	}
+}
+
+func TestMiddleware_UnknownMethod_RecordedAsOther(t *testing.T) {
+	//	Arrange
+	router := mux.NewRouter()
+	router.Use(metrics.Middleware("methodtest"))
+	router.HandleFunc("/things", func(rw http.ResponseWriter, req *http.Request) {})
+
+	//	Act
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("MADEUP1", "/things", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("MADEUP2", "/things", nil))
+
+	//	Assert
+	rw := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `authserver_http_request_duration_seconds_count{code="200",method="other",route="/things",service="methodtest"} 2`
+	if strings.Contains(rw.Body.String(), expected) == false || strings.Contains(rw.Body.String(), "MADEUP") {
+		t.Errorf("Middleware failed: Should have recorded unknown methods as other, but got: %s", rw.Body.String())
+	}
+}
+
+func TestRegisterActiveTokens_Collect_ReportsCount(t *testing.T) {
+	//	Arrange
+	tokens := int64(3)
+	if err := metrics.RegisterActiveTokens(func() (int64, error) { return tokens, nil }); err != nil {
+		t.Fatalf("RegisterActiveTokens failed: %s", err)
+	}
+
+	//	Act
+	rw := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	//	Assert
+	if strings.Contains(rw.Body.String(), fmt.Sprintf("authserver_active_tokens %v", tokens)) == false {
+		t.Errorf("RegisterActiveTokens failed: Should have reported the active token count, but got: %s", rw.Body.String())
+	}
+}
@@ -0,0 +1,283 @@
+// Package ratelimit has authserver's rate limiting middleware.  Requests are limited
+// with token buckets for each client, each source ip address and each route, and
+// requests over a limit get a 429 with a Retry-After header
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danesparza/authserver/basicauth"
+	"github.com/danesparza/authserver/logging"
+	"github.com/danesparza/authserver/metrics"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// Limit is a token bucket:  requests are allowed at Rate per second on average, in bursts
+// of up to Burst (a zero Burst is a second's worth).  A zero Rate is no limit
+type Limit struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// Config is the set of limits.  Each request counts against its client's limit (if
+// it says which client it's from), its source ip address's limit and its route's limit
+type Config struct {
+	// Client is the limit for each client (by client_id)
+	Client Limit `mapstructure:"client"`
+
+	// IP is the limit for each source ip address
+	IP Limit `mapstructure:"ip"`
+
+	// Route is the limit for each route, shared by everyone calling it
+	Route Limit `mapstructure:"route"`
+
+	// Clients overrides the client limit for specific clients (by client_id).  Config file keys
+	// aren't case sensitive, so client_ids that aren't found are looked up in lower case too
+	Clients map[string]Limit `mapstructure:"clients"`
+
+	// Routes overrides the route limit for specific routes (by path template, like /oauth/token/client)
+	Routes map[string]Limit `mapstructure:"routes"`
+}
+
+// Validate returns an error if any of the limits are negative
+func (config Config) Validate() error {
+	limits := map[string]Limit{"client": config.Client, "ip": config.IP, "route": config.Route}
+	for name, limit := range config.Clients {
+		limits["clients."+name] = limit
+	}
+	for name, limit := range config.Routes {
+		limits["routes."+name] = limit
+	}
+
+	for name, limit := range limits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("The %s rate limit can't be negative", name)
+		}
+	}
+
+	return nil
+}
+
+// clientLimit returns the limit for the client
+func (config Config) clientLimit(clientID string) Limit {
+	if limit, ok := config.Clients[clientID]; ok {
+		return limit
+	}
+
+	if limit, ok := config.Clients[strings.ToLower(clientID)]; ok {
+		return limit
+	}
+
+	return config.Client
+}
+
+// routeLimit returns the limit for the route
+func (config Config) routeLimit(route string) Limit {
+	if limit, ok := config.Routes[route]; ok {
+		return limit
+	}
+
+	return config.Route
+}
+
+// Limiter keeps the token buckets for a set of limits.  It's safe for concurrent use,
+// and its limits can be changed while it's being used (see SetConfig)
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	buckets   map[string]*bucket
+	lastPurge time.Time
+}
+
+// bucket is the token bucket for a client, ip address or route
+type bucket struct {
+	limit   Limit
+	limiter *rate.Limiter
+}
+
+// New returns a limiter for the limits
+func New(config Config) *Limiter {
+	return &Limiter{config: config, buckets: make(map[string]*bucket), lastPurge: time.Now()}
+}
+
+// SetConfig changes the limits.  Buckets whose limit changed start over (full)
+func (limiter *Limiter) SetConfig(config Config) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.config = config
+}
+
+// Middleware returns router middleware that limits the named service's requests
+func (limiter *Limiter) Middleware(service string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			route := req.URL.Path
+			if current := mux.CurrentRoute(req); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			clientID := requestClientID(req)
+
+			ip, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				ip = req.RemoteAddr
+			}
+
+			limit, wait := limiter.allow(service, route, clientID, ip, time.Now())
+			if limit != "" {
+				logging.FromContext(req.Context()).Warn("Request rate limited", "service", service, "route", route, logging.FieldClientID, clientID, "ip", ip, "limit", limit)
+				metrics.RateLimited.WithLabelValues(service, limit).Inc()
+				sendTooManyRequests(rw, limit, wait)
+				return
+			}
+
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// allow takes a token from each of the request's buckets.  If any of them is empty, no tokens
+// are taken, and it returns which limit the request is over ('client', 'ip' or 'route') along
+// with how long until it would be allowed
+func (limiter *Limiter) allow(service, route, clientID, ip string, now time.Time) (string, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	//	Every so often, forget the buckets that have filled back up (they're the same as new ones)
+	if now.Sub(limiter.lastPurge) > time.Minute {
+		for key, item := range limiter.buckets {
+			if item.limiter.TokensAt(now) >= float64(item.limiter.Burst()) {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.lastPurge = now
+	}
+
+	type check struct {
+		name  string
+		key   string
+		limit Limit
+	}
+
+	checks := []check{
+		{"route", service + " route:" + route, limiter.config.routeLimit(route)},
+		{"ip", service + " ip:" + ip, limiter.config.IP},
+	}
+	if clientID != "" {
+		checks = append(checks, check{"client", service + " client:" + clientID, limiter.config.clientLimit(clientID)})
+	}
+
+	reservations := []*rate.Reservation{}
+	cancel := func() {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+
+	for _, item := range checks {
+		if item.limit.Rate == 0 {
+			continue
+		}
+
+		reservation := limiter.bucket(item.key, item.limit).ReserveN(now, 1)
+		if reservation.OK() == false {
+			cancel()
+			return item.name, time.Second
+		}
+
+		if wait := reservation.DelayFrom(now); wait > 0 {
+			reservation.CancelAt(now)
+			cancel()
+			return item.name, wait
+		}
+
+		reservations = append(reservations, reservation)
+	}
+
+	return "", 0
+}
+
+// bucket returns the token bucket for the key, creating it if needed
+// (or if its limit has changed).  The caller has to hold the lock
+func (limiter *Limiter) bucket(key string, limit Limit) *rate.Limiter {
+	item, ok := limiter.buckets[key]
+	if ok == false || item.limit != limit {
+		burst := limit.Burst
+		if burst < 1 {
+			burst = int(math.Ceil(limit.Rate))
+		}
+
+		item = &bucket{limit: limit, limiter: rate.NewLimiter(rate.Limit(limit.Rate), burst)}
+		limiter.buckets[key] = item
+	}
+
+	return item.limiter
+}
+
+// maxFormSize is the most of a form post's body that's read to find its client_id
+const maxFormSize = 64 << 10
+
+// requestClientID returns the client a request says it's from -- the HTTP basic auth user or
+// the client_id form value.  It hasn't been authenticated yet, so it's only used for limiting
+func requestClientID(req *http.Request) string {
+	if user, _, ok := basicauth.Credentials(req); ok && user != "" {
+		return user
+	}
+
+	//	Only read the body of form posts, and put it back so the handler can still read it
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" || req.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxFormSize))
+	req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+	if err != nil {
+		return ""
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+
+	return form.Get("client_id")
+}
+
+// tooManyRequestsResponse is the body of a 429 response (the same shape as the API's error responses)
+type tooManyRequestsResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// sendTooManyRequests sends a 429, with a Retry-After header saying how many seconds to wait
+func sendTooManyRequests(rw http.ResponseWriter, limit string, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(rw).Encode(tooManyRequestsResponse{
+		Status:  http.StatusTooManyRequests,
+		Message: fmt.Sprintf("Error: Too many requests (over the %s rate limit) -- try again in %v seconds", limit, retryAfter),
+	})
+}
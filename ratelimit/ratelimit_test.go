@@ -0,0 +1,181 @@
+package ratelimit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/authserver/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+//	Returns a router with the limiter's middleware and a couple of routes
+func getTestRouter(limiter *ratelimit.Limiter) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware("test"))
+	router.HandleFunc("/oauth/token/client", func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		rw.Write([]byte(req.PostForm.Get("grant_type")))
+	}).Methods("POST")
+	router.HandleFunc("/oauth/authorize", func(rw http.ResponseWriter, req *http.Request) {}).Methods("GET")
+
+	return router
+}
+
+//	Sends a request from the ip address (and client, if it isn't blank) and returns the response
+func sendTestRequest(router *mux.Router, method, path, ip, clientID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":12345"
+	if clientID != "" {
+		req.SetBasicAuth(clientID, "secret")
+	}
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestMiddleware_OverIPLimit_Returns429WithRetryAfter(t *testing.T) {
+	//	Arrange
+	router := getTestRouter(ratelimit.New(ratelimit.Config{IP: ratelimit.Limit{Rate: 0.1, Burst: 2}}))
+
+	//	Act
+	first := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	second := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	limited := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	otherIP := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.2", "")
+
+	//	Assert
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Errorf("Middleware failed: Should have allowed a burst of 2, but got %v / %v", first.Code, second.Code)
+	}
+
+	if limited.Code != http.StatusTooManyRequests || limited.Header().Get("Retry-After") != "10" {
+		t.Errorf("Middleware failed: Should have returned 429 with Retry-After 10, but got %v with Retry-After '%s'", limited.Code, limited.Header().Get("Retry-After"))
+	}
+
+	if otherIP.Code != http.StatusOK {
+		t.Errorf("Middleware failed: Other ip addresses shouldn't be limited, but got %v", otherIP.Code)
+	}
+}
+
+func TestMiddleware_ClientOverride_UsesClientLimit(t *testing.T) {
+	//	Arrange
+	router := getTestRouter(ratelimit.New(ratelimit.Config{
+		Client:  ratelimit.Limit{Rate: 0.1, Burst: 1},
+		Clients: map[string]ratelimit.Limit{"client1": {Rate: 0.1, Burst: 3}},
+	}))
+
+	//	Act
+	client1Codes := []int{}
+	client2Codes := []int{}
+	for i := 0; i < 3; i++ {
+		client1Codes = append(client1Codes, sendTestRequest(router, "POST", "/oauth/token/client", "10.0.0.1", "client1").Code)
+		client2Codes = append(client2Codes, sendTestRequest(router, "POST", "/oauth/token/client", "10.0.0.1", "client2").Code)
+	}
+
+	//	Assert
+	for _, code := range client1Codes {
+		if code != http.StatusOK {
+			t.Errorf("Middleware failed: client1's override should have allowed 3 requests, but got %v", client1Codes)
+			break
+		}
+	}
+
+	if client2Codes[0] != http.StatusOK || client2Codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Middleware failed: client2 should have been limited after 1 request, but got %v", client2Codes)
+	}
+}
+
+func TestMiddleware_RouteOverride_OnlyLimitsThatRoute(t *testing.T) {
+	//	Arrange
+	router := getTestRouter(ratelimit.New(ratelimit.Config{
+		Routes: map[string]ratelimit.Limit{"/oauth/token/client": {Rate: 0.1, Burst: 1}},
+	}))
+
+	//	Act
+	token := sendTestRequest(router, "POST", "/oauth/token/client", "10.0.0.1", "")
+	limitedToken := sendTestRequest(router, "POST", "/oauth/token/client", "10.0.0.2", "")
+	authorize := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	authorizeAgain := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+
+	//	Assert
+	if token.Code != http.StatusOK || limitedToken.Code != http.StatusTooManyRequests {
+		t.Errorf("Middleware failed: The route limit should be shared by everyone calling it, but got %v / %v", token.Code, limitedToken.Code)
+	}
+
+	if authorize.Code != http.StatusOK || authorizeAgain.Code != http.StatusOK {
+		t.Errorf("Middleware failed: Other routes shouldn't be limited, but got %v / %v", authorize.Code, authorizeAgain.Code)
+	}
+}
+
+func TestMiddleware_LimitedRequest_DoesntUseOtherLimits(t *testing.T) {
+	//	Arrange
+	limiter := ratelimit.New(ratelimit.Config{
+		IP:    ratelimit.Limit{Rate: 0.1, Burst: 1},
+		Route: ratelimit.Limit{Rate: 0.1, Burst: 2},
+	})
+	router := getTestRouter(limiter)
+
+	//	Act
+	first := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	limited := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.1", "")
+	otherIP := sendTestRequest(router, "GET", "/oauth/authorize", "10.0.0.2", "")
+
+	//	Assert
+	if first.Code != http.StatusOK || limited.Code != http.StatusTooManyRequests {
+		t.Errorf("Middleware failed: Should have limited the second request from the ip address, but got %v / %v", first.Code, limited.Code)
+	}
+
+	if otherIP.Code != http.StatusOK {
+		t.Errorf("Middleware failed: A request over the ip limit shouldn't use up the route limit, but got %v", otherIP.Code)
+	}
+}
+
+func TestMiddleware_FormClientID_HandlerCanStillReadForm(t *testing.T) {
+	//	Arrange
+	router := getTestRouter(ratelimit.New(ratelimit.Config{Client: ratelimit.Limit{Rate: 0.1, Burst: 1}}))
+
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {"client1"}}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "/oauth/token/client", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	//	Act
+	first := httptest.NewRecorder()
+	router.ServeHTTP(first, newRequest())
+	second := httptest.NewRecorder()
+	router.ServeHTTP(second, newRequest())
+
+	//	Assert
+	if first.Code != http.StatusOK || first.Body.String() != "client_credentials" {
+		t.Errorf("Middleware failed: The handler should have read the form, but got %v '%s'", first.Code, first.Body.String())
+	}
+
+	if second.Code != http.StatusTooManyRequests {
+		t.Errorf("Middleware failed: Should have limited the client by its client_id, but got %v", second.Code)
+	}
+}
+
+func TestConfig_Validate_NegativeLimit_ReturnsError(t *testing.T) {
+	//	Arrange
+	valid := ratelimit.Config{IP: ratelimit.Limit{Rate: 10, Burst: 20}}
+	invalid := ratelimit.Config{Clients: map[string]ratelimit.Limit{"client1": {Rate: -1}}}
+
+	//	Act
+	validErr := valid.Validate()
+	invalidErr := invalid.Validate()
+
+	//	Assert
+	if validErr != nil {
+		t.Errorf("Validate failed: Should have accepted the config, but got: %s", validErr)
+	}
+
+	if invalidErr == nil {
+		t.Errorf("Validate failed: Should have rejected a negative limit")
+	}
+}
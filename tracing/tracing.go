@@ -0,0 +1,136 @@
+// Package tracing sets up OpenTelemetry tracing.  Incoming requests are traced by Middleware
+// (continuing any W3C traceparent the caller sent), and DBManager calls are traced as children
+// of the request's span.  Spans are exported with OTLP, to stdout, or not at all
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/danesparza/authserver/logging"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// instrumentationName is the name of the tracer used for authserver's spans
+const instrumentationName = "github.com/danesparza/authserver"
+
+// Config is the tracing configuration (the 'tracing' section of the config file)
+type Config struct {
+	// Exporter is where spans are sent:  none, stdout or otlp
+	Exporter string
+
+	// Endpoint is the OTLP/HTTP collector endpoint (host:port)
+	Endpoint string
+
+	// Insecure sends spans to the collector over plain HTTP instead of HTTPS
+	Insecure bool
+
+	// SampleRatio is the fraction of new traces to sample (0 - 1).  Traces
+	// started by a caller follow the caller's sampling decision
+	SampleRatio float64
+}
+
+// Setup configures the global tracer provider and W3C trace context propagation.  The
+// returned function flushes any spans that haven't been exported and shuts the exporter down
+func Setup(config Config) (func(context.Context) error, error) {
+	//	Always accept and pass along trace context, even if we aren't exporting spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch strings.ToLower(config.Exporter) {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case ExporterOTLP:
+		options := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("Problem setting up tracing: '%s' isn't one of %s/%s/%s", config.Exporter, ExporterNone, ExporterStdout, ExporterOTLP)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Problem creating the %s trace exporter: %s", config.Exporter, err)
+	}
+
+	serviceResource, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "authserver")))
+	if err != nil {
+		return nil, fmt.Errorf("Problem creating the trace resource: %s", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(serviceResource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer for authserver's spans
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware returns router middleware that starts a server span for each request (named
+// for the route's path template), continuing the trace from the caller's traceparent header
+func Middleware(service string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			route := req.URL.Path
+			if current := mux.CurrentRoute(req); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			ctx, span := Tracer().Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("authserver.service", service),
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", route),
+					attribute.String("url.path", req.URL.Path),
+				),
+			)
+			defer span.End()
+
+			recorder := logging.NewStatusRecorder(rw)
+			next.ServeHTTP(recorder, req.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", recorder.Status()))
+			if recorder.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(recorder.Status()))
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danesparza/authserver/tracing"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// getTestRecorder sets up trace propagation and a tracer provider that records spans in memory
+func getTestRecorder(t *testing.T) *tracetest.SpanRecorder {
+	if _, err := tracing.Setup(tracing.Config{Exporter: tracing.ExporterNone}); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	return recorder
+}
+
+func TestMiddleware_Traceparent_ContinuesTrace(t *testing.T) {
+	//	Arrange
+	recorder := getTestRecorder(t)
+
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("test"))
+	router.HandleFunc("/users/{id}", func(rw http.ResponseWriter, req *http.Request) {
+		//	Start a child span, like a DBManager call would
+		_, span := tracing.Tracer().Start(req.Context(), "child")
+		span.End()
+	})
+
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	//	Act
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	//	Assert
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Middleware failed: Should have recorded 2 spans, but got %v", len(spans))
+	}
+
+	child, server := spans[0], spans[1]
+
+	if server.Name() != "GET /users/{id}" {
+		t.Errorf("Middleware failed: Should have named the span for the route template, but got '%s'", server.Name())
+	}
+
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Middleware failed: Should have continued the caller's trace, but got trace %s", server.SpanContext().TraceID())
+	}
+
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Middleware failed: Should have used the caller's span as the parent, but got %s", server.Parent().SpanID())
+	}
+
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Middleware failed: Spans started by the handler should be children of the request's span")
+	}
+}
+
+func TestMiddleware_ServerError_SetsErrorStatus(t *testing.T) {
+	//	Arrange
+	recorder := getTestRecorder(t)
+
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("test"))
+	router.HandleFunc("/fail", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	})
+
+	//	Act
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+
+	//	Assert
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Middleware failed: Should have recorded 1 span, but got %v", len(spans))
+	}
+
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("Middleware failed: Should have set an error status for a 500, but got %v", spans[0].Status().Code)
+	}
+}
+
+func TestSetup_UnknownExporter_ReturnsError(t *testing.T) {
+	//	Act
+	_, err := tracing.Setup(tracing.Config{Exporter: "jaeger"})
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Setup failed: Should have returned an error for an unknown exporter")
+	}
+}
+
+func TestSetup_Stdout_Successful(t *testing.T) {
+	//	Act
+	shutdown, err := tracing.Setup(tracing.Config{Exporter: tracing.ExporterStdout, SampleRatio: 1})
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Setup failed: Should have set up the stdout exporter without error: %s", err)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Setup failed: Should have shut the exporter down without error: %s", err)
+	}
+}
@@ -0,0 +1,180 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// CBOR major types (RFC 8949, section 3.1)
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// cborMaxDepth is how deeply arrays and maps can be nested.  Attestation objects and
+// COSE keys are only a couple of levels deep
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR data item in b, and returns it along with the rest of b.
+// It only handles what authenticators send (CTAP2 canonical CBOR):  integers (as int64), byte
+// and text strings, arrays, maps (with integer or text keys), true, false and null.  Tags are
+// skipped.  Indefinite lengths and floats aren't supported
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("Problem decoding CBOR: it's nested too deeply")
+	}
+
+	major, arg, rest, err := decodeCBORHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("Problem decoding CBOR: integer %v is too big", arg)
+		}
+		return int64(arg), rest, nil
+
+	case cborNegative:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("Problem decoding CBOR: negative integer is too big")
+		}
+		return -1 - int64(arg), rest, nil
+
+	case cborBytes, cborText:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("Problem decoding CBOR: string is longer than the data")
+		}
+		if major == cborText {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+		return append([]byte{}, rest[:arg]...), rest[arg:], nil
+
+	case cborArray:
+		//	Each item takes at least a byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("Problem decoding CBOR: array is longer than the data")
+		}
+
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+
+	case cborMap:
+		//	Each entry takes at least two bytes
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, fmt.Errorf("Problem decoding CBOR: map is longer than the data")
+		}
+
+		entries := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("Problem decoding CBOR: map keys have to be integers or text")
+			}
+
+			if _, exists := entries[key]; exists {
+				return nil, nil, fmt.Errorf("Problem decoding CBOR: map has a duplicate key (%v)", key)
+			}
+
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries[key] = value
+		}
+		return entries, rest, nil
+
+	case cborTag:
+		return decodeCBORItem(rest, depth+1)
+	}
+
+	//	Simple values
+	switch arg {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23:
+		return nil, rest, nil
+	}
+
+	return nil, nil, fmt.Errorf("Problem decoding CBOR: simple value or float %v isn't supported", arg)
+}
+
+// decodeCBORHead decodes the initial byte (and argument) of a CBOR data item, and
+// returns its major type and argument along with the rest of b
+func decodeCBORHead(b []byte) (byte, uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, nil, fmt.Errorf("Problem decoding CBOR: unexpected end of data")
+	}
+
+	major, info, rest := b[0]>>5, b[0]&0x1f, b[1:]
+
+	//	Floats are encoded with the 'simple' major type, so the size of their argument is the same
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), rest, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == 31:
+		return 0, 0, nil, fmt.Errorf("Problem decoding CBOR: indefinite lengths aren't supported")
+	default:
+		return 0, 0, nil, fmt.Errorf("Problem decoding CBOR: invalid additional information %v", info)
+	}
+
+	if len(rest) < size {
+		return 0, 0, nil, fmt.Errorf("Problem decoding CBOR: unexpected end of data")
+	}
+
+	arg := uint64(0)
+	switch size {
+	case 1:
+		arg = uint64(rest[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(rest))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(rest))
+	case 8:
+		arg = binary.BigEndian.Uint64(rest)
+	}
+
+	if major == cborSimple && size > 1 {
+		return 0, 0, nil, fmt.Errorf("Problem decoding CBOR: floats aren't supported")
+	}
+
+	return major, arg, rest[size:], nil
+}
@@ -0,0 +1,84 @@
+package webauthn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeCBOR_AttestationObject_ReturnsMap(t *testing.T) {
+	//	Arrange
+	//	{"fmt": "none", "attStmt": {}, "authData": h'0102', -2: true}
+	encoded := []byte{0xa4,
+		0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e',
+		0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0,
+		0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x42, 0x01, 0x02,
+		0x21, 0xf5,
+		0xff}
+
+	//	Act
+	item, rest, err := decodeCBOR(encoded)
+	entries, _ := item.(map[interface{}]interface{})
+
+	//	Assert
+	if err != nil || bytes.Equal(rest, []byte{0xff}) != true {
+		t.Errorf("decodeCBOR failed: Should have decoded the first item and returned the rest, but got %v (%v)", rest, err)
+	}
+
+	if entries["fmt"] != "none" || bytes.Equal(entries["authData"].([]byte), []byte{1, 2}) != true || entries[int64(-2)] != true {
+		t.Errorf("decodeCBOR failed: Should have decoded the map entries, but got %v", entries)
+	}
+
+	if statement, ok := entries["attStmt"].(map[interface{}]interface{}); ok == false || len(statement) != 0 {
+		t.Errorf("decodeCBOR failed: Should have decoded the empty map, but got %v", entries["attStmt"])
+	}
+}
+
+func TestDecodeCBOR_Integers_ReturnsInt64(t *testing.T) {
+	//	Arrange
+	tests := []struct {
+		encoded []byte
+		want    int64
+	}{
+		{[]byte{0x17}, 23},
+		{[]byte{0x18, 0x18}, 24},
+		{[]byte{0x19, 0x01, 0x00}, 256},
+		{[]byte{0x1a, 0x00, 0x01, 0x00, 0x00}, 65536},
+		{[]byte{0x26}, -7},
+		{[]byte{0x39, 0x01, 0x00}, -257},
+	}
+
+	for _, test := range tests {
+		//	Act
+		item, _, err := decodeCBOR(test.encoded)
+
+		//	Assert
+		if err != nil || item != test.want {
+			t.Errorf("decodeCBOR failed: Should have decoded %x as %v, but got %v (%v)", test.encoded, test.want, item, err)
+		}
+	}
+}
+
+func TestDecodeCBOR_InvalidData_ReturnsError(t *testing.T) {
+	//	Arrange
+	tests := map[string][]byte{
+		"empty":              {},
+		"truncated string":   {0x44, 0x01, 0x02},
+		"truncated argument": {0x19, 0x01},
+		"indefinite length":  {0x5f, 0x41, 0x01, 0xff},
+		"float":              {0xfa, 0x3f, 0x80, 0x00, 0x00},
+		"huge array":         {0x9a, 0xff, 0xff, 0xff, 0xff},
+		"duplicate key":      {0xa2, 0x01, 0x01, 0x01, 0x02},
+		"array key":          {0xa1, 0x80, 0x01},
+		"too deep":           bytes.Repeat([]byte{0x81}, 20),
+	}
+
+	for name, encoded := range tests {
+		//	Act
+		_, _, err := decodeCBOR(encoded)
+
+		//	Assert
+		if err == nil {
+			t.Errorf("decodeCBOR failed: Should have rejected invalid data (%s)", name)
+		}
+	}
+}
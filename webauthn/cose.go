@@ -0,0 +1,172 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // for the SHA-256 algorithms
+	_ "crypto/sha512" // for the SHA-384 / SHA-512 algorithms
+	"encoding/base64"
+	"fmt"
+
+	"github.com/danesparza/authserver/jose"
+)
+
+// COSE algorithms (https://www.iana.org/assignments/cose/cose.xhtml#algorithms) credentials can use
+const (
+	AlgES256 = -7
+	AlgES384 = -35
+	AlgES512 = -36
+	AlgEdDSA = -8
+	AlgPS256 = -37
+	AlgRS256 = -257
+	AlgRS384 = -258
+	AlgRS512 = -259
+)
+
+// Algorithms are the algorithms relying parties accept, most preferred first
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgES384, AlgES512, AlgPS256, AlgRS256, AlgRS384, AlgRS512}
+
+// coseAlgorithms maps COSE algorithms to their JOSE names
+var coseAlgorithms = map[int]string{
+	AlgES256: "ES256",
+	AlgES384: "ES384",
+	AlgES512: "ES512",
+	AlgEdDSA: "EdDSA",
+	AlgPS256: "PS256",
+	AlgRS256: "RS256",
+	AlgRS384: "RS384",
+	AlgRS512: "RS512",
+}
+
+// COSE key types and EC curves (RFC 9053)
+const (
+	coseKeyOKP = 1
+	coseKeyEC2 = 2
+	coseKeyRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveP384    = 2
+	coseCurveP521    = 3
+	coseCurveEd25519 = 6
+)
+
+// PublicKey is a credential's public key, read from a COSE key (RFC 9052, section 7)
+type PublicKey struct {
+	// Algorithm is the COSE algorithm the credential signs with (like AlgES256)
+	Algorithm int
+
+	// JWK is the key as a JSON Web Key
+	JWK jose.JWK
+
+	key crypto.PublicKey
+}
+
+// ParsePublicKey reads a COSE key.  The key has to have one of the supported algorithms
+func ParsePublicKey(coseKey []byte) (PublicKey, error) {
+	item, rest, err := decodeCBOR(coseKey)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	if len(rest) != 0 {
+		return PublicKey{}, fmt.Errorf("Problem reading COSE key: it has trailing data")
+	}
+
+	return publicKeyFromCOSE(item)
+}
+
+// publicKeyFromCOSE reads a decoded COSE key
+func publicKeyFromCOSE(item interface{}) (PublicKey, error) {
+	retval := PublicKey{}
+
+	params, ok := item.(map[interface{}]interface{})
+	if ok == false {
+		return retval, fmt.Errorf("Problem reading COSE key: it isn't a map")
+	}
+
+	kty, _ := params[int64(1)].(int64)
+	alg, _ := params[int64(3)].(int64)
+	crv, _ := params[int64(-1)].(int64)
+	x, _ := params[int64(-2)].([]byte)
+	y, _ := params[int64(-3)].([]byte)
+
+	retval.Algorithm = int(alg)
+	name, supported := coseAlgorithms[retval.Algorithm]
+	if supported == false {
+		return retval, fmt.Errorf("Problem reading COSE key: unsupported algorithm %v", alg)
+	}
+
+	retval.JWK = jose.JWK{Alg: name}
+	switch {
+	case kty == coseKeyEC2 && (alg == AlgES256 && crv == coseCurveP256 || alg == AlgES384 && crv == coseCurveP384 || alg == AlgES512 && crv == coseCurveP521):
+		retval.JWK.Kty = "EC"
+		retval.JWK.Crv = map[int64]string{coseCurveP256: "P-256", coseCurveP384: "P-384", coseCurveP521: "P-521"}[crv]
+		retval.JWK.X = base64.RawURLEncoding.EncodeToString(x)
+		retval.JWK.Y = base64.RawURLEncoding.EncodeToString(y)
+	case kty == coseKeyOKP && alg == AlgEdDSA && crv == coseCurveEd25519:
+		retval.JWK.Kty = "OKP"
+		retval.JWK.Crv = "Ed25519"
+		retval.JWK.X = base64.RawURLEncoding.EncodeToString(x)
+	case kty == coseKeyRSA && (alg == AlgPS256 || alg == AlgRS256 || alg == AlgRS384 || alg == AlgRS512):
+		//	RSA keys use -1 and -2 for the modulus and exponent
+		n, _ := params[int64(-1)].([]byte)
+		retval.JWK.Kty = "RSA"
+		retval.JWK.N = base64.RawURLEncoding.EncodeToString(n)
+		retval.JWK.E = base64.RawURLEncoding.EncodeToString(x)
+	default:
+		return retval, fmt.Errorf("Problem reading COSE key: key type %v and curve %v don't match algorithm %s", kty, crv, name)
+	}
+
+	key, err := retval.JWK.PublicKey()
+	if err != nil {
+		return retval, fmt.Errorf("Problem reading COSE key: %s", err)
+	}
+
+	if rsaKey, ok := key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return retval, fmt.Errorf("Problem reading COSE key: RSA keys have to be at least 2048 bits")
+	}
+	retval.key = key
+
+	return retval, nil
+}
+
+// Verify checks a signature made by the credential.  ECDSA signatures are ASN.1 DER encoded
+func (key PublicKey) Verify(signed, signature []byte) error {
+	hash := crypto.SHA256
+	switch key.Algorithm {
+	case AlgES384, AlgRS384:
+		hash = crypto.SHA384
+	case AlgES512, AlgRS512:
+		hash = crypto.SHA512
+	}
+
+	digest := func() []byte {
+		h := hash.New()
+		h.Write(signed)
+		return h.Sum(nil)
+	}
+
+	valid := false
+	switch publicKey := key.key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(publicKey, digest(), signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(publicKey, signed, signature)
+	case *rsa.PublicKey:
+		if key.Algorithm == AlgPS256 {
+			valid = rsa.VerifyPSS(publicKey, hash, digest(), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		} else {
+			valid = rsa.VerifyPKCS1v15(publicKey, hash, digest(), signature) == nil
+		}
+	default:
+		return fmt.Errorf("Problem verifying signature: the key hasn't been read")
+	}
+
+	if valid == false {
+		return fmt.Errorf("The signature is invalid")
+	}
+
+	return nil
+}
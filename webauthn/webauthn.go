@@ -0,0 +1,508 @@
+// Package webauthn runs the relying party side of WebAuthn (https://www.w3.org/TR/webauthn-2/)
+// registration and authentication ceremonies.  Relying parties ask for 'none' attestation, so
+// attestation statements aren't verified -- any authenticator the user registers is trusted.
+// Credentials can use ES256/384/512, EdDSA (Ed25519), PS256 or RS256/384/512 keys
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authenticator data flags (https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data)
+const (
+	FlagUserPresent        = 0x01
+	FlagUserVerified       = 0x04
+	FlagBackupEligible     = 0x08
+	FlagBackedUp           = 0x10
+	FlagAttestedCredential = 0x40
+	FlagExtensions         = 0x80
+)
+
+// User verification requirements
+const (
+	VerificationRequired    = "required"
+	VerificationPreferred   = "preferred"
+	VerificationDiscouraged = "discouraged"
+)
+
+// DefaultTimeout is how long ceremonies can take if the relying party doesn't set a timeout
+const DefaultTimeout = 5 * time.Minute
+
+// URLBytes are bytes that are base64url encoded (without padding) in JSON, the way the WebAuthn
+// JSON serialization (PublicKeyCredential.toJSON() and parseCreationOptionsFromJSON()) encodes them
+type URLBytes []byte
+
+// MarshalJSON implements json.Marshaler
+func (b URLBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Padding is allowed
+func (b *URLBytes) UnmarshalJSON(data []byte) error {
+	encoded := ""
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("Problem decoding base64url value: %s", err)
+	}
+
+	*b = decoded
+	return nil
+}
+
+// RelyingParty is the site credentials are registered with and used on
+type RelyingParty struct {
+	// ID is the relying party's domain (like 'login.example.com').  Credentials can only be used on it
+	ID string
+
+	// Name is shown to the user when they register a credential
+	Name string
+
+	// Origins are where the ceremonies can run (like 'https://login.example.com:3001')
+	Origins []string
+
+	// Timeout is how long the user has to finish a ceremony.  If it isn't set, it's DefaultTimeout
+	Timeout time.Duration
+}
+
+// RelyingPartyEntity describes the relying party to the authenticator
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity describes the user to the authenticator.  ID is the user handle, which
+// authenticators return when discoverable credentials (passkeys) are used
+type UserEntity struct {
+	ID          URLBytes `json:"id"`
+	Name        string   `json:"name"`
+	DisplayName string   `json:"displayName"`
+}
+
+// CredentialParameters is a type of credential the relying party accepts
+type CredentialParameters struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies a registered credential
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         URLBytes `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection says what kind of authenticator the user should register
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the options for navigator.credentials.create()
+// (PublicKeyCredentialCreationOptionsJSON)
+type CreationOptions struct {
+	RelyingParty           RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              URLBytes               `json:"challenge"`
+	Parameters             []CredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get()
+// (PublicKeyCredentialRequestOptionsJSON).  If AllowCredentials is empty, the user
+// picks one of their discoverable credentials (passkeys)
+type RequestOptions struct {
+	Challenge        URLBytes               `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RelyingPartyID   string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the credential navigator.credentials.create() returns (RegistrationResponseJSON)
+type RegistrationResponse struct {
+	ID       string   `json:"id"`
+	RawID    URLBytes `json:"rawId"`
+	Type     string   `json:"type"`
+	Response struct {
+		ClientDataJSON    URLBytes `json:"clientDataJSON"`
+		AttestationObject URLBytes `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AuthenticationResponse is the credential navigator.credentials.get() returns (AuthenticationResponseJSON)
+type AuthenticationResponse struct {
+	ID       string   `json:"id"`
+	RawID    URLBytes `json:"rawId"`
+	Type     string   `json:"type"`
+	Response struct {
+		ClientDataJSON    URLBytes `json:"clientDataJSON"`
+		AuthenticatorData URLBytes `json:"authenticatorData"`
+		Signature         URLBytes `json:"signature"`
+		UserHandle        URLBytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// clientData is the client data the browser collects for a ceremony
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+// AuthenticatorData is the data the authenticator signs (or returns when a credential is registered)
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// AAGUID (the authenticator's model), CredentialID and PublicKey (a COSE key)
+	// are only there when a credential is registered
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// Credential is a newly registered credential
+type Credential struct {
+	ID         []byte
+	PublicKey  []byte
+	Algorithm  int
+	SignCount  uint32
+	AAGUID     []byte
+	Transports []string
+
+	// UserVerified is 'true' if the user was verified (with a PIN or biometric) when they registered it
+	UserVerified bool
+
+	// BackupEligible is 'true' if the credential can be synced to the user's other devices
+	BackupEligible bool
+}
+
+// NewChallenge returns a random challenge for a ceremony
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("Problem generating a challenge: %s", err)
+	}
+
+	return challenge, nil
+}
+
+// timeout returns how long the user has to finish a ceremony
+func (rp RelyingParty) timeout() time.Duration {
+	if rp.Timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return rp.Timeout
+}
+
+// CreationOptions returns the options for registering a credential.  Discoverable credentials
+// (passkeys) can be used to log in without a password, so the user has to be verified too
+func (rp RelyingParty) CreationOptions(challenge []byte, user UserEntity, exclude []CredentialDescriptor, discoverable bool) CreationOptions {
+	retval := CreationOptions{
+		RelyingParty:       RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		Challenge:          challenge,
+		Timeout:            rp.timeout().Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      VerificationDiscouraged,
+			UserVerification: VerificationDiscouraged,
+		},
+		Attestation: "none",
+	}
+
+	for _, alg := range Algorithms {
+		retval.Parameters = append(retval.Parameters, CredentialParameters{Type: "public-key", Algorithm: alg})
+	}
+
+	if discoverable {
+		retval.AuthenticatorSelection = AuthenticatorSelection{
+			ResidentKey:        VerificationRequired,
+			RequireResidentKey: true,
+			UserVerification:   VerificationRequired,
+		}
+	}
+
+	if retval.ExcludeCredentials == nil {
+		retval.ExcludeCredentials = []CredentialDescriptor{}
+	}
+
+	return retval
+}
+
+// RequestOptions returns the options for authenticating with one of the allowed credentials
+// (or, if there aren't any, one of the user's discoverable credentials)
+func (rp RelyingParty) RequestOptions(challenge []byte, allow []CredentialDescriptor, userVerification string) RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.timeout().Milliseconds(),
+		RelyingPartyID:   rp.ID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// Challenge returns the challenge the registration was made for, so the
+// relying party can find the ceremony it belongs to.  It isn't verified
+func (response RegistrationResponse) Challenge() ([]byte, error) {
+	return challengeFor(response.Response.ClientDataJSON)
+}
+
+// Challenge returns the challenge the authentication was made for, so the
+// relying party can find the ceremony it belongs to.  It isn't verified
+func (response AuthenticationResponse) Challenge() ([]byte, error) {
+	return challengeFor(response.Response.ClientDataJSON)
+}
+
+// challengeFor returns the challenge in the client data
+func challengeFor(clientDataJSON []byte) ([]byte, error) {
+	collected := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &collected); err != nil {
+		return nil, fmt.Errorf("Problem reading the client data: %s", err)
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(collected.Challenge, "="))
+	if err != nil {
+		return nil, fmt.Errorf("Problem decoding the challenge: %s", err)
+	}
+
+	return challenge, nil
+}
+
+// checkClientData checks that the client data is for the ceremony type and challenge, and
+// that the ceremony ran on one of the relying party's origins
+func (rp RelyingParty) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	collected := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &collected); err != nil {
+		return fmt.Errorf("Problem reading the client data: %s", err)
+	}
+
+	if collected.Type != ceremony {
+		return fmt.Errorf("The client data is for a '%s' ceremony, not '%s'", collected.Type, ceremony)
+	}
+
+	received, err := challengeFor(clientDataJSON)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return fmt.Errorf("The client data is for another challenge")
+	}
+
+	if collected.CrossOrigin {
+		return fmt.Errorf("The ceremony ran in a cross-origin frame")
+	}
+
+	for _, origin := range rp.Origins {
+		if collected.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("The ceremony ran on an unexpected origin (%s)", collected.Origin)
+}
+
+// ParseAuthenticatorData reads authenticator data
+func ParseAuthenticatorData(data []byte) (AuthenticatorData, error) {
+	retval := AuthenticatorData{}
+
+	if len(data) < 37 {
+		return retval, fmt.Errorf("Problem reading authenticator data: it's too short")
+	}
+
+	retval.RPIDHash = data[:32]
+	retval.Flags = data[32]
+	retval.SignCount = binary.BigEndian.Uint32(data[33:37])
+	rest := data[37:]
+
+	if retval.Flags&FlagAttestedCredential != 0 {
+		if len(rest) < 18 {
+			return retval, fmt.Errorf("Problem reading authenticator data: the attested credential data is too short")
+		}
+
+		retval.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > len(rest) || idLength > 1023 {
+			return retval, fmt.Errorf("Problem reading authenticator data: the credential id is too long")
+		}
+
+		retval.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		//	The public key is a COSE key:  find where it ends
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return retval, fmt.Errorf("Problem reading authenticator data: %s", err)
+		}
+
+		retval.PublicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	//	Extensions aren't used, but they have to be well formed
+	if retval.Flags&FlagExtensions != 0 {
+		var err error
+		_, rest, err = decodeCBOR(rest)
+		if err != nil {
+			return retval, fmt.Errorf("Problem reading authenticator data extensions: %s", err)
+		}
+	}
+
+	if len(rest) != 0 {
+		return retval, fmt.Errorf("Problem reading authenticator data: it has trailing data")
+	}
+
+	return retval, nil
+}
+
+// checkAuthenticatorData checks that the authenticator data is for the relying party,
+// and that the user was present (and verified, if that's required)
+func (rp RelyingParty) checkAuthenticatorData(authData AuthenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if bytes.Equal(authData.RPIDHash, rpIDHash[:]) != true {
+		return fmt.Errorf("The authenticator data is for another relying party")
+	}
+
+	if authData.Flags&FlagUserPresent == 0 {
+		return fmt.Errorf("The user wasn't present")
+	}
+
+	if requireUserVerification && authData.Flags&FlagUserVerified == 0 {
+		return fmt.Errorf("The user wasn't verified by the authenticator")
+	}
+
+	return nil
+}
+
+// VerifyRegistration checks a registration response for the challenge, and returns
+// the new credential.  If user verification is required, the user has to have been verified
+func (rp RelyingParty) VerifyRegistration(challenge []byte, response RegistrationResponse, requireUserVerification bool) (Credential, error) {
+	retval := Credential{}
+
+	if response.Type != "public-key" {
+		return retval, fmt.Errorf("The credential isn't a public key credential")
+	}
+
+	if err := rp.checkClientData(response.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return retval, err
+	}
+
+	//	Read the attestation object:  {fmt, attStmt, authData}
+	item, rest, err := decodeCBOR(response.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return retval, fmt.Errorf("Problem reading the attestation object: %v", err)
+	}
+
+	attestation, _ := item.(map[interface{}]interface{})
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if format == "" || statement == nil || rawAuthData == nil {
+		return retval, fmt.Errorf("Problem reading the attestation object: it's missing fmt, attStmt or authData")
+	}
+
+	//	'none' attestation doesn't have a statement.  Other statements aren't verified (see the package doc)
+	if format == "none" && len(statement) != 0 {
+		return retval, fmt.Errorf("Problem reading the attestation object: 'none' attestation has a statement")
+	}
+
+	authData, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return retval, err
+	}
+
+	if err := rp.checkAuthenticatorData(authData, requireUserVerification); err != nil {
+		return retval, err
+	}
+
+	if authData.CredentialID == nil {
+		return retval, fmt.Errorf("The authenticator data doesn't have the new credential")
+	}
+
+	if len(response.RawID) != 0 && bytes.Equal(response.RawID, authData.CredentialID) != true {
+		return retval, fmt.Errorf("The credential id doesn't match the authenticator data")
+	}
+
+	publicKey, err := ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return retval, err
+	}
+
+	retval = Credential{
+		ID:             authData.CredentialID,
+		PublicKey:      authData.PublicKey,
+		Algorithm:      publicKey.Algorithm,
+		SignCount:      authData.SignCount,
+		AAGUID:         authData.AAGUID,
+		Transports:     response.Response.Transports,
+		UserVerified:   authData.Flags&FlagUserVerified != 0,
+		BackupEligible: authData.Flags&FlagBackupEligible != 0,
+	}
+
+	return retval, nil
+}
+
+// VerifyAuthentication checks an authentication response for the challenge, signed with
+// the credential's public key (a COSE key), and returns the authenticator data.  The
+// signature counter has to have gone up since it was last used (signCount), unless the
+// authenticator doesn't keep one.  If user verification is required, the user has to have been verified
+func (rp RelyingParty) VerifyAuthentication(challenge []byte, response AuthenticationResponse, publicKey []byte, signCount uint32, requireUserVerification bool) (AuthenticatorData, error) {
+	if response.Type != "public-key" {
+		return AuthenticatorData{}, fmt.Errorf("The credential isn't a public key credential")
+	}
+
+	if err := rp.checkClientData(response.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	authData, err := ParseAuthenticatorData(response.Response.AuthenticatorData)
+	if err != nil {
+		return authData, err
+	}
+
+	if err := rp.checkAuthenticatorData(authData, requireUserVerification); err != nil {
+		return authData, err
+	}
+
+	//	The signature is over the authenticator data and the hash of the client data
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return authData, err
+	}
+
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(append([]byte{}, response.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.Verify(signed, response.Response.Signature); err != nil {
+		return authData, err
+	}
+
+	//	A counter that didn't go up means the credential may have been cloned
+	if (authData.SignCount != 0 || signCount != 0) && authData.SignCount <= signCount {
+		return authData, fmt.Errorf("The authenticator's signature counter didn't go up -- it may have been cloned")
+	}
+
+	return authData, nil
+}
@@ -0,0 +1,152 @@
+package webauthn_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/danesparza/authserver/webauthn"
+	"github.com/danesparza/authserver/webauthn/webauthntest"
+)
+
+var testRelyingParty = webauthn.RelyingParty{
+	ID:      "login.example.com",
+	Name:    "Example",
+	Origins: []string{"https://login.example.com:3001"},
+}
+
+//	Registers a credential with a new test authenticator, and returns the
+//	authenticator along with the credential
+func registerTestCredential(t *testing.T) (*webauthntest.Authenticator, webauthn.Credential) {
+	challenge, _ := webauthn.NewChallenge()
+	options := testRelyingParty.CreationOptions(challenge, webauthn.UserEntity{ID: []byte("user1"), Name: "user1"}, nil, true)
+
+	authenticator := webauthntest.NewAuthenticator("https://login.example.com:3001")
+	response, err := authenticator.Register(options)
+	if err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+
+	credential, err := testRelyingParty.VerifyRegistration(challenge, response, true)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: Should have verified the registration without error: %s", err)
+	}
+
+	return authenticator, credential
+}
+
+func TestVerifyRegistration_ValidResponse_ReturnsCredential(t *testing.T) {
+	//	Arrange
+	challenge, _ := webauthn.NewChallenge()
+	options := testRelyingParty.CreationOptions(challenge, webauthn.UserEntity{ID: []byte("user1"), Name: "user1"}, nil, true)
+	authenticator := webauthntest.NewAuthenticator("https://login.example.com:3001")
+	response, _ := authenticator.Register(options)
+
+	//	Act
+	credential, err := testRelyingParty.VerifyRegistration(challenge, response, true)
+	responseChallenge, challengeErr := response.Challenge()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyRegistration failed: Should have verified the registration without error: %s", err)
+	}
+
+	if bytes.Equal(credential.ID, authenticator.CredentialID) != true || credential.Algorithm != webauthn.AlgES256 || credential.UserVerified != true {
+		t.Errorf("VerifyRegistration failed: Should have returned the new credential, but got %+v", credential)
+	}
+
+	if _, err := webauthn.ParsePublicKey(credential.PublicKey); err != nil {
+		t.Errorf("VerifyRegistration failed: Should have returned the credential's COSE key, but got: %s", err)
+	}
+
+	if challengeErr != nil || bytes.Equal(responseChallenge, challenge) != true {
+		t.Errorf("Challenge failed: Should have returned the response's challenge (%v)", challengeErr)
+	}
+}
+
+func TestVerifyRegistration_WrongChallengeOriginOrVerification_ReturnsError(t *testing.T) {
+	//	Arrange
+	challenge, _ := webauthn.NewChallenge()
+	otherChallenge, _ := webauthn.NewChallenge()
+	options := testRelyingParty.CreationOptions(challenge, webauthn.UserEntity{ID: []byte("user1"), Name: "user1"}, nil, true)
+
+	authenticator := webauthntest.NewAuthenticator("https://login.example.com:3001")
+	response, _ := authenticator.Register(options)
+
+	phishing := webauthntest.NewAuthenticator("https://login.example.co:3001")
+	phishingResponse, _ := phishing.Register(options)
+
+	unverified := webauthntest.NewAuthenticator("https://login.example.com:3001")
+	unverified.UserVerified = false
+	unverifiedResponse, _ := unverified.Register(options)
+
+	otherRelyingParty := testRelyingParty
+	otherRelyingParty.ID = "example.com"
+
+	//	Act
+	_, challengeErr := testRelyingParty.VerifyRegistration(otherChallenge, response, true)
+	_, originErr := testRelyingParty.VerifyRegistration(challenge, phishingResponse, true)
+	_, verificationErr := testRelyingParty.VerifyRegistration(challenge, unverifiedResponse, true)
+	_, presenceErr := testRelyingParty.VerifyRegistration(challenge, unverifiedResponse, false)
+	_, rpErr := otherRelyingParty.VerifyRegistration(challenge, response, true)
+
+	//	Assert
+	if challengeErr == nil || originErr == nil || rpErr == nil {
+		t.Errorf("VerifyRegistration failed: Should have rejected responses for another challenge, origin or relying party")
+	}
+
+	if verificationErr == nil || presenceErr != nil {
+		t.Errorf("VerifyRegistration failed: Should only have needed user verification when it's required (%v)", presenceErr)
+	}
+}
+
+func TestVerifyAuthentication_ValidResponse_ReturnsAuthenticatorData(t *testing.T) {
+	//	Arrange
+	authenticator, credential := registerTestCredential(t)
+	challenge, _ := webauthn.NewChallenge()
+	options := testRelyingParty.RequestOptions(challenge, nil, webauthn.VerificationRequired)
+	response, _ := authenticator.Authenticate(options)
+
+	//	Act
+	authData, err := testRelyingParty.VerifyAuthentication(challenge, response, credential.PublicKey, credential.SignCount, true)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("VerifyAuthentication failed: Should have verified the authentication without error: %s", err)
+	}
+
+	if authData.SignCount != 1 || bytes.Equal(response.Response.UserHandle, []byte("user1")) != true {
+		t.Errorf("VerifyAuthentication failed: Should have returned the signature counter and user handle, but got %v and %s", authData.SignCount, response.Response.UserHandle)
+	}
+}
+
+func TestVerifyAuthentication_BadSignatureOrCounter_ReturnsError(t *testing.T) {
+	//	Arrange
+	authenticator, credential := registerTestCredential(t)
+	_, otherCredential := registerTestCredential(t)
+	challenge, _ := webauthn.NewChallenge()
+	options := testRelyingParty.RequestOptions(challenge, nil, webauthn.VerificationRequired)
+	response, _ := authenticator.Authenticate(options)
+
+	tampered := response
+	tampered.Response.AuthenticatorData = append([]byte{}, response.Response.AuthenticatorData...)
+	tampered.Response.AuthenticatorData[36]++
+
+	//	Act
+	_, otherKeyErr := testRelyingParty.VerifyAuthentication(challenge, response, otherCredential.PublicKey, 0, true)
+	_, tamperedErr := testRelyingParty.VerifyAuthentication(challenge, tampered, credential.PublicKey, 0, true)
+	_, counterErr := testRelyingParty.VerifyAuthentication(challenge, response, credential.PublicKey, 1, true)
+	_, createErr := testRelyingParty.VerifyAuthentication(challenge, webauthn.AuthenticationResponse{Type: "public-key"}, credential.PublicKey, 0, true)
+
+	//	Assert
+	if otherKeyErr == nil || tamperedErr == nil {
+		t.Errorf("VerifyAuthentication failed: Should have rejected a signature from another key or over other data")
+	}
+
+	if counterErr == nil {
+		t.Errorf("VerifyAuthentication failed: Should have rejected a signature counter that didn't go up")
+	}
+
+	if createErr == nil {
+		t.Errorf("VerifyAuthentication failed: Should have rejected a response without client data")
+	}
+}
@@ -0,0 +1,185 @@
+// Package webauthntest provides a software authenticator for testing WebAuthn ceremonies
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/danesparza/authserver/webauthn"
+)
+
+// Authenticator is a software authenticator with a single ES256 credential.  It does
+// what a browser and authenticator do together:  it collects the client data for its
+// origin, and signs it
+type Authenticator struct {
+	// Origin is where the authenticator says ceremonies run
+	Origin string
+
+	// UserVerified says whether the authenticator verifies the user (with a 'PIN')
+	UserVerified bool
+
+	// CredentialID and UserHandle are set when a credential is registered
+	CredentialID []byte
+	UserHandle   []byte
+
+	// SignCount is the signature counter.  It goes up each time the credential is used
+	SignCount uint32
+
+	rpID string
+	key  *ecdsa.PrivateKey
+}
+
+// NewAuthenticator returns an authenticator that verifies users, for ceremonies on the origin
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Register creates a credential for the options, and returns the response a browser would
+func (authenticator *Authenticator) Register(options webauthn.CreationOptions) (webauthn.RegistrationResponse, error) {
+	retval := webauthn.RegistrationResponse{}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return retval, err
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		return retval, err
+	}
+
+	authenticator.key = key
+	authenticator.rpID = options.RelyingParty.ID
+	authenticator.CredentialID = credentialID
+	authenticator.UserHandle = options.User.ID
+	authenticator.SignCount = 0
+
+	//	The attested credential data:  AAGUID, credential id and COSE key
+	size := 32
+	coseKey := encodeMap(
+		encodeInt(1), encodeInt(2), // kty: EC2
+		encodeInt(3), encodeInt(webauthn.AlgES256), // alg
+		encodeInt(-1), encodeInt(1), // crv: P-256
+		encodeInt(-2), encodeBytes(key.X.FillBytes(make([]byte, size))),
+		encodeInt(-3), encodeBytes(key.Y.FillBytes(make([]byte, size))),
+	)
+
+	credentialData := make([]byte, 16)
+	credentialData = binary.BigEndian.AppendUint16(credentialData, uint16(len(credentialID)))
+	credentialData = append(credentialData, credentialID...)
+	credentialData = append(credentialData, coseKey...)
+
+	authData := authenticator.authenticatorData(webauthn.FlagAttestedCredential)
+	authData = append(authData, credentialData...)
+
+	retval.ID = base64.RawURLEncoding.EncodeToString(credentialID)
+	retval.RawID = credentialID
+	retval.Type = "public-key"
+	retval.Response.ClientDataJSON = authenticator.clientData("webauthn.create", options.Challenge)
+	retval.Response.AttestationObject = encodeMap(
+		encodeText("fmt"), encodeText("none"),
+		encodeText("attStmt"), encodeMap(),
+		encodeText("authData"), encodeBytes(authData),
+	)
+	retval.Response.Transports = []string{"internal"}
+
+	return retval, nil
+}
+
+// Authenticate signs the challenge in the options with the registered credential, and
+// returns the response a browser would
+func (authenticator *Authenticator) Authenticate(options webauthn.RequestOptions) (webauthn.AuthenticationResponse, error) {
+	retval := webauthn.AuthenticationResponse{}
+
+	authenticator.SignCount++
+	authData := authenticator.authenticatorData(0)
+	clientData := authenticator.clientData("webauthn.get", options.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, authenticator.key, digest[:])
+	if err != nil {
+		return retval, err
+	}
+
+	retval.ID = base64.RawURLEncoding.EncodeToString(authenticator.CredentialID)
+	retval.RawID = authenticator.CredentialID
+	retval.Type = "public-key"
+	retval.Response.ClientDataJSON = clientData
+	retval.Response.AuthenticatorData = authData
+	retval.Response.Signature = signature
+	retval.Response.UserHandle = authenticator.UserHandle
+
+	return retval, nil
+}
+
+// authenticatorData returns the authenticator data (without attested credential data)
+func (authenticator *Authenticator) authenticatorData(flags byte) []byte {
+	flags |= webauthn.FlagUserPresent
+	if authenticator.UserVerified {
+		flags |= webauthn.FlagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(authenticator.rpID))
+	authData := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(authData, authenticator.SignCount)
+}
+
+// clientData returns the client data JSON for a ceremony
+func (authenticator *Authenticator) clientData(ceremony string, challenge []byte) []byte {
+	clientData, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    authenticator.Origin,
+	})
+
+	return clientData
+}
+
+// CBOR encoding -- just what's needed for attestation objects and COSE keys
+
+func encodeHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+}
+
+func encodeInt(value int) []byte {
+	if value < 0 {
+		return encodeHead(1, uint64(-1-value))
+	}
+
+	return encodeHead(0, uint64(value))
+}
+
+func encodeBytes(value []byte) []byte {
+	return append(encodeHead(2, uint64(len(value))), value...)
+}
+
+func encodeText(value string) []byte {
+	return append(encodeHead(3, uint64(len(value))), value...)
+}
+
+// encodeMap encodes a map from its encoded keys and values (key, value, key, value ...)
+func encodeMap(items ...[]byte) []byte {
+	encoded := encodeHead(5, uint64(len(items)/2))
+	for _, item := range items {
+		encoded = append(encoded, item...)
+	}
+
+	return encoded
+}